@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+
+	"mes/internal/net/api"
+)
+
+// runAudit has a running MES count its warehouses and compare them with the
+// ERP, or lists the previous audits.
+//
+// Usage: mes audit [flags]
+func runAudit(args []string) {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	apiUrl := flags.String("api-url", api.DEFAULT_BASE_URL, "base url of the MES API")
+	correct := flags.Bool("correct", false,
+		"correct the ERP where the MES agrees with the PLC, and the MES where the ERP does")
+	operator := flags.String("operator", os.Getenv("USER"), "operator running the audit")
+	list := flags.Bool("list", false, "list the previous audits")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: mes audit [flags]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	var body []byte
+	var err error
+	if *list {
+		body, err = api.Get(*apiUrl, api.ENDPOINT_AUDIT)
+	} else {
+		body, err = api.Post(*apiUrl, api.ENDPOINT_AUDIT, url.Values{
+			"correct":  {strconv.FormatBool(*correct)},
+			"operator": {*operator},
+		})
+	}
+	if err != nil {
+		log.Fatalf("[audit] %v\n", err)
+	}
+	os.Stdout.Write(body)
+}
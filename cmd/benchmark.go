@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"mes/internal/sim"
+)
+
+// runBenchmark replays a recorded demand on an idle factory, offline, once
+// with the default scoring weights and once for each weights file given,
+// and prints how each set of weights performed.
+//
+// Usage: mes benchmark [flags] [weights.json...]
+func runBenchmark(args []string) {
+	flags := flag.NewFlagSet("benchmark", flag.ExitOnError)
+	demandPath := flags.String("demand", sim.DEMAND_LOG_PATH, "demand log to replay")
+	scheduler := flags.String("scheduler", sim.SCHEDULER_DEFAULT,
+		"line assignment policy, one of: "+strings.Join(sim.SchedulerNames(), ", "))
+	startDay := flags.Uint("start-day", 0, "day the demand is dispatched on")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: mes benchmark [flags] [weights.json...]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	demand, err := sim.LoadDemand(*demandPath)
+	if err != nil {
+		log.Fatalf("[benchmark] %v\n", err)
+	}
+
+	weightSets := map[string]sim.ScoringWeights{"default": sim.DefaultScoringWeights()}
+	for _, path := range flags.Args() {
+		weights, err := sim.ReadScoringWeights(path)
+		if err != nil {
+			log.Fatalf("[benchmark] %v\n", err)
+		}
+		weightSets[strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))] = weights
+	}
+
+	results, err := sim.BenchmarkScoring(demand, weightSets, *scheduler, *startDay)
+	if err != nil {
+		log.Fatalf("[benchmark] %v\n", err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(results)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+
+	"mes/internal/net/api"
+)
+
+// runForecast asks a running MES when its backlog will be completed, and
+// optionally how accepting a new order (a JSON file with its pieces and
+// their recipe steps) would change that.
+//
+// Usage: mes forecast [flags]
+func runForecast(args []string) {
+	flags := flag.NewFlagSet("forecast", flag.ExitOnError)
+	apiUrl := flags.String("api-url", api.DEFAULT_BASE_URL, "base url of the MES API")
+	order := flags.String("order", "", "JSON file with the pieces of a hypothetical order")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: mes forecast [flags]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	var body []byte
+	var err error
+	if *order == "" {
+		body, err = api.Get(*apiUrl, api.ENDPOINT_FORECAST)
+	} else {
+		var pieces []byte
+		if pieces, err = os.ReadFile(*order); err == nil {
+			body, err = api.Post(*apiUrl, api.ENDPOINT_FORECAST, url.Values{
+				"pieces": {string(pieces)},
+			})
+		}
+	}
+	if err != nil {
+		log.Fatalf("[forecast] %v\n", err)
+	}
+	os.Stdout.Write(body)
+}
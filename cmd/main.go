@@ -2,12 +2,106 @@ package main
 
 import (
 	"context"
+	"flag"
+	"log"
+	"os"
+	"strings"
 	"time"
 
 	mes "mes/internal"
+	"mes/internal/net/api"
+	"mes/internal/net/erp"
+	"mes/internal/sim"
+	"mes/internal/utils"
 )
 
 func main() {
-	simTime := 1 * time.Minute
-	mes.Run(context.Background(), simTime)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "override":
+			runOverride(os.Args[2:])
+			return
+		case "forecast":
+			runForecast(os.Args[2:])
+			return
+		case "benchmark":
+			runBenchmark(os.Args[2:])
+			return
+		case "audit":
+			runAudit(os.Args[2:])
+			return
+		}
+	}
+
+	scheduler := flag.String("scheduler", sim.SCHEDULER_DEFAULT,
+		"line assignment policy, one of: "+strings.Join(sim.SchedulerNames(), ", "))
+	batchMaxWait := flag.Duration("batch-max-wait", sim.TOOL_BATCH_MAX_WAIT,
+		"longest time the batch scheduler holds a piece back to avoid a tool swap")
+	toolPreSetup := flag.Bool("tool-presetup", true,
+		"swap tools on idle machines ahead of the upcoming work")
+	wipCap := flag.Int("wip-cap", 0,
+		"maximum number of pieces released from W1 and not completed, 0 for no limit")
+	lineWipCaps := flag.String("line-wip-caps", "",
+		"maximum number of pieces on each line conveyor, e.g. L1=2,L4=3")
+	dayPlanner := flag.Bool("day-planner", false,
+		"plan the backlog at every day tick and have the dispatcher follow the plan")
+	scoringConfig := flag.String("scoring-config", "",
+		"JSON file with the weights of the control form scoring terms, reloadable at runtime")
+	partialShipments := flag.Bool("partial-shipments", false,
+		"receive the part of a shipment that fits in W1 and defer the rest")
+	partialDeliveries := flag.Bool("partial-deliveries", false,
+		"send the pieces of a delivery that are in W2 and the rest as they are produced")
+	lineLayouts := flag.String("line-layouts", "",
+		"JSON file with the machines of each processing line and their conveyor positions")
+	erpStockUrl := flag.String("erp-stock-url",
+		erp.ENDPOINT_DEFAULT_BASE_URL+erp.ENDPOINT_WAREHOUSE_STOCK,
+		"URL of the ERP endpoint listing the items in the warehouses, compared by audits")
+	apiAddr := flag.String("api-addr", api.DEFAULT_ADDR, "address the MES HTTP API listens on")
+	dataDir := flag.String("data-dir", ".",
+		"directory the MES logs and the state it restores on startup are written to")
+	flag.Parse()
+
+	if err := utils.SetDataDir(*dataDir); err != nil {
+		log.Fatalf("[main] %v\n", err)
+	}
+
+	schedulerOpts := sim.DefaultSchedulerOptions()
+	schedulerOpts.BatchMaxWait = *batchMaxWait
+	if err := sim.UseScheduler(*scheduler, schedulerOpts); err != nil {
+		log.Fatalf("[main] %v\n", err)
+	}
+
+	sim.UseToolPreSetup(*toolPreSetup)
+	sim.UseDayPlanner(*dayPlanner)
+	sim.UsePartialShipments(*partialShipments)
+	sim.UsePartialDeliveries(*partialDeliveries)
+
+	if err := sim.UseErpStockEndpoint(*erpStockUrl); err != nil {
+		log.Fatalf("[main] %v\n", err)
+	}
+
+	if *scoringConfig != "" {
+		if err := sim.LoadScoringWeights(*scoringConfig); err != nil {
+			log.Fatalf("[main] %v\n", err)
+		}
+	}
+
+	if *lineLayouts != "" {
+		if err := sim.LoadLineLayouts(*lineLayouts); err != nil {
+			log.Fatalf("[main] %v\n", err)
+		}
+	}
+
+	perLineCaps, err := sim.ParseLineCaps(*lineWipCaps)
+	if err != nil {
+		log.Fatalf("[main] %v\n", err)
+	}
+	if err := sim.SetWipLimits(sim.WipLimits{Global: *wipCap, PerLine: perLineCaps}); err != nil {
+		log.Fatalf("[main] %v\n", err)
+	}
+
+	mes.Run(context.Background(), mes.Config{
+		SimTime: 1 * time.Minute,
+		ApiAddr: *apiAddr,
+	})
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"mes/internal/net/api"
+	"mes/internal/sim"
+)
+
+var overrideActions = []string{
+	sim.OVERRIDE_PIN,
+	sim.OVERRIDE_UNPIN,
+	sim.OVERRIDE_HOLD,
+	sim.OVERRIDE_RELEASE,
+	sim.OVERRIDE_BLOCK_TOOL,
+	sim.OVERRIDE_UNBLOCK_TOOL,
+	sim.OVERRIDE_PRIORITY,
+	sim.OVERRIDE_EXPEDITE,
+}
+
+// runOverride sends a supervisor override to a running MES, or lists the
+// active overrides (or the audit log) when no action is given.
+//
+// Usage: mes override [flags] [action]
+func runOverride(args []string) {
+	flags := flag.NewFlagSet("override", flag.ExitOnError)
+	apiUrl := flags.String("api-url", api.DEFAULT_BASE_URL, "base url of the MES API")
+	piece := flags.String("piece", "", "piece ID (pin, unpin, hold, release, priority, expedite)")
+	line := flags.String("line", "", "line ID (pin, block-tool, unblock-tool)")
+	machine := flags.String("machine", "", "machine name (block-tool, unblock-tool)")
+	tool := flags.String("tool", "", "tool (block-tool, unblock-tool)")
+	untilDay := flags.Uint("until-day", 0, "last day a tool is blocked, 0 for no limit")
+	priority := flags.Int("priority", sim.PRIORITY_NORMAL,
+		fmt.Sprintf("priority class, %d to %d (priority)", sim.PRIORITY_NORMAL, sim.PRIORITY_URGENT))
+	operator := flags.String("operator", os.Getenv("USER"), "operator giving the override")
+	reason := flags.String("reason", "", "reason for the override")
+	audit := flags.Bool("audit", false, "list the overrides audit log")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: mes override [flags] [%s]\n",
+			strings.Join(overrideActions, "|"))
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	var body []byte
+	var err error
+	switch {
+	case *audit:
+		body, err = api.Get(*apiUrl, api.ENDPOINT_OVERRIDES_AUDIT)
+	case flags.NArg() == 0:
+		body, err = api.Get(*apiUrl, api.ENDPOINT_OVERRIDES)
+	default:
+		body, err = api.Post(*apiUrl, api.ENDPOINT_OVERRIDES, url.Values{
+			"action":    {flags.Arg(0)},
+			"piece":     {*piece},
+			"line":      {*line},
+			"machine":   {*machine},
+			"tool":      {*tool},
+			"until_day": {strconv.FormatUint(uint64(*untilDay), 10)},
+			"priority":  {strconv.Itoa(*priority)},
+			"operator":  {*operator},
+			"reason":    {*reason},
+		})
+	}
+	if err != nil {
+		log.Fatalf("[override] %v\n", err)
+	}
+	os.Stdout.Write(body)
+}
@@ -2,12 +2,14 @@ module mes
 
 go 1.22.2
 
+require github.com/gopcua/opcua v0.5.3
+
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/gopcua/opcua v0.5.3 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/testify v1.9.0 // indirect
 	golang.org/x/exp v0.0.0-20230522175609-2e198f4a06a1 // indirect
+	golang.org/x/tools v0.2.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
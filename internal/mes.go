@@ -3,18 +3,29 @@ package mes
 import (
 	"context"
 	"log"
+	"mes/internal/net/api"
 	"mes/internal/sim"
+	"mes/internal/utils"
 	"time"
 )
 
+// Config holds the MES runtime settings.
+type Config struct {
+	// Simulation time period (> 0), i.e. the duration of a day
+	SimTime time.Duration
+	// Address the MES HTTP API listens on
+	ApiAddr string
+}
+
 // Run starts the MES operation.
 // It blocks until the context is canceled.
-// simTime (> 0) is the simulation time period.
-func Run(ctx context.Context, simTime time.Duration) {
+func Run(ctx context.Context, config Config) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	defer utils.FlushJSONLogs()
 
-	dateCh := sim.DateCounter(ctx, simTime)
+	apiErrCh := api.Start(ctx, config.ApiAddr)
+	dateCh := sim.DateCounter(ctx, config.SimTime)
 	deliveryHandler := sim.StartDeliveryHandler(ctx)
 	pieceHandler := sim.StartPieceHandler(ctx)
 	shipmentHandler := sim.StartShipmentHandler(ctx, pieceHandler.WakeUpCh)
@@ -47,6 +58,12 @@ func Run(ctx context.Context, simTime time.Duration) {
 		case factoryError := <-factoryErrorCh:
 			log.Panicf("[mes.Run] %v\n", factoryError)
 
+		case apiError, open := <-apiErrCh:
+			if open {
+				log.Panicf("[mes.Run] %v\n", apiError)
+			}
+			apiErrCh = nil
+
 		}
 	}
 }
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// Post sends the form to the MES API at baseUrl and returns the response
+// body. It is used by the command line tools to talk to a running MES.
+func Post(baseUrl string, endpoint string, formData url.Values) ([]byte, error) {
+	client := http.Client{Timeout: DEFAULT_HTTP_TIMEOUT}
+
+	resp, err := client.PostForm(baseUrl+endpoint, formData)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("[api.Post] unexpected status code %d: %s", resp.StatusCode, body)
+	}
+	return body, nil
+}
+
+// Get queries the MES API at baseUrl and returns the response body.
+func Get(baseUrl string, endpoint string) ([]byte, error) {
+	client := http.Client{Timeout: DEFAULT_HTTP_TIMEOUT}
+
+	resp, err := client.Get(baseUrl + endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("[api.Get] unexpected status code %d: %s", resp.StatusCode, body)
+	}
+	return body, nil
+}
@@ -0,0 +1,44 @@
+package api
+
+import "time"
+
+const (
+	ENDPOINT_DECISIONS = "/decisions"
+	ENDPOINT_LATENESS  = "/lateness"
+
+	ENDPOINT_DOWNTIME         = "/downtime"
+	ENDPOINT_DOWNTIME_WINDOWS = "/downtime/windows"
+
+	ENDPOINT_OVERRIDES       = "/overrides"
+	ENDPOINT_OVERRIDES_AUDIT = "/overrides/audit"
+
+	ENDPOINT_WIP = "/wip"
+
+	ENDPOINT_FORECAST = "/forecast"
+
+	ENDPOINT_SCORING        = "/scoring"
+	ENDPOINT_SCORING_RELOAD = "/scoring/reload"
+
+	ENDPOINT_DAY_PLAN = "/plan"
+
+	ENDPOINT_LAYOUTS = "/layouts"
+
+	ENDPOINT_DEFERRED_SHIPMENTS = "/shipments/deferred"
+	ENDPOINT_SUPPLY             = "/shipments/supply"
+	ENDPOINT_RECEIPTS           = "/shipments/receipts"
+
+	ENDPOINT_DELIVERY_QUEUE = "/deliveries/queue"
+	ENDPOINT_DELIVERY_LOADS = "/deliveries/loads"
+	ENDPOINT_DELIVERY_LINES = "/deliveries/lines"
+	ENDPOINT_STOCK          = "/stock"
+
+	ENDPOINT_INVENTORY = "/inventory"
+	ENDPOINT_AUDIT     = "/inventory/audit"
+
+	ENDPOINT_TRACES = "/traces"
+
+	DEFAULT_ADDR         = ":8081"
+	DEFAULT_BASE_URL     = "http://localhost:8081"
+	DEFAULT_HTTP_TIMEOUT = 5 * time.Second
+	DEFAULT_QUERY_LIMIT  = 100
+)
@@ -0,0 +1,17 @@
+package api
+
+import (
+	"errors"
+	"mes/internal/sim"
+	"net/http"
+)
+
+// getDayPlan reports the day plan being followed and how closely.
+func getDayPlan(w http.ResponseWriter, _ *http.Request) {
+	plan, ok := sim.CurrentDayPlan()
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("no day plan in use"))
+		return
+	}
+	writeJSON(w, http.StatusOK, plan)
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"fmt"
+	"mes/internal/sim"
+	"net/http"
+	"strconv"
+)
+
+// getDeliveryQueue lists the deliveries not confirmed to the ERP yet.
+func getDeliveryQueue(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, sim.DeliveryQueue())
+}
+
+// getDeliveryLoads lists the loads unloaded by the delivery lines, newest
+// first. Optional query parameters: order, line and limit.
+func getDeliveryLoads(w http.ResponseWriter, r *http.Request) {
+	limit, err := queryInt(r, "limit", DEFAULT_QUERY_LIMIT)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	loads := sim.DeliveryLoads(sim.DeliveryLoadFilter{
+		OrderID: r.URL.Query().Get("order"),
+		Line:    r.URL.Query().Get("line"),
+		Limit:   limit,
+	})
+	writeJSON(w, http.StatusOK, loads)
+}
+
+// getDeliveryLines reports the pieces unloaded by each delivery line.
+func getDeliveryLines(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, sim.DeliveryLines())
+}
+
+// getStock reports the finished pieces of each kind in W2.
+func getStock(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, sim.Stock())
+}
+
+// postStock sets the finished stock of a kind after a physical count.
+// Form fields: kind and quantity.
+func postStock(w http.ResponseWriter, r *http.Request) {
+	quantity, err := strconv.Atoi(r.FormValue("quantity"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid quantity: %q", r.FormValue("quantity")))
+		return
+	}
+
+	if err := sim.SetStock(r.FormValue("kind"), quantity); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, sim.Stock())
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"fmt"
+	"mes/internal/sim"
+	"net/http"
+	"strconv"
+)
+
+// getDowntime lists the availability of every line and machine.
+func getDowntime(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, sim.Availabilities())
+}
+
+// postDowntime marks a line or machine as down or back up.
+// Form fields: line, machine (optional), down (bool) and reason.
+func postDowntime(w http.ResponseWriter, r *http.Request) {
+	down, err := strconv.ParseBool(r.FormValue("down"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid down: %q", r.FormValue("down")))
+		return
+	}
+
+	err = sim.SetManualDowntime(
+		r.FormValue("line"),
+		r.FormValue("machine"),
+		down,
+		r.FormValue("reason"),
+	)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, sim.Availabilities())
+}
+
+// getDowntimeWindows lists the scheduled maintenance windows.
+func getDowntimeWindows(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, sim.DowntimeWindows())
+}
+
+// postDowntimeWindow schedules a maintenance window.
+// Form fields: line, machine (optional), from_day, to_day and reason.
+func postDowntimeWindow(w http.ResponseWriter, r *http.Request) {
+	fromDay, err := strconv.ParseUint(r.FormValue("from_day"), 10, 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid from_day: %q", r.FormValue("from_day")))
+		return
+	}
+	toDay, err := strconv.ParseUint(r.FormValue("to_day"), 10, 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid to_day: %q", r.FormValue("to_day")))
+		return
+	}
+
+	err = sim.AddDowntimeWindow(sim.DowntimeWindow{
+		LineID:    r.FormValue("line"),
+		MachineID: r.FormValue("machine"),
+		FromDay:   uint(fromDay),
+		ToDay:     uint(toDay),
+		Reason:    r.FormValue("reason"),
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, sim.DowntimeWindows())
+}
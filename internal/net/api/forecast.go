@@ -0,0 +1,32 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"mes/internal/sim"
+	"net/http"
+)
+
+// getForecast estimates when the current backlog will be completed.
+func getForecast(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, sim.Forecast(nil))
+}
+
+// postForecast estimates when the current backlog would be completed if
+// the given pieces were accepted today.
+// Form fields: pieces (a JSON array of pieces, with their recipe steps).
+func postForecast(w http.ResponseWriter, r *http.Request) {
+	pieces := []sim.Piece{}
+	if err := json.Unmarshal([]byte(r.FormValue("pieces")), &pieces); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid pieces: %w", err))
+		return
+	}
+	for _, piece := range pieces {
+		if len(piece.Steps) == 0 {
+			writeError(w, http.StatusBadRequest,
+				fmt.Errorf("piece %q has no steps", piece.ErpIdentifier))
+			return
+		}
+	}
+	writeJSON(w, http.StatusCreated, sim.Forecast(pieces))
+}
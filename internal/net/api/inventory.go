@@ -0,0 +1,61 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"mes/internal/sim"
+	"net/http"
+	"strconv"
+)
+
+// getInventory reports the pieces of each kind in each warehouse, next to
+// the totals read from the PLC.
+func getInventory(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, sim.Inventory())
+}
+
+// postInventory sets the pieces of a kind in a warehouse after a physical
+// count. Form fields: warehouse, kind and quantity.
+func postInventory(w http.ResponseWriter, r *http.Request) {
+	quantity, err := strconv.Atoi(r.FormValue("quantity"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid quantity: %q", r.FormValue("quantity")))
+		return
+	}
+
+	if err := sim.CorrectInventory(r.FormValue("warehouse"), r.FormValue("kind"), quantity); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, sim.Inventory())
+}
+
+// getAudits lists the audit reports, oldest first.
+func getAudits(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, sim.Audits())
+}
+
+// postAudit runs a cycle count and reports the discrepancies found.
+// Form fields: operator and correct (correct the side that disagrees with
+// the PLC). Corrections are refused with a conflict while pieces are moving.
+func postAudit(w http.ResponseWriter, r *http.Request) {
+	correct := false
+	if value := r.FormValue("correct"); value != "" {
+		var err error
+		if correct, err = strconv.ParseBool(value); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid correct: %q", value))
+			return
+		}
+	}
+
+	report, err := sim.RunAudit(r.Context(), r.FormValue("operator"), correct)
+	if errors.Is(err, sim.ErrAuditInFlight) {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, report)
+}
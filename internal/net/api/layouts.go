@@ -0,0 +1,30 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"mes/internal/sim"
+	"net/http"
+)
+
+// getLayouts reports the machines of every processing line and where they
+// sit along its conveyor.
+func getLayouts(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, sim.LineLayouts())
+}
+
+// postLayouts replaces the layouts of idle lines.
+// Form fields: layouts (JSON object, line ID -> layout).
+func postLayouts(w http.ResponseWriter, r *http.Request) {
+	layouts := map[string]sim.LineLayout{}
+	if err := json.Unmarshal([]byte(r.FormValue("layouts")), &layouts); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid layouts: %w", err))
+		return
+	}
+
+	if err := sim.SetLineLayouts(layouts); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, sim.LineLayouts())
+}
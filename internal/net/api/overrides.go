@@ -0,0 +1,58 @@
+package api
+
+import (
+	"fmt"
+	"mes/internal/sim"
+	"net/http"
+	"strconv"
+)
+
+// getOverrides lists the overrides currently in effect.
+func getOverrides(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, sim.Overrides())
+}
+
+// getOverridesAudit lists every override received, oldest first.
+func getOverridesAudit(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, sim.OverridesAudit())
+}
+
+// postOverride applies a supervisor override.
+// Form fields: action, piece, line, machine, tool, until_day, priority,
+// operator and reason.
+func postOverride(w http.ResponseWriter, r *http.Request) {
+	untilDay := uint64(0)
+	if value := r.FormValue("until_day"); value != "" {
+		var err error
+		if untilDay, err = strconv.ParseUint(value, 10, 0); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid until_day: %q", value))
+			return
+		}
+	}
+
+	priority := 0
+	if value := r.FormValue("priority"); value != "" {
+		var err error
+		if priority, err = strconv.Atoi(value); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid priority: %q", value))
+			return
+		}
+	}
+
+	err := sim.ApplyOverride(sim.Override{
+		Action:    r.FormValue("action"),
+		PieceID:   r.FormValue("piece"),
+		LineID:    r.FormValue("line"),
+		MachineID: r.FormValue("machine"),
+		Tool:      r.FormValue("tool"),
+		UntilDay:  uint(untilDay),
+		Priority:  priority,
+		Operator:  r.FormValue("operator"),
+		Reason:    r.FormValue("reason"),
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, sim.Overrides())
+}
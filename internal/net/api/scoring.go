@@ -0,0 +1,47 @@
+package api
+
+import (
+	"mes/internal/sim"
+	"net/http"
+)
+
+type scoringResponse struct {
+	Weights sim.ScoringWeights `json:"weights"`
+	Terms   []string           `json:"terms"`
+}
+
+func currentScoring() scoringResponse {
+	return scoringResponse{
+		Weights: sim.CurrentScoringWeights(),
+		Terms:   sim.ScoreTermNames(),
+	}
+}
+
+// getScoring reports the scoring weights in use and the available terms.
+func getScoring(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, currentScoring())
+}
+
+// postScoring replaces the scoring weights.
+// Form fields: weights (e.g. "time=1,queue=125,tool_changes=30").
+func postScoring(w http.ResponseWriter, r *http.Request) {
+	weights, err := sim.ParseScoringWeights(r.FormValue("weights"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := sim.SetScoringWeights(weights); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, currentScoring())
+}
+
+// postScoringReload reads the scoring config file again.
+func postScoringReload(w http.ResponseWriter, _ *http.Request) {
+	if err := sim.ReloadScoringWeights(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, currentScoring())
+}
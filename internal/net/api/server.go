@@ -0,0 +1,128 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mes/internal/sim"
+	"net/http"
+	"strconv"
+)
+
+// Start serves the MES HTTP API on addr until the context is cancelled.
+// Errors that stop the server are reported on the returned channel.
+func Start(ctx context.Context, addr string) <-chan error {
+	errCh := make(chan error, 1)
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           newMux(),
+		ReadHeaderTimeout: DEFAULT_HTTP_TIMEOUT,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), DEFAULT_HTTP_TIMEOUT)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	go func() {
+		defer close(errCh)
+
+		log.Printf("[api.Start] Serving MES API on %s\n", addr)
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errCh <- fmt.Errorf("[api.Start] %w", err)
+		}
+	}()
+
+	return errCh
+}
+
+// newMux routes the endpoints of the API to their handlers.
+func newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+ENDPOINT_DECISIONS, getDecisions)
+	mux.HandleFunc("GET "+ENDPOINT_LATENESS, getLateness)
+	mux.HandleFunc("GET "+ENDPOINT_DOWNTIME, getDowntime)
+	mux.HandleFunc("POST "+ENDPOINT_DOWNTIME, postDowntime)
+	mux.HandleFunc("GET "+ENDPOINT_DOWNTIME_WINDOWS, getDowntimeWindows)
+	mux.HandleFunc("POST "+ENDPOINT_DOWNTIME_WINDOWS, postDowntimeWindow)
+	mux.HandleFunc("GET "+ENDPOINT_OVERRIDES, getOverrides)
+	mux.HandleFunc("POST "+ENDPOINT_OVERRIDES, postOverride)
+	mux.HandleFunc("GET "+ENDPOINT_OVERRIDES_AUDIT, getOverridesAudit)
+	mux.HandleFunc("GET "+ENDPOINT_WIP, getWip)
+	mux.HandleFunc("POST "+ENDPOINT_WIP, postWip)
+	mux.HandleFunc("GET "+ENDPOINT_FORECAST, getForecast)
+	mux.HandleFunc("POST "+ENDPOINT_FORECAST, postForecast)
+	mux.HandleFunc("GET "+ENDPOINT_SCORING, getScoring)
+	mux.HandleFunc("POST "+ENDPOINT_SCORING, postScoring)
+	mux.HandleFunc("POST "+ENDPOINT_SCORING_RELOAD, postScoringReload)
+	mux.HandleFunc("GET "+ENDPOINT_DAY_PLAN, getDayPlan)
+	mux.HandleFunc("GET "+ENDPOINT_LAYOUTS, getLayouts)
+	mux.HandleFunc("POST "+ENDPOINT_LAYOUTS, postLayouts)
+	mux.HandleFunc("GET "+ENDPOINT_DEFERRED_SHIPMENTS, getDeferredShipments)
+	mux.HandleFunc("GET "+ENDPOINT_SUPPLY, getSupply)
+	mux.HandleFunc("GET "+ENDPOINT_RECEIPTS, getReceipts)
+	mux.HandleFunc("GET "+ENDPOINT_DELIVERY_QUEUE, getDeliveryQueue)
+	mux.HandleFunc("GET "+ENDPOINT_DELIVERY_LOADS, getDeliveryLoads)
+	mux.HandleFunc("GET "+ENDPOINT_DELIVERY_LINES, getDeliveryLines)
+	mux.HandleFunc("GET "+ENDPOINT_STOCK, getStock)
+	mux.HandleFunc("POST "+ENDPOINT_STOCK, postStock)
+	mux.HandleFunc("GET "+ENDPOINT_INVENTORY, getInventory)
+	mux.HandleFunc("POST "+ENDPOINT_INVENTORY, postInventory)
+	mux.HandleFunc("GET "+ENDPOINT_AUDIT, getAudits)
+	mux.HandleFunc("POST "+ENDPOINT_AUDIT, postAudit)
+	mux.HandleFunc("GET "+ENDPOINT_TRACES, getTraces)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[api.writeJSON] failed to encode response: %v\n", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// queryInt parses an optional integer query parameter.
+func queryInt(r *http.Request, key string, fallback int) (int, error) {
+	value := r.URL.Query().Get(key)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %q", key, value)
+	}
+	return n, nil
+}
+
+// getDecisions lists the most recent dispatch decisions, newest first.
+// Optional query parameters: piece, line and limit.
+func getDecisions(w http.ResponseWriter, r *http.Request) {
+	limit, err := queryInt(r, "limit", DEFAULT_QUERY_LIMIT)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	decisions := sim.Decisions(sim.DecisionFilter{
+		PieceID: r.URL.Query().Get("piece"),
+		LineID:  r.URL.Query().Get("line"),
+		Limit:   limit,
+	})
+	writeJSON(w, http.StatusOK, decisions)
+}
+
+// getLateness lists the projected lateness of the pieces waiting for a line.
+func getLateness(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, sim.ProjectedLateness())
+}
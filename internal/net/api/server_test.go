@@ -0,0 +1,77 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDecisionsEndpoint(t *testing.T) {
+	server := httptest.NewServer(newMux())
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+	}{
+		{"no filter", "", http.StatusOK},
+		{"filters", "?piece=a&line=L1&limit=5", http.StatusOK},
+		{"invalid limit", "?limit=many", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(server.URL + ENDPOINT_DECISIONS + tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("Expected status %d, got %d", tt.status, resp.StatusCode)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+				t.Fatalf("Expected a JSON response, got %q", ct)
+			}
+			var body any
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("Expected a JSON body: %v", err)
+			}
+		})
+	}
+}
+
+func TestMethodsAreRouted(t *testing.T) {
+	server := httptest.NewServer(newMux())
+	defer server.Close()
+
+	// Decisions are read only
+	resp, err := http.PostForm(server.URL+ENDPOINT_DECISIONS, url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected status %d, got %d", http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+}
+
+func TestClientReportsErrors(t *testing.T) {
+	server := httptest.NewServer(newMux())
+	defer server.Close()
+
+	body, err := Get(server.URL, ENDPOINT_DECISIONS)
+	if err != nil || !strings.HasPrefix(string(body), "[") {
+		t.Fatalf("Expected a list of decisions, got %q (%v)", body, err)
+	}
+	if _, err := Get(server.URL, ENDPOINT_DECISIONS+"?limit=many"); err == nil ||
+		!strings.Contains(err.Error(), "invalid limit") {
+		t.Fatalf("Expected the API error reported, got %v", err)
+	}
+	if _, err := Post(server.URL, ENDPOINT_DECISIONS, url.Values{}); err == nil {
+		t.Fatal("Expected an error for a rejected post")
+	}
+}
@@ -0,0 +1,21 @@
+package api
+
+import (
+	"mes/internal/sim"
+	"net/http"
+)
+
+// getDeferredShipments lists the shipments waiting for space in W1.
+func getDeferredShipments(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, sim.DeferredShipments())
+}
+
+// getSupply reports the pieces being brought in by each supply line.
+func getSupply(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, sim.Supply())
+}
+
+// getReceipts lists the shipments reconciled against the W1 total.
+func getReceipts(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, sim.ShipmentReceipts())
+}
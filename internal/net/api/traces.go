@@ -0,0 +1,30 @@
+package api
+
+import (
+	"mes/internal/sim"
+	"net/http"
+)
+
+// getTraces lists the genealogy of the pieces, most recently received
+// first. Optional query parameters: piece (any ID the piece had),
+// shipment, order and limit.
+func getTraces(w http.ResponseWriter, r *http.Request) {
+	limit, err := queryInt(r, "limit", DEFAULT_QUERY_LIMIT)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	shipment, err := queryInt(r, "shipment", 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	traces := sim.Traces(sim.TraceFilter{
+		PieceID:    r.URL.Query().Get("piece"),
+		ShipmentID: shipment,
+		OrderID:    r.URL.Query().Get("order"),
+		Limit:      limit,
+	})
+	writeJSON(w, http.StatusOK, traces)
+}
@@ -0,0 +1,34 @@
+package api
+
+import (
+	"fmt"
+	"mes/internal/sim"
+	"net/http"
+	"strconv"
+)
+
+// getWip reports the WIP caps and the W1 release queue metrics.
+func getWip(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, sim.Wip())
+}
+
+// postWip changes the WIP caps.
+// Form fields: global and per_line (e.g. "L1=2,L4=3").
+func postWip(w http.ResponseWriter, r *http.Request) {
+	global, err := strconv.Atoi(r.FormValue("global"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid global: %q", r.FormValue("global")))
+		return
+	}
+	perLine, err := sim.ParseLineCaps(r.FormValue("per_line"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := sim.SetWipLimits(sim.WipLimits{Global: global, PerLine: perLine}); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, sim.Wip())
+}
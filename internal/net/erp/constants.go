@@ -3,14 +3,19 @@ package erp
 import "time"
 
 const (
-	ENDPOINT_DATE              = "/date"
-	ENDPOINT_WAREHOUSE         = "/warehouse"
-	ENDPOINT_SHIPMENT_ARRIVAL  = "/materials/arrivals"
-	ENDPOINT_EXPECTED_SHIPMENT = "/materials/expected"
-	ENDPOINT_TRANSFORMATION    = "/transformations"
-	ENDPOINT_PRODUCTION        = "/production"
-	ENDPOINT_DELIVERY          = "/deliveries"
-	ENDPOINT_DELIVERY_STATS    = "/deliveries/statistics"
+	ENDPOINT_DATE                 = "/date"
+	ENDPOINT_WAREHOUSE            = "/warehouse"
+	ENDPOINT_WAREHOUSE_CORRECTION = "/warehouse/corrections"
+	ENDPOINT_WAREHOUSE_STOCK      = "/warehouse/stock"
+	ENDPOINT_SHIPMENT_ARRIVAL     = "/materials/arrivals"
+	ENDPOINT_EXPECTED_SHIPMENT    = "/materials/expected"
+	ENDPOINT_SHIPMENT_DEFERRED    = "/materials/deferred"
+	ENDPOINT_SHIPMENT_MISMATCH    = "/materials/discrepancies"
+	ENDPOINT_TRANSFORMATION       = "/transformations"
+	ENDPOINT_PRODUCTION           = "/production"
+	ENDPOINT_DELIVERY             = "/deliveries"
+	ENDPOINT_DELIVERY_STATS       = "/deliveries/statistics"
+	ENDPOINT_DELIVERY_SHORTFALL   = "/deliveries/shortfalls"
 
 	ENDPOINT_DEFAULT_BASE_URL = "http://localhost:8080"
 	DEFAULT_HTTP_TIMEOUT      = 5 * time.Second
@@ -212,17 +212,16 @@ func TestInitCells(t *testing.T) {
 		if cell.command.PieceKind.Value != 0 {
 			t.Errorf("Error creating cells: %v", cells)
 		}
-		if cell.command.ProcessBot.Value != false {
+		if len(cell.command.Machines) != CELL_DEFAULT_MACHINES {
 			t.Errorf("Error creating cells: %v", cells)
 		}
-		if cell.command.ProcessTop.Value != false {
-			t.Errorf("Error creating cells: %v", cells)
-		}
-		if cell.command.ToolBot.Value != 0 {
-			t.Errorf("Error creating cells: %v", cells)
-		}
-		if cell.command.ToolTop.Value != 0 {
-			t.Errorf("Error creating cells: %v", cells)
+		for _, machine := range cell.command.Machines {
+			if machine.Process.Value != false {
+				t.Errorf("Error creating cells: %v", cells)
+			}
+			if machine.Tool.Value != 0 {
+				t.Errorf("Error creating cells: %v", cells)
+			}
 		}
 		if cell.state.TxIdPieceIN.Value != 0 {
 			t.Errorf("Error creating cells: %v", cells)
@@ -31,6 +31,18 @@ const (
 	CELL_REPEATTOP_POSTFIX  = ".repeatTop"
 	CELL_REPEATBOT_POSTFIX  = ".repeatBot"
 
+	// Cell machine fault opcua node data
+	CELL_FAULTTOP_POSTFIX = ".faultTop"
+	CELL_FAULTBOT_POSTFIX = ".faultBot"
+
+	// Cells have a top and a bottom machine unless configured otherwise.
+	// Machines past the second one are numbered from 3 (e.g. ".tool_M3")
+	CELL_DEFAULT_MACHINES = 2
+	CELL_PROCESS_POSTFIX  = ".processM"
+	CELL_TOOL_POSTFIX     = ".tool_M"
+	CELL_REPEAT_POSTFIX   = ".repeatM"
+	CELL_FAULT_POSTFIX    = ".faultM"
+
 	// Warehouse entry Ack
 	NODE_ID_WAREHOUSE_ACK = POU_PATH + "mes"
 
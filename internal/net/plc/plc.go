@@ -8,32 +8,34 @@ import (
 	"github.com/gopcua/opcua/ua"
 )
 
+// MachineCommand is the part of a cell command addressed to one machine.
+type MachineCommand struct {
+	Process OpcuaBool
+	Tool    OpcuaInt16
+	Repeat  OpcuaInt16
+}
+
 type CellCommand struct {
 	TxId      OpcuaInt16
 	PieceKind OpcuaInt16
 
-	ProcessTop OpcuaBool
-	ToolTop    OpcuaInt16
-	RepeatTop  OpcuaInt16
-
-	ProcessBot OpcuaBool
-	ToolBot    OpcuaInt16
-	RepeatBot  OpcuaInt16
+	// One per machine of the cell, in conveyor order
+	Machines []MachineCommand
 }
 
 func (cc *CellCommand) OpcuaVars() []opcuaVariable {
-	return []opcuaVariable{
+	vars := []opcuaVariable{
 		&cc.TxId,
 		&cc.PieceKind,
-
-		&cc.ProcessTop,
-		&cc.ToolTop,
-		&cc.RepeatTop,
-
-		&cc.ProcessBot,
-		&cc.ToolBot,
-		&cc.RepeatBot,
 	}
+	for i := range cc.Machines {
+		vars = append(vars,
+			&cc.Machines[i].Process,
+			&cc.Machines[i].Tool,
+			&cc.Machines[i].Repeat,
+		)
+	}
+	return vars
 }
 
 type CellState struct {
@@ -48,13 +50,112 @@ func (cs *CellState) OpcuaVars() []opcuaVariable {
 	}
 }
 
+// CellFaults reports which machines of a cell are faulted.
+type CellFaults struct {
+	// One per machine of the cell, in conveyor order
+	Machines []OpcuaBool
+	// Whether the last read of each fault node failed
+	unreadable []bool
+}
+
+func (cf *CellFaults) OpcuaVars() []opcuaVariable {
+	vars := make([]opcuaVariable, len(cf.Machines))
+	for i := range cf.Machines {
+		vars[i] = &cf.Machines[i]
+	}
+	return vars
+}
+
 type Cell struct {
+	prefix      string // node ID prefix of the cell command and faults
 	command     *CellCommand
 	state       *CellState
 	oldState    *CellState
+	faults      *CellFaults
 	cellExitAck OpcuaInt16
 }
 
+// machineNodePostfixes returns the node ID postfixes of the command and
+// fault variables of the i-th machine (0-based) of a cell. The first two
+// machines keep the top and bottom machine names of two machine cells.
+func machineNodePostfixes(i int) (process, tool, repeat, fault string) {
+	switch i {
+	case 0:
+		return CELL_PROCESSTOP_POSTFIX, CELL_TOOLTOP_POSTFIX,
+			CELL_REPEATTOP_POSTFIX, CELL_FAULTTOP_POSTFIX
+	case 1:
+		return CELL_PROCESSBOT_POSTFIX, CELL_TOOLBOT_POSTFIX,
+			CELL_REPEATBOT_POSTFIX, CELL_FAULTBOT_POSTFIX
+	default:
+		n := strconv.Itoa(i + 1)
+		return CELL_PROCESS_POSTFIX + n, CELL_TOOL_POSTFIX + n,
+			CELL_REPEAT_POSTFIX + n, CELL_FAULT_POSTFIX + n
+	}
+}
+
+// SetMachineCount sets the number of machines the cell commands and
+// reports faults for. The command values of the machines kept are preserved.
+func (c *Cell) SetMachineCount(n int) {
+	utils.Assert(n > 0, "[Cell.SetMachineCount] a cell needs at least one machine")
+
+	machines := make([]MachineCommand, n)
+	faults := make([]OpcuaBool, n)
+	for i := range n {
+		process, tool, repeat, fault := machineNodePostfixes(i)
+		machines[i] = MachineCommand{
+			Process: OpcuaBool{nodeID: c.prefix + process},
+			Tool:    OpcuaInt16{nodeID: c.prefix + tool},
+			Repeat:  OpcuaInt16{nodeID: c.prefix + repeat},
+		}
+		if i < len(c.command.Machines) {
+			machines[i].Process.Value = c.command.Machines[i].Process.Value
+			machines[i].Tool.Value = c.command.Machines[i].Tool.Value
+			machines[i].Repeat.Value = c.command.Machines[i].Repeat.Value
+		}
+		faults[i] = OpcuaBool{nodeID: c.prefix + fault}
+	}
+
+	c.command.Machines = machines
+	c.faults.Machines = faults
+	c.faults.unreadable = make([]bool, n)
+}
+
+func (c *Cell) FaultOpcuaVars() []opcuaVariable {
+	return c.faults.OpcuaVars()
+}
+
+func (c *Cell) UpdateFaults(response *ua.ReadResponse) {
+	utils.Assert(response != nil, "Response is nil")
+	utils.Assert(len(response.Results) == len(c.faults.Machines),
+		"Cell faults response has wrong number of results")
+
+	// Older PLC images may lack the fault nodes of some machines: a node
+	// that cannot be read is taken as no fault, and logged when it starts
+	// failing
+	for i, result := range response.Results {
+		fault := &c.faults.Machines[i]
+		value, ok := false, false
+		if result != nil && result.Status == ua.StatusOK && result.Value != nil {
+			value, ok = result.Value.Value().(bool)
+		}
+		if !ok && !c.faults.unreadable[i] {
+			log.Printf("[Cell.UpdateFaults] cannot read %s as a boolean, assuming no fault\n",
+				fault.nodeID)
+		}
+		fault.Value = value
+		c.faults.unreadable[i] = !ok
+	}
+}
+
+// Returns whether each machine of the cell is faulted, in conveyor order
+func (c *Cell) Faults() []bool {
+	faults := make([]bool, len(c.faults.Machines))
+	for i, fault := range c.faults.Machines {
+		faults[i] = fault.Value
+	}
+	return faults
+}
+
 func (c *Cell) StateOpcuaVars() []opcuaVariable {
 	return c.state.OpcuaVars()
 }
@@ -84,17 +185,48 @@ func (c *Cell) UpdateState(response *ua.ReadResponse) {
 	c.state.TxIdPieceOut.Value = response.Results[1].Value.Value().(int16)
 }
 
+// UpdateCommandOpcuaVars copies the command values to the cell. Machines
+// of the cell the command says nothing about are left idle.
 func (c *Cell) UpdateCommandOpcuaVars(pcf *CellCommand) {
 	c.command.TxId.Value = pcf.TxId.Value
 	c.command.PieceKind.Value = pcf.PieceKind.Value
 
-	c.command.ProcessTop.Value = pcf.ProcessTop.Value
-	c.command.ToolTop.Value = pcf.ToolTop.Value
-	c.command.RepeatTop.Value = pcf.RepeatTop.Value
+	for i := range c.command.Machines {
+		machine := MachineCommand{}
+		if i < len(pcf.Machines) {
+			machine = pcf.Machines[i]
+		}
+		c.command.Machines[i].Process.Value = machine.Process.Value
+		c.command.Machines[i].Tool.Value = machine.Tool.Value
+		c.command.Machines[i].Repeat.Value = machine.Repeat.Value
+	}
+}
+
+// SetTools changes the tools of the cell machines without starting a new
+// command, so that idle machines can be set up ahead of the next piece
+func (c *Cell) SetTools(tools []int16) {
+	for i := range c.command.Machines {
+		if i < len(tools) {
+			c.command.Machines[i].Tool.Value = tools[i]
+		}
+	}
+}
 
-	c.command.ProcessBot.Value = pcf.ProcessBot.Value
-	c.command.ToolBot.Value = pcf.ToolBot.Value
-	c.command.RepeatBot.Value = pcf.RepeatBot.Value
+// Returns the tools commanded to each machine of the cell, in conveyor order
+func (c *Cell) Tools() []int16 {
+	tools := make([]int16, len(c.command.Machines))
+	for i, machine := range c.command.Machines {
+		tools[i] = machine.Tool.Value
+	}
+	return tools
+}
+
+func (c *Cell) ToolOpcuaVars() []opcuaVariable {
+	vars := make([]opcuaVariable, len(c.command.Machines))
+	for i := range c.command.Machines {
+		vars[i] = &c.command.Machines[i].Tool
+	}
+	return vars
 }
 
 func (c *Cell) InPieceTxId() int16 {
@@ -138,17 +270,10 @@ func InitCells() []*Cell {
 		ackID := NODE_ID_WAREHOUSE_ACK + strconv.Itoa(i)
 
 		cells[i] = &Cell{
+			prefix: commandPrefix,
 			command: &CellCommand{
 				TxId:      OpcuaInt16{nodeID: commandPrefix + CELL_ID_POSTFIX},
 				PieceKind: OpcuaInt16{nodeID: commandPrefix + CELL_PIECE_POSTFIX},
-
-				ProcessTop: OpcuaBool{nodeID: commandPrefix + CELL_PROCESSTOP_POSTFIX},
-				ToolTop:    OpcuaInt16{nodeID: commandPrefix + CELL_TOOLTOP_POSTFIX},
-				RepeatTop:  OpcuaInt16{nodeID: commandPrefix + CELL_REPEATTOP_POSTFIX},
-
-				ProcessBot: OpcuaBool{nodeID: commandPrefix + CELL_PROCESSBOT_POSTFIX},
-				ToolBot:    OpcuaInt16{nodeID: commandPrefix + CELL_TOOLBOT_POSTFIX},
-				RepeatBot:  OpcuaInt16{nodeID: commandPrefix + CELL_REPEATBOT_POSTFIX},
 			},
 			state: &CellState{
 				TxIdPieceIN:  OpcuaInt16{nodeID: controlPrefix + CELL_CONTROL_OUT_POSTFIX},
@@ -158,8 +283,10 @@ func InitCells() []*Cell {
 				TxIdPieceIN:  OpcuaInt16{nodeID: controlPrefix + CELL_CONTROL_OUT_POSTFIX},
 				TxIdPieceOut: OpcuaInt16{nodeID: controlPrefix + CELL_CONTROL_IN_POSTFIX},
 			},
+			faults:      &CellFaults{},
 			cellExitAck: OpcuaInt16{nodeID: ackID},
 		}
+		cells[i].SetMachineCount(CELL_DEFAULT_MACHINES)
 	}
 
 	return cells
@@ -277,6 +404,14 @@ func (w *Warehouse) OpcuaVars() []opcuaVariable {
 	}
 }
 
+func (w *Warehouse) UpdateState(response *ua.ReadResponse) {
+	utils.Assert(response != nil, "Response is nil")
+	utils.Assert(len(response.Results) == 1, "Warehouse response has wrong number of results")
+	utils.Assert(response.Results[0].Value.Type() == ua.TypeIDInt16, "Warehouse response has wrong type")
+
+	w.Quantity.Value = response.Results[0].Value.Value().(int16)
+}
+
 type DeliveryCommand struct {
 	TxId  OpcuaInt16
 	Np    OpcuaInt16
@@ -345,6 +480,14 @@ func (dl *DeliveryLine) SetDelivery(quantity int16, pieceKind int16) {
 	dl.command.Piece.Value = pieceKind
 }
 
+// RestoreCommand sets the last command of the line to one written before
+// the MES restarted, without writing it, so that its ack is recognised.
+func (dl *DeliveryLine) RestoreCommand(txId int16, quantity int16, pieceKind int16) {
+	dl.command.TxId.Value = txId
+	dl.command.Np.Value = quantity
+	dl.command.Piece.Value = pieceKind
+}
+
 func (dl *DeliveryLine) LastCommandTxId() int16 {
 	return dl.command.TxId.Value
 }
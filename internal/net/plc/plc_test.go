@@ -0,0 +1,34 @@
+package plc
+
+import (
+	"testing"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+func TestCellUpdateFaults(t *testing.T) {
+	tests := []struct {
+		name   string
+		result *ua.DataValue
+		fault  bool
+	}{
+		{"faulted", &ua.DataValue{Status: ua.StatusOK, Value: ua.MustVariant(true)}, true},
+		{"running", &ua.DataValue{Status: ua.StatusOK, Value: ua.MustVariant(false)}, false},
+		{"missing node", &ua.DataValue{Status: ua.StatusBadNodeIDUnknown}, false},
+		{"no value", &ua.DataValue{Status: ua.StatusOK}, false},
+		{"not a boolean", &ua.DataValue{Status: ua.StatusOK, Value: ua.MustVariant(int16(1))}, false},
+		{"no result", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cell := InitCells()[0]
+			cell.SetMachineCount(1)
+			cell.faults.Machines[0].Value = true
+
+			cell.UpdateFaults(&ua.ReadResponse{Results: []*ua.DataValue{tt.result}})
+			if faults := cell.Faults(); faults[0] != tt.fault {
+				t.Fatalf("Expected fault %v, got %v", tt.fault, faults[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,409 @@
+package sim
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mes/internal/net/erp"
+	"mes/internal/net/plc"
+	"mes/internal/utils"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErpStockItem is an item of the ERP's view of the warehouses.
+type ErpStockItem struct {
+	ItemID    string `json:"item_id"`
+	Kind      string `json:"kind"`
+	Warehouse string `json:"warehouse"`
+}
+
+// GetWarehouseStock returns the items the ERP believes are in the warehouses,
+// listed by the endpoint set with UseErpStockEndpoint.
+func GetWarehouseStock(ctx context.Context) ([]ErpStockItem, error) {
+	audits.lock.Lock()
+	config := audits.stock
+	audits.lock.Unlock()
+
+	resp, err := erp.Get(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("[GetWarehouseStock] unexpected status code: %d", resp.StatusCode)
+	}
+
+	var items []ErpStockItem
+	if err := json.NewDecoder(resp.Body).Decode(&items); err != nil {
+		return nil, fmt.Errorf("[GetWarehouseStock] failed to unmarshal response: %w", err)
+	}
+	return items, nil
+}
+
+// UseErpStockEndpoint sets the URL of the ERP endpoint listing the items in
+// the warehouses. The ERP's /warehouse endpoint only records movements, so
+// the listing is served separately.
+func UseErpStockEndpoint(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("[UseErpStockEndpoint] invalid URL %q", rawURL)
+	}
+
+	audits.lock.Lock()
+	defer audits.lock.Unlock()
+	audits.stock.BaseUrl = u.Scheme + "://" + u.Host
+	audits.stock.Endpoint = u.EscapedPath()
+	return nil
+}
+
+// InventoryCorrectionForm is a form used to post to the ERP the counted
+// pieces of a kind in a warehouse when its records disagree with the MES.
+//
+// Implements the ErpPoster interface.
+type InventoryCorrectionForm struct {
+	Warehouse string `json:"warehouse"`
+	Kind      string `json:"kind"`
+	Quantity  int    `json:"quantity"`
+	Day       uint   `json:"day"`
+}
+
+func (c *InventoryCorrectionForm) Post(ctx context.Context) error {
+	data := url.Values{
+		"warehouse": {c.Warehouse},
+		"kind":      {c.Kind},
+		"quantity":  {strconv.Itoa(c.Quantity)},
+		"day":       {strconv.FormatUint(uint64(c.Day), 10)},
+	}
+	config := erp.ConfigDefaultWithEndpoint(erp.ENDPOINT_WAREHOUSE_CORRECTION)
+	return erp.Post(ctx, config, data)
+}
+
+// KindAudit compares the pieces of a kind in a warehouse as seen by the
+// MES and by the ERP.
+type KindAudit struct {
+	Kind string `json:"kind"`
+	Mes  int    `json:"mes"`
+	Erp  int    `json:"erp"`
+}
+
+// WarehouseAudit compares a warehouse as seen by the PLC, the MES and the ERP.
+type WarehouseAudit struct {
+	Warehouse string `json:"warehouse"`
+	PlcTotal  int    `json:"plc_total"`
+	MesTotal  int    `json:"mes_total"`
+	ErpTotal  int    `json:"erp_total"`
+	// Pieces still on their way to the warehouse when it was counted
+	Heading int `json:"heading"`
+	// Kinds the MES and the ERP disagree on
+	Discrepancies []KindAudit `json:"discrepancies"`
+	// Pieces of known ID one side has and the other does not
+	MissingInErp []string `json:"missing_in_erp"`
+	MissingInMes []string `json:"missing_in_mes"`
+}
+
+// balanced reports whether the MES agrees with the PLC, in which case its
+// counts can be trusted to correct the ERP.
+func (wa *WarehouseAudit) balanced() bool {
+	return wa.PlcTotal == wa.MesTotal
+}
+
+// Systems an audit corrects.
+const (
+	AUDIT_CORRECTS_ERP = "erp"
+	AUDIT_CORRECTS_MES = "mes"
+)
+
+// AuditCorrection is a correction made by an audit, of the ERP to the MES
+// counts or of the MES to the ERP counts.
+type AuditCorrection struct {
+	InventoryCorrectionForm
+	System string `json:"system"`
+	Error  string `json:"error"`
+}
+
+// corrections returns the corrections of the kinds the MES and the ERP
+// disagree on. The side that agrees with the PLC total is trusted, and
+// nothing is corrected when neither does.
+func (wa *WarehouseAudit) corrections(day uint) []AuditCorrection {
+	system := ""
+	switch {
+	case wa.balanced():
+		system = AUDIT_CORRECTS_ERP
+	case wa.ErpTotal == wa.PlcTotal:
+		system = AUDIT_CORRECTS_MES
+	default:
+		return nil
+	}
+
+	corrections := []AuditCorrection{}
+	for _, kind := range wa.Discrepancies {
+		quantity := kind.Mes
+		if system == AUDIT_CORRECTS_MES {
+			quantity = kind.Erp
+		}
+		corrections = append(corrections, AuditCorrection{
+			InventoryCorrectionForm: InventoryCorrectionForm{
+				Warehouse: wa.Warehouse,
+				Kind:      kind.Kind,
+				Quantity:  quantity,
+				Day:       day,
+			},
+			System: system,
+		})
+	}
+	return corrections
+}
+
+// apply makes the correction to its system.
+func (c *AuditCorrection) apply(ctx context.Context) error {
+	if c.System == AUDIT_CORRECTS_ERP {
+		return c.Post(ctx)
+	}
+	return correctCount(c.Warehouse, c.Kind, c.Quantity)
+}
+
+// AuditReport is the result of a cycle count.
+type AuditReport struct {
+	Time       time.Time        `json:"time"`
+	Day        uint             `json:"day"`
+	Operator   string           `json:"operator"`
+	Warehouses []WarehouseAudit `json:"warehouses"`
+	// What was moving while the warehouses were counted, if anything
+	InFlight    []string          `json:"in_flight"`
+	Corrected   bool              `json:"corrected"`
+	Corrections []AuditCorrection `json:"corrections"`
+	Error       string            `json:"error"`
+}
+
+// auditLog keeps the audit reports, and makes sure a single audit runs at a time.
+type auditLog struct {
+	running sync.Mutex
+	lock    sync.Mutex
+	reports []AuditReport
+	journal *utils.JSONLog
+	// ERP endpoint listing the items in the warehouses
+	stock erp.HttpRequestConfig
+}
+
+var audits = &auditLog{
+	journal: utils.NewJSONLog(AUDIT_LOG_PATH),
+	stock:   erp.ConfigDefaultWithEndpoint(erp.ENDPOINT_WAREHOUSE_STOCK),
+}
+
+// load restores the reports of the audits run before the MES started.
+func (al *auditLog) load() error {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+
+	al.reports = nil
+	return utils.ReplayJSONLog(al.journal, func(report AuditReport) {
+		al.reports = append(al.reports, report)
+	})
+}
+
+func (al *auditLog) record(report AuditReport) {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+
+	al.reports = append(al.reports, report)
+	al.journal.Append(report)
+}
+
+// ErrAuditInFlight is returned by an audit asked to correct while pieces
+// are moving, as the counts then do not describe the same moment.
+var ErrAuditInFlight = errors.New("pieces are moving, no correction made")
+
+// movementsInFlight describes the pieces moving in or out of the warehouses:
+// pieces on their way to a warehouse, on the supply lines, or in loads on
+// the delivery lines.
+func movementsInFlight(room *warehouseRoom, supply *supplyScheduler, deliveries *deliveryQueue) []string {
+	inFlight := []string{}
+	for _, warehouse := range []string{utils.ID_W1, utils.ID_W2} {
+		if n := room.headingTo(warehouse); n > 0 {
+			inFlight = append(inFlight, fmt.Sprintf("%d pieces on their way to %s", n, warehouse))
+		}
+	}
+	if n := supply.outstanding(); n > 0 {
+		inFlight = append(inFlight, fmt.Sprintf("%d pieces on the supply lines", n))
+	}
+	if n := len(deliveries.loadsOnLine()); n > 0 {
+		inFlight = append(inFlight, fmt.Sprintf("%d loads on the delivery lines", n))
+	}
+	return inFlight
+}
+
+// readWarehouseTotals reads the total of each warehouse from the PLC, rather
+// than using the totals of the last poll.
+func readWarehouseTotals(ctx context.Context) (map[string]int, error) {
+	factory, mutex := getFactoryInstance()
+	defer mutex.Unlock()
+
+	readCtx, cancel := context.WithTimeout(ctx, plc.DEFAULT_OPCUA_TIMEOUT)
+	defer cancel()
+	for _, warehouse := range factory.warehouses {
+		readResponse, err := factory.plcClient.Read(warehouse.OpcuaVars(), readCtx)
+		if err != nil {
+			return nil, fmt.Errorf("[readWarehouseTotals] failed to read the warehouses: %w", err)
+		}
+		warehouse.UpdateState(readResponse)
+	}
+	return factory.warehouseTotals(), nil
+}
+
+// compareInventories compares the MES inventory of each warehouse with the
+// ERP's view of it.
+func compareInventories(mes []WarehouseInventory, erpItems []ErpStockItem) []WarehouseAudit {
+	audits := []WarehouseAudit{}
+	for _, inventory := range mes {
+		audit := WarehouseAudit{
+			Warehouse:     inventory.Warehouse,
+			PlcTotal:      inventory.PlcTotal,
+			MesTotal:      inventory.Total,
+			Discrepancies: []KindAudit{},
+			MissingInErp:  []string{},
+			MissingInMes:  []string{},
+		}
+
+		erpKinds := make(map[string]int)
+		erpIDs := make(map[string]bool)
+		for _, item := range erpItems {
+			if item.Warehouse == inventory.Warehouse {
+				erpKinds[item.Kind]++
+				erpIDs[item.ItemID] = true
+				audit.ErpTotal++
+			}
+		}
+
+		kinds := []string{}
+		for kind := range inventory.Kinds {
+			kinds = append(kinds, kind)
+		}
+		for kind := range erpKinds {
+			if _, ok := inventory.Kinds[kind]; !ok {
+				kinds = append(kinds, kind)
+			}
+		}
+		sort.Strings(kinds)
+		for _, kind := range kinds {
+			if inventory.Kinds[kind] != erpKinds[kind] {
+				audit.Discrepancies = append(audit.Discrepancies,
+					KindAudit{Kind: kind, Mes: inventory.Kinds[kind], Erp: erpKinds[kind]})
+			}
+		}
+
+		mesIDs := make(map[string]bool)
+		for _, piece := range inventory.Pieces {
+			mesIDs[piece.ID] = true
+			if !erpIDs[piece.ID] {
+				audit.MissingInErp = append(audit.MissingInErp, piece.ID)
+			}
+		}
+		for _, item := range erpItems {
+			if item.Warehouse == inventory.Warehouse && !mesIDs[item.ItemID] {
+				audit.MissingInMes = append(audit.MissingInMes, item.ItemID)
+			}
+		}
+		audits = append(audits, audit)
+	}
+	return audits
+}
+
+// RunAudit counts the warehouses: with releases paused it compares the
+// totals read from the PLC, the MES inventory and the ERP's view of the
+// warehouses. With correct set, the kinds the MES and the ERP disagree on are
+// corrected on the side that does not agree with the PLC, unless pieces are
+// moving.
+func RunAudit(ctx context.Context, operator string, correct bool) (AuditReport, error) {
+	if !audits.running.TryLock() {
+		return AuditReport{}, fmt.Errorf("[RunAudit] an audit is already running")
+	}
+	defer audits.running.Unlock()
+
+	pieceReleaseQueue.pause(true)
+	defer pieceReleaseQueue.pause(false)
+
+	day, _ := simCalendar.today()
+	report := AuditReport{
+		Time:        time.Now(),
+		Day:         day,
+		Operator:    operator,
+		Corrected:   correct,
+		Corrections: []AuditCorrection{},
+	}
+	defer func() { audits.record(report) }()
+
+	// Pieces that start moving while the counts are read are caught on the
+	// second look
+	report.InFlight = movementsInFlight(warehouseBound, pieceSupply, pendingDeliveries)
+	plcTotals, err := readWarehouseTotals(ctx)
+	if err != nil {
+		report.Error = err.Error()
+		return report, err
+	}
+	inventory := stockroom.snapshot(plcTotals, w2Stock)
+	erpItems, err := GetWarehouseStock(ctx)
+	if err != nil {
+		report.Error = err.Error()
+		return report, err
+	}
+	if len(report.InFlight) == 0 {
+		report.InFlight = movementsInFlight(warehouseBound, pieceSupply, pendingDeliveries)
+	}
+
+	report.Warehouses = compareInventories(inventory, erpItems)
+	for i := range report.Warehouses {
+		report.Warehouses[i].Heading = warehouseBound.headingTo(report.Warehouses[i].Warehouse)
+	}
+	for _, audit := range report.Warehouses {
+		log.Printf("[RunAudit] %s: %d pieces by the PLC, %d by the MES, %d by the ERP, %d kinds differ\n",
+			audit.Warehouse, audit.PlcTotal, audit.MesTotal, audit.ErpTotal, len(audit.Discrepancies))
+	}
+	if !correct {
+		return report, nil
+	}
+
+	if len(report.InFlight) > 0 {
+		report.Corrected = false
+		err := fmt.Errorf("[RunAudit] %w: %s", ErrAuditInFlight, strings.Join(report.InFlight, ", "))
+		report.Error = err.Error()
+		return report, err
+	}
+
+	for _, audit := range report.Warehouses {
+		if len(audit.Discrepancies) == 0 {
+			continue
+		}
+		corrections := audit.corrections(day)
+		if corrections == nil {
+			log.Printf("[RunAudit] %s not corrected, neither the MES nor the ERP agrees with the PLC\n",
+				audit.Warehouse)
+			continue
+		}
+
+		for _, correction := range corrections {
+			if err := correction.apply(ctx); err != nil {
+				correction.Error = err.Error()
+			}
+			report.Corrections = append(report.Corrections, correction)
+		}
+	}
+	return report, nil
+}
+
+// Audits returns the audit reports, oldest first.
+func Audits() []AuditReport {
+	audits.lock.Lock()
+	defer audits.lock.Unlock()
+
+	reports := make([]AuditReport, len(audits.reports))
+	copy(reports, audits.reports)
+	return reports
+}
@@ -0,0 +1,177 @@
+package sim
+
+import (
+	"context"
+	"encoding/json"
+	"mes/internal/utils"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestCompareInventories(t *testing.T) {
+	mes := []WarehouseInventory{
+		{
+			Warehouse: utils.ID_W1,
+			Kinds:     map[string]int{"P1": 2, "P2": 1},
+			Pieces:    []InventoryPiece{{ID: "a", Kind: "P1"}, {ID: "b", Kind: "P1"}},
+			Total:     3,
+			PlcTotal:  3,
+		},
+		{
+			Warehouse: utils.ID_W2,
+			Kinds:     map[string]int{"P5": 1},
+			Pieces:    []InventoryPiece{{ID: "c", Kind: "P5"}},
+			Total:     1,
+			PlcTotal:  2,
+		},
+	}
+	erpItems := []ErpStockItem{
+		{ItemID: "a", Kind: "P1", Warehouse: utils.ID_W1},
+		{ItemID: "d", Kind: "P9", Warehouse: utils.ID_W1},
+		{ItemID: "c", Kind: "P5", Warehouse: utils.ID_W2},
+	}
+
+	audits := compareInventories(mes, erpItems)
+	if len(audits) != 2 {
+		t.Fatalf("Expected 2 warehouses audited, got %d", len(audits))
+	}
+
+	w1 := audits[0]
+	if w1.ErpTotal != 2 || !w1.balanced() {
+		t.Fatalf("Unexpected W1 audit %+v", w1)
+	}
+	expected := []KindAudit{{"P1", 2, 1}, {"P2", 1, 0}, {"P9", 0, 1}}
+	if len(w1.Discrepancies) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, w1.Discrepancies)
+	}
+	for i := range expected {
+		if w1.Discrepancies[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected, w1.Discrepancies)
+		}
+	}
+	if len(w1.MissingInErp) != 1 || w1.MissingInErp[0] != "b" ||
+		len(w1.MissingInMes) != 1 || w1.MissingInMes[0] != "d" {
+		t.Fatalf("Unexpected missing pieces %v %v", w1.MissingInErp, w1.MissingInMes)
+	}
+
+	// The ERP agrees with the MES, the PLC does not
+	w2 := audits[1]
+	if len(w2.Discrepancies) != 0 || w2.balanced() {
+		t.Fatalf("Unexpected W2 audit %+v", w2)
+	}
+}
+
+func TestGetWarehouseStock(t *testing.T) {
+	items := []ErpStockItem{{ItemID: "a", Kind: "P1", Warehouse: utils.ID_W1}}
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/erp/stock" {
+			t.Errorf("Expected GET /erp/stock, got %s %s", r.Method, r.URL.Path)
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(items)
+	}))
+	defer server.Close()
+
+	previous := audits.stock
+	t.Cleanup(func() { audits.stock = previous })
+	if err := UseErpStockEndpoint(server.URL + "/erp/stock"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := GetWarehouseStock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, items) {
+		t.Fatalf("Expected %v, got %v", items, got)
+	}
+
+	status = http.StatusMethodNotAllowed
+	if _, err := GetWarehouseStock(context.Background()); err == nil {
+		t.Fatal("Expected an error for an endpoint that does not list the stock")
+	}
+
+	if err := UseErpStockEndpoint("/warehouse"); err == nil {
+		t.Fatal("Expected an error for a URL without a host")
+	}
+}
+
+func TestMovementsInFlight(t *testing.T) {
+	room := &warehouseRoom{heading: make(map[string]int)}
+	supply := newSupplyScheduler(2)
+	deliveries := &deliveryQueue{journal: newTestJournal(t, "deliveries.jsonl")}
+
+	if inFlight := movementsInFlight(room, supply, deliveries); len(inFlight) != 0 {
+		t.Fatalf("Expected nothing moving, got %v", inFlight)
+	}
+
+	room.bound(utils.ID_W2, 2)
+	supply.add(shipmentAdmission{nPieces: 3})
+	deliveries.onLine = []DeliveryLoad{{ID: 1, Kind: "P5", Quantity: 2}}
+	expected := []string{
+		"2 pieces on their way to W2",
+		"3 pieces on the supply lines",
+		"1 loads on the delivery lines",
+	}
+	if inFlight := movementsInFlight(room, supply, deliveries); !reflect.DeepEqual(inFlight, expected) {
+		t.Fatalf("Expected %v, got %v", expected, inFlight)
+	}
+}
+
+func TestWarehouseAuditCorrections(t *testing.T) {
+	discrepancies := []KindAudit{{Kind: "P1", Mes: 2, Erp: 1}}
+	tests := []struct {
+		name     string
+		plc      int
+		mes      int
+		erp      int
+		system   string
+		quantity int
+	}{
+		{"MES agrees with the PLC", 2, 2, 1, AUDIT_CORRECTS_ERP, 2},
+		{"ERP agrees with the PLC", 1, 2, 1, AUDIT_CORRECTS_MES, 1},
+		{"neither agrees with the PLC", 3, 2, 1, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			audit := WarehouseAudit{
+				Warehouse:     utils.ID_W1,
+				PlcTotal:      tt.plc,
+				MesTotal:      tt.mes,
+				ErpTotal:      tt.erp,
+				Discrepancies: discrepancies,
+			}
+			corrections := audit.corrections(3)
+			if tt.system == "" {
+				if corrections != nil {
+					t.Fatalf("Expected no correction, got %v", corrections)
+				}
+				return
+			}
+			if len(corrections) != 1 || corrections[0].System != tt.system ||
+				corrections[0].Quantity != tt.quantity || corrections[0].Kind != "P1" {
+				t.Fatalf("Expected %s corrected to %d, got %+v", tt.system, tt.quantity, corrections)
+			}
+		})
+	}
+}
+
+func TestAuditLogLoad(t *testing.T) {
+	journal := newTestJournal(t, "audits.jsonl")
+	al := &auditLog{journal: journal}
+	al.record(AuditReport{Operator: "first"})
+	al.record(AuditReport{Operator: "second", InFlight: []string{"1 loads on the delivery lines"}})
+	journal.Flush()
+
+	restored := &auditLog{journal: journal}
+	if err := restored.load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.reports) != 2 || restored.reports[0].Operator != "first" ||
+		restored.reports[1].Operator != "second" || len(restored.reports[1].InFlight) != 1 {
+		t.Fatalf("Expected the audits restored in order, got %+v", restored.reports)
+	}
+}
@@ -0,0 +1,103 @@
+package sim
+
+import (
+	"sort"
+	"time"
+)
+
+// isSetUpFor reports whether the line can run the best control form it
+// offers the piece without swapping any tool.
+func (pl *ProcessingLine) isSetUpFor(piece *Piece) bool {
+	form := pl.createBestForm(piece)
+	return form != nil && form.toolChanges() == 0
+}
+
+// upcomingTool returns the first tool used by the control form.
+func (pcf *processControlForm) upcomingTool() string {
+	if first := pcf.firstMachine(); first >= 0 {
+		return pcf.machines[first].tool
+	}
+	return ""
+}
+
+// toolBatchingScheduler assigns pieces to lines like the lenient scheduler
+// but sequences the waiters of each line to minimise tool swaps:
+//
+//   - pieces that waited longer than maxWait are claimed first, oldest first,
+//     so that no piece starves;
+//   - then pieces the line is already set up for;
+//   - then pieces that need a swap, grouped by their upcoming tool with the
+//     largest group first, so that consecutive pieces share the new tool.
+//
+// A piece that needs a swap is held back from a line if another line it is
+// registered with is already set up for it.
+type toolBatchingScheduler struct {
+	lenientScheduler
+	maxWait time.Duration
+}
+
+func (s *toolBatchingScheduler) Rank(
+	pl *ProcessingLine,
+	waiters []*freeLineWaiter,
+) []*freeLineWaiter {
+	now := time.Now()
+
+	overdue := []*freeLineWaiter{}
+	setUp := []*freeLineWaiter{}
+	toolGroups := make(map[string][]*freeLineWaiter)
+	toolOrder := []string{}
+
+	for _, w := range waiters {
+		if now.Sub(w.waitingSince) >= s.maxWait {
+			overdue = append(overdue, w)
+			continue
+		}
+
+		form := pl.createBestForm(w.piece)
+		if form == nil {
+			continue
+		}
+		if form.toolChanges() == 0 {
+			setUp = append(setUp, w)
+			continue
+		}
+		if s.setUpElsewhere(pl, w) {
+			continue
+		}
+
+		tool := form.upcomingTool()
+		if _, ok := toolGroups[tool]; !ok {
+			toolOrder = append(toolOrder, tool)
+		}
+		toolGroups[tool] = append(toolGroups[tool], w)
+	}
+
+	sort.SliceStable(overdue, func(i, j int) bool {
+		return overdue[i].waitingSince.Before(overdue[j].waitingSince)
+	})
+	sort.SliceStable(toolOrder, func(i, j int) bool {
+		return len(toolGroups[toolOrder[i]]) > len(toolGroups[toolOrder[j]])
+	})
+
+	ranked := make([]*freeLineWaiter, 0, len(waiters))
+	ranked = append(ranked, overdue...)
+	ranked = append(ranked, setUp...)
+	for _, tool := range toolOrder {
+		ranked = append(ranked, toolGroups[tool]...)
+	}
+	return ranked
+}
+
+// setUpElsewhere reports whether the waiter is registered with a line other
+// than pl that is already set up for its piece.
+func (s *toolBatchingScheduler) setUpElsewhere(
+	pl *ProcessingLine,
+	w *freeLineWaiter,
+) bool {
+	for _, line := range w.lines {
+		if line != pl && line.isSetUpFor(w.piece) {
+			return true
+		}
+	}
+	return false
+}
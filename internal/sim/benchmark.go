@@ -0,0 +1,140 @@
+package sim
+
+import (
+	"mes/internal/utils"
+	"sort"
+)
+
+var demandLog = utils.NewJSONLog(DEMAND_LOG_PATH)
+
+// recordDemand appends the pieces received from the ERP to the demand log,
+// so that they can be replayed by the scoring benchmark.
+func recordDemand(pieces []Piece) {
+	for _, piece := range pieces {
+		demandLog.Append(piece)
+	}
+}
+
+// LoadDemand reads the pieces recorded in a demand log.
+func LoadDemand(path string) ([]Piece, error) {
+	return utils.ReadJSONLines[Piece](path)
+}
+
+// ScoringBenchmark summarises how a set of scoring weights performs when
+// dispatching a given demand on an idle factory.
+type ScoringBenchmark struct {
+	Name        string         `json:"name"`
+	Weights     ScoringWeights `json:"weights"`
+	Pieces      int            `json:"pieces"`
+	Unscheduled int            `json:"unscheduled"`
+	// Seconds until the last piece is completed
+	Makespan int `json:"makespan"`
+	// Mean seconds until a piece is completed
+	MeanFlowTime float64 `json:"mean_flow_time"`
+	ToolChanges  int     `json:"tool_changes"`
+	LatePieces   int     `json:"late_pieces"`
+	DaysLate     int     `json:"days_late"`
+}
+
+// newIdleFactory returns a factory with the processing lines of the real
+// one, idle and with their default tools, that is not connected to the PLC.
+func newIdleFactory(scheduler Scheduler, schedulerName string) *factory {
+	processLines := make(map[string]*ProcessingLine)
+	for _, lineID := range []string{utils.ID_L1, utils.ID_L2, utils.ID_L3} {
+		processLines[lineID] = &ProcessingLine{
+			id:            lineID,
+			conveyorLine:  initType1Conveyor(),
+			waitingPieces: []*freeLineWaiter{},
+			readyForNext:  true,
+		}
+	}
+	for _, lineID := range []string{utils.ID_L4, utils.ID_L5, utils.ID_L6} {
+		processLines[lineID] = &ProcessingLine{
+			id:            lineID,
+			conveyorLine:  initType2Conveyor(),
+			waitingPieces: []*freeLineWaiter{},
+			readyForNext:  true,
+		}
+	}
+
+	return &factory{
+		processLines:  processLines,
+		scheduler:     scheduler,
+		schedulerName: schedulerName,
+	}
+}
+
+// BenchmarkScoring dispatches the demand on an idle factory, in virtual
+// time and starting on startDay, once for each set of weights, and reports
+// how each set performed.
+//
+// It swaps the weights and the day in use, so it must not be called while
+// the factory is running.
+func BenchmarkScoring(
+	demand []Piece,
+	weightSets map[string]ScoringWeights,
+	schedulerName string,
+	startDay uint,
+) ([]ScoringBenchmark, error) {
+	scheduler, err := newScheduler(schedulerName, DefaultSchedulerOptions())
+	if err != nil {
+		return nil, err
+	}
+	for _, weights := range weightSets {
+		if err := weights.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	previousDay, dayLength := simCalendar.today()
+	simCalendar.setDay(startDay)
+	defer simCalendar.setDay(previousDay)
+
+	previousWeights := CurrentScoringWeights()
+	defer activeScoring.set(previousWeights)
+
+	names := make([]string, 0, len(weightSets))
+	for name := range weightSets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	results := make([]ScoringBenchmark, 0, len(names))
+	for _, name := range names {
+		activeScoring.set(weightSets[name])
+
+		backlog := make([]*forecastPiece, len(demand))
+		for i, piece := range demand {
+			backlog[i] = &forecastPiece{piece: piece}
+		}
+		forecasts := newIdleFactory(scheduler, schedulerName).
+			simulate(map[string]int{}, backlog)
+
+		result := ScoringBenchmark{
+			Name:    name,
+			Weights: weightSets[name],
+			Pieces:  len(forecasts),
+		}
+		totalFlowTime := 0
+		for _, pf := range forecasts {
+			if pf.Unscheduled != "" {
+				result.Unscheduled++
+				continue
+			}
+			pf.setCompletionDay(startDay, dayLength)
+
+			result.Makespan = max(result.Makespan, pf.CompletionTime)
+			result.ToolChanges += pf.ToolChanges
+			totalFlowTime += pf.CompletionTime
+			if pf.DueDate != 0 && pf.DaysLate > 0 {
+				result.LatePieces++
+				result.DaysLate += pf.DaysLate
+			}
+		}
+		if scheduled := result.Pieces - result.Unscheduled; scheduled > 0 {
+			result.MeanFlowTime = float64(totalFlowTime) / float64(scheduled)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
@@ -0,0 +1,132 @@
+package sim
+
+import (
+	"log"
+	"mes/internal/utils"
+	"sync"
+)
+
+// warehouseRoom counts the pieces on their way to each warehouse, so that
+// pieces are only sent where there will be room for them when they arrive.
+//
+// A released piece is bound for W2. A piece taken out of W2 by L0 is bound
+// for W1, and for W2 again once its next line is done.
+type warehouseRoom struct {
+	lock    sync.Mutex
+	heading map[string]int // warehouse ID -> pieces bound for it
+}
+
+var warehouseBound = &warehouseRoom{heading: make(map[string]int)}
+
+// bound records pieces that will enter the warehouse.
+func (wr *warehouseRoom) bound(warehouse string, n int) {
+	wr.lock.Lock()
+	defer wr.lock.Unlock()
+	wr.heading[warehouse] += n
+}
+
+// arrived records a piece that entered the warehouse.
+func (wr *warehouseRoom) arrived(warehouse string) {
+	wr.unbound(warehouse, 1)
+}
+
+// unbound records pieces that will no longer enter the warehouse.
+func (wr *warehouseRoom) unbound(warehouse string, n int) {
+	wr.lock.Lock()
+	defer wr.lock.Unlock()
+	wr.heading[warehouse] = max(0, wr.heading[warehouse]-n)
+}
+
+func (wr *warehouseRoom) headingTo(warehouse string) int {
+	wr.lock.Lock()
+	defer wr.lock.Unlock()
+	return wr.heading[warehouse]
+}
+
+// pieceBound is the part of a warehouseRoom counted for one piece, so that
+// its tracker can give back what the piece did not use however it ends.
+type pieceBound struct {
+	room    *warehouseRoom
+	heading map[string]int
+}
+
+// forPiece tracks a piece already counted as bound for the warehouses.
+func (wr *warehouseRoom) forPiece(warehouses ...string) *pieceBound {
+	pb := &pieceBound{room: wr, heading: make(map[string]int)}
+	for _, warehouse := range warehouses {
+		pb.heading[warehouse]++
+	}
+	return pb
+}
+
+// bound records that the piece will enter the warehouse.
+func (pb *pieceBound) bound(warehouse string) {
+	pb.heading[warehouse]++
+	pb.room.bound(warehouse, 1)
+}
+
+// arrived records that the piece entered the warehouse.
+func (pb *pieceBound) arrived(warehouse string) {
+	pb.heading[warehouse] = max(0, pb.heading[warehouse]-1)
+	pb.room.arrived(warehouse)
+}
+
+// release gives back the room the piece was counted for and will not use,
+// once its tracker ends.
+func (pb *pieceBound) release() {
+	for warehouse, n := range pb.heading {
+		if n > 0 {
+			pb.room.unbound(warehouse, n)
+		}
+	}
+	clear(pb.heading)
+}
+
+// warehouseFreeSpace returns the number of pieces the warehouse has room
+// for once the pieces on their way to it arrive.
+func warehouseFreeSpace(warehouse string) int {
+	factory, mutex := getFactoryInstance()
+	defer mutex.Unlock()
+	return factory.warehouseFreeSpace(warehouse)
+}
+
+func (f *factory) warehouseFreeSpace(warehouse string) int {
+	idx := 0
+	if warehouse == utils.ID_W2 {
+		idx = 1
+	}
+	total := int(f.warehouses[idx].Quantity.Value)
+	return max(0, WAREHOUSE_CAPACITY-total-warehouseBound.headingTo(warehouse))
+}
+
+// refreshExitRoom stops L0 from taking pieces out of W2 while W1 has no room
+// for them next to the pieces on their way from the supply lines.
+func (f *factory) refreshExitRoom(line *ProcessingLine) {
+	if line.id != utils.ID_L0 {
+		return
+	}
+
+	full := f.warehouseFreeSpace(utils.ID_W1)-pieceSupply.outstanding() <= 0
+	if full != line.exitFull {
+		if full {
+			log.Printf("[factory.refreshExitRoom] W1 has no room, %s holds the pieces in W2\n", line.id)
+		} else {
+			log.Printf("[factory.refreshExitRoom] W1 has room again, %s takes pieces out of W2\n", line.id)
+		}
+	}
+	line.exitFull = full
+}
+
+// releasePieces releases the pieces of the release queue W2 will have
+// room for when they are done.
+func releasePieces() []Piece {
+	released := pieceReleaseQueue.release(warehouseFreeSpace(utils.ID_W2))
+	warehouseBound.bound(utils.ID_W2, len(released))
+	return released
+}
+
+// w2NearlyFull reports whether W2 is close enough to full that deliveries
+// should free space even if it means sending them in parts.
+func w2NearlyFull() bool {
+	return warehouseFreeSpace(utils.ID_W2) <= WAREHOUSE_NEAR_FULL
+}
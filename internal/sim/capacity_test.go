@@ -0,0 +1,127 @@
+package sim
+
+import (
+	"mes/internal/net/plc"
+	"mes/internal/utils"
+	"testing"
+)
+
+func TestReleaseQueueWarehouseRoom(t *testing.T) {
+	rq := &releaseQueue{wakeCh: make(chan struct{}, 1)}
+	rq.enqueue([]Piece{{ErpIdentifier: "a"}, {ErpIdentifier: "b"}, {ErpIdentifier: "c"}})
+
+	if released := rq.release(2); len(released) != 2 {
+		t.Fatalf("Expected 2 pieces released for the room in W2, got %d", len(released))
+	}
+	if released := rq.release(0); len(released) != 0 {
+		t.Fatalf("Expected no release without room in W2, got %v", released)
+	}
+}
+
+func TestWarehouseRoomHeading(t *testing.T) {
+	wr := &warehouseRoom{heading: make(map[string]int)}
+
+	// A piece released, then taken back to W1 by L0 for another line
+	wr.bound(utils.ID_W2, 1)
+	wr.arrived(utils.ID_W2)
+	wr.bound(utils.ID_W1, 1)
+	wr.bound(utils.ID_W2, 1)
+	if wr.headingTo(utils.ID_W1) != 1 || wr.headingTo(utils.ID_W2) != 1 {
+		t.Fatalf("Expected a piece bound for each warehouse, got %v", wr.heading)
+	}
+	wr.arrived(utils.ID_W1)
+	wr.arrived(utils.ID_W2)
+	if wr.headingTo(utils.ID_W1) != 0 || wr.headingTo(utils.ID_W2) != 0 {
+		t.Fatalf("Expected no piece on its way, got %v", wr.heading)
+	}
+}
+
+func TestPieceBoundRelease(t *testing.T) {
+	tests := []struct {
+		name    string
+		arrived []string // warehouses the piece entered before its tracker ended
+	}{
+		{"tracker ends on its first line", nil},
+		{"tracker ends on L0", []string{utils.ID_W2}},
+		{"tracker ends on its next line", []string{utils.ID_W2, utils.ID_W1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wr := &warehouseRoom{heading: make(map[string]int)}
+			wr.bound(utils.ID_W2, 2) // Another piece is on its way too
+
+			// Released, then taken back to W1 by L0 for another line
+			pb := wr.forPiece(utils.ID_W2)
+			for i, warehouse := range tt.arrived {
+				pb.arrived(warehouse)
+				if i == 0 {
+					pb.bound(utils.ID_W1)
+					pb.bound(utils.ID_W2)
+				}
+			}
+			pb.release()
+
+			if wr.headingTo(utils.ID_W1) != 0 || wr.headingTo(utils.ID_W2) != 1 {
+				t.Fatalf("Expected only the other piece on its way, got %v", wr.heading)
+			}
+			pb.release()
+			if wr.headingTo(utils.ID_W2) != 1 {
+				t.Fatalf("Expected the room to be given back once, got %v", wr.heading)
+			}
+		})
+	}
+}
+
+func TestReleaseQueueW2Full(t *testing.T) {
+	rq := &releaseQueue{wakeCh: make(chan struct{}, 1)}
+	rq.enqueue([]Piece{{ErpIdentifier: "a"}, {ErpIdentifier: "b"}})
+
+	rq.release(0)
+	if !rq.w2Full {
+		t.Fatal("Expected W2 to be reported full")
+	}
+	rq.release(0)
+	if !rq.w2Full {
+		t.Fatal("Expected W2 to stay full")
+	}
+	if released := rq.release(2); len(released) != 2 || rq.w2Full {
+		t.Fatalf("Expected W2 to have room again, released %v", released)
+	}
+}
+
+func TestRefreshExitRoom(t *testing.T) {
+	f := &factory{warehouses: plc.InitWarehouses()}
+	l0 := &ProcessingLine{id: utils.ID_L0}
+	l1 := &ProcessingLine{id: utils.ID_L1}
+
+	f.warehouses[0].Quantity.Value = WAREHOUSE_CAPACITY
+	f.refreshExitRoom(l0)
+	f.refreshExitRoom(l1)
+	if !l0.exitFull {
+		t.Fatal("Expected L0 to hold the pieces in W2 while W1 is full")
+	}
+	if l1.exitFull {
+		t.Fatal("Expected lines exiting to W2 not to be throttled on W1")
+	}
+
+	f.warehouses[0].Quantity.Value = WAREHOUSE_CAPACITY - 1
+	f.refreshExitRoom(l0)
+	if l0.exitFull {
+		t.Fatal("Expected L0 to take pieces out of W2 once W1 has room")
+	}
+}
+
+func TestDeliveryQueueDrainsNearlyFullW2(t *testing.T) {
+	dq := &deliveryQueue{journal: newTestJournal(t, "deliveries.jsonl")}
+	stock := newFinishedStock(newTestJournal(t, "stock.jsonl"))
+	stock.pieces["P5"] = 2
+	dq.add([]Delivery{{ID: "order", Piece: "P5", Quantity: 5}})
+
+	if _, _, ok := dq.next(DELIVERY_LINE_CAPACITY, stock); ok {
+		t.Fatal("Expected the delivery to wait for all its pieces")
+	}
+	dq.drain(true)
+	if _, parts, ok := dq.next(DELIVERY_LINE_CAPACITY, stock); !ok || parts[0].Quantity != 2 {
+		t.Fatalf("Expected the pieces in stock to be sent to free W2, got %+v", parts)
+	}
+}
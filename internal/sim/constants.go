@@ -1,5 +1,7 @@
 package sim
 
+import "time"
+
 const (
 	// Factory constants
 	LINE_CONVEYOR_SIZE  = 5
@@ -9,10 +11,86 @@ const (
 	DELIVERY_LINE_CAPACITY = 6
 
 	MACHINE_TOOL_SWAP_TIME = 30
+	// Energy drawn by a tool swap, in machine-seconds of processing
+	MACHINE_TOOL_SWAP_ENERGY = 60
+
+	// Estimated time (in seconds) of a round trip between the warehouses,
+	// used to penalise routes with many line visits
+	ROUTE_TRANSFER_TIME = 60
 
+	// Default weights of the control form scoring terms
 	TIME_WEIGHT  = 1
 	QUEUE_WEIGHT = 125
 	STEP_WEIGHT  = 100
 
 	WAREHOUSE_CAPACITY = 32
+	// Free places in W2 at or below which deliveries are sent in parts
+	WAREHOUSE_NEAR_FULL = 4
+
+	// Scheduler names
+	SCHEDULER_LENIENT = "lenient" // register with every line close to the best score
+	SCHEDULER_BEST    = "best"    // register only with the best scoring lines
+	SCHEDULER_EDD     = "edd"     // claim the piece with the earliest due date first
+	SCHEDULER_CR      = "cr"      // claim the piece with the lowest critical ratio first
+	SCHEDULER_BATCH   = "batch"   // batch pieces on lines already set up for their tools
+	SCHEDULER_DEFAULT = SCHEDULER_LENIENT
+
+	SCHEDULER_LENIENCY = 0.2 // 20% leniency
+
+	// Longest time a piece can be held back waiting for a line that is
+	// already set up for its tool before any line is allowed to claim it
+	TOOL_BATCH_MAX_WAIT = 2 * time.Minute
+
+	// Dispatch decisions log
+	DECISIONS_LOG_PATH       = "decisions.jsonl"
+	DECISIONS_KEPT_IN_MEMORY = 1000
+
+	// Line and machine availability events log
+	DOWNTIME_LOG_PATH = "downtime.jsonl"
+
+	// Supervisor overrides audit log
+	OVERRIDES_AUDIT_LOG_PATH = "overrides.jsonl"
+
+	// Day planner search budget and objective
+	PLAN_TIME_BUDGET      = 2 * time.Second
+	PLAN_MAX_ITERATIONS   = 2000
+	PLAN_LATENESS_WEIGHT  = 10  // cost of each second a piece is late
+	PLAN_UNSCHEDULED_COST = 1e6 // cost of each piece no line can process
+
+	// Waiting time after which a piece is promoted one priority class, so
+	// that higher priority work cannot starve it, and the most pieces that
+	// can be expedited at once
+	PRIORITY_AGING_INTERVAL = 10 * time.Minute
+	MAX_EXPEDITED_PIECES    = 3
+
+	// Shipments waiting for space in W1, and how often their admission
+	// is retried while there are any
+	SHIPMENT_BACKLOG_PATH   = "shipments.jsonl"
+	SHIPMENT_RETRY_INTERVAL = 5 * time.Second
+
+	// Reconciled shipment receipts, and how long after its last piece is
+	// acknowledged a shipment is reconciled against the W1 total
+	RECEIPTS_LOG_PATH       = "receipts.jsonl"
+	RECEIPT_SETTLE_INTERVAL = 3 * time.Second
+
+	// Deliveries received from the ERP and not confirmed yet
+	DELIVERY_QUEUE_PATH = "deliveries.jsonl"
+
+	// Finished pieces stored in W2 and delivered
+	STOCK_LOG_PATH = "stock.jsonl"
+
+	// Loads unloaded by the delivery lines
+	DELIVERY_LEDGER_PATH = "delivery_loads.jsonl"
+
+	// Pieces moved in and out of the warehouses
+	INVENTORY_LOG_PATH = "inventory.jsonl"
+
+	// Cycle count reports
+	AUDIT_LOG_PATH = "audits.jsonl"
+
+	// Events in the life of each physical piece
+	TRACE_LOG_PATH = "traces.jsonl"
+
+	// Pieces received from the ERP, replayed by the scoring benchmark
+	DEMAND_LOG_PATH = "demand.jsonl"
 )
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"mes/internal/net/erp"
+	"mes/internal/utils"
 	"net/url"
 	"strconv"
 	"sync"
@@ -16,6 +17,35 @@ type DateForm struct {
 	Day uint `json:"day"`
 }
 
+// calendar keeps track of the current simulation day and of how long
+// (in real time) a simulation day lasts.
+type calendar struct {
+	lock      sync.Mutex
+	day       uint
+	dayLength time.Duration
+}
+
+var simCalendar = &calendar{dayLength: utils.DEFAULT_SIM_TIME}
+
+func (c *calendar) setDay(day uint) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.day = day
+}
+
+func (c *calendar) setDayLength(dayLength time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.dayLength = dayLength
+}
+
+// today returns the current simulation day and the length of a day.
+func (c *calendar) today() (uint, time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.day, c.dayLength
+}
+
 func (d *DateForm) post(ctx context.Context) error {
 	data := url.Values{
 		"day": {strconv.Itoa(int(d.Day))},
@@ -52,6 +82,7 @@ func getDate(ctx context.Context) (DateForm, error) {
 
 func DateCounter(ctx context.Context, sleepPeriod time.Duration) <-chan DateForm {
 	dateCh := make(chan DateForm)
+	simCalendar.setDayLength(sleepPeriod)
 
 	initialDate, err := getDate(ctx)
 	if err != nil {
@@ -59,6 +90,7 @@ func DateCounter(ctx context.Context, sleepPeriod time.Duration) <-chan DateForm
 		initialDate = DateForm{Day: 1}
 	}
 
+	go runDayPlanner(ctx)
 	go func() {
 		defer close(dateCh)
 
@@ -94,6 +126,15 @@ func (d *DateForm) HandleNew(ctx context.Context) (
 		return
 	}
 	log.Printf("[DateForm.HandleNew] date changed to: %d", d.Day)
+	simCalendar.setDay(d.Day)
+	requestDayPlan(d.Day)
+
+	for _, lateness := range ProjectedLateness() {
+		if lateness.DaysLate > 0 {
+			log.Printf("[DateForm.HandleNew] piece %s (order %s) projected %d days late\n",
+				lateness.PieceID, lateness.OrderID, lateness.DaysLate)
+		}
+	}
 
 	wg := sync.WaitGroup{}
 	wg.Add(2)
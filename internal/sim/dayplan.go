@@ -0,0 +1,417 @@
+package sim
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"mes/internal/utils"
+	"sort"
+	"time"
+)
+
+// PlannedPiece is the part of the day plan concerning a piece.
+type PlannedPiece struct {
+	PieceID  string `json:"piece_id"`
+	OrderID  string `json:"order_id"`
+	DueDate  uint   `json:"due_date"`
+	Priority int    `json:"priority"`
+	// Lines the piece is planned to visit, in order
+	Lines          []string `json:"lines"`
+	CompletionTime int      `json:"completion_time"`
+	Unscheduled    string   `json:"unscheduled"`
+}
+
+// DayPlan is the schedule computed by the day planner at the start of a day,
+// and how closely the online dispatcher followed it so far.
+type DayPlan struct {
+	Day        uint           `json:"day"`
+	CreatedAt  time.Time      `json:"created_at"`
+	Iterations int            `json:"iterations"`
+	Cost       float64        `json:"cost"`
+	GreedyCost float64        `json:"greedy_cost"`
+	Pieces     []PlannedPiece `json:"pieces"`
+	// Dispatches to the planned line and to another line
+	Followed   int `json:"followed"`
+	Deviations int `json:"deviations"`
+}
+
+// dayPlan is a day plan as followed by the online dispatcher.
+// Pieces are identified by their planning key, which does not change as
+// their recipe is completed.
+type dayPlan struct {
+	report   DayPlan
+	priority map[string]int            // key -> position in the plan
+	lines    map[string]map[int]string // key -> first step of a visit -> line ID
+}
+
+// planKey identifies a piece across its whole recipe: the ID of the raw
+// material it was made from.
+func (p *Piece) planKey() string {
+	if len(p.Steps) == 0 {
+		return p.ErpIdentifier
+	}
+	return p.Steps[0].MaterialID
+}
+
+// plannedLine returns the line the piece is planned to visit next.
+func (dp *dayPlan) plannedLine(piece *Piece) (string, bool) {
+	lineID, ok := dp.lines[piece.planKey()][piece.CurrentStep]
+	return lineID, ok
+}
+
+// observe records whether the piece was dispatched to its planned line.
+func (dp *dayPlan) observe(piece *Piece, lineID string) {
+	// Going back to W1 through L0 is part of the trip between two visits
+	planned, ok := dp.plannedLine(piece)
+	if !ok || lineID == utils.ID_L0 {
+		return
+	}
+	if planned == lineID {
+		dp.report.Followed++
+		return
+	}
+	dp.report.Deviations++
+	log.Printf("[dayPlan.observe] Piece %s dispatched to line %s instead of planned line %s\n",
+		piece.ErpIdentifier, lineID, planned)
+}
+
+// plannedScheduler follows the day plan on top of another scheduler:
+// pieces are also registered with the line they are planned to visit, and
+// free lines claim the pieces planned for them first, in plan order.
+// Pieces the plan does not know about, or whose planned line is not
+// available, are dispatched by the underlying scheduler, so that the
+// factory keeps running when reality deviates from the plan.
+type plannedScheduler struct {
+	base Scheduler
+	plan *dayPlan
+}
+
+func (s *plannedScheduler) Assign(
+	f *factory,
+	piece *Piece,
+	d *DispatchDecision,
+) []string {
+	lineIDs := s.base.Assign(f, piece, d)
+
+	planned, ok := s.plan.plannedLine(piece)
+	if !ok || containsString(lineIDs, planned) {
+		return lineIDs
+	}
+	if line, ok := f.processLines[planned]; ok && line.isAvailableFor(piece) {
+		lineIDs = append(lineIDs, planned)
+	}
+	return lineIDs
+}
+
+func (s *plannedScheduler) Rank(
+	pl *ProcessingLine,
+	waiters []*freeLineWaiter,
+) []*freeLineWaiter {
+	planned := []*freeLineWaiter{}
+	rest := []*freeLineWaiter{}
+	for _, w := range s.base.Rank(pl, waiters) {
+		if lineID, ok := s.plan.plannedLine(w.piece); ok && lineID == pl.id {
+			planned = append(planned, w)
+		} else {
+			rest = append(rest, w)
+		}
+	}
+
+	sort.SliceStable(planned, func(i, j int) bool {
+		return s.plan.priority[planned[i].piece.planKey()] <
+			s.plan.priority[planned[j].piece.planKey()]
+	})
+	return append(planned, rest...)
+}
+
+// priorityScheduler assigns pieces like its base scheduler and lets free
+// lines claim their waiters in a fixed priority order. It is used by the
+// day planner to turn a candidate piece order into a schedule.
+type priorityScheduler struct {
+	base     Scheduler
+	priority map[string]int
+}
+
+func (s *priorityScheduler) Assign(
+	f *factory,
+	piece *Piece,
+	d *DispatchDecision,
+) []string {
+	return s.base.Assign(f, piece, d)
+}
+
+func (s *priorityScheduler) Rank(
+	_ *ProcessingLine,
+	waiters []*freeLineWaiter,
+) []*freeLineWaiter {
+	ranked := make([]*freeLineWaiter, len(waiters))
+	copy(ranked, waiters)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return s.priority[ranked[i].piece.planKey()] < s.priority[ranked[j].piece.planKey()]
+	})
+	return ranked
+}
+
+// planSnapshot is the state of the factory a day plan is computed from.
+type planSnapshot struct {
+	factory   *factory
+	busyUntil map[string]int
+	backlog   []*forecastPiece
+	today     uint
+	dayLength time.Duration
+}
+
+// evaluate dispatches the backlog with the scheduler on a copy of the
+// snapshot and returns the outcome and its cost.
+func (ps *planSnapshot) evaluate(s Scheduler) ([]PieceForecast, float64) {
+	virtual := &factory{processLines: make(map[string]*ProcessingLine), scheduler: s}
+	for lineID, line := range ps.factory.processLines {
+		virtual.processLines[lineID] = line.virtualCopy()
+	}
+
+	busyUntil := make(map[string]int, len(ps.busyUntil))
+	for lineID, busy := range ps.busyUntil {
+		busyUntil[lineID] = busy
+	}
+
+	backlog := make([]*forecastPiece, len(ps.backlog))
+	for i, fp := range ps.backlog {
+		clone := *fp
+		clone.lines = append([]string{}, fp.lines...)
+		clone.legSteps = append([]int{}, fp.legSteps...)
+		backlog[i] = &clone
+	}
+
+	forecasts := virtual.simulate(busyUntil, backlog)
+	return forecasts, ps.cost(forecasts)
+}
+
+// cost is the objective the day planner minimises: the sum of the
+// completion times plus a heavy penalty for every second a piece is late
+// and for every piece that cannot be scheduled.
+func (ps *planSnapshot) cost(forecasts []PieceForecast) float64 {
+	cost := 0.0
+	for _, pf := range forecasts {
+		if pf.Unscheduled != "" {
+			cost += PLAN_UNSCHEDULED_COST
+			continue
+		}
+		cost += float64(pf.CompletionTime)
+		if pf.DueDate == 0 {
+			continue
+		}
+		deadline := (float64(pf.DueDate) - float64(ps.today)) * ps.dayLength.Seconds()
+		if late := float64(pf.CompletionTime) - deadline; late > 0 {
+			cost += PLAN_LATENESS_WEIGHT * late
+		}
+	}
+	return cost
+}
+
+func priorities(order []string) map[string]int {
+	priority := make(map[string]int, len(order))
+	for i, key := range order {
+		priority[key] = i
+	}
+	return priority
+}
+
+// optimizeDay searches, by local search over the order in which lines
+// claim the pieces, for the schedule of the snapshot's backlog with the
+// lowest cost. It starts from the better of the earliest due date order and
+// the order the greedy base scheduler completes the pieces in, and tries
+// swapping and moving pieces until the time or iteration budget runs out.
+func optimizeDay(ps *planSnapshot, base Scheduler, rng *rand.Rand) *dayPlan {
+	start := time.Now()
+	greedy, greedyCost := ps.evaluate(base)
+
+	edd := make([]*forecastPiece, len(ps.backlog))
+	copy(edd, ps.backlog)
+	sort.SliceStable(edd, func(i, j int) bool {
+		return dueBefore(&edd[i].piece, &edd[j].piece)
+	})
+	eddOrder := make([]string, len(edd))
+	for i, fp := range edd {
+		eddOrder[i] = fp.piece.planKey()
+	}
+
+	sort.SliceStable(greedy, func(i, j int) bool {
+		return greedy[i].CompletionTime < greedy[j].CompletionTime
+	})
+	greedyOrder := make([]string, len(greedy))
+	for i, pf := range greedy {
+		greedyOrder[i] = pf.key
+	}
+
+	bestOrder := eddOrder
+	best, bestCost := ps.evaluate(&priorityScheduler{base, priorities(eddOrder)})
+	if forecasts, cost := ps.evaluate(&priorityScheduler{base, priorities(greedyOrder)}); cost < bestCost {
+		bestOrder, best, bestCost = greedyOrder, forecasts, cost
+	}
+
+	iterations := 0
+	for n := len(bestOrder); n > 1 && iterations < PLAN_MAX_ITERATIONS &&
+		time.Since(start) < PLAN_TIME_BUDGET; iterations++ {
+
+		candidate := append([]string{}, bestOrder...)
+		i, j := rng.Intn(n), rng.Intn(n)
+		if rng.Intn(2) == 0 {
+			candidate[i], candidate[j] = candidate[j], candidate[i]
+		} else {
+			moved := candidate[i]
+			candidate = append(candidate[:i], candidate[i+1:]...)
+			candidate = append(candidate[:j], append([]string{moved}, candidate[j:]...)...)
+		}
+
+		// Sideways moves are accepted to get across plateaus
+		forecasts, cost := ps.evaluate(&priorityScheduler{base, priorities(candidate)})
+		if cost <= bestCost {
+			bestOrder, best, bestCost = candidate, forecasts, cost
+		}
+	}
+
+	plan := &dayPlan{
+		report: DayPlan{
+			Day:        ps.today,
+			CreatedAt:  time.Now(),
+			Iterations: iterations,
+			Cost:       bestCost,
+			GreedyCost: greedyCost,
+			Pieces:     make([]PlannedPiece, 0, len(best)),
+		},
+		priority: priorities(bestOrder),
+		lines:    make(map[string]map[int]string),
+	}
+
+	sort.SliceStable(best, func(i, j int) bool {
+		return plan.priority[best[i].key] < plan.priority[best[j].key]
+	})
+	for _, pf := range best {
+		plan.lines[pf.key] = make(map[int]string)
+		for i, lineID := range pf.Lines {
+			plan.lines[pf.key][pf.legSteps[i]] = lineID
+		}
+		plan.report.Pieces = append(plan.report.Pieces, PlannedPiece{
+			PieceID:        pf.PieceID,
+			OrderID:        pf.OrderID,
+			DueDate:        pf.DueDate,
+			Priority:       plan.priority[pf.key],
+			Lines:          pf.Lines,
+			CompletionTime: pf.CompletionTime,
+			Unscheduled:    pf.Unscheduled,
+		})
+	}
+	return plan
+}
+
+// baseScheduler returns the scheduler in use without the day plan.
+func (f *factory) baseScheduler() Scheduler {
+	if planned, ok := f.scheduler.(*plannedScheduler); ok {
+		return planned.base
+	}
+	return f.scheduler
+}
+
+// installDayPlan makes the dispatcher follow the plan, or stop following
+// any plan if it is nil.
+func (f *factory) installDayPlan(plan *dayPlan) {
+	base := f.baseScheduler()
+	f.dayPlan = plan
+	if plan == nil {
+		f.scheduler = base
+		return
+	}
+	f.scheduler = &plannedScheduler{base: base, plan: plan}
+}
+
+// dayPlanRequests holds the next day to plan. A day whose plan has not
+// started when the next day comes is skipped.
+var dayPlanRequests = make(chan uint, 1)
+
+// requestDayPlan has the planner plan the day, without waiting for the
+// plan: planning takes up to PLAN_TIME_BUDGET.
+func requestDayPlan(day uint) {
+	for {
+		select {
+		case dayPlanRequests <- day:
+			return
+		default:
+			select {
+			case stale := <-dayPlanRequests:
+				log.Printf("[requestDayPlan] Day %d not planned in time, skipped\n", stale)
+			default:
+			}
+		}
+	}
+}
+
+// runDayPlanner plans the requested days, one at a time, until the
+// context is cancelled.
+func runDayPlanner(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case day := <-dayPlanRequests:
+			planDay(day)
+		}
+	}
+}
+
+// planDay computes the plan for the day from every piece known to the
+// factory, if the day planner is enabled, and has the dispatcher follow it.
+func planDay(day uint) {
+	factory, mutex := getFactoryInstance()
+	if !factory.dayPlanner {
+		mutex.Unlock()
+		return
+	}
+	virtual, busyUntil, backlog, _ := factory.forecastSnapshot()
+	base := factory.baseScheduler()
+	mutex.Unlock()
+
+	for _, queued := range pieceReleaseQueue.snapshot() {
+		backlog = append(backlog, &forecastPiece{piece: queued})
+	}
+
+	_, dayLength := simCalendar.today()
+	plan := optimizeDay(&planSnapshot{
+		factory:   virtual,
+		busyUntil: busyUntil,
+		backlog:   backlog,
+		today:     day,
+		dayLength: dayLength,
+	}, base, rand.New(rand.NewSource(int64(day))))
+
+	log.Printf("[planDay] Day %d planned for %d pieces in %d iterations: cost %.0f (greedy %.0f)\n",
+		day, len(plan.report.Pieces), plan.report.Iterations, plan.report.Cost, plan.report.GreedyCost)
+
+	factory, mutex = getFactoryInstance()
+	defer mutex.Unlock()
+	factory.installDayPlan(plan)
+}
+
+// UseDayPlanner enables or disables planning each day at the day tick.
+// Disabling it stops following the current plan.
+func UseDayPlanner(enabled bool) {
+	factory, mutex := getFactoryInstance()
+	defer mutex.Unlock()
+
+	factory.dayPlanner = enabled
+	if !enabled {
+		factory.installDayPlan(nil)
+	}
+}
+
+// CurrentDayPlan returns the plan the dispatcher is following, if any.
+func CurrentDayPlan() (DayPlan, bool) {
+	factory, mutex := getFactoryInstance()
+	defer mutex.Unlock()
+
+	if factory.dayPlan == nil {
+		return DayPlan{}, false
+	}
+	plan := factory.dayPlan.report
+	plan.Pieces = append([]PlannedPiece{}, plan.Pieces...)
+	return plan, true
+}
@@ -0,0 +1,128 @@
+package sim
+
+import (
+	"math/rand"
+	u "mes/internal/utils"
+	"testing"
+	"time"
+)
+
+func newPlanTestPiece(id string, dueDate uint) Piece {
+	return Piece{
+		ErpIdentifier: id,
+		Location:      u.ID_W1,
+		DueDate:       dueDate,
+		Steps:         []Transformation{{MaterialID: id, Tool: u.TOOL_4, Time: 30}},
+	}
+}
+
+func TestOptimizeDay(t *testing.T) {
+	f := newTestFactory()
+	// Only L4 can run T4
+	f.processLines[u.ID_L5].down = true
+	f.processLines[u.ID_L6].down = true
+
+	base, err := newScheduler(SCHEDULER_LENIENT, DefaultSchedulerOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The greedy scheduler serves the pieces in arrival order, which makes
+	// the urgent piece late: it is only done after 30+30+30 seconds
+	relaxed := newPlanTestPiece("relaxed", 10)
+	urgent := newPlanTestPiece("urgent", 1)
+	ps := &planSnapshot{
+		factory:   f,
+		busyUntil: map[string]int{},
+		backlog:   []*forecastPiece{{piece: relaxed}, {piece: urgent}},
+		today:     0,
+		dayLength: time.Minute,
+	}
+
+	plan := optimizeDay(ps, base, rand.New(rand.NewSource(1)))
+	if plan.report.Cost >= plan.report.GreedyCost {
+		t.Fatalf("Expected the plan (cost %v) to beat the greedy schedule (cost %v)",
+			plan.report.Cost, plan.report.GreedyCost)
+	}
+	if plan.priority[urgent.planKey()] > plan.priority[relaxed.planKey()] {
+		t.Fatal("Expected the urgent piece to be planned first")
+	}
+	if lineID, ok := plan.plannedLine(&urgent); !ok || lineID != u.ID_L4 {
+		t.Fatalf("Expected the urgent piece to be planned on L4, got %q", lineID)
+	}
+
+	// The snapshot is left untouched by the search
+	if f.processLines[u.ID_L4].currentTool(LINE_DEFAULT_M2_POS) != u.TOOL_1 {
+		t.Fatal("Expected the snapshot lines to keep their tools")
+	}
+}
+
+func TestPlannedSchedulerRank(t *testing.T) {
+	f := newTestFactory()
+	base, err := newScheduler(SCHEDULER_LENIENT, DefaultSchedulerOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := newPlanTestPiece("first", 0)
+	second := newPlanTestPiece("second", 0)
+	elsewhere := newPlanTestPiece("elsewhere", 0)
+	unplanned := newPlanTestPiece("unplanned", 0)
+	plan := &dayPlan{
+		priority: map[string]int{"elsewhere": 0, "first": 1, "second": 2},
+		lines: map[string]map[int]string{
+			"first":     {0: u.ID_L4},
+			"second":    {0: u.ID_L4},
+			"elsewhere": {0: u.ID_L5},
+		},
+	}
+	s := &plannedScheduler{base: base, plan: plan}
+
+	waiters := []*freeLineWaiter{
+		{piece: &unplanned}, {piece: &elsewhere}, {piece: &second}, {piece: &first},
+	}
+	ranked := s.Rank(f.processLines[u.ID_L4], waiters)
+	expected := []string{"first", "second", "unplanned", "elsewhere"}
+	for i, id := range expected {
+		if ranked[i].piece.ErpIdentifier != id {
+			t.Fatalf("Expected rank %d to be %s, got %s", i, id, ranked[i].piece.ErpIdentifier)
+		}
+	}
+
+	// Planned lines that went down are not assigned
+	f.processLines[u.ID_L5].down = true
+	for _, lineID := range s.Assign(f, &elsewhere, nil) {
+		if lineID == u.ID_L5 {
+			t.Fatal("Expected the down planned line not to be assigned")
+		}
+	}
+
+	plan.observe(&first, u.ID_L4)
+	plan.observe(&second, u.ID_L6)
+	plan.observe(&unplanned, u.ID_L6)
+	// Going back to W1 between two visits is not a deviation
+	plan.observe(&first, u.ID_L0)
+	if plan.report.Followed != 1 || plan.report.Deviations != 1 {
+		t.Fatalf("Unexpected plan adherence %+v", plan.report)
+	}
+}
+
+func TestRequestDayPlanKeepsLatest(t *testing.T) {
+	requestDayPlan(3)
+	// Day 3 was not planned in time
+	requestDayPlan(4)
+
+	select {
+	case day := <-dayPlanRequests:
+		if day != 4 {
+			t.Fatalf("Expected the latest day to be planned, got %d", day)
+		}
+	default:
+		t.Fatal("Expected a day to plan")
+	}
+	select {
+	case day := <-dayPlanRequests:
+		t.Fatalf("Expected a single day to plan, got %d too", day)
+	default:
+	}
+}
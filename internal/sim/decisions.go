@@ -0,0 +1,206 @@
+package sim
+
+import (
+	"fmt"
+	"mes/internal/utils"
+	"sync"
+	"time"
+)
+
+// MachineCandidate is what a machine of a candidate line would do to the
+// piece under the control form the line offered.
+type MachineCandidate struct {
+	Position int    `json:"position"`
+	Process  bool   `json:"process"`
+	Tool     string `json:"tool"`
+	Repeat   int16  `json:"repeat"`
+	Change   bool   `json:"change"`
+}
+
+// LineCandidate is a line considered for a piece during a dispatch decision,
+// along with the control form it offered and the components of its score.
+type LineCandidate struct {
+	LineID         string             `json:"line_id"`
+	Machines       []MachineCandidate `json:"machines"`
+	StepsCompleted int                `json:"steps_completed"`
+	TotalSteps     int                `json:"total_steps"`
+	IntrinsicTime  int                `json:"intrinsic_time"`
+	QueueSize      int                `json:"queue_size"`
+	Score          int                `json:"score"`
+
+	// Whether the line passed the scheduler's filter (e.g. leniency)
+	// and the piece was registered with it
+	Registered bool `json:"registered"`
+}
+
+// DispatchDecision records how a piece waiting in a warehouse was matched
+// with a processing line: the lines that were considered, the ones it was
+// registered with and the one that finally claimed it.
+type DispatchDecision struct {
+	ID           int             `json:"id"`
+	PieceID      string          `json:"piece_id"`
+	Step         int             `json:"step"`
+	TotalSteps   int             `json:"total_steps"`
+	Scheduler    string          `json:"scheduler"`
+	PlannedLines []string        `json:"planned_lines"`
+	Leniency     float64         `json:"leniency"`
+	BestScore    int             `json:"best_score"`
+	Candidates   []LineCandidate `json:"candidates"`
+	RegisteredAt time.Time       `json:"registered_at"`
+	Override     string          `json:"override"`
+
+	ChosenLine string    `json:"chosen_line"`
+	ClaimedAt  time.Time `json:"claimed_at"`
+	Reason     string    `json:"reason"`
+}
+
+func newDispatchDecision(piece *Piece, scheduler string) *DispatchDecision {
+	d := &DispatchDecision{
+		PieceID:      piece.ErpIdentifier,
+		Step:         piece.CurrentStep,
+		TotalSteps:   len(piece.Steps),
+		Scheduler:    scheduler,
+		RegisteredAt: time.Now(),
+	}
+	if len(piece.route) > 0 {
+		d.PlannedLines = piece.route[0].lines
+	}
+	return d
+}
+
+// offer records the form a line offered to the piece.
+// Safe to call on a nil decision, in which case nothing is recorded.
+func (d *DispatchDecision) offer(
+	lineID string,
+	form *processControlForm,
+	registered bool,
+) {
+	if d == nil {
+		return
+	}
+
+	machines := make([]MachineCandidate, len(form.machines))
+	for i, cmd := range form.machines {
+		machines[i] = MachineCandidate{
+			Position: cmd.pos,
+			Process:  cmd.process,
+			Tool:     cmd.tool,
+			Repeat:   cmd.repeat,
+			Change:   cmd.change,
+		}
+	}
+
+	d.Candidates = append(d.Candidates, LineCandidate{
+		LineID:         lineID,
+		Machines:       machines,
+		StepsCompleted: form.stepsCompleted,
+		TotalSteps:     form.totalSteps,
+		IntrinsicTime:  form.intrinsicTime,
+		QueueSize:      form.queueSize,
+		Score:          form.metadataScore(),
+		Registered:     registered,
+	})
+}
+
+// DecisionFilter selects dispatch decisions. Empty fields match everything.
+type DecisionFilter struct {
+	PieceID string
+	LineID  string
+	Limit   int
+}
+
+func (df *DecisionFilter) matches(d *DispatchDecision) bool {
+	if df.PieceID != "" && d.PieceID != df.PieceID {
+		return false
+	}
+	if df.LineID == "" {
+		return true
+	}
+	for _, c := range d.Candidates {
+		if c.LineID == df.LineID {
+			return true
+		}
+	}
+	return d.ChosenLine == df.LineID
+}
+
+// decisionLog keeps the most recent dispatch decisions in memory and
+// appends every completed decision to a file for post-mortem analysis.
+type decisionLog struct {
+	lock      sync.Mutex
+	nextID    int
+	decisions []*DispatchDecision
+	journal   *utils.JSONLog
+}
+
+var dispatchDecisions = &decisionLog{journal: utils.NewJSONLog(DECISIONS_LOG_PATH)}
+
+func (dl *decisionLog) publish(d *DispatchDecision) {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+
+	dl.nextID++
+	d.ID = dl.nextID
+	dl.decisions = append(dl.decisions, d)
+	if len(dl.decisions) > DECISIONS_KEPT_IN_MEMORY {
+		dl.decisions = dl.decisions[len(dl.decisions)-DECISIONS_KEPT_IN_MEMORY:]
+	}
+}
+
+// claimed completes the decision with the line that claimed the piece
+// and persists it.
+func (dl *decisionLog) claimed(d *DispatchDecision, lineID string, reason string) {
+	if d == nil {
+		return
+	}
+
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+
+	d.ChosenLine = lineID
+	d.ClaimedAt = time.Now()
+	d.Reason = reason
+
+	dl.journal.Append(d)
+}
+
+// annotate records a supervisor's override on a decision that may already
+// be published.
+func (dl *decisionLog) annotate(d *DispatchDecision, override string) {
+	if d == nil {
+		return
+	}
+
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+	d.Override = override
+}
+
+func (dl *decisionLog) query(filter DecisionFilter) []DispatchDecision {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+
+	result := []DispatchDecision{}
+	for i := len(dl.decisions) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(result) >= filter.Limit {
+			break
+		}
+		if filter.matches(dl.decisions[i]) {
+			result = append(result, *dl.decisions[i])
+		}
+	}
+	return result
+}
+
+// Decisions returns the most recent dispatch decisions matching the filter,
+// newest first.
+func Decisions(filter DecisionFilter) []DispatchDecision {
+	return dispatchDecisions.query(filter)
+}
+
+func claimReason(scheduler string, rank int, nWaiters int) string {
+	return fmt.Sprintf(
+		"line was free and the piece ranked %d of %d waiters by the %s scheduler",
+		rank+1, nWaiters, scheduler,
+	)
+}
@@ -0,0 +1,111 @@
+package sim
+
+import (
+	"mes/internal/utils"
+	"testing"
+)
+
+func newTestDecision(pieceID string, lines ...string) *DispatchDecision {
+	d := newDispatchDecision(&Piece{ErpIdentifier: pieceID}, SCHEDULER_LENIENT)
+	for _, lineID := range lines {
+		d.offer(lineID, &processControlForm{}, true)
+	}
+	return d
+}
+
+func TestDecisionLogQuery(t *testing.T) {
+	dl := &decisionLog{journal: newTestJournal(t, "decisions.jsonl")}
+	dl.publish(newTestDecision("a", utils.ID_L1, utils.ID_L2))
+	dl.publish(newTestDecision("b", utils.ID_L4))
+	dl.publish(newTestDecision("a", utils.ID_L4))
+
+	tests := []struct {
+		name    string
+		filter  DecisionFilter
+		decided []int // IDs, newest first
+	}{
+		{"all", DecisionFilter{}, []int{3, 2, 1}},
+		{"piece", DecisionFilter{PieceID: "a"}, []int{3, 1}},
+		{"candidate line", DecisionFilter{LineID: utils.ID_L4}, []int{3, 2}},
+		{"piece and line", DecisionFilter{PieceID: "a", LineID: utils.ID_L2}, []int{1}},
+		{"limit", DecisionFilter{Limit: 1}, []int{3}},
+		{"no match", DecisionFilter{PieceID: "c"}, []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decisions := dl.query(tt.filter)
+			if len(decisions) != len(tt.decided) {
+				t.Fatalf("Expected decisions %v, got %+v", tt.decided, decisions)
+			}
+			for i, id := range tt.decided {
+				if decisions[i].ID != id {
+					t.Fatalf("Expected decisions %v, got %+v", tt.decided, decisions)
+				}
+			}
+		})
+	}
+}
+
+func TestDecisionLogMatchesChosenLine(t *testing.T) {
+	dl := &decisionLog{journal: newTestJournal(t, "decisions.jsonl")}
+	d := newTestDecision("a")
+	dl.publish(d)
+
+	// Claimed by a line the piece was pinned to, without candidates
+	dl.claimed(d, utils.ID_L3, "pinned")
+	if decisions := dl.query(DecisionFilter{LineID: utils.ID_L3}); len(decisions) != 1 {
+		t.Fatalf("Expected the decision found by its chosen line, got %+v", decisions)
+	}
+}
+
+func TestDecisionLogAnnotate(t *testing.T) {
+	dl := &decisionLog{journal: newTestJournal(t, "decisions.jsonl")}
+	d := newTestDecision("a", utils.ID_L1)
+	dl.publish(d)
+
+	// A pin applied while the API reads the decisions
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		dl.annotate(d, "pinned to line L1")
+	}()
+	dl.query(DecisionFilter{})
+	<-done
+
+	if decisions := dl.query(DecisionFilter{}); decisions[0].Override != "pinned to line L1" {
+		t.Fatalf("Expected the override on the published decision, got %+v", decisions[0])
+	}
+	dl.annotate(nil, "ignored")
+}
+
+func TestDecisionLogKeepsRecentDecisions(t *testing.T) {
+	dl := &decisionLog{journal: newTestJournal(t, "decisions.jsonl")}
+	for i := 0; i < DECISIONS_KEPT_IN_MEMORY+5; i++ {
+		dl.publish(newTestDecision("a"))
+	}
+
+	decisions := dl.query(DecisionFilter{})
+	if len(decisions) != DECISIONS_KEPT_IN_MEMORY || decisions[0].ID != DECISIONS_KEPT_IN_MEMORY+5 {
+		t.Fatalf("Expected the %d most recent decisions, got %d from %d",
+			DECISIONS_KEPT_IN_MEMORY, len(decisions), decisions[0].ID)
+	}
+}
+
+func TestDecisionLogPersistsClaims(t *testing.T) {
+	journal := newTestJournal(t, "decisions.jsonl")
+	dl := &decisionLog{journal: journal}
+	claimed := newTestDecision("a", utils.ID_L1)
+	dl.publish(claimed)
+	dl.publish(newTestDecision("b", utils.ID_L1))
+	dl.claimed(claimed, utils.ID_L1, "free")
+
+	// Only completed decisions are written
+	persisted, err := utils.ReadJSONLog[DispatchDecision](journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(persisted) != 1 || persisted[0].PieceID != "a" ||
+		persisted[0].ChosenLine != utils.ID_L1 || persisted[0].Reason != "free" {
+		t.Fatalf("Expected the claimed decision persisted, got %+v", persisted)
+	}
+}
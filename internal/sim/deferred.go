@@ -0,0 +1,238 @@
+package sim
+
+import (
+	"context"
+	"log"
+	"mes/internal/utils"
+	"sync"
+	"time"
+)
+
+// Shipment backlog events
+const (
+	SHIPMENT_DEFERRED = "deferred" // (part of) a shipment did not fit in W1
+	SHIPMENT_ADMITTED = "admitted" // (part of) a shipment was sent to the supply lines
+)
+
+// DeferredShipment is a shipment, or the rest of one, waiting for space in W1.
+type DeferredShipment struct {
+	Shipment
+	// Pieces of the shipment not admitted yet
+	Remaining  int       `json:"remaining"`
+	DeferredAt time.Time `json:"deferred_at"`
+	DeferredOn uint      `json:"deferred_on"` // day it was first deferred
+}
+
+// shipmentEvent is a shipment deferred or admitted, with the pieces of it
+// still waiting for W1 after the event.
+type shipmentEvent struct {
+	Time     time.Time `json:"time"`
+	Day      uint      `json:"day"`
+	Event    string    `json:"event"`
+	Shipment Shipment  `json:"shipment"`
+	// Pieces of the shipment still deferred after the event
+	Remaining int `json:"remaining"`
+}
+
+// shipmentAdmission is (part of) a shipment W1 has room for.
+type shipmentAdmission struct {
+	shipment Shipment
+	nPieces  int
+	// Whether these are the last pieces of the shipment to arrive
+	final bool
+}
+
+// shipmentBacklog keeps the shipments that did not fit in W1 and admits
+// them, oldest first, as space frees up.
+type shipmentBacklog struct {
+	lock    sync.Mutex
+	pending []DeferredShipment
+	// Whether a shipment may be admitted in parts
+	partial bool
+	journal *utils.JSONLog
+
+	// Signals the shipment handler that W1 may have room again
+	wakeCh chan struct{}
+}
+
+var deferredShipments = &shipmentBacklog{
+	journal: utils.NewCompactedJSONLog(SHIPMENT_BACKLOG_PATH),
+	wakeCh:  make(chan struct{}, 1),
+}
+
+// load restores the shipments that were still waiting for W1 when the MES
+// stopped, with the day each was first deferred.
+func (sb *shipmentBacklog) load() error {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+
+	sb.pending = nil
+	err := utils.ReplayJSONLog(sb.journal, func(event shipmentEvent) {
+		sb.setRemainingLocked(event.Shipment, event.Remaining, event.Time, event.Day)
+	})
+	if len(sb.pending) > 0 {
+		log.Printf("[shipmentBacklog.load] %d deferred shipments restored\n", len(sb.pending))
+	}
+	return err
+}
+
+func (sb *shipmentBacklog) find(shipmentID int) int {
+	for i, deferred := range sb.pending {
+		if deferred.ID == shipmentID {
+			return i
+		}
+	}
+	return -1
+}
+
+func (sb *shipmentBacklog) setRemainingLocked(
+	shipment Shipment, remaining int, at time.Time, day uint,
+) {
+	i := sb.find(shipment.ID)
+	switch {
+	case remaining <= 0 && i >= 0:
+		sb.pending = append(sb.pending[:i], sb.pending[i+1:]...)
+	case remaining > 0 && i >= 0:
+		sb.pending[i].Remaining = remaining
+	case remaining > 0:
+		sb.pending = append(sb.pending, DeferredShipment{
+			Shipment:   shipment,
+			Remaining:  remaining,
+			DeferredAt: at,
+			DeferredOn: day,
+		})
+	}
+}
+
+func (sb *shipmentBacklog) record(event string, shipment Shipment, remaining int) {
+	day, _ := simCalendar.today()
+	entry := shipmentEvent{
+		Time:      time.Now(),
+		Day:       day,
+		Event:     event,
+		Shipment:  shipment,
+		Remaining: remaining,
+	}
+	sb.setRemainingLocked(shipment, remaining, entry.Time, day)
+
+	sb.journal.Append(entry)
+	sb.journal.CompactIfFull(sb.stateLocked)
+}
+
+// stateLocked returns the events that rebuild the backlog as it is.
+func (sb *shipmentBacklog) stateLocked() []any {
+	events := make([]any, len(sb.pending))
+	for i, deferred := range sb.pending {
+		events[i] = shipmentEvent{
+			Time:      deferred.DeferredAt,
+			Day:       deferred.DeferredOn,
+			Event:     SHIPMENT_DEFERRED,
+			Shipment:  deferred.Shipment,
+			Remaining: deferred.Remaining,
+		}
+	}
+	return events
+}
+
+// admit decides which of the deferred and new shipments fit in the free
+// space of W1, deferred ones first. Shipments that do not fit are deferred,
+// or admitted in part if partial admission is enabled. New shipments that
+// are already deferred (re-sent by the ERP) are ignored.
+// Returns the admissions and the shipments deferred for the first time.
+func (sb *shipmentBacklog) admit(
+	shipments []Shipment, space int,
+) ([]shipmentAdmission, []DeferredShipment) {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+
+	type candidate struct {
+		shipment  Shipment
+		remaining int
+		deferred  bool
+	}
+	candidates := []candidate{}
+	for _, deferred := range sb.pending {
+		candidates = append(candidates,
+			candidate{shipment: deferred.Shipment, remaining: deferred.Remaining, deferred: true})
+	}
+	for _, shipment := range shipments {
+		if sb.find(shipment.ID) < 0 {
+			candidates = append(candidates, candidate{shipment: shipment, remaining: shipment.NPieces})
+		}
+	}
+
+	admissions := []shipmentAdmission{}
+	newlyDeferred := []DeferredShipment{}
+	for _, c := range candidates {
+		nPieces := 0
+		switch {
+		case c.remaining <= space:
+			nPieces = c.remaining
+		case sb.partial:
+			nPieces = space
+		}
+		space -= nPieces
+		remaining := c.remaining - nPieces
+
+		if nPieces > 0 {
+			admissions = append(admissions, shipmentAdmission{
+				shipment: c.shipment,
+				nPieces:  nPieces,
+				final:    remaining == 0,
+			})
+			if c.deferred || remaining > 0 {
+				sb.record(SHIPMENT_ADMITTED, c.shipment, remaining)
+			}
+		}
+		if remaining > 0 && !c.deferred {
+			sb.record(SHIPMENT_DEFERRED, c.shipment, remaining)
+			newlyDeferred = append(newlyDeferred, sb.pending[sb.find(c.shipment.ID)])
+		}
+	}
+	return admissions, newlyDeferred
+}
+
+func (sb *shipmentBacklog) wakeUp() {
+	utils.Signal(sb.wakeCh)
+}
+
+func (sb *shipmentBacklog) isEmpty() bool {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	return len(sb.pending) == 0
+}
+
+// reportDeferred tells the ERP which shipments are waiting for room in W1.
+// A report the ERP rejects is only logged: the shipments stay deferred and
+// are admitted as W1 empties either way.
+func reportDeferred(ctx context.Context, deferred []DeferredShipment) {
+	for _, d := range deferred {
+		log.Printf("[ShipmentHandler] Shipment %d deferred: %d of %d pieces do not fit in W1\n",
+			d.ID, d.Remaining, d.NPieces)
+
+		form := ShipmentDeferralForm{ID: d.ID, NDeferred: d.Remaining, Day: d.DeferredOn}
+		if err := form.Post(ctx); err != nil {
+			log.Printf("[ShipmentHandler] failed to report deferred shipment %d: %v\n", d.ID, err)
+		}
+	}
+}
+
+// UsePartialShipments enables or disables admitting the part of a shipment
+// that fits in W1 when the whole of it does not.
+func UsePartialShipments(enabled bool) {
+	deferredShipments.lock.Lock()
+	deferredShipments.partial = enabled
+	deferredShipments.lock.Unlock()
+
+	deferredShipments.wakeUp()
+}
+
+// DeferredShipments returns the shipments waiting for space in W1, oldest first.
+func DeferredShipments() []DeferredShipment {
+	deferredShipments.lock.Lock()
+	defer deferredShipments.lock.Unlock()
+
+	pending := make([]DeferredShipment, len(deferredShipments.pending))
+	copy(pending, deferredShipments.pending)
+	return pending
+}
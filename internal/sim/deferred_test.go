@@ -0,0 +1,183 @@
+package sim
+
+import (
+	"mes/internal/utils"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestShipmentBacklogAdmit(t *testing.T) {
+	shipments := []Shipment{
+		{ID: 1, MaterialKind: "P1", NPieces: 6},
+		{ID: 2, MaterialKind: "P2", NPieces: 4},
+		{ID: 3, MaterialKind: "P1", NPieces: 2},
+	}
+	tests := []struct {
+		name     string
+		room     int
+		partial  bool
+		admitted map[int]int // shipment ID -> pieces admitted
+		deferred map[int]int // shipment ID -> pieces deferred
+	}{
+		{"room for all", 12, false, map[int]int{1: 6, 2: 4, 3: 2}, map[int]int{}},
+		{"smaller shipments fit", 8, false, map[int]int{1: 6, 3: 2}, map[int]int{2: 4}},
+		{"no room", 0, false, map[int]int{}, map[int]int{1: 6, 2: 4, 3: 2}},
+		{"partial", 8, true, map[int]int{1: 6, 2: 2}, map[int]int{2: 2, 3: 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sb := newTestShipmentBacklog(t)
+			sb.partial = tt.partial
+
+			admissions, deferred := sb.admit(shipments, tt.room)
+			admitted := map[int]int{}
+			for _, a := range admissions {
+				admitted[a.shipment.ID] += a.nPieces
+			}
+			if !sameCounts(admitted, tt.admitted) {
+				t.Fatalf("Expected %v admitted, got %v", tt.admitted, admitted)
+			}
+			waiting := map[int]int{}
+			for _, d := range deferred {
+				waiting[d.ID] = d.Remaining
+			}
+			if !sameCounts(waiting, tt.deferred) {
+				t.Fatalf("Expected %v deferred, got %v", tt.deferred, waiting)
+			}
+		})
+	}
+}
+
+func TestShipmentBacklogIgnoresResentShipment(t *testing.T) {
+	sb := newTestShipmentBacklog(t)
+	sb.admit([]Shipment{{ID: 2, MaterialKind: "P2", NPieces: 4}}, 0)
+
+	if _, deferred := sb.admit([]Shipment{{ID: 2, MaterialKind: "P2", NPieces: 4}}, 0); len(deferred) != 0 {
+		t.Fatalf("Expected a re-sent shipment to be ignored, got %+v", deferred)
+	}
+	if len(sb.pending) != 1 {
+		t.Fatalf("Expected the shipment deferred once, got %+v", sb.pending)
+	}
+}
+
+func TestShipmentBacklogAdmitsRestInOrder(t *testing.T) {
+	sb := newTestShipmentBacklog(t)
+	sb.partial = true
+	sb.admit([]Shipment{{ID: 2, MaterialKind: "P2", NPieces: 4}}, 0)
+
+	admissions, _ := sb.admit(nil, 3)
+	if len(admissions) != 1 || admissions[0].nPieces != 3 || admissions[0].final {
+		t.Fatalf("Expected 3 pieces of shipment 2 admitted, got %+v", admissions)
+	}
+	admissions, _ = sb.admit(nil, 3)
+	if len(admissions) != 1 || admissions[0].nPieces != 1 || !admissions[0].final || len(sb.pending) != 0 {
+		t.Fatalf("Expected the last piece of shipment 2 admitted, got %+v", admissions)
+	}
+}
+
+func TestShipmentBacklogLoad(t *testing.T) {
+	deferred := func(id, remaining int) shipmentEvent {
+		return shipmentEvent{Event: SHIPMENT_DEFERRED, Day: 2,
+			Shipment: Shipment{ID: id, NPieces: 4}, Remaining: remaining}
+	}
+	admitted := func(id, remaining int) shipmentEvent {
+		return shipmentEvent{Event: SHIPMENT_ADMITTED, Day: 3,
+			Shipment: Shipment{ID: id, NPieces: 4}, Remaining: remaining}
+	}
+	tests := []struct {
+		name   string
+		events []shipmentEvent
+		torn   bool
+		want   map[int]int // shipment ID -> pieces still deferred
+	}{
+		{"no log", nil, false, map[int]int{}},
+		{"deferred", []shipmentEvent{deferred(1, 4)}, false, map[int]int{1: 4}},
+		{"admitted in part", []shipmentEvent{deferred(1, 4), admitted(1, 1)}, false, map[int]int{1: 1}},
+		{"admitted", []shipmentEvent{deferred(1, 4), admitted(1, 0)}, false, map[int]int{}},
+		{"interleaved shipments", []shipmentEvent{
+			deferred(1, 4), deferred(2, 4), admitted(1, 0), admitted(2, 3),
+		}, false, map[int]int{2: 3}},
+		{"torn last line", []shipmentEvent{deferred(1, 4), admitted(1, 2)}, true, map[int]int{1: 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sb := newTestShipmentBacklog(t)
+			for _, event := range tt.events {
+				sb.journal.Append(event)
+			}
+			if tt.torn {
+				tearLastLine(t, sb.journal)
+			}
+
+			if err := sb.load(); err != nil {
+				t.Fatal(err)
+			}
+			got := map[int]int{}
+			for _, d := range sb.pending {
+				got[d.ID] = d.Remaining
+				if d.DeferredOn != 2 {
+					t.Fatalf("Expected shipment %d deferred on day 2, got %d", d.ID, d.DeferredOn)
+				}
+			}
+			if !sameCounts(got, tt.want) {
+				t.Fatalf("Expected %v restored, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func newTestShipmentBacklog(t *testing.T) *shipmentBacklog {
+	return &shipmentBacklog{
+		journal: newTestCompactedJournal(t, "shipments.jsonl"),
+		wakeCh:  make(chan struct{}, 1),
+	}
+}
+
+func sameCounts[K comparable](got, want map[K]int) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for k, n := range want {
+		if got[k] != n {
+			return false
+		}
+	}
+	return true
+}
+
+// newTestJournal returns a log in the test's temporary directory, flushed
+// before the directory is removed.
+func newTestJournal(t *testing.T, name string) *utils.JSONLog {
+	journal := utils.NewJSONLog(filepath.Join(t.TempDir(), name))
+	t.Cleanup(journal.Flush)
+	return journal
+}
+
+// newTestCompactedJournal returns a log replayed by its owner in the
+// test's temporary directory. compactAtNextAppend makes the owner compact
+// it the next time it appends to it.
+func newTestCompactedJournal(t *testing.T, name string) *utils.JSONLog {
+	journal := utils.NewCompactedJSONLog(filepath.Join(t.TempDir(), name))
+	t.Cleanup(journal.Flush)
+	return journal
+}
+
+func compactAtNextAppend(journal *utils.JSONLog) {
+	journal.Flush()
+	journal.SetMaxSize(1)
+}
+
+// tearLastLine leaves half a line at the end of the log, as a crash while
+// it was written would.
+func tearLastLine(t *testing.T, journal *utils.JSONLog) {
+	journal.Flush()
+	file, err := os.OpenFile(journal.Path(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(`{"time":"2026-`); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -5,21 +5,23 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"math"
 	"mes/internal/net/erp"
 	"mes/internal/net/plc"
 	"mes/internal/utils"
 	"net/http"
 	"net/url"
 	"strconv"
+	"time"
 )
 
 type Delivery struct {
 	ID       string `json:"id"`
 	Piece    string `json:"piece"`
 	Quantity int    `json:"quantity"`
-
-	nConfirmations int
+	// Priority class (PRIORITY_*), higher classes are dispatched first
+	Priority int `json:"priority"`
+	// Day the order is due, 0 if the ERP did not set a deadline
+	DueDate uint `json:"due_date"`
 }
 
 func (d *Delivery) PostConfirmation(ctx context.Context) error {
@@ -51,6 +53,42 @@ func GetDeliveries(ctx context.Context) ([]Delivery, error) {
 	return deliveries, nil
 }
 
+// DeliveryShortfallForm is a form used to report to the ERP a delivery
+// that W2 does not hold enough finished pieces for.
+//
+// Implements the ErpPoster interface.
+type DeliveryShortfallForm struct {
+	ID       string `json:"id"`
+	Piece    string `json:"piece"`
+	NMissing int    `json:"quantity"`
+}
+
+func (ds *DeliveryShortfallForm) Post(ctx context.Context) error {
+	formData := url.Values{
+		"id":       {ds.ID},
+		"piece":    {ds.Piece},
+		"quantity": {strconv.Itoa(ds.NMissing)},
+	}
+
+	config := erp.ConfigDefaultWithEndpoint(erp.ENDPOINT_DELIVERY_SHORTFALL)
+	return erp.Post(ctx, config, formData)
+}
+
+// reportShortfalls tells the ERP which deliveries W2 cannot fill yet, so
+// that it can plan their pieces. Failing to report is logged, the
+// deliveries go out when their pieces are produced.
+func reportShortfalls(ctx context.Context, shortfalls []QueuedDelivery) {
+	for _, s := range shortfalls {
+		log.Printf("[DeliveryHandler] Delivery %s short of %d pieces of type %v in W2\n",
+			s.ID, s.Shortfall, s.Piece)
+
+		form := DeliveryShortfallForm{ID: s.ID, Piece: s.Piece, NMissing: s.Shortfall}
+		if err := form.Post(ctx); err != nil {
+			log.Printf("[DeliveryHandler] failed to report shortfall of delivery %s: %v\n", s.ID, err)
+		}
+	}
+}
+
 type DeliveryStatistics struct {
 	Line              string `json:"line"`
 	Piece             string `json:"piece"`
@@ -91,6 +129,26 @@ func lineIdxToString(idx int) string {
 	}
 }
 
+// restoreLoadsOnLine puts the loads that were on a delivery line when the
+// MES stopped back on their line, so that the line is not given another
+// load and the ack of the load is matched to it.
+func restoreLoadsOnLine() {
+	factory, mutex := getFactoryInstance()
+	defer mutex.Unlock()
+
+	for _, load := range pendingDeliveries.loadsOnLine() {
+		for lIdx, line := range factory.deliveryLines {
+			if lineIdxToString(lIdx) != load.Line {
+				continue
+			}
+			line.RestoreCommand(load.TxId, int16(load.Quantity), PieceStrToInt(load.Kind))
+			deliveryLoads.sent(lIdx, load)
+			log.Printf("[DeliveryHandler] Waiting for %d pieces of type %v on line %s\n",
+				load.Quantity, load.Kind, load.Line)
+		}
+	}
+}
+
 type DeliveryHandler struct {
 	// Send new shipments to this channel
 	DeliveryCh chan<- []Delivery
@@ -105,122 +163,120 @@ func StartDeliveryHandler(ctx context.Context) *DeliveryHandler {
 	deliveryAckCh := make(chan DeliveryAckMetadata, plc.NUMBER_OF_OUTPUTS+1)
 	errCh := make(chan error)
 
-	freeLines := [plc.NUMBER_OF_OUTPUTS]bool{true, true, true, true}
-	metadataMap := make(map[DeliveryAckMetadata]Delivery) // metadata -> delivery
-	confirmationsMap := make(map[string]int)              // delivery ID -> number of confirmations received
+	if err := pendingDeliveries.load(); err != nil {
+		log.Printf("[DeliveryHandler] failed to restore queued deliveries: %v\n", err)
+	}
+	if err := w2Stock.load(); err != nil {
+		log.Printf("[DeliveryHandler] failed to restore W2 stock: %v\n", err)
+	}
+	if err := deliveryLoads.load(); err != nil {
+		log.Printf("[DeliveryHandler] failed to restore delivery ledger: %v\n", err)
+	}
+	restoreLoadsOnLine()
+	w2Stock.restoreLoads(pendingDeliveries.loadsOnLine())
 
 	go func() {
 		defer close(deliveryCh)
 		defer close(errCh)
 
-		for {
-			select {
-			case <-ctx.Done():
-				return
-
-			case metadata := <-deliveryAckCh:
-				delivery, ok := metadataMap[metadata]
-				utils.Assert(ok, "[DeliveryHandler] Delivery not found for confirmation")
+		// Loads every free delivery line with the next pieces of the queue
+		// that are in W2
+		load := func() {
+			factory, mutex := getFactoryInstance()
+			defer mutex.Unlock()
 
-				freeLines[metadata.line] = true
-				confirmationsMap[delivery.ID]++
-				utils.Assert(confirmationsMap[delivery.ID] <= delivery.nConfirmations,
-					fmt.Sprintf("[DeliveryHandler] Too many confirmations received for delivery %v", delivery.ID))
+			writeCtx, cancel := context.WithTimeout(ctx, plc.DEFAULT_OPCUA_TIMEOUT)
+			defer cancel()
 
-				log.Printf("[DeliveryHandler] Delivery %v partially executed on line %d\n",
-					delivery.ID, metadata.line)
+			for lIdx, line := range factory.deliveryLines {
+				if !deliveryLoads.isFree(lIdx) {
+					continue
+				}
 
-				log.Printf("[DeliveryHandler] Delivery %v has %d confirmations out of %d\n",
-					delivery.ID, confirmationsMap[delivery.ID], delivery.nConfirmations)
+				kind, parts, ok := pendingDeliveries.next(DELIVERY_LINE_CAPACITY, w2Stock)
+				if !ok {
+					return
+				}
 
-				stats := DeliveryStatistics{
-					Line:              lineIdxToString(metadata.line),
-					Piece:             delivery.Piece,
-					AssociatedOrderID: delivery.ID,
-					Quantity:          delivery.Quantity,
+				quantity := 0
+				for _, part := range parts {
+					quantity += part.Quantity
 				}
-				err := stats.Post(ctx)
-				utils.Assert(err == nil, "[DeliveryHandler] Failed to post delivery stats to ERP")
-
-				if confirmationsMap[delivery.ID] == delivery.nConfirmations {
-					err := delivery.PostConfirmation(ctx)
-					utils.Assert(err == nil, "[DeliveryHandler] Error confirming delivery")
-					log.Printf("[DeliveryHandler] Delivery %v confirmed to ERP\n", delivery.ID)
-					delete(confirmationsMap, delivery.ID)
+				line.SetDelivery(int16(quantity), PieceStrToInt(kind))
+				log.Printf("[DeliveryHandler] Delivering %d pieces of type %v of %d deliveries to line %d\n",
+					quantity, kind, len(parts), lIdx)
+				_, err := factory.plcClient.Write(line.CommandOpcuaVars(), writeCtx)
+
+				utils.Assert(err == nil, "[DeliveryHandler] Error writing to delivery line")
+				sent := DeliveryLoad{
+					Line:     lineIdxToString(lIdx),
+					Kind:     kind,
+					Quantity: quantity,
+					Parts:    parts,
+					TxId:     line.LastCommandTxId(),
+					SentAt:   time.Now(),
 				}
-				delete(metadataMap, metadata)
+				sent = pendingDeliveries.dispatched(sent)
+				deliveryLoads.sent(lIdx, sent)
+				pieceIDs := w2Stock.delivered(sent)
+				pieceTraces.delivered(pieceIDs, sent.Line, sent.TxId, parts)
+			}
+		}
 
-			case deliveries := <-deliveryCh:
-				log.Printf("[DeliveryHandler] Received %d new deliveries\n", len(deliveries))
-				for _, delivery := range deliveries {
-					linesRemaining := 0
-					for _, line := range freeLines {
-						if line {
-							linesRemaining++
-						}
+		dispatch := func() {
+			sortDeliveries(pendingDeliveries)
+			pendingDeliveries.drain(w2NearlyFull())
+			load()
+			reportShortfalls(ctx, pendingDeliveries.newShortfalls())
+		}
+
+		// Restored deliveries wait for the first batch of the ERP, the
+		// factory floor may not be connected yet
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case metadata := <-deliveryAckCh:
+				load, err := deliveryLoads.acked(metadata, time.Now())
+				utils.Assert(err == nil, fmt.Sprintf("[DeliveryHandler] %v", err))
+				w2Stock.unloaded(load.ID)
+				// Room in W2 may let more pieces be released
+				pieceReleaseQueue.wakeUp()
+
+				for _, part := range load.Parts {
+					log.Printf("[DeliveryHandler] Delivery %v: %d pieces unloaded on line %s\n",
+						part.OrderID, part.Quantity, load.Line)
+
+					stats := DeliveryStatistics{
+						Line:              load.Line,
+						Piece:             load.Kind,
+						AssociatedOrderID: part.OrderID,
+						Quantity:          part.Quantity,
 					}
+					err = stats.Post(ctx)
+					utils.Assert(err == nil, "[DeliveryHandler] Failed to post delivery stats to ERP")
+				}
 
-					log.Printf(
-						"[DeliveryHandler] Delivery %v: %d pieces of type %v",
-						delivery.ID,
-						delivery.Quantity,
-						delivery.Piece,
-					)
-
-					neededLines := int(math.Ceil(float64(delivery.Quantity) / DELIVERY_LINE_CAPACITY))
-					log.Printf("[DeliveryHandler] Delivery %s needs: %d lines\n",
-						delivery.ID, neededLines)
-
-					if linesRemaining < neededLines {
-						log.Printf("[DeliveryHandler] No lines available for delivery %s\n",
-							delivery.ID)
-						continue
+				for _, delivery := range pendingDeliveries.unloaded(load) {
+					if delivery.Delivered >= delivery.Quantity {
+						err := delivery.PostConfirmation(ctx)
+						utils.Assert(err == nil, "[DeliveryHandler] Error confirming delivery")
+						log.Printf("[DeliveryHandler] Delivery %v confirmed to ERP\n", delivery.ID)
+						pendingDeliveries.confirmed(delivery.ID)
+						forgetOrderPriority(delivery.ID)
 					}
-					linesRemaining -= neededLines
-
-					func() {
-						piecesRemaining := delivery.Quantity
-						factory, mutex := getFactoryInstance()
-						defer mutex.Unlock()
-
-						writeCtx, cancel := context.WithTimeout(ctx, plc.DEFAULT_OPCUA_TIMEOUT)
-						defer cancel()
-
-						delivery.nConfirmations = neededLines
-						for i := 0; i < neededLines; i++ {
-							for lIdx, line := range factory.deliveryLines {
-								if piecesRemaining == 0 {
-									break
-								}
-
-								if !freeLines[lIdx] {
-									continue
-								}
-
-								quantity := piecesRemaining
-								if quantity > DELIVERY_LINE_CAPACITY {
-									quantity = DELIVERY_LINE_CAPACITY
-								}
-
-								piecesRemaining -= quantity
-								line.SetDelivery(int16(quantity), PieceStrToInt(delivery.Piece))
-								log.Printf("[DeliveryHandler] Delivering %d pieces of type %v to line %d\n",
-									quantity, delivery.Piece, lIdx)
-								_, err := factory.plcClient.Write(line.CommandOpcuaVars(), writeCtx)
-
-								utils.Assert(err == nil, "[DeliveryHandler] Error writing to delivery line")
-								freeLines[lIdx] = false
-								metadataMap[DeliveryAckMetadata{
-									txId:     line.LastCommandTxId(),
-									line:     lIdx,
-									quantity: quantity,
-								}] = delivery
-							}
-
-							utils.Assert(piecesRemaining == 0, "[DeliveryHandler] Wrong number of pieces delivered")
-						}
-					}()
 				}
+				dispatch()
+
+			case deliveries := <-deliveryCh:
+				queued := pendingDeliveries.add(deliveries)
+				log.Printf("[DeliveryHandler] Received %d deliveries, %d new\n",
+					len(deliveries), queued)
+				dispatch()
+
+			case <-w2Stock.wakeCh:
+				dispatch()
 			}
 		}
 	}()
@@ -0,0 +1,175 @@
+package sim
+
+import (
+	"fmt"
+	"mes/internal/net/plc"
+	"mes/internal/utils"
+	"sync"
+	"time"
+)
+
+// DeliveryLoadPart is the pieces of an order in a load.
+type DeliveryLoadPart struct {
+	OrderID  string `json:"order_id"`
+	Quantity int    `json:"quantity"`
+}
+
+// DeliveryLoad is a load of pieces sent to a delivery line. Orders for the
+// same kind of piece share a load.
+type DeliveryLoad struct {
+	ID       int                `json:"id"`
+	Line     string             `json:"line"`
+	Kind     string             `json:"kind"`
+	Quantity int                `json:"quantity"`
+	Parts    []DeliveryLoadPart `json:"parts"`
+	TxId     int16              `json:"tx_id"`
+	SentAt   time.Time          `json:"sent_at"`
+	// Zero while the load is on the line
+	AckedAt time.Time `json:"acked_at"`
+}
+
+// orderQuantity returns the pieces of the order in the load.
+func (load *DeliveryLoad) orderQuantity(orderID string) int {
+	pieces := 0
+	for _, part := range load.Parts {
+		if part.OrderID == orderID {
+			pieces += part.Quantity
+		}
+	}
+	return pieces
+}
+
+// DeliveryLineStats sums up the loads a delivery line has unloaded.
+type DeliveryLineStats struct {
+	Line   string         `json:"line"`
+	Loads  int            `json:"loads"`
+	Pieces int            `json:"pieces"`
+	Kinds  map[string]int `json:"kinds"` // kind -> pieces
+	// Load on the line, nil if the line is free
+	OnLine *DeliveryLoad `json:"on_line"`
+}
+
+// DeliveryLoadFilter selects the loads returned by DeliveryLoads.
+// Empty fields match everything, a zero limit returns every load.
+type DeliveryLoadFilter struct {
+	OrderID string
+	Line    string
+	Limit   int
+}
+
+// deliveryLedger records every load sent to the delivery lines. It knows
+// which load each line is unloading, so that an ack can only be matched
+// to the load it was written for.
+type deliveryLedger struct {
+	lock    sync.Mutex
+	onLine  []*DeliveryLoad // per line, nil if the line is free
+	loads   []DeliveryLoad  // unloaded, oldest first
+	journal *utils.JSONLog
+}
+
+var deliveryLoads = newDeliveryLedger(plc.NUMBER_OF_OUTPUTS, utils.NewJSONLog(DELIVERY_LEDGER_PATH))
+
+func newDeliveryLedger(nLines int, journal *utils.JSONLog) *deliveryLedger {
+	return &deliveryLedger{onLine: make([]*DeliveryLoad, nLines), journal: journal}
+}
+
+// load restores the loads unloaded before the MES stopped. Loads that were
+// on a line are not in the ledger, the delivery queue puts them back.
+func (dl *deliveryLedger) load() error {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+
+	dl.loads = nil
+	return utils.ReplayJSONLog(dl.journal, func(load DeliveryLoad) {
+		dl.loads = append(dl.loads, load)
+	})
+}
+
+func (dl *deliveryLedger) isFree(line int) bool {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+	return dl.onLine[line] == nil
+}
+
+// sent records a load written to a delivery line.
+func (dl *deliveryLedger) sent(line int, load DeliveryLoad) {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+
+	utils.Assert(dl.onLine[line] == nil, "[deliveryLedger.sent] delivery line is busy")
+	dl.onLine[line] = &load
+}
+
+// acked closes the load the ack is for and frees its line.
+func (dl *deliveryLedger) acked(ack DeliveryAckMetadata, at time.Time) (DeliveryLoad, error) {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+
+	if ack.line < 0 || ack.line >= len(dl.onLine) {
+		return DeliveryLoad{}, fmt.Errorf("[deliveryLedger.acked] unknown delivery line %d", ack.line)
+	}
+	load := dl.onLine[ack.line]
+	if load == nil || load.TxId != ack.txId || load.Quantity != ack.quantity {
+		return DeliveryLoad{}, fmt.Errorf(
+			"[deliveryLedger.acked] unexpected ack %d (%d pieces) on delivery line %d",
+			ack.txId, ack.quantity, ack.line)
+	}
+
+	dl.onLine[ack.line] = nil
+	load.AckedAt = at
+	dl.loads = append(dl.loads, *load)
+	dl.journal.Append(*load)
+	return *load, nil
+}
+
+func (dl *deliveryLedger) lineStats() []DeliveryLineStats {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+
+	stats := make([]DeliveryLineStats, len(dl.onLine))
+	for i, load := range dl.onLine {
+		stats[i] = DeliveryLineStats{Line: lineIdxToString(i), Kinds: make(map[string]int)}
+		if load != nil {
+			onLine := *load
+			stats[i].OnLine = &onLine
+		}
+	}
+	for _, load := range dl.loads {
+		for i := range stats {
+			if stats[i].Line == load.Line {
+				stats[i].Loads++
+				stats[i].Pieces += load.Quantity
+				stats[i].Kinds[load.Kind] += load.Quantity
+			}
+		}
+	}
+	return stats
+}
+
+func (dl *deliveryLedger) query(filter DeliveryLoadFilter) []DeliveryLoad {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+
+	loads := []DeliveryLoad{}
+	for i := len(dl.loads) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(loads) >= filter.Limit {
+			break
+		}
+		load := dl.loads[i]
+		if (filter.OrderID == "" || load.orderQuantity(filter.OrderID) > 0) &&
+			(filter.Line == "" || load.Line == filter.Line) {
+			loads = append(loads, load)
+		}
+	}
+	return loads
+}
+
+// DeliveryLoads returns the unloaded loads matching the filter, newest first.
+func DeliveryLoads(filter DeliveryLoadFilter) []DeliveryLoad {
+	return deliveryLoads.query(filter)
+}
+
+// DeliveryLines returns the statistics of each delivery line.
+func DeliveryLines() []DeliveryLineStats {
+	return deliveryLoads.lineStats()
+}
@@ -0,0 +1,51 @@
+package sim
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeliveryLedgerAcks(t *testing.T) {
+	journal := newTestJournal(t, "delivery_loads.jsonl")
+	dl := newDeliveryLedger(2, journal)
+	now := time.Now()
+
+	// Two orders with loads of the same size and tx id on different lines
+	dl.sent(0, DeliveryLoad{Line: lineIdxToString(0), Kind: "P5", Quantity: 3, TxId: 1, SentAt: now,
+		Parts: []DeliveryLoadPart{{OrderID: "A", Quantity: 3}}})
+	dl.sent(1, DeliveryLoad{Line: lineIdxToString(1), Kind: "P6", Quantity: 3, TxId: 1, SentAt: now,
+		Parts: []DeliveryLoadPart{{OrderID: "B", Quantity: 3}}})
+	if dl.isFree(0) || dl.isFree(1) {
+		t.Fatal("Expected both lines to be busy")
+	}
+
+	if _, err := dl.acked(DeliveryAckMetadata{txId: 2, line: 1, quantity: 3}, now); err == nil {
+		t.Fatal("Expected an ack for another command to be rejected")
+	}
+	load, err := dl.acked(DeliveryAckMetadata{txId: 1, line: 1, quantity: 3}, now)
+	if err != nil || load.orderQuantity("B") != 3 || !dl.isFree(1) {
+		t.Fatalf("Expected the load of order B to be unloaded, got %+v (%v)", load, err)
+	}
+
+	dl.sent(1, DeliveryLoad{Line: lineIdxToString(1), Kind: "P5", Quantity: 2, TxId: 2, SentAt: now,
+		Parts: []DeliveryLoadPart{{OrderID: "A", Quantity: 2}}})
+	dl.acked(DeliveryAckMetadata{txId: 2, line: 1, quantity: 2}, now)
+	dl.acked(DeliveryAckMetadata{txId: 1, line: 0, quantity: 3}, now)
+	if loads := dl.query(DeliveryLoadFilter{OrderID: "A"}); len(loads) != 2 {
+		t.Fatalf("Expected the 2 loads of A unloaded, got %+v", loads)
+	}
+
+	// Statistics count the pieces of each load, not of the whole order
+	stats := dl.lineStats()
+	if stats[1].Loads != 2 || stats[1].Pieces != 5 || stats[1].Kinds["P5"] != 2 {
+		t.Fatalf("Unexpected statistics of line %s: %+v", stats[1].Line, stats[1])
+	}
+
+	restored := newDeliveryLedger(2, journal)
+	if err := restored.load(); err != nil {
+		t.Fatal(err)
+	}
+	if loads := restored.query(DeliveryLoadFilter{OrderID: "A"}); len(loads) != 2 || loads[0].Line != "DL1" {
+		t.Fatalf("Expected the 2 loads of order A restored, newest first, got %+v", loads)
+	}
+}
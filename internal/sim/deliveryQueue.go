@@ -0,0 +1,366 @@
+package sim
+
+import (
+	"log"
+	"mes/internal/utils"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Delivery queue events
+const (
+	DELIVERY_QUEUED     = "queued"     // an order was received from the ERP
+	DELIVERY_DISPATCHED = "dispatched" // a load was written to a delivery line
+	DELIVERY_UNLOADED   = "unloaded"   // a delivery line acknowledged a load
+	DELIVERY_CONFIRMED  = "confirmed"  // an order was confirmed to the ERP
+)
+
+// QueuedDelivery is an order waiting for, or being sent to, the delivery lines.
+type QueuedDelivery struct {
+	Delivery
+	// Pieces not sent to a delivery line yet
+	Remaining int `json:"remaining"`
+	// Pieces sent to a delivery line and not acknowledged yet
+	InFlight int `json:"in_flight"`
+	// Pieces acknowledged by a delivery line
+	Delivered int `json:"delivered"`
+	// Pieces reserved in W2 and not sent to a delivery line yet
+	Reserved int `json:"reserved"`
+	// Pieces missing in W2 when the delivery was last dispatched
+	Shortfall int       `json:"shortfall"`
+	QueuedAt  time.Time `json:"queued_at"`
+
+	shortfallReported bool
+}
+
+// deliveryEvent is a delivery queued or confirmed to the ERP, or a load of
+// deliveries dispatched to or unloaded by a delivery line.
+type deliveryEvent struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Delivery Delivery  `json:"delivery"`
+	// The load dispatched or unloaded
+	Load *DeliveryLoad `json:"load,omitempty"`
+}
+
+// deliveryQueue keeps the orders to deliver in dispatch order and hands
+// them to the delivery lines as they free up, one line load at a time, so
+// that a large order does not need all its lines at once.
+type deliveryQueue struct {
+	lock    sync.Mutex
+	pending []*QueuedDelivery
+	// Whether a delivery may be sent in parts as its pieces reach W2
+	partial bool
+	// Whether deliveries are sent in parts to free space in W2
+	draining bool
+	// Loads written to a delivery line and not acknowledged yet
+	onLine     []DeliveryLoad
+	lastLoadID int
+	journal    *utils.JSONLog
+}
+
+var pendingDeliveries = &deliveryQueue{journal: utils.NewCompactedJSONLog(DELIVERY_QUEUE_PATH)}
+
+// load restores the deliveries the ERP had not confirmed when the MES
+// stopped, with the pieces already unloaded for each, and the loads that
+// were on a delivery line. Those are waited for, not sent again.
+func (dq *deliveryQueue) load() error {
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+
+	dq.pending = nil
+	dq.onLine = nil
+	err := utils.ReplayJSONLog(dq.journal, dq.applyLocked)
+	if len(dq.pending) > 0 {
+		log.Printf("[deliveryQueue.load] %d queued deliveries restored, %d loads on the lines\n",
+			len(dq.pending), len(dq.onLine))
+	}
+	return err
+}
+
+func (dq *deliveryQueue) applyLocked(event deliveryEvent) {
+	switch event.Event {
+	case DELIVERY_QUEUED:
+		if dq.find(event.Delivery.ID) < 0 {
+			dq.pending = append(dq.pending, newQueuedDelivery(event.Delivery, event.Time))
+		}
+	case DELIVERY_DISPATCHED:
+		dq.lastLoadID = max(dq.lastLoadID, event.Load.ID)
+		for _, part := range event.Load.Parts {
+			if i := dq.find(part.OrderID); i >= 0 {
+				dq.pending[i].Remaining -= part.Quantity
+				dq.pending[i].InFlight += part.Quantity
+			}
+		}
+		dq.onLine = append(dq.onLine, *event.Load)
+	case DELIVERY_UNLOADED:
+		dq.unloadedLocked(*event.Load)
+	case DELIVERY_CONFIRMED:
+		if i := dq.find(event.Delivery.ID); i >= 0 {
+			dq.pending = append(dq.pending[:i], dq.pending[i+1:]...)
+		}
+	}
+}
+
+func newQueuedDelivery(delivery Delivery, at time.Time) *QueuedDelivery {
+	return &QueuedDelivery{Delivery: delivery, Remaining: delivery.Quantity, QueuedAt: at}
+}
+
+func (dq *deliveryQueue) find(deliveryID string) int {
+	for i, queued := range dq.pending {
+		if queued.ID == deliveryID {
+			return i
+		}
+	}
+	return -1
+}
+
+func (dq *deliveryQueue) record(event string, delivery Delivery, load *DeliveryLoad) {
+	entry := deliveryEvent{Time: time.Now(), Event: event, Delivery: delivery, Load: load}
+	dq.journal.Append(entry)
+	dq.journal.CompactIfFull(dq.stateLocked)
+}
+
+// stateLocked returns the events that rebuild the queue as it is. The
+// pieces already unloaded of a delivery are written as a load of their own,
+// on no line.
+func (dq *deliveryQueue) stateLocked() []any {
+	events := []any{}
+	for _, queued := range dq.pending {
+		events = append(events, deliveryEvent{
+			Time:     queued.QueuedAt,
+			Event:    DELIVERY_QUEUED,
+			Delivery: queued.Delivery,
+		})
+		if queued.Delivered > 0 {
+			events = append(events, deliveryEvent{
+				Time:  queued.QueuedAt,
+				Event: DELIVERY_UNLOADED,
+				Load: &DeliveryLoad{
+					Kind:     queued.Piece,
+					Quantity: queued.Delivered,
+					Parts:    []DeliveryLoadPart{{OrderID: queued.ID, Quantity: queued.Delivered}},
+				},
+			})
+		}
+	}
+	for _, load := range dq.onLine {
+		events = append(events, deliveryEvent{Time: load.SentAt, Event: DELIVERY_DISPATCHED, Load: &load})
+	}
+	return events
+}
+
+// add queues the new deliveries. Deliveries already queued (re-listed by
+// the ERP) are ignored. Returns the number of deliveries queued.
+func (dq *deliveryQueue) add(deliveries []Delivery) int {
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+
+	queued := 0
+	for _, delivery := range deliveries {
+		if dq.find(delivery.ID) >= 0 || delivery.Quantity <= 0 {
+			continue
+		}
+		dq.pending = append(dq.pending, newQueuedDelivery(delivery, time.Now()))
+		dq.record(DELIVERY_QUEUED, delivery, nil)
+		queued++
+	}
+	return queued
+}
+
+// prioritise orders the queue by priority, then by due date. Otherwise the
+// order in which the deliveries were queued is kept.
+func (dq *deliveryQueue) prioritise(priority func(Delivery) int) {
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+
+	sort.SliceStable(dq.pending, func(i, j int) bool {
+		a, b := dq.pending[i].Delivery, dq.pending[j].Delivery
+		if priority(a) != priority(b) {
+			return priority(a) > priority(b)
+		}
+		return dueDayBefore(a.DueDate, b.DueDate)
+	})
+}
+
+// takeLocked takes up to space reserved pieces of the delivery. Unless
+// partial deliveries are allowed, all the pieces left of a delivery are
+// reserved before any is taken: the pieces stored meanwhile are held for
+// it, so that the deliveries after it do not take them first. The stock
+// is debited when the load is dispatched.
+func (dq *deliveryQueue) takeLocked(queued *QueuedDelivery, space int, stock *finishedStock) int {
+	if queued.Remaining <= 0 {
+		return 0
+	}
+	partial := dq.partial || dq.draining
+	switch {
+	case partial && queued.Reserved == 0:
+		queued.Reserved = stock.reserve(queued.Piece, min(queued.Remaining, space))
+	case !partial && queued.Reserved < queued.Remaining:
+		queued.Reserved += stock.reserve(queued.Piece, queued.Remaining-queued.Reserved)
+	}
+	queued.Shortfall = max(0,
+		queued.Remaining-queued.Reserved-stock.available(queued.Piece))
+	if queued.Shortfall == 0 {
+		// A later shortfall is reported again
+		queued.shortfallReported = false
+	}
+	if !partial && queued.Reserved < queued.Remaining {
+		return 0
+	}
+
+	quantity := min(queued.Reserved, space)
+	queued.Reserved -= quantity
+	queued.Remaining -= quantity
+	queued.InFlight += quantity
+	return quantity
+}
+
+// next plans a line load of at most capacity pieces: the next pieces of the
+// first delivery in stock, topped up with pieces of the following
+// deliveries of the same kind. Returns the kind and the pieces of each order.
+func (dq *deliveryQueue) next(capacity int, stock *finishedStock) (string, []DeliveryLoadPart, bool) {
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+
+	kind := ""
+	parts := []DeliveryLoadPart{}
+	space := capacity
+	for _, queued := range dq.pending {
+		if space == 0 {
+			break
+		}
+		if kind != "" && queued.Piece != kind {
+			continue
+		}
+		if quantity := dq.takeLocked(queued, space, stock); quantity > 0 {
+			kind = queued.Piece
+			parts = append(parts, DeliveryLoadPart{OrderID: queued.ID, Quantity: quantity})
+			space -= quantity
+		}
+	}
+	return kind, parts, len(parts) > 0
+}
+
+// drain makes deliveries go out in parts, whatever the partial deliveries
+// setting, while W2 is nearly full.
+func (dq *deliveryQueue) drain(draining bool) {
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+
+	if draining != dq.draining {
+		log.Printf("[deliveryQueue.drain] W2 nearly full: %v\n", draining)
+	}
+	dq.draining = draining
+}
+
+// newShortfalls returns the deliveries found short of pieces in W2 that
+// were not reported yet.
+func (dq *deliveryQueue) newShortfalls() []QueuedDelivery {
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+
+	shortfalls := []QueuedDelivery{}
+	for _, queued := range dq.pending {
+		if queued.Shortfall > 0 && !queued.shortfallReported {
+			queued.shortfallReported = true
+			shortfalls = append(shortfalls, *queued)
+		}
+	}
+	return shortfalls
+}
+
+// dispatched records a load written to a delivery line, so that it is not
+// sent again if the MES stops before the line acknowledges it. Returns the
+// load with its ID.
+func (dq *deliveryQueue) dispatched(load DeliveryLoad) DeliveryLoad {
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+
+	dq.lastLoadID++
+	load.ID = dq.lastLoadID
+	dq.onLine = append(dq.onLine, load)
+	dq.record(DELIVERY_DISPATCHED, Delivery{}, &load)
+	return load
+}
+
+// unloaded records that a delivery line acknowledged a load. Returns the
+// deliveries of the load, with the pieces delivered so far.
+func (dq *deliveryQueue) unloaded(load DeliveryLoad) []QueuedDelivery {
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+
+	deliveries := dq.unloadedLocked(load)
+	dq.record(DELIVERY_UNLOADED, Delivery{}, &load)
+	return deliveries
+}
+
+func (dq *deliveryQueue) unloadedLocked(load DeliveryLoad) []QueuedDelivery {
+	for i, onLine := range dq.onLine {
+		if load.Line != "" && onLine.Line == load.Line {
+			dq.onLine = append(dq.onLine[:i], dq.onLine[i+1:]...)
+			break
+		}
+	}
+
+	deliveries := []QueuedDelivery{}
+	for _, part := range load.Parts {
+		i := dq.find(part.OrderID)
+		if i < 0 {
+			continue
+		}
+		queued := dq.pending[i]
+		queued.InFlight = max(0, queued.InFlight-part.Quantity)
+		queued.Delivered += part.Quantity
+		queued.Remaining = max(0, queued.Quantity-queued.Delivered-queued.InFlight)
+		if queued.Delivered > queued.Quantity {
+			log.Printf("[deliveryQueue.unloaded] %d pieces of delivery %s unloaded, %d ordered\n",
+				queued.Delivered, queued.ID, queued.Quantity)
+		}
+		deliveries = append(deliveries, *queued)
+	}
+	return deliveries
+}
+
+// loadsOnLine returns the loads written to a delivery line and not
+// acknowledged yet.
+func (dq *deliveryQueue) loadsOnLine() []DeliveryLoad {
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+	return append([]DeliveryLoad{}, dq.onLine...)
+}
+
+// confirmed removes a delivery confirmed to the ERP.
+func (dq *deliveryQueue) confirmed(deliveryID string) {
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+
+	if i := dq.find(deliveryID); i >= 0 {
+		delivery := dq.pending[i].Delivery
+		dq.pending = append(dq.pending[:i], dq.pending[i+1:]...)
+		dq.record(DELIVERY_CONFIRMED, delivery, nil)
+	}
+}
+
+// UsePartialDeliveries enables or disables sending the pieces of a delivery
+// that are in W2 when the whole of it is not.
+func UsePartialDeliveries(enabled bool) {
+	pendingDeliveries.lock.Lock()
+	pendingDeliveries.partial = enabled
+	pendingDeliveries.lock.Unlock()
+
+	w2Stock.wakeUp()
+}
+
+// DeliveryQueue returns the deliveries not confirmed yet, in dispatch order.
+func DeliveryQueue() []QueuedDelivery {
+	pendingDeliveries.lock.Lock()
+	defer pendingDeliveries.lock.Unlock()
+
+	queue := make([]QueuedDelivery, len(pendingDeliveries.pending))
+	for i, queued := range pendingDeliveries.pending {
+		queue[i] = *queued
+	}
+	return queue
+}
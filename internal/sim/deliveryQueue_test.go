@@ -0,0 +1,376 @@
+package sim
+
+import (
+	"mes/internal/utils"
+	"testing"
+)
+
+func TestDeliveryQueueSplitsLargeOrders(t *testing.T) {
+	dq := &deliveryQueue{journal: newTestCompactedJournal(t, "deliveries.jsonl")}
+	stock := newFinishedStock(newTestJournal(t, "stock.jsonl"))
+	stock.pieces["P5"] = 8
+	stock.pieces["P6"] = 2
+
+	queued := dq.add([]Delivery{
+		{ID: "big", Piece: "P5", Quantity: 8},
+		{ID: "small", Piece: "P6", Quantity: 2},
+	})
+	if queued != 2 {
+		t.Fatalf("Expected 2 deliveries queued, got %d", queued)
+	}
+	// Re-listed by the ERP
+	if queued = dq.add([]Delivery{{ID: "big", Piece: "P5", Quantity: 8}}); queued != 0 {
+		t.Fatalf("Expected a re-listed delivery to be ignored, got %d", queued)
+	}
+
+	// A single free line takes the order one load at a time
+	for _, want := range []int{DELIVERY_LINE_CAPACITY, 8 - DELIVERY_LINE_CAPACITY} {
+		_, parts, ok := dq.next(DELIVERY_LINE_CAPACITY, stock)
+		if !ok || len(parts) != 1 || parts[0].OrderID != "big" || parts[0].Quantity != want {
+			t.Fatalf("Expected a load of %d pieces of the big order, got %+v", want, parts)
+		}
+		dq.unloaded(DeliveryLoad{Parts: parts})
+	}
+	if dq.pending[0].Delivered != 8 {
+		t.Fatalf("Expected the big order to be complete, got %+v", dq.pending[0])
+	}
+	dq.confirmed("big")
+
+	_, parts, ok := dq.next(DELIVERY_LINE_CAPACITY, stock)
+	if !ok || parts[0].OrderID != "small" {
+		t.Fatalf("Expected the small order next, got %+v", parts)
+	}
+	if _, _, ok = dq.next(DELIVERY_LINE_CAPACITY, stock); ok {
+		t.Fatal("Expected nothing left to send")
+	}
+}
+
+func TestDeliveryQueueLoad(t *testing.T) {
+	queued := func(id string) deliveryEvent {
+		return deliveryEvent{Event: DELIVERY_QUEUED, Delivery: Delivery{ID: id, Piece: "P5", Quantity: 8}}
+	}
+	unloaded := func(id string, quantity int) deliveryEvent {
+		return deliveryEvent{Event: DELIVERY_UNLOADED,
+			Load: &DeliveryLoad{Parts: []DeliveryLoadPart{{OrderID: id, Quantity: quantity}}}}
+	}
+	dispatched := func(id string, quantity int) deliveryEvent {
+		return deliveryEvent{Event: DELIVERY_DISPATCHED,
+			Load: &DeliveryLoad{Line: "DL1", Parts: []DeliveryLoadPart{{OrderID: id, Quantity: quantity}}}}
+	}
+	confirmed := func(id string) deliveryEvent {
+		return deliveryEvent{Event: DELIVERY_CONFIRMED, Delivery: Delivery{ID: id}}
+	}
+	tests := []struct {
+		name   string
+		events []deliveryEvent
+		torn   bool
+		want   map[string]int // delivery ID -> pieces delivered
+	}{
+		{"no log", nil, false, map[string]int{}},
+		{"queued", []deliveryEvent{queued("a")}, false, map[string]int{"a": 0}},
+		{"unloaded in parts", []deliveryEvent{
+			queued("a"), unloaded("a", 4), unloaded("a", 2),
+		}, false, map[string]int{"a": 6}},
+		{"confirmed", []deliveryEvent{
+			queued("a"), unloaded("a", 8), confirmed("a"),
+		}, false, map[string]int{}},
+		{"interleaved deliveries", []deliveryEvent{
+			queued("a"), queued("b"), unloaded("b", 4), unloaded("a", 1), unloaded("b", 4), confirmed("b"),
+		}, false, map[string]int{"a": 1}},
+		{"queued twice", []deliveryEvent{queued("a"), unloaded("a", 3), queued("a")}, false, map[string]int{"a": 3}},
+		{"unloaded before queued", []deliveryEvent{unloaded("a", 3), queued("a")}, false, map[string]int{"a": 0}},
+		{"torn last line", []deliveryEvent{queued("a"), unloaded("a", 4)}, true, map[string]int{"a": 4}},
+		{"on a line", []deliveryEvent{queued("a"), dispatched("a", 4)}, false, map[string]int{"a": 0}},
+		{"dispatched and unloaded", []deliveryEvent{
+			queued("a"), dispatched("a", 4), {Event: DELIVERY_UNLOADED, Load: dispatched("a", 4).Load},
+		}, false, map[string]int{"a": 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dq := &deliveryQueue{journal: newTestCompactedJournal(t, "deliveries.jsonl")}
+			for _, event := range tt.events {
+				dq.journal.Append(event)
+			}
+			if tt.torn {
+				tearLastLine(t, dq.journal)
+			}
+
+			if err := dq.load(); err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]int{}
+			for _, d := range dq.pending {
+				got[d.ID] = d.Delivered
+				if d.Delivered+d.InFlight+d.Remaining != d.Quantity {
+					t.Fatalf("Expected the pieces of %s to add up, got %+v", d.ID, d)
+				}
+			}
+			if !sameCounts(got, tt.want) {
+				t.Fatalf("Expected %v restored, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestDeliveryQueueKeepsLoadsOnLine(t *testing.T) {
+	journal := newTestCompactedJournal(t, "deliveries.jsonl")
+	dq := &deliveryQueue{journal: journal}
+	stock := newFinishedStock(newTestJournal(t, "stock.jsonl"))
+	stock.pieces["P5"] = 8
+	dq.add([]Delivery{{ID: "big", Piece: "P5", Quantity: 8}})
+
+	_, parts, _ := dq.next(DELIVERY_LINE_CAPACITY, stock)
+	stock.delivered(dq.dispatched(DeliveryLoad{Line: "DL2", Kind: "P5", Quantity: parts[0].Quantity, Parts: parts, TxId: 3}))
+
+	// The MES stops before the line acknowledges the load, reservations are
+	// made again
+	restored := &deliveryQueue{journal: journal}
+	stock.reserved = make(map[string]int)
+	if err := restored.load(); err != nil {
+		t.Fatal(err)
+	}
+	onLine := restored.loadsOnLine()
+	if len(onLine) != 1 || onLine[0].Line != "DL2" || onLine[0].TxId != 3 {
+		t.Fatalf("Expected the load on DL2 restored, got %+v", onLine)
+	}
+	_, parts, _ = restored.next(DELIVERY_LINE_CAPACITY, stock)
+	if len(parts) != 1 || parts[0].Quantity != 8-DELIVERY_LINE_CAPACITY {
+		t.Fatalf("Expected only the pieces not on a line sent, got %+v", parts)
+	}
+
+	deliveries := restored.unloaded(onLine[0])
+	if len(deliveries) != 1 || deliveries[0].ID != "big" || len(restored.loadsOnLine()) != 0 {
+		t.Fatalf("Expected the load to leave the line, got %+v", restored.loadsOnLine())
+	}
+	if queued := restored.pending[0]; queued.Delivered != DELIVERY_LINE_CAPACITY || queued.Remaining != 0 {
+		t.Fatalf("Unexpected delivery %+v", queued)
+	}
+}
+
+func TestDeliveryQueueCountsUnloadedPieces(t *testing.T) {
+	load := func(quantities ...int) DeliveryLoad {
+		load := DeliveryLoad{Kind: "P5"}
+		for i, quantity := range quantities {
+			load.Parts = append(load.Parts, DeliveryLoadPart{OrderID: []string{"a", "b"}[i], Quantity: quantity})
+		}
+		return load
+	}
+	tests := []struct {
+		name  string
+		loads []DeliveryLoad
+		want  map[string]int // delivery ID -> pieces delivered after the last load
+	}{
+		{"one load", []DeliveryLoad{load(4)}, map[string]int{"a": 4}},
+		{"loads add up", []DeliveryLoad{load(2), load(2)}, map[string]int{"a": 4}},
+		{"shared load", []DeliveryLoad{load(3, 1), load(1, 1)}, map[string]int{"a": 4, "b": 2}},
+		{"more than ordered", []DeliveryLoad{load(4), load(1)}, map[string]int{"a": 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dq := &deliveryQueue{journal: newTestCompactedJournal(t, "deliveries.jsonl")}
+			dq.add([]Delivery{{ID: "a", Piece: "P5", Quantity: 4}, {ID: "b", Piece: "P5", Quantity: 2}})
+
+			var deliveries []QueuedDelivery
+			for _, load := range tt.loads {
+				deliveries = dq.unloaded(load)
+			}
+			got := map[string]int{}
+			for _, delivery := range deliveries {
+				got[delivery.ID] = delivery.Delivered
+			}
+			if !sameCounts(got, tt.want) {
+				t.Fatalf("Expected %v delivered, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestDeliveryQueueStockCheck(t *testing.T) {
+	dq := &deliveryQueue{journal: newTestCompactedJournal(t, "deliveries.jsonl")}
+	stock := newFinishedStock(newTestCompactedJournal(t, "stock.jsonl"))
+	stock.stored("P5", "")
+	stock.stored("P5", "")
+	stock.stored("P7", "")
+
+	dq.add([]Delivery{
+		{ID: "short", Piece: "P5", Quantity: 3},
+		{ID: "full", Piece: "P7", Quantity: 1},
+	})
+
+	// The short delivery waits without blocking the one in stock
+	_, parts, ok := sendNext(dq, stock)
+	if !ok || parts[0].OrderID != "full" {
+		t.Fatalf("Expected the delivery in stock to be sent, got %+v", parts)
+	}
+
+	// Partial deliveries send what is in stock
+	dq.partial = true
+	_, parts, ok = sendNext(dq, stock)
+	if !ok || parts[0].OrderID != "short" || parts[0].Quantity != 2 {
+		t.Fatalf("Expected 2 pieces of the short delivery, got %+v", parts)
+	}
+	if _, _, ok = sendNext(dq, stock); ok {
+		t.Fatal("Expected nothing left in stock")
+	}
+
+	stock.stored("P5", "")
+	if _, parts, ok = sendNext(dq, stock); !ok || parts[0].Quantity != 1 {
+		t.Fatalf("Expected the last piece of the short delivery, got %+v", parts)
+	}
+	if stock.pieces["P5"] != 0 || stock.pieces["P7"] != 0 {
+		t.Fatalf("Expected the stock to be empty, got %v", stock.pieces)
+	}
+}
+
+func TestDeliveryQueueReportsShortfalls(t *testing.T) {
+	dq := &deliveryQueue{journal: newTestCompactedJournal(t, "deliveries.jsonl")}
+	stock := newFinishedStock(newTestCompactedJournal(t, "stock.jsonl"))
+	dq.add([]Delivery{{ID: "short", Piece: "P5", Quantity: DELIVERY_LINE_CAPACITY + 2}})
+	dq.next(DELIVERY_LINE_CAPACITY, stock)
+
+	shortfalls := dq.newShortfalls()
+	if len(shortfalls) != 1 || shortfalls[0].ID != "short" || shortfalls[0].Shortfall != DELIVERY_LINE_CAPACITY+2 {
+		t.Fatalf("Expected the whole delivery short, got %+v", shortfalls)
+	}
+	dq.next(DELIVERY_LINE_CAPACITY, stock)
+	if len(dq.newShortfalls()) != 0 {
+		t.Fatal("Expected the shortfall to be reported once")
+	}
+
+	// Covered: the first load goes out and the rest is held
+	stock.pieces["P5"] = DELIVERY_LINE_CAPACITY + 2
+	sendNext(dq, stock)
+	if len(dq.newShortfalls()) != 0 {
+		t.Fatal("Expected no shortfall once the pieces are in stock")
+	}
+
+	// A count finds the pieces held missing
+	dq.pending[0].Reserved = 0
+	stock.reserved["P5"] = 0
+	stock.pieces["P5"] = 1
+	dq.next(DELIVERY_LINE_CAPACITY, stock)
+	if shortfalls = dq.newShortfalls(); len(shortfalls) != 1 || shortfalls[0].Shortfall != 1 {
+		t.Fatalf("Expected the new shortfall reported, got %+v", shortfalls)
+	}
+}
+
+func TestDeliveryQueueHoldsStockForHeadOfLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		partial bool
+		// Orders sent as one piece at a time is stored
+		want []string
+	}{
+		{"whole deliveries", false, []string{"", "", "big", "small", ""}},
+		{"partial deliveries", true, []string{"big", "big", "big", "small", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dq := &deliveryQueue{journal: newTestCompactedJournal(t, "deliveries.jsonl"), partial: tt.partial}
+			stock := newFinishedStock(newTestCompactedJournal(t, "stock.jsonl"))
+			dq.add([]Delivery{
+				{ID: "big", Piece: "P5", Quantity: 3},
+				{ID: "small", Piece: "P5", Quantity: 1},
+			})
+
+			for i, want := range tt.want {
+				if i < 4 {
+					stock.stored("P5", "")
+				}
+				_, parts, _ := sendNext(dq, stock)
+				got := ""
+				if len(parts) > 0 {
+					got = parts[0].OrderID
+				}
+				if got != want {
+					t.Fatalf("Expected %q sent after %d pieces, got %+v", want, i+1, parts)
+				}
+			}
+		})
+	}
+}
+
+// sendNext plans the next load and dispatches it, as the delivery handler
+// does once the load is written to a line.
+func sendNext(dq *deliveryQueue, stock *finishedStock) (string, []DeliveryLoadPart, bool) {
+	kind, parts, ok := dq.next(DELIVERY_LINE_CAPACITY, stock)
+	if ok {
+		load := DeliveryLoad{Kind: kind, Parts: parts}
+		for _, part := range parts {
+			load.Quantity += part.Quantity
+		}
+		stock.delivered(dq.dispatched(load))
+	}
+	return kind, parts, ok
+}
+
+func TestDeliveryQueueConsolidatesOrders(t *testing.T) {
+	dq := &deliveryQueue{journal: newTestJournal(t, "deliveries.jsonl")}
+	stock := newFinishedStock(newTestJournal(t, "stock.jsonl"))
+	stock.pieces["P5"] = 10
+	stock.pieces["P6"] = 2
+
+	dq.add([]Delivery{
+		{ID: "late", Piece: "P5", Quantity: 4},
+		{ID: "other", Piece: "P6", Quantity: 2},
+		{ID: "soon", Piece: "P5", Quantity: 2, DueDate: 4},
+		{ID: "urgent", Piece: "P5", Quantity: 2, Priority: PRIORITY_URGENT},
+	})
+	dq.prioritise(func(d Delivery) int { return d.Priority })
+
+	// Orders of the same kind share a load, most pressing first
+	kind, parts, ok := dq.next(DELIVERY_LINE_CAPACITY, stock)
+	if !ok || kind != "P5" || len(parts) != 3 {
+		t.Fatalf("Expected a load of 3 orders of P5, got %s %+v", kind, parts)
+	}
+	if parts[0].OrderID != "urgent" || parts[1].OrderID != "soon" ||
+		parts[2].OrderID != "late" || parts[2].Quantity != 2 {
+		t.Fatalf("Unexpected load %+v", parts)
+	}
+
+	kind, parts, _ = dq.next(DELIVERY_LINE_CAPACITY, stock)
+	if kind != "P5" || len(parts) != 1 || parts[0].OrderID != "late" || parts[0].Quantity != 2 {
+		t.Fatalf("Expected the rest of the late order, got %s %+v", kind, parts)
+	}
+	if kind, _, _ = dq.next(DELIVERY_LINE_CAPACITY, stock); kind != "P6" {
+		t.Fatalf("Expected the P6 order last, got %s", kind)
+	}
+}
+
+func TestDeliveryQueueCompaction(t *testing.T) {
+	journal := newTestCompactedJournal(t, "deliveries.jsonl")
+	dq := &deliveryQueue{journal: journal}
+	dq.add([]Delivery{
+		{ID: "done", Piece: "P5", Quantity: 2},
+		{ID: "started", Piece: "P6", Quantity: 4},
+		{ID: "new", Piece: "P7", Quantity: 1},
+	})
+	dq.unloaded(DeliveryLoad{Parts: []DeliveryLoadPart{{OrderID: "done", Quantity: 2}}})
+	dq.unloaded(DeliveryLoad{Parts: []DeliveryLoadPart{{OrderID: "started", Quantity: 3}}})
+
+	compactAtNextAppend(journal)
+	dq.confirmed("done")
+
+	events, err := utils.ReadJSONLog[deliveryEvent](journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Queued and unloaded for the started delivery, queued for the new one
+	if len(events) != 3 {
+		t.Fatalf("Expected the log compacted to the 2 pending deliveries, got %+v", events)
+	}
+
+	restored := &deliveryQueue{journal: journal}
+	if err := restored.load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.pending) != 2 {
+		t.Fatalf("Expected 2 deliveries restored, got %d", len(restored.pending))
+	}
+	if started := restored.pending[0]; started.ID != "started" || started.Delivered != 3 || started.Remaining != 1 {
+		t.Fatalf("Expected 1 piece of the started delivery left, got %+v", started)
+	}
+	if restored.pending[1].ID != "new" || restored.pending[1].Remaining != 1 {
+		t.Fatalf("Expected the new delivery restored, got %+v", restored.pending[1])
+	}
+}
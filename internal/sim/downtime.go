@@ -0,0 +1,419 @@
+package sim
+
+import (
+	"fmt"
+	"log"
+	"mes/internal/utils"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Downtime sources
+const (
+	DOWNTIME_MANUAL   = "manual"
+	DOWNTIME_CALENDAR = "calendar"
+	DOWNTIME_FAULT    = "fault"
+)
+
+// DowntimeWindow takes a line (or one of its machines, if MachineID is set)
+// out of service from the start of FromDay until the start of ToDay.
+type DowntimeWindow struct {
+	LineID    string `json:"line_id"`
+	MachineID string `json:"machine_id"`
+	FromDay   uint   `json:"from_day"`
+	ToDay     uint   `json:"to_day"`
+	Reason    string `json:"reason"`
+}
+
+func (dw *DowntimeWindow) activeOn(day uint) bool {
+	return dw.FromDay <= day && day < dw.ToDay
+}
+
+// DowntimeEvent records a line or machine going down or coming back up.
+type DowntimeEvent struct {
+	Time      time.Time `json:"time"`
+	LineID    string    `json:"line_id"`
+	MachineID string    `json:"machine_id"`
+	Down      bool      `json:"down"`
+	Source    string    `json:"source"`
+	Reason    string    `json:"reason"`
+}
+
+// Availability is the availability KPI of a line or machine.
+type Availability struct {
+	LineID       string        `json:"line_id"`
+	MachineID    string        `json:"machine_id"`
+	Down         bool          `json:"down"`
+	Source       string        `json:"source"`
+	Reason       string        `json:"reason"`
+	Tracked      time.Duration `json:"tracked_ns"`
+	Downtime     time.Duration `json:"downtime_ns"`
+	Availability float64       `json:"availability"`
+}
+
+type availabilityRecord struct {
+	down      bool
+	source    string
+	reason    string
+	since     time.Time
+	trackedAt time.Time
+	downtime  time.Duration
+}
+
+// downtimeRegistry combines the manual, calendar and PLC fault downtime
+// sources into the availability of every line and machine.
+// Targets are identified by the line ID, or by "<line ID>/<machine name>".
+type downtimeRegistry struct {
+	manual  map[string]string // target -> reason
+	faults  map[string]bool   // target -> faulted
+	windows []DowntimeWindow
+	records map[string]*availabilityRecord
+	journal *utils.JSONLog
+}
+
+func newDowntimeRegistry() *downtimeRegistry {
+	return &downtimeRegistry{
+		manual:  make(map[string]string),
+		faults:  make(map[string]bool),
+		windows: []DowntimeWindow{},
+		records: make(map[string]*availabilityRecord),
+		journal: utils.NewJSONLog(DOWNTIME_LOG_PATH),
+	}
+}
+
+func downtimeTarget(lineID string, machineID string) string {
+	if machineID == "" {
+		return lineID
+	}
+	return lineID + "/" + machineID
+}
+
+// status returns whether the target is down, and if so why.
+func (dr *downtimeRegistry) status(target string, day uint) (bool, string, string) {
+	if reason, ok := dr.manual[target]; ok {
+		return true, DOWNTIME_MANUAL, reason
+	}
+	if dr.faults[target] {
+		return true, DOWNTIME_FAULT, "PLC reported a fault"
+	}
+	for _, w := range dr.windows {
+		if downtimeTarget(w.LineID, w.MachineID) == target && w.activeOn(day) {
+			return true, DOWNTIME_CALENDAR, w.Reason
+		}
+	}
+	return false, "", ""
+}
+
+// update sets the availability of the target and reports whether it changed.
+func (dr *downtimeRegistry) update(
+	lineID string,
+	machineID string,
+	day uint,
+	now time.Time,
+) (down bool, changed bool) {
+	target := downtimeTarget(lineID, machineID)
+	down, source, reason := dr.status(target, day)
+
+	record, ok := dr.records[target]
+	if !ok {
+		record = &availabilityRecord{trackedAt: now, since: now}
+		dr.records[target] = record
+	}
+	if record.down == down {
+		return down, false
+	}
+
+	if record.down {
+		record.downtime += now.Sub(record.since)
+	}
+	record.down = down
+	record.source = source
+	record.reason = reason
+	record.since = now
+
+	event := DowntimeEvent{
+		Time:      now,
+		LineID:    lineID,
+		MachineID: machineID,
+		Down:      down,
+		Source:    source,
+		Reason:    reason,
+	}
+	log.Printf("[downtimeRegistry.update] %s down: %t (%s: %s)\n", target, down, source, reason)
+	dr.journal.Append(event)
+	return down, true
+}
+
+// prune forgets the faults, manual downtime and availability of the
+// machines of the line that are not in machines.
+func (dr *downtimeRegistry) prune(lineID string, machines map[string]struct{}) {
+	removed := func(target string) bool {
+		machineID, ok := strings.CutPrefix(target, lineID+"/")
+		if !ok {
+			return false
+		}
+		_, kept := machines[machineID]
+		return !kept
+	}
+
+	for target := range dr.faults {
+		if removed(target) {
+			delete(dr.faults, target)
+		}
+	}
+	for target := range dr.manual {
+		if removed(target) {
+			log.Printf("[downtimeRegistry.prune] %s removed, its downtime is cleared\n", target)
+			delete(dr.manual, target)
+		}
+	}
+	for target := range dr.records {
+		if removed(target) {
+			delete(dr.records, target)
+		}
+	}
+}
+
+// refreshAvailability recomputes whether the line and its machines are down.
+// Pieces waiting on the line that can no longer be processed by it are
+// handed to other lines; pieces already on its conveyor are left to finish.
+func (f *factory) refreshAvailability(line *ProcessingLine) {
+	day, _ := simCalendar.today()
+	now := time.Now()
+
+	changed := false
+	down, lineChanged := f.downtime.update(line.id, "", day, now)
+	line.down = down
+	changed = changed || lineChanged
+
+	for _, conveyor := range line.conveyorLine {
+		if conveyor.machine == nil {
+			continue
+		}
+		down, machineChanged := f.downtime.update(line.id, conveyor.machine.name, day, now)
+		conveyor.machine.down = down
+		changed = changed || machineChanged
+	}
+
+	if changed {
+		f.redistributeWaiters(line)
+		f.adoptOrphanWaiters()
+	}
+}
+
+// anyDown reports whether any line or machine of the factory is down.
+func (f *factory) anyDown() bool {
+	for _, record := range f.downtime.records {
+		if record.down {
+			return true
+		}
+	}
+	return false
+}
+
+// adoptOrphanWaiters registers the pieces left without any available line
+// with the lines that can now process them.
+func (f *factory) adoptOrphanWaiters() {
+	orphans := f.orphanWaiters
+	f.orphanWaiters = nil
+
+	for _, w := range orphans {
+		if w.piece.Location == utils.ID_W2 {
+			f.processLines[utils.ID_L0].registerWaitingPiece(w)
+			continue
+		}
+
+		w.piece.route = planRoute(f, w.piece)
+		lineIDs := f.scheduler.Assign(f, w.piece, nil)
+		if len(lineIDs) == 0 {
+			f.orphanWaiters = append(f.orphanWaiters, w)
+			continue
+		}
+		for _, lineID := range lineIDs {
+			f.processLines[lineID].registerWaitingPiece(w)
+		}
+		log.Printf("[factory.adoptOrphanWaiters] Piece %s registered with lines %v\n",
+			w.piece.ErpIdentifier, lineIDs)
+	}
+}
+
+// setFault records whether the machine at the given conveyor position
+// of the line is faulted.
+func (f *factory) setFault(line *ProcessingLine, mIndex int, faulted bool) {
+	m := line.conveyorLine[mIndex].machine
+	utils.Assert(m != nil, "[factory.setFault] machine is null")
+	f.downtime.faults[downtimeTarget(line.id, m.name)] = faulted
+}
+
+// isAvailableFor reports whether the line is up and can offer a control
+// form to the piece with its machines that are up.
+func (pl *ProcessingLine) isAvailableFor(piece *Piece) bool {
+	if pl.down {
+		return false
+	}
+	return pl.id == utils.ID_L0 || pl.createBestForm(piece) != nil
+}
+
+// redistributeWaiters unregisters from the line the pieces it can no longer
+// process and registers them again with other lines if none of the lines
+// they wait on can process them. Pieces in W2 can only leave it through L0,
+// and wait on it until it is back up.
+func (f *factory) redistributeWaiters(line *ProcessingLine) {
+	line.pruneDeadWaiters()
+
+	kept := make([]*freeLineWaiter, 0, len(line.waitingPieces))
+	for _, w := range line.waitingPieces {
+		if line.isAvailableFor(w.piece) || w.piece.Location == utils.ID_W2 {
+			kept = append(kept, w)
+			continue
+		}
+		w.removeLine(line)
+
+		stillServed := false
+		for _, other := range w.lines {
+			if other.isAvailableFor(w.piece) {
+				stillServed = true
+				break
+			}
+		}
+		if stillServed {
+			continue
+		}
+
+		w.piece.route = planRoute(f, w.piece)
+		lineIDs := f.scheduler.Assign(f, w.piece, nil)
+		for _, lineID := range lineIDs {
+			if !w.isRegisteredWith(f.processLines[lineID]) {
+				f.processLines[lineID].registerWaitingPiece(w)
+			}
+		}
+		if len(lineIDs) == 0 {
+			log.Printf("[factory.redistributeWaiters] WARNING: no line available for piece %s\n",
+				w.piece.ErpIdentifier)
+			f.orphanWaiters = append(f.orphanWaiters, w)
+			continue
+		}
+		log.Printf("[factory.redistributeWaiters] Piece %s moved from line %s to lines %v\n",
+			w.piece.ErpIdentifier, line.id, lineIDs)
+	}
+	line.waitingPieces = kept
+}
+
+// SetManualDowntime marks a line, or one of its machines if machineID is
+// not empty, as down (or back up) at the request of an operator.
+func SetManualDowntime(lineID string, machineID string, down bool, reason string) error {
+	factory, mutex := getFactoryInstance()
+	defer mutex.Unlock()
+
+	line, err := factory.findTarget(lineID, machineID)
+	if err != nil {
+		return err
+	}
+
+	target := downtimeTarget(lineID, machineID)
+	if down {
+		factory.downtime.manual[target] = reason
+	} else {
+		delete(factory.downtime.manual, target)
+	}
+	factory.refreshAvailability(line)
+	return nil
+}
+
+// AddDowntimeWindow schedules a maintenance window on the calendar.
+func AddDowntimeWindow(window DowntimeWindow) error {
+	if window.ToDay <= window.FromDay {
+		return fmt.Errorf("[AddDowntimeWindow] window must end after it starts")
+	}
+
+	factory, mutex := getFactoryInstance()
+	defer mutex.Unlock()
+
+	line, err := factory.findTarget(window.LineID, window.MachineID)
+	if err != nil {
+		return err
+	}
+
+	factory.downtime.windows = append(factory.downtime.windows, window)
+	factory.refreshAvailability(line)
+	return nil
+}
+
+// DowntimeWindows returns the scheduled maintenance windows.
+func DowntimeWindows() []DowntimeWindow {
+	factory, mutex := getFactoryInstance()
+	defer mutex.Unlock()
+
+	windows := make([]DowntimeWindow, len(factory.downtime.windows))
+	copy(windows, factory.downtime.windows)
+	return windows
+}
+
+func (f *factory) findTarget(lineID string, machineID string) (*ProcessingLine, error) {
+	line, ok := f.processLines[lineID]
+	if !ok {
+		return nil, fmt.Errorf("[findTarget] unknown line %q", lineID)
+	}
+	if machineID == "" {
+		return line, nil
+	}
+	for _, conveyor := range line.conveyorLine {
+		if conveyor.machine != nil && conveyor.machine.name == machineID {
+			return line, nil
+		}
+	}
+	return nil, fmt.Errorf("[findTarget] line %s has no machine %q", lineID, machineID)
+}
+
+// Availabilities returns the availability KPI of every line and machine
+// tracked so far.
+func Availabilities() []Availability {
+	factory, mutex := getFactoryInstance()
+	defer mutex.Unlock()
+
+	now := time.Now()
+	report := make([]Availability, 0, len(factory.downtime.records))
+	for _, line := range factory.processLines {
+		targets := [][2]string{{line.id, ""}}
+		for _, conveyor := range line.conveyorLine {
+			if conveyor.machine != nil {
+				targets = append(targets, [2]string{line.id, conveyor.machine.name})
+			}
+		}
+
+		for _, t := range targets {
+			record, ok := factory.downtime.records[downtimeTarget(t[0], t[1])]
+			if !ok {
+				continue
+			}
+
+			downtime := record.downtime
+			if record.down {
+				downtime += now.Sub(record.since)
+			}
+			tracked := now.Sub(record.trackedAt)
+			availability := 1.0
+			if tracked > 0 {
+				availability = 1 - float64(downtime)/float64(tracked)
+			}
+
+			report = append(report, Availability{
+				LineID:       t[0],
+				MachineID:    t[1],
+				Down:         record.down,
+				Source:       record.source,
+				Reason:       record.reason,
+				Tracked:      tracked,
+				Downtime:     downtime,
+				Availability: availability,
+			})
+		}
+	}
+
+	sort.Slice(report, func(i, j int) bool {
+		a, b := report[i], report[j]
+		return downtimeTarget(a.LineID, a.MachineID) < downtimeTarget(b.LineID, b.MachineID)
+	})
+	return report
+}
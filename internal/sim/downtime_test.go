@@ -0,0 +1,111 @@
+package sim
+
+import (
+	u "mes/internal/utils"
+	"sync"
+	"testing"
+)
+
+func TestMachineDowntimeRedistributesWaiters(t *testing.T) {
+	f := newTestFactory()
+	f.downtime = newDowntimeRegistry()
+	f.downtime.journal = newTestJournal(t, "downtime.jsonl")
+
+	scheduler, err := newScheduler(SCHEDULER_LENIENT, DefaultSchedulerOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.scheduler = scheduler
+
+	// Only the bottom machine (M4) of type 2 lines has T6
+	waiter := &freeLineWaiter{
+		piece:          &Piece{Steps: []Transformation{{Tool: u.TOOL_6, Time: 30}}},
+		pieceClaimedCh: make(chan struct{}),
+		claimCountLock: &sync.Mutex{},
+	}
+	l4 := f.processLines[u.ID_L4]
+	l4.registerWaitingPiece(waiter)
+
+	f.downtime.manual[downtimeTarget(u.ID_L4, "M4")] = "maintenance"
+	f.refreshAvailability(l4)
+
+	if len(l4.waitingPieces) != 0 {
+		t.Fatalf("Expected the waiter to leave line %s", u.ID_L4)
+	}
+	if waiter.isRegisteredWith(l4) {
+		t.Fatalf("Expected the waiter not to be registered with line %s", u.ID_L4)
+	}
+	for _, line := range waiter.lines {
+		if line.id != u.ID_L5 && line.id != u.ID_L6 {
+			t.Fatalf("Expected the waiter to move to the other type 2 lines, got %s", line.id)
+		}
+	}
+	if len(waiter.lines) != 2 {
+		t.Fatalf("Expected the waiter to be registered with 2 lines, got %d", len(waiter.lines))
+	}
+
+	availability := f.downtime.records[downtimeTarget(u.ID_L4, "M4")]
+	if availability == nil || !availability.down {
+		t.Fatalf("Expected machine M4 of line %s to be recorded as down", u.ID_L4)
+	}
+}
+
+func TestL0DowntimeKeepsW2Waiters(t *testing.T) {
+	f := newTestFactory()
+	f.downtime = newDowntimeRegistry()
+	f.downtime.journal = newTestJournal(t, "downtime.jsonl")
+	scheduler, err := newScheduler(SCHEDULER_LENIENT, DefaultSchedulerOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.scheduler = scheduler
+	l0 := &ProcessingLine{id: u.ID_L0, waitingPieces: []*freeLineWaiter{}, readyForNext: true}
+	f.processLines[u.ID_L0] = l0
+
+	// A piece halfway through its recipe, waiting in W2 to be taken back to W1
+	claimCh := make(chan string, 1)
+	waiter := &freeLineWaiter{
+		piece: &Piece{
+			Location:    u.ID_W2,
+			CurrentStep: 1,
+			Steps:       []Transformation{{Tool: u.TOOL_1}, {Tool: u.TOOL_2}},
+		},
+		pieceClaimedCh: make(chan struct{}),
+		claimPieceCh:   claimCh,
+		claimLock:      &sync.Mutex{},
+		claimCountLock: &sync.Mutex{},
+	}
+	l0.registerWaitingPiece(waiter)
+
+	f.downtime.manual[downtimeTarget(u.ID_L0, "")] = "maintenance"
+	f.refreshAvailability(l0)
+
+	if len(waiter.lines) != 1 || !waiter.isRegisteredWith(l0) || len(l0.waitingPieces) != 1 {
+		t.Fatalf("Expected the piece to keep waiting on L0 only, got lines %d", len(waiter.lines))
+	}
+	if len(f.orphanWaiters) != 0 {
+		t.Fatalf("Expected no orphan waiter, got %d", len(f.orphanWaiters))
+	}
+	l0.claimWaitingPiece(f.scheduler)
+	if len(claimCh) != 0 {
+		t.Fatal("Expected L0 not to claim the piece while down")
+	}
+
+	delete(f.downtime.manual, downtimeTarget(u.ID_L0, ""))
+	f.refreshAvailability(l0)
+	l0.claimWaitingPiece(f.scheduler)
+	if line := <-claimCh; line != u.ID_L0 {
+		t.Fatalf("Expected L0 to claim the piece once back up, got %s", line)
+	}
+}
+
+func TestDowntimeWindowActive(t *testing.T) {
+	dr := newDowntimeRegistry()
+	dr.windows = append(dr.windows, DowntimeWindow{LineID: u.ID_L1, FromDay: 3, ToDay: 5})
+
+	for day, expected := range map[uint]bool{2: false, 3: true, 4: true, 5: false} {
+		if down, _, _ := dr.status(u.ID_L1, day); down != expected {
+			t.Fatalf("Expected line down on day %d to be %t", day, expected)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package sim
+
+import (
+	"math"
+	"sort"
+)
+
+// remainingWork returns the processing time (in seconds) still needed to
+// complete the piece's recipe, ignoring tool swaps and queues.
+func (p *Piece) remainingWork() int {
+	return p.remainingWorkAfter(p.CurrentStep)
+}
+
+// remainingWorkAfter returns the processing time (in seconds) of the steps
+// of the piece's recipe from the given step on.
+func (p *Piece) remainingWorkAfter(step int) int {
+	work := 0
+	for _, s := range p.Steps[min(step, len(p.Steps)):] {
+		work += s.Time
+	}
+	return work
+}
+
+// criticalRatio returns the ratio between the time left until the piece's
+// due date and the processing time it still needs. Ratios below 1 mean the
+// piece is expected to be late even if it is processed right away.
+func (p *Piece) criticalRatio() float64 {
+	if p.DueDate == 0 {
+		return math.Inf(1)
+	}
+
+	today, dayLength := simCalendar.today()
+	timeLeft := (float64(p.DueDate) - float64(today)) * dayLength.Seconds()
+	work := float64(p.remainingWork())
+	if work == 0 {
+		return math.Inf(1)
+	}
+	return timeLeft / work
+}
+
+// dueBefore reports whether piece a is due before piece b.
+// Pieces without a due date are never due before pieces with one.
+func dueBefore(a, b *Piece) bool {
+	return dueDayBefore(a.DueDate, b.DueDate)
+}
+
+// dueDayBefore reports whether due day a comes before due day b, 0 being
+// no due date.
+func dueDayBefore(a, b uint) bool {
+	if a == 0 {
+		return false
+	}
+	return b == 0 || a < b
+}
+
+// criticalRatioBefore reports whether piece a is more critical than piece b.
+func criticalRatioBefore(a, b *Piece) bool {
+	return a.criticalRatio() < b.criticalRatio()
+}
+
+// dueDateScheduler assigns pieces to lines like the lenient scheduler
+// but lets free lines claim the most urgent waiting piece first.
+type dueDateScheduler struct {
+	lenientScheduler
+	before func(a, b *Piece) bool
+}
+
+func (s *dueDateScheduler) Rank(
+	_ *ProcessingLine,
+	waiters []*freeLineWaiter,
+) []*freeLineWaiter {
+	ranked := make([]*freeLineWaiter, len(waiters))
+	copy(ranked, waiters)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return s.before(ranked[i].piece, ranked[j].piece)
+	})
+	return ranked
+}
+
+// PieceLateness is the projected lateness of a piece waiting for a line.
+type PieceLateness struct {
+	PieceID      string `json:"piece_id"`
+	OrderID      string `json:"order_id"`
+	DueDate      uint   `json:"due_date"`
+	ProjectedDay uint   `json:"projected_day"`
+	DaysLate     int    `json:"days_late"`
+}
+
+// ProjectedLateness estimates, for every piece waiting for a line, the day
+// its recipe will be completed and how late that is in regards to its due
+// date. Each piece is assumed to be processed by the line where the least
+// work is queued ahead of it (in the order given by the current scheduler).
+func ProjectedLateness() []PieceLateness {
+	factory, mutex := getFactoryInstance()
+	defer mutex.Unlock()
+
+	today, dayLength := simCalendar.today()
+
+	finishTimes := make(map[*Piece]int) // piece -> seconds until completion
+	for _, line := range factory.processLines {
+		queuedWork := 0
+		for _, w := range factory.scheduler.Rank(line, line.waitingPieces) {
+			select {
+			case <-w.pieceClaimedCh:
+				continue
+			default:
+			}
+
+			queuedWork += w.piece.remainingWork()
+			if finish, ok := finishTimes[w.piece]; !ok || queuedWork < finish {
+				finishTimes[w.piece] = queuedWork
+			}
+		}
+	}
+
+	report := make([]PieceLateness, 0, len(finishTimes))
+	for piece, finish := range finishTimes {
+		days := uint(math.Ceil(float64(finish) / dayLength.Seconds()))
+		lateness := PieceLateness{
+			PieceID:      piece.ErpIdentifier,
+			OrderID:      piece.OrderID,
+			DueDate:      piece.DueDate,
+			ProjectedDay: today + days,
+		}
+		if piece.DueDate != 0 {
+			lateness.DaysLate = int(lateness.ProjectedDay) - int(piece.DueDate)
+		}
+		report = append(report, lateness)
+	}
+
+	sort.Slice(report, func(i, j int) bool {
+		return report[i].DaysLate > report[j].DaysLate
+	})
+	return report
+}
@@ -13,6 +13,14 @@ import (
 // TODO: add delivery lines
 type factory struct {
 	processLines    map[string]*ProcessingLine
+	scheduler       Scheduler
+	schedulerName   string
+	downtime        *downtimeRegistry
+	orphanWaiters   []*freeLineWaiter // pieces with no available line
+	overrides       *overrideRegistry
+	toolPreSetup    bool // set up idle machines for the upcoming work
+	dayPlanner      bool // plan each day at the day tick
+	dayPlan         *dayPlan
 	stateUpdateFunc func(context.Context, *factory) error
 	plcClient       *plc.Client
 	supplyLines     []*plc.SupplyLine
@@ -45,8 +53,9 @@ func factoryStateUpdate(ctx context.Context, f *factory) error {
 		func() {
 			readCtx, cancel := context.WithTimeout(ctx, time.Minute)
 			defer cancel()
-			_, err := f.plcClient.Read(warehouse.OpcuaVars(), readCtx)
+			readResponse, err := f.plcClient.Read(warehouse.OpcuaVars(), readCtx)
 			utils.Assert(err == nil, "[factoryStateUpdate] Error reading warehouse")
+			warehouse.UpdateState(readResponse)
 		}()
 	}
 
@@ -85,7 +94,30 @@ func factoryStateUpdate(ctx context.Context, f *factory) error {
 			line.plc.UpdateState(readResponse)
 		}()
 
-		line.UpdateConveyor()
+		if line.id != utils.ID_L0 {
+			func() {
+				readCtx, cancel := context.WithTimeout(ctx, time.Minute)
+				defer cancel()
+				readResponse, err := f.plcClient.Read(line.plc.FaultOpcuaVars(), readCtx)
+				utils.Assert(err == nil, "[factoryStateUpdate] Error reading line faults")
+				line.plc.UpdateFaults(readResponse)
+			}()
+
+			positions := line.machinePositions()
+			for i, faulted := range line.plc.Faults() {
+				// The cell may report faults for machines the line does not have
+				if i < len(positions) {
+					f.setFault(line, positions[i], faulted)
+				}
+			}
+		}
+		f.refreshAvailability(line)
+		f.refreshExitRoom(line)
+
+		line.UpdateConveyor(f.scheduler)
+		if f.toolPreSetup {
+			f.preSetupTools(ctx, line)
+		}
 	}
 
 	return nil
@@ -93,8 +125,9 @@ func factoryStateUpdate(ctx context.Context, f *factory) error {
 
 func mockFactoryStateUpdate(f *factory, _ context.Context) error {
 	for _, line := range f.processLines {
+		f.refreshExitRoom(line)
 		if line.readyForNext {
-			line.claimWaitingPiece()
+			line.claimWaitingPiece(f.scheduler)
 		}
 		line.ProgressNewPiece()
 		line.progressConveyor()
@@ -137,8 +170,16 @@ func InitFactory(
 		}
 	}
 
+	scheduler, err := newScheduler(SCHEDULER_DEFAULT, DefaultSchedulerOptions())
+	utils.Assert(err == nil, "[InitFactory] Default scheduler not found")
+
 	return &factory{
 		processLines:    processLines,
+		scheduler:       scheduler,
+		schedulerName:   SCHEDULER_DEFAULT,
+		downtime:        newDowntimeRegistry(),
+		overrides:       newOverrideRegistry(),
+		toolPreSetup:    true,
 		stateUpdateFunc: factoryStateUpdate,
 		plcClient:       plc.NewClient(plc.OPCUA_ENDPOINT),
 		supplyLines:     plc.InitSupplyLines(),
@@ -151,40 +192,44 @@ func registerWaitingPiece(waiter *freeLineWaiter, piece *Piece) {
 	factory, mutex := getFactoryInstance()
 	defer mutex.Unlock()
 
+	waiter.priority = factory.piecePriority(piece)
+	waiter.decision = newDispatchDecision(piece, factory.schedulerName)
+	defer dispatchDecisions.publish(waiter.decision)
+
+	if _, held := factory.overrides.holds[piece.ErpIdentifier]; held {
+		waiter.held = true
+		waiter.decision.Override = "held in the warehouse"
+	}
+
 	if piece.Location == utils.ID_W2 {
 		line := factory.processLines[utils.ID_L0]
 		line.registerWaitingPiece(waiter)
+		waiter.decision.PlannedLines = []string{utils.ID_L0}
 		return
 	}
 
-	nRegistered := 0
-	lineOffers := make(map[string]int)
-	for _, line := range factory.processLines {
-		if line.id == utils.ID_L0 {
-			continue
-		}
-
-		if form := line.createBestForm(piece); form != nil {
-			score := form.metadataScore()
-			lineOffers[line.id] = score
-		}
+	piece.route = planRoute(factory, piece)
+	for _, leg := range piece.route {
+		log.Printf("[registerWaitingPiece] Piece %s route: steps %d-%d on lines %v\n",
+			piece.ErpIdentifier, leg.firstStep, leg.firstStep+leg.nSteps-1, leg.lines)
 	}
 
-	bestScore := 9999999
-	for _, score := range lineOffers {
-		if score < bestScore {
-			bestScore = score
-		}
+	if factory.applyPin(waiter) {
+		return
 	}
 
-	leniency := 0.2 // 20% leniency
-	for lineId, score := range lineOffers {
-		if (1-leniency)*float64(score) <= float64(bestScore) {
-			factory.processLines[lineId].registerWaitingPiece(waiter)
-			nRegistered++
-		}
+	nRegistered := 0
+	for _, lineID := range factory.scheduler.Assign(factory, piece, waiter.decision) {
+		factory.processLines[lineID].registerWaitingPiece(waiter)
+		nRegistered++
 	}
 
+	if nRegistered == 0 && factory.anyDown() {
+		log.Printf("[registerWaitingPiece] No line available for piece %s, waiting for one\n",
+			piece.ErpIdentifier)
+		factory.orphanWaiters = append(factory.orphanWaiters, waiter)
+		return
+	}
 	utils.Assert(nRegistered > 0, "[registerWaitingPiece] No lines exist for piece")
 }
 
@@ -201,12 +246,29 @@ func sendToLine(lineID string, piece *Piece) *itemHandler {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
 
+	// The line (or one of its machines) may have gone down since it
+	// claimed the piece, in which case the piece must be dispatched again
+	if !factory.processLines[lineID].isAvailableFor(piece) {
+		log.Printf("[sendToLine] line %s no longer available for piece %s\n",
+			lineID, piece.ErpIdentifier)
+		factory.processLines[lineID].claimPending = false
+		return nil
+	}
+
+	// A pin only applies to the dispatch it was honored in
+	delete(factory.overrides.pins, piece.ErpIdentifier)
+
+	if factory.dayPlan != nil {
+		factory.dayPlan.observe(piece, lineID)
+	}
+
 	piece.ControlID = factory.processLines[lineID].plc.LastCommandTxId() + 1
-	controlForm := factory.processLines[lineID].createBestForm(piece)
+	controlForm := factory.processLines[lineID].createRouteForm(piece)
 	utils.Assert(controlForm != nil, "[sendToLine] controlForm is nil")
 
-	factory.processLines[lineID].setCurrentTool(LINE_DEFAULT_M1_POS, controlForm.toolTop)
-	factory.processLines[lineID].setCurrentTool(LINE_DEFAULT_M2_POS, controlForm.toolBot)
+	for _, cmd := range controlForm.machines {
+		factory.processLines[lineID].setCurrentTool(cmd.pos, cmd.tool)
+	}
 
 	log.Printf("[sendToLine] line: %s processForm: %v piece: %s\n",
 		lineID, controlForm, piece.ErpIdentifier)
@@ -216,20 +278,16 @@ func sendToLine(lineID string, piece *Piece) *itemHandler {
 	utils.Assert(err == nil, "[sendToLine] Error writing to PLC")
 
 	factory.processLines[lineID].addItem(&conveyorItem{
+		piece: piece,
 		handler: &conveyorItemHandler{
 			transformCh: transformCh,
 			lineEntryCh: lineEntryCh,
 			lineExitCh:  lineExitCh,
 			errCh:       errCh,
 		},
-		controlID: controlForm.id,
-		m1Repeats: controlForm.repeatTop,
-		m2Repeats: controlForm.repeatBot,
-		useM1:     controlForm.processTop,
-		useM2:     controlForm.processBot,
-
-		toolChangeM1: controlForm.changeM1,
-		toolChangeM2: controlForm.changeM2,
+		controlID:  controlForm.id,
+		commands:   controlForm.machines,
+		dispatched: *piece,
 	})
 
 	return &itemHandler{
@@ -244,6 +302,13 @@ func sendToProduction(
 	ctx context.Context,
 	piece *Piece,
 ) *itemHandler {
+	return registerForProduction(piece)(ctx)
+}
+
+// registerForProduction registers the piece with the lines that may claim
+// it next, and returns a function that waits for one of them to claim it.
+// Pieces registered first are the first ones the lines see.
+func registerForProduction(piece *Piece) func(context.Context) *itemHandler {
 	claimed := make(chan struct{})
 	claimPieceCh := make(chan string)
 	lock := &sync.Mutex{}
@@ -254,33 +319,40 @@ func sendToProduction(
 		claimLock:      lock,
 		claimCount:     0,
 		claimCountLock: countLock,
+		piece:          piece,
+		waitingSince:   time.Now(),
 	}
 
 	registerWaitingPiece(waiter, piece)
 
-	// Once a line is available, the check
-	select {
-	case <-ctx.Done():
-		log.Panicf("[sendToProduction] Context cancelled before piece %s was claimed",
-			piece.ErpIdentifier)
-	case line, open := <-claimPieceCh:
-		close(claimed)
-		lock.Unlock()
-
-		errorMsg := fmt.Sprintf("[sendToProduction] claimPieceCh closed before piece %s was claimed: %s",
-			piece.ErpIdentifier, line)
-		utils.Assert(open, errorMsg)
-		log.Printf("[sendToProduction] Piece %v claimed by line %s",
-			piece.ErpIdentifier, line)
-		return sendToLine(line, piece)
+	return func(ctx context.Context) *itemHandler {
+		// Once a line is available, the check
+		select {
+		case <-ctx.Done():
+			log.Panicf("[sendToProduction] Context cancelled before piece %s was claimed",
+				piece.ErpIdentifier)
+		case line, open := <-claimPieceCh:
+			close(claimed)
+			lock.Unlock()
+
+			errorMsg := fmt.Sprintf("[sendToProduction] claimPieceCh closed before piece %s was claimed: %s",
+				piece.ErpIdentifier, line)
+			utils.Assert(open, errorMsg)
+			log.Printf("[sendToProduction] Piece %v claimed by line %s",
+				piece.ErpIdentifier, line)
+			if handler := sendToLine(line, piece); handler != nil {
+				return handler
+			}
+			return sendToProduction(ctx, piece)
+		}
+		panic("unreachable")
 	}
-	panic("unreachable")
 }
 
 // TODO: rethink this way of handling updates
 func runFactoryStateUpdateFunc(
 	ctx context.Context,
-	shipAckCh chan<- int16,
+	shipAckCh chan<- SupplyAckMetadata,
 	deliveryAckCh chan<- DeliveryAckMetadata,
 ) {
 	factory, mutex := getFactoryInstance()
@@ -293,9 +365,14 @@ func runFactoryStateUpdateFunc(
 	err := factory.stateUpdateFunc(ctx, factory)
 	utils.Assert(err == nil, "[updateFactoryState] Error updating factory state")
 
-	for _, supplyLine := range factory.supplyLines {
+	for idx, supplyLine := range factory.supplyLines {
 		if supplyLine.PieceAcked() {
-			shipAckCh <- supplyLine.LastCommandTxId()
+			// Read in the same poll as the W1 total
+			shipmentReceipts.moved(1)
+			shipAckCh <- SupplyAckMetadata{
+				txId: supplyLine.LastCommandTxId(),
+				line: idx,
+			}
 		}
 	}
 
@@ -315,7 +392,7 @@ func runFactoryStateUpdateFunc(
 
 func StartFactoryHandler(
 	ctx context.Context,
-	shipAckCh chan<- int16,
+	shipAckCh chan<- SupplyAckMetadata,
 	deliveryAckCh chan<- DeliveryAckMetadata,
 ) <-chan error {
 	errCh := make(chan error)
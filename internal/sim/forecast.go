@@ -0,0 +1,428 @@
+package sim
+
+import (
+	"math"
+	"mes/internal/utils"
+	"sort"
+	"time"
+)
+
+// PieceForecast is the estimated completion of a piece's recipe.
+type PieceForecast struct {
+	PieceID      string   `json:"piece_id"`
+	OrderID      string   `json:"order_id"`
+	DueDate      uint     `json:"due_date"`
+	Hypothetical bool     `json:"hypothetical"`
+	Lines        []string `json:"lines"`
+	ToolChanges  int      `json:"tool_changes"`
+	// Seconds from now until the recipe is completed
+	CompletionTime int  `json:"completion_time"`
+	CompletionDay  uint `json:"completion_day"`
+	DaysLate       int  `json:"days_late"`
+	// Why the piece could not be scheduled, empty if it was
+	Unscheduled string `json:"unscheduled"`
+
+	// Planning key of the piece and first recipe step run on each line
+	key      string
+	legSteps []int
+}
+
+// OrderForecast is the estimated completion of all the pieces of an order.
+type OrderForecast struct {
+	OrderID        string `json:"order_id"`
+	Pieces         int    `json:"pieces"`
+	Hypothetical   bool   `json:"hypothetical"`
+	DueDate        uint   `json:"due_date"`
+	CompletionTime int    `json:"completion_time"`
+	CompletionDay  uint   `json:"completion_day"`
+	DaysLate       int    `json:"days_late"`
+	Unscheduled    int    `json:"unscheduled"`
+}
+
+// ForecastReport is the outcome of a what-if simulation of the backlog.
+type ForecastReport struct {
+	Day       uint            `json:"day"`
+	DayLength time.Duration   `json:"day_length_ns"`
+	Scheduler string          `json:"scheduler"`
+	Pieces    []PieceForecast `json:"pieces"`
+	Orders    []OrderForecast `json:"orders"`
+}
+
+// forecastPiece is a piece of the backlog in the virtual-time simulation.
+type forecastPiece struct {
+	piece        Piece
+	readyAt      int // seconds from now when it is back in a warehouse
+	hypothetical bool
+	lines        []string
+	legSteps     []int
+	toolChanges  int
+}
+
+// virtualCopy returns an idle copy of the line with the same machines,
+// tools and availability, that can be used to run control form logic
+// without affecting the factory.
+func (pl *ProcessingLine) virtualCopy() *ProcessingLine {
+	conveyor := make([]Conveyor, len(pl.conveyorLine))
+	for i, c := range pl.conveyorLine {
+		if c.machine == nil {
+			continue
+		}
+		m := *c.machine
+		m.blockedTools = make(map[string]uint, len(c.machine.blockedTools))
+		for tool, untilDay := range c.machine.blockedTools {
+			m.blockedTools[tool] = untilDay
+		}
+		conveyor[i].machine = &m
+	}
+
+	return &ProcessingLine{
+		id:            pl.id,
+		conveyorLine:  conveyor,
+		waitingPieces: []*freeLineWaiter{},
+		readyForNext:  true,
+		down:          pl.down,
+		wipCap:        pl.wipCap,
+	}
+}
+
+// remainingLegSteps returns the number of steps the conveyor item at the
+// given position still has to go through before it leaves the line.
+func (item *conveyorItem) remainingLegSteps(pos int) int {
+	steps := 0
+	for _, cmd := range item.commands {
+		if cmd.process && pos <= cmd.pos {
+			steps += int(cmd.repeat)
+		}
+	}
+	return steps
+}
+
+// pieceAt returns the piece as it is at the given conveyor position, from
+// the copy taken when it was sent to the line and the steps the machines
+// before that position ran.
+func (item *conveyorItem) pieceAt(pos int) Piece {
+	piece := item.dispatched
+	for _, cmd := range item.commands {
+		if cmd.process && cmd.pos < pos {
+			piece.CurrentStep += int(cmd.repeat)
+		}
+	}
+	piece.CurrentStep = min(piece.CurrentStep, len(piece.Steps))
+	if piece.CurrentStep > item.dispatched.CurrentStep {
+		step := piece.Steps[piece.CurrentStep-1]
+		piece.ErpIdentifier, piece.Kind = step.ProductID, step.ProductKind
+	}
+	return piece
+}
+
+// forecastSnapshot copies the state of the factory relevant to the forecast:
+// the lines, the pieces on their conveyors (as line busy times and pieces
+// coming back to the warehouses) and the pieces waiting in W1 and W2.
+// Pieces on L0, or waiting in W2 to go through it, are counted as
+// coming back to W1 after a warehouse round trip.
+// Must be called with the factory lock held.
+func (f *factory) forecastSnapshot() (*factory, map[string]int, []*forecastPiece, []PieceForecast) {
+	virtual := &factory{
+		processLines:  make(map[string]*ProcessingLine),
+		scheduler:     f.scheduler,
+		schedulerName: f.schedulerName,
+	}
+	busyUntil := make(map[string]int)
+	backlog := []*forecastPiece{}
+	held := []PieceForecast{}
+	seen := make(map[*Piece]struct{})
+
+	addWaiters := func(line *ProcessingLine, readyAt int) {
+		line.pruneDeadWaiters()
+		for _, w := range line.waitingPieces {
+			if _, ok := seen[w.piece]; ok {
+				continue
+			}
+			seen[w.piece] = struct{}{}
+			if w.held {
+				held = append(held, PieceForecast{
+					PieceID:     w.piece.ErpIdentifier,
+					OrderID:     w.piece.OrderID,
+					DueDate:     w.piece.DueDate,
+					Unscheduled: "held in the warehouse",
+				})
+				continue
+			}
+			backlog = append(backlog, &forecastPiece{piece: *w.piece, readyAt: readyAt})
+		}
+	}
+
+	for lineID, line := range f.processLines {
+		if lineID == utils.ID_L0 {
+			for pos := len(line.conveyorLine) - 1; pos >= 0; pos-- {
+				item := line.conveyorLine[pos].item
+				if item == nil || item.piece == nil {
+					continue
+				}
+				seen[item.piece] = struct{}{}
+				backlog = append(backlog, &forecastPiece{
+					piece:   item.pieceAt(pos),
+					readyAt: ROUTE_TRANSFER_TIME,
+				})
+			}
+			addWaiters(line, ROUTE_TRANSFER_TIME)
+			continue
+		}
+		virtual.processLines[lineID] = line.virtualCopy()
+
+		// The furthest item along the conveyor leaves the line first
+		for pos := len(line.conveyorLine) - 1; pos >= 0; pos-- {
+			item := line.conveyorLine[pos].item
+			if item == nil || item.piece == nil {
+				continue
+			}
+			seen[item.piece] = struct{}{}
+
+			piece := item.pieceAt(pos)
+			last := min(piece.CurrentStep+item.remainingLegSteps(pos), len(piece.Steps))
+			for _, step := range piece.Steps[piece.CurrentStep:last] {
+				busyUntil[lineID] += step.Time
+			}
+			piece.CurrentStep = last
+			readyAt := busyUntil[lineID]
+			if last < len(piece.Steps) {
+				readyAt += ROUTE_TRANSFER_TIME
+			}
+			backlog = append(backlog, &forecastPiece{
+				piece:    piece,
+				readyAt:  readyAt,
+				lines:    []string{lineID},
+				legSteps: []int{item.dispatched.CurrentStep},
+			})
+		}
+		addWaiters(line, 0)
+	}
+
+	for _, w := range f.orphanWaiters {
+		if _, ok := seen[w.piece]; !ok {
+			seen[w.piece] = struct{}{}
+			backlog = append(backlog, &forecastPiece{piece: *w.piece})
+		}
+	}
+	return virtual, busyUntil, backlog, held
+}
+
+// simulate dispatches the backlog on the virtual lines in virtual time,
+// with the scheduler and the control form logic used by the real factory.
+// A piece is assigned to lines when it enters a warehouse, and each line
+// claims its waiters as it becomes free. Each line is modelled as processing
+// one control form at a time, and each warehouse round trip between two
+// visits costs ROUTE_TRANSFER_TIME.
+//
+// Returns the forecast of every piece with the completion time filled in,
+// or the reason it could not be scheduled.
+func (f *factory) simulate(busyUntil map[string]int, backlog []*forecastPiece) []PieceForecast {
+	forecasts := []PieceForecast{}
+	finish := func(fp *forecastPiece, at int, reason string) {
+		forecasts = append(forecasts, PieceForecast{
+			PieceID:        fp.piece.ErpIdentifier,
+			OrderID:        fp.piece.OrderID,
+			DueDate:        fp.piece.DueDate,
+			Hypothetical:   fp.hypothetical,
+			Lines:          fp.lines,
+			ToolChanges:    fp.toolChanges,
+			CompletionTime: at,
+			Unscheduled:    reason,
+			key:            fp.piece.planKey(),
+			legSteps:       fp.legSteps,
+		})
+	}
+
+	// Pieces in (or on their way to) a warehouse, by arrival
+	pending := []*forecastPiece{}
+	for _, fp := range backlog {
+		if fp.piece.CurrentStep >= len(fp.piece.Steps) {
+			finish(fp, fp.readyAt, "")
+			continue
+		}
+		pending = append(pending, fp)
+	}
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].readyAt < pending[j].readyAt
+	})
+
+	lineIDs := make([]string, 0, len(f.processLines))
+	for lineID := range f.processLines {
+		lineIDs = append(lineIDs, lineID)
+	}
+	sort.Strings(lineIDs)
+
+	registered := make(map[string][]*freeLineWaiter)
+	waiterOf := make(map[*freeLineWaiter]*forecastPiece)
+
+	for len(pending) > 0 || len(waiterOf) > 0 {
+		// The next dispatch happens on the line that is first free while
+		// one of its waiters is in the warehouse
+		var line *ProcessingLine
+		at := math.MaxInt
+		for _, lineID := range lineIDs {
+			for _, w := range registered[lineID] {
+				if t := max(busyUntil[lineID], waiterOf[w].readyAt); t < at {
+					at = t
+					line = f.processLines[lineID]
+				}
+			}
+		}
+
+		// Pieces reaching the warehouse before then are assigned first
+		if len(pending) > 0 && (line == nil || pending[0].readyAt <= at) {
+			fp := pending[0]
+			pending = pending[1:]
+
+			fp.piece.route = planRoute(f, &fp.piece)
+			assigned := f.scheduler.Assign(f, &fp.piece, nil)
+			if len(assigned) == 0 {
+				finish(fp, 0, "no line can process it")
+				continue
+			}
+			sort.Strings(assigned)
+
+			w := &freeLineWaiter{piece: &fp.piece, waitingSince: time.Now(), priority: fp.piece.Priority}
+			waiterOf[w] = fp
+			for _, lineID := range assigned {
+				w.lines = append(w.lines, f.processLines[lineID])
+				registered[lineID] = append(registered[lineID], w)
+			}
+			continue
+		}
+
+		ready := []*freeLineWaiter{}
+		for _, w := range registered[line.id] {
+			if waiterOf[w].readyAt <= at {
+				ready = append(ready, w)
+			}
+		}
+		ranked := f.scheduler.Rank(line, ready)
+		if len(ranked) == 0 {
+			// The scheduler held every piece back for another line,
+			// which the virtual clock cannot wait for
+			ranked = ready
+		}
+		claimed := ranked[0]
+		fp := waiterOf[claimed]
+
+		delete(waiterOf, claimed)
+		for _, other := range claimed.lines {
+			registered[other.id] = removeWaiter(registered[other.id], claimed)
+		}
+
+		form := line.createRouteForm(&fp.piece)
+		for _, cmd := range form.machines {
+			line.setCurrentTool(cmd.pos, cmd.tool)
+		}
+		busyUntil[line.id] = at + form.intrinsicTime
+
+		fp.lines = append(fp.lines, line.id)
+		fp.legSteps = append(fp.legSteps, fp.piece.CurrentStep)
+		fp.piece.CurrentStep += form.stepsCompleted
+		fp.toolChanges += form.toolChanges()
+		if fp.piece.CurrentStep >= len(fp.piece.Steps) {
+			finish(fp, busyUntil[line.id], "")
+			continue
+		}
+
+		fp.readyAt = busyUntil[line.id] + ROUTE_TRANSFER_TIME
+		i := sort.Search(len(pending), func(i int) bool {
+			return pending[i].readyAt > fp.readyAt
+		})
+		pending = append(pending[:i], append([]*forecastPiece{fp}, pending[i:]...)...)
+	}
+	return forecasts
+}
+
+func removeWaiter(waiters []*freeLineWaiter, w *freeLineWaiter) []*freeLineWaiter {
+	for i, waiter := range waiters {
+		if waiter == w {
+			return append(waiters[:i], waiters[i+1:]...)
+		}
+	}
+	return waiters
+}
+
+// setCompletionDay converts the completion time of the piece into the day
+// it is completed on, starting from today.
+func (pf *PieceForecast) setCompletionDay(today uint, dayLength time.Duration) {
+	days := uint(math.Ceil(float64(pf.CompletionTime) / dayLength.Seconds()))
+	pf.CompletionDay = today + days
+	if pf.DueDate != 0 {
+		pf.DaysLate = int(pf.CompletionDay) - int(pf.DueDate)
+	}
+}
+
+// Forecast estimates when the current backlog, plus the given hypothetical
+// pieces (e.g. of an order not yet accepted), would be completed.
+// The live factory is snapshotted and the backlog dispatched on a copy of it
+// in virtual time, so the forecast does not affect production.
+func Forecast(hypothetical []Piece) ForecastReport {
+	factory, mutex := getFactoryInstance()
+	virtual, busyUntil, backlog, held := factory.forecastSnapshot()
+	mutex.Unlock()
+
+	for _, queued := range pieceReleaseQueue.snapshot() {
+		backlog = append(backlog, &forecastPiece{piece: queued})
+	}
+	for _, piece := range hypothetical {
+		if piece.Location == "" {
+			piece.Location = utils.ID_W1
+		}
+		backlog = append(backlog, &forecastPiece{piece: piece, hypothetical: true})
+	}
+
+	today, dayLength := simCalendar.today()
+	report := ForecastReport{
+		Day:       today,
+		DayLength: dayLength,
+		Scheduler: virtual.schedulerName,
+		Pieces:    append(virtual.simulate(busyUntil, backlog), held...),
+		Orders:    []OrderForecast{},
+	}
+
+	orders := make(map[string]*OrderForecast)
+	for i := range report.Pieces {
+		pf := &report.Pieces[i]
+		if pf.Unscheduled == "" {
+			pf.setCompletionDay(today, dayLength)
+		}
+
+		if pf.OrderID == "" {
+			continue
+		}
+		order, ok := orders[pf.OrderID]
+		if !ok {
+			order = &OrderForecast{OrderID: pf.OrderID, DueDate: pf.DueDate}
+			orders[pf.OrderID] = order
+		}
+		order.Pieces++
+		order.Hypothetical = order.Hypothetical || pf.Hypothetical
+		if pf.Unscheduled != "" {
+			order.Unscheduled++
+			continue
+		}
+		if pf.CompletionTime >= order.CompletionTime {
+			order.CompletionTime = pf.CompletionTime
+			order.CompletionDay = pf.CompletionDay
+			order.DaysLate = pf.DaysLate
+		}
+	}
+	for _, order := range orders {
+		report.Orders = append(report.Orders, *order)
+	}
+
+	// Unscheduled pieces are listed last
+	sort.Slice(report.Pieces, func(i, j int) bool {
+		a, b := report.Pieces[i], report.Pieces[j]
+		if (a.Unscheduled == "") != (b.Unscheduled == "") {
+			return a.Unscheduled == ""
+		}
+		return a.CompletionTime < b.CompletionTime
+	})
+	sort.Slice(report.Orders, func(i, j int) bool {
+		return report.Orders[i].CompletionTime < report.Orders[j].CompletionTime
+	})
+	return report
+}
@@ -0,0 +1,182 @@
+package sim
+
+import (
+	u "mes/internal/utils"
+	"sync"
+	"testing"
+)
+
+func TestForecastSimulate(t *testing.T) {
+	f := newTestFactory()
+	s, err := newScheduler(SCHEDULER_LENIENT, DefaultSchedulerOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.scheduler = s
+
+	// Only the 3 type 2 lines have T4, set up with T1
+	backlog := []*forecastPiece{}
+	for _, id := range []string{"p1", "p2", "p3", "p4"} {
+		backlog = append(backlog, &forecastPiece{piece: Piece{
+			ErpIdentifier: id,
+			Location:      u.ID_W1,
+			Steps:         []Transformation{{Tool: u.TOOL_4, Time: 30}},
+		}})
+	}
+	backlog = append(backlog, &forecastPiece{piece: Piece{
+		ErpIdentifier: "impossible",
+		Location:      u.ID_W1,
+		Steps:         []Transformation{{Tool: "T9", Time: 30}},
+	}})
+
+	forecasts := f.simulate(map[string]int{}, backlog)
+	if len(forecasts) != len(backlog) {
+		t.Fatalf("Expected %d forecasts, got %d", len(backlog), len(forecasts))
+	}
+
+	completions := make(map[string]PieceForecast)
+	for _, pf := range forecasts {
+		completions[pf.PieceID] = pf
+	}
+	if completions["impossible"].Unscheduled == "" {
+		t.Fatal("Expected the piece without a compatible line to be unscheduled")
+	}
+
+	// The first 3 pieces pay for the tool swap, the last one reuses the tool
+	times := map[int]int{}
+	for _, id := range []string{"p1", "p2", "p3", "p4"} {
+		pf := completions[id]
+		if pf.Unscheduled != "" || len(pf.Lines) != 1 {
+			t.Fatalf("Expected piece %s to be scheduled on one line, got %+v", id, pf)
+		}
+		times[pf.CompletionTime]++
+	}
+	if times[30+MACHINE_TOOL_SWAP_TIME] != 3 || times[60+MACHINE_TOOL_SWAP_TIME] != 1 {
+		t.Fatalf("Unexpected completion times %v", times)
+	}
+
+	// The lines were left set up for the last pieces they processed
+	next := &Piece{Steps: []Transformation{{Tool: u.TOOL_4, Time: 30}}}
+	for _, lineID := range []string{u.ID_L4, u.ID_L5, u.ID_L6} {
+		if !f.processLines[lineID].isSetUpFor(next) {
+			t.Fatalf("Expected line %s to be set up with T4", lineID)
+		}
+	}
+}
+
+func TestVirtualCopy(t *testing.T) {
+	f := newTestFactory()
+	line := f.processLines[u.ID_L1]
+	line.conveyorLine[LINE_DEFAULT_M1_POS].machine.blockedTools[u.TOOL_2] = 0
+
+	virtual := line.virtualCopy()
+	virtual.setCurrentTool(LINE_DEFAULT_M1_POS, u.TOOL_3)
+	delete(virtual.conveyorLine[LINE_DEFAULT_M1_POS].machine.blockedTools, u.TOOL_2)
+
+	if line.currentTool(LINE_DEFAULT_M1_POS) != u.TOOL_1 {
+		t.Fatal("Expected the tool of the real line to be unchanged")
+	}
+	if !line.conveyorLine[LINE_DEFAULT_M1_POS].machine.isToolBlocked(u.TOOL_2) {
+		t.Fatal("Expected the real line to keep its tool blocks")
+	}
+}
+
+func twoStepPiece(id string) Piece {
+	return Piece{
+		ErpIdentifier: id,
+		Kind:          "P1",
+		Location:      u.ID_W1,
+		OrderID:       "order-1",
+		Steps: []Transformation{
+			{MaterialID: id, ProductID: id + "-a", ProductKind: "P2", Tool: u.TOOL_1, Time: 20},
+			{MaterialID: id + "-a", ProductID: id + "-b", ProductKind: "P3", Tool: u.TOOL_2, Time: 30},
+		},
+	}
+}
+
+func TestForecastSnapshotCountsL0(t *testing.T) {
+	f := newTestFactory()
+	l0 := &ProcessingLine{
+		id:            u.ID_L0,
+		conveyorLine:  make([]Conveyor, LINE_CONVEYOR_SIZE),
+		waitingPieces: []*freeLineWaiter{},
+		readyForNext:  true,
+	}
+	f.processLines[u.ID_L0] = l0
+
+	// One piece on its way from W2 to W1, another waiting in W2 for L0
+	onL0 := twoStepPiece("on-l0")
+	onL0.CurrentStep, onL0.Location = 1, u.ID_L0
+	l0.conveyorLine[2].item = &conveyorItem{piece: &onL0, dispatched: onL0}
+
+	inW2 := twoStepPiece("in-w2")
+	inW2.CurrentStep, inW2.Location = 1, u.ID_W2
+	l0.registerWaitingPiece(&freeLineWaiter{
+		piece:          &inW2,
+		pieceClaimedCh: make(chan struct{}),
+		claimCountLock: &sync.Mutex{},
+	})
+
+	virtual, _, backlog, _ := f.forecastSnapshot()
+	if _, ok := virtual.processLines[u.ID_L0]; ok {
+		t.Fatal("Expected L0 not to be a line the forecast dispatches to")
+	}
+	if len(backlog) != 2 {
+		t.Fatalf("Expected both pieces going through L0 in the backlog, got %d", len(backlog))
+	}
+	for _, fp := range backlog {
+		if fp.readyAt != ROUTE_TRANSFER_TIME || fp.piece.CurrentStep != 1 {
+			t.Fatalf("Expected piece %s back in W1 after a round trip at step 1, got %d at step %d",
+				fp.piece.ErpIdentifier, fp.readyAt, fp.piece.CurrentStep)
+		}
+	}
+}
+
+// The tracker of a piece on a conveyor transforms it without the factory
+// lock, run with -race to check the snapshot does not read it.
+func TestForecastSnapshotWithRunningTracker(t *testing.T) {
+	f := newTestFactory()
+	piece := twoStepPiece("p1")
+	item := &conveyorItem{
+		piece: &piece,
+		commands: []machineCommand{
+			{pos: LINE_DEFAULT_M1_POS, tool: u.TOOL_1, repeat: 1, process: true},
+			{pos: LINE_DEFAULT_M2_POS, tool: u.TOOL_2, repeat: 1, process: true},
+		},
+		dispatched: piece,
+	}
+	// M1 is done, M2 is next
+	f.processLines[u.ID_L1].conveyorLine[LINE_DEFAULT_M2_POS].item = item
+
+	transformCh := make(chan string)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for machine := range transformCh {
+			piece.transform(u.ID_L1, machine, false)
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		if i == 10 {
+			transformCh <- "M1"
+		}
+		if i == 20 {
+			transformCh <- "M2"
+		}
+		_, busyUntil, backlog, _ := f.forecastSnapshot()
+		if len(backlog) != 1 {
+			t.Fatalf("Expected the piece on L1 in the backlog, got %d pieces", len(backlog))
+		}
+		fp := backlog[0]
+		if fp.piece.CurrentStep != 2 || fp.piece.ErpIdentifier != "p1-a" || busyUntil[u.ID_L1] != 30 {
+			t.Fatalf("Expected the piece done with M1 to keep L1 busy for M2, got %s at step %d, busy %d",
+				fp.piece.ErpIdentifier, fp.piece.CurrentStep, busyUntil[u.ID_L1])
+		}
+		if fp.legSteps[0] != 0 {
+			t.Fatalf("Expected the leg to start at the first step, got %d", fp.legSteps[0])
+		}
+	}
+	close(transformCh)
+	<-done
+}
@@ -0,0 +1,340 @@
+package sim
+
+import (
+	"fmt"
+	"log"
+	"mes/internal/utils"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Traceability events
+const (
+	TRACE_RECEIVED    = "received"    // a material came in from a supply line
+	TRACE_IDENTIFIED  = "identified"  // the ERP assigned a piece to a material
+	TRACE_EXITED      = "exited"      // the piece left a warehouse for a line
+	TRACE_TRANSFORMED = "transformed" // a machine transformed the piece
+	TRACE_STORED      = "stored"      // the piece came back from a line
+	TRACE_DELIVERED   = "delivered"   // the piece left on a delivery line
+)
+
+// TraceEvent is an event in the life of a physical piece.
+type TraceEvent struct {
+	Time  time.Time `json:"time"`
+	Trace int       `json:"trace"`
+	Event string    `json:"event"`
+	// ERP ID and kind of the piece after the event, the ID is empty for
+	// materials the ERP has not assigned yet
+	PieceID string `json:"piece_id"`
+	Kind    string `json:"kind"`
+	// Where the piece came from and went to: supply line, warehouse,
+	// production line or delivery line
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+	TxId int16  `json:"tx_id,omitempty"`
+
+	ShipmentID int    `json:"shipment_id,omitempty"`
+	OrderID    string `json:"order_id,omitempty"`
+
+	// Set on transformations
+	PreviousID       string `json:"previous_id,omitempty"`
+	Machine          string `json:"machine,omitempty"`
+	Tool             string `json:"tool,omitempty"`
+	ToolChange       bool   `json:"tool_change,omitempty"`
+	TransformationID int    `json:"transformation_id,omitempty"`
+
+	// Whether the piece completed its recipe, on W2 entries
+	Finished bool `json:"finished,omitempty"`
+}
+
+// PieceTrace is the history of a physical piece, under every ID the ERP
+// gave it.
+type PieceTrace struct {
+	ID       int      `json:"id"`
+	PieceIDs []string `json:"piece_ids"` // oldest first
+	Kind     string   `json:"kind"`
+	Location string   `json:"location"`
+	// Zero if the material was in W1 before it was traced
+	ShipmentID int          `json:"shipment_id"`
+	OrderID    string       `json:"order_id"`
+	Events     []TraceEvent `json:"events"`
+}
+
+// TraceFilter selects the traces returned by Traces.
+// Empty fields match everything, a zero limit returns every trace.
+type TraceFilter struct {
+	PieceID    string
+	ShipmentID int
+	OrderID    string
+	Limit      int
+}
+
+// traceStore keeps the genealogy of every physical piece. Supply lines
+// move pieces by kind, not by ID: as in the inventory, a piece identified by
+// the ERP is matched to the oldest material of its kind received. The
+// pieces a delivery takes are those the finished stock gives it.
+type traceStore struct {
+	lock       sync.Mutex
+	traces     []*PieceTrace
+	byID       map[string]int   // piece ID -> trace
+	unassigned map[string][]int // kind -> traces of materials in W1 without an ID
+	journal    *utils.JSONLog
+}
+
+var pieceTraces = newTraceStore(utils.NewCompactedJSONLog(TRACE_LOG_PATH))
+
+func newTraceStore(journal *utils.JSONLog) *traceStore {
+	ts := &traceStore{journal: journal}
+	ts.reset()
+	return ts
+}
+
+func (ts *traceStore) reset() {
+	ts.traces = nil
+	ts.byID = make(map[string]int)
+	ts.unassigned = make(map[string][]int)
+}
+
+// load rebuilds the traces, and which materials wait for an ID, from the
+// events logged.
+func (ts *traceStore) load() error {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	ts.reset()
+	return utils.ReplayJSONLog(ts.journal, ts.applyLocked)
+}
+
+func removeTrace(traces []int, trace int) []int {
+	if i := slices.Index(traces, trace); i >= 0 {
+		return append(traces[:i], traces[i+1:]...)
+	}
+	return traces
+}
+
+// applyLocked adds an event to its trace, creating the trace if needed.
+func (ts *traceStore) applyLocked(event TraceEvent) {
+	for event.Trace >= len(ts.traces) {
+		ts.traces = append(ts.traces, &PieceTrace{ID: len(ts.traces), PieceIDs: []string{}})
+	}
+	trace := ts.traces[event.Trace]
+
+	trace.Events = append(trace.Events, event)
+	trace.Kind = event.Kind
+	if event.To != "" {
+		trace.Location = event.To
+	}
+	if event.ShipmentID != 0 {
+		trace.ShipmentID = event.ShipmentID
+	}
+	if event.OrderID != "" {
+		trace.OrderID = event.OrderID
+	}
+	if event.PieceID != "" && !slices.Contains(trace.PieceIDs, event.PieceID) {
+		trace.PieceIDs = append(trace.PieceIDs, event.PieceID)
+		ts.byID[event.PieceID] = trace.ID
+	}
+
+	switch event.Event {
+	case TRACE_RECEIVED:
+		ts.unassigned[event.Kind] = append(ts.unassigned[event.Kind], trace.ID)
+	case TRACE_IDENTIFIED:
+		ts.unassigned[event.Kind] = removeTrace(ts.unassigned[event.Kind], trace.ID)
+	}
+}
+
+func (ts *traceStore) recordLocked(event TraceEvent) {
+	event.Time = time.Now()
+	ts.applyLocked(event)
+	ts.journal.Append(event)
+	ts.journal.CompactIfFull(ts.stateLocked)
+}
+
+// stateLocked returns the events of the pieces not delivered yet. The
+// traces of delivered pieces are left in the archived logs.
+func (ts *traceStore) stateLocked() []any {
+	events := []any{}
+	for _, trace := range ts.traces {
+		n := len(trace.Events)
+		if n == 0 || trace.Events[n-1].Event == TRACE_DELIVERED {
+			continue
+		}
+		for _, event := range trace.Events {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// traceOfLocked returns the trace of a piece, a new one if it is not traced.
+func (ts *traceStore) traceOfLocked(pieceID string) int {
+	if trace, ok := ts.byID[pieceID]; ok {
+		return trace
+	}
+	return len(ts.traces)
+}
+
+// received starts the trace of a material a supply line brought into W1.
+func (ts *traceStore) received(shipment Shipment, supplyLine int, txId int16) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	ts.recordLocked(TraceEvent{
+		Trace:      len(ts.traces),
+		Event:      TRACE_RECEIVED,
+		Kind:       shipment.MaterialKind,
+		From:       fmt.Sprintf("SL%d", supplyLine+1),
+		To:         utils.ID_W1,
+		TxId:       txId,
+		ShipmentID: shipment.ID,
+	})
+}
+
+// identified matches a piece the ERP assigned to a material in W1 with the
+// oldest material of its kind received.
+func (ts *traceStore) identified(piece *Piece) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	if _, ok := ts.byID[piece.ErpIdentifier]; ok {
+		return
+	}
+	trace := len(ts.traces)
+	if materials := ts.unassigned[piece.Kind]; len(materials) > 0 {
+		trace = materials[0]
+	}
+	ts.recordLocked(TraceEvent{
+		Trace:   trace,
+		Event:   TRACE_IDENTIFIED,
+		PieceID: piece.ErpIdentifier,
+		Kind:    piece.Kind,
+		To:      piece.Location,
+		OrderID: piece.OrderID,
+	})
+}
+
+// exited records a piece leaving a warehouse for a line.
+func (ts *traceStore) exited(piece *Piece, warehouse string, line string) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	ts.recordLocked(TraceEvent{
+		Trace:   ts.traceOfLocked(piece.ErpIdentifier),
+		Event:   TRACE_EXITED,
+		PieceID: piece.ErpIdentifier,
+		Kind:    piece.Kind,
+		From:    warehouse,
+		To:      line,
+		TxId:    piece.ControlID,
+	})
+}
+
+// transformed records a step of the recipe. The piece has already taken
+// its new ID and kind.
+func (ts *traceStore) transformed(piece *Piece, line string, machine string, toolChange bool) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	step := piece.Steps[piece.CurrentStep-1]
+	ts.recordLocked(TraceEvent{
+		Trace:            ts.traceOfLocked(step.MaterialID),
+		Event:            TRACE_TRANSFORMED,
+		PieceID:          piece.ErpIdentifier,
+		Kind:             piece.Kind,
+		From:             line,
+		TxId:             piece.ControlID,
+		PreviousID:       step.MaterialID,
+		Machine:          machine,
+		Tool:             step.Tool,
+		ToolChange:       toolChange,
+		TransformationID: step.ID,
+	})
+}
+
+// stored records a piece coming back from a line to a warehouse.
+func (ts *traceStore) stored(piece *Piece, line string, warehouse string) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	ts.recordLocked(TraceEvent{
+		Trace:    ts.traceOfLocked(piece.ErpIdentifier),
+		Event:    TRACE_STORED,
+		PieceID:  piece.ErpIdentifier,
+		Kind:     piece.Kind,
+		From:     line,
+		To:       warehouse,
+		TxId:     piece.ControlID,
+		Finished: warehouse == utils.ID_W2 && piece.CurrentStep == len(piece.Steps),
+	})
+}
+
+// delivered records the pieces of a load sent to a delivery line, given to
+// the orders of the load in turn. Pieces of unknown ID, counted into the
+// stock by an operator, are not traced.
+func (ts *traceStore) delivered(pieceIDs []string, line string, txId int16, parts []DeliveryLoadPart) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	for _, part := range parts {
+		for n := 0; n < part.Quantity && len(pieceIDs) > 0; n++ {
+			pieceID := pieceIDs[0]
+			pieceIDs = pieceIDs[1:]
+			trace, ok := ts.byID[pieceID]
+			if !ok {
+				log.Printf("[traceStore.delivered] piece %s of order %s is not traced\n",
+					pieceID, part.OrderID)
+				continue
+			}
+			ts.recordLocked(TraceEvent{
+				Trace:   trace,
+				Event:   TRACE_DELIVERED,
+				PieceID: pieceID,
+				Kind:    ts.traces[trace].Kind,
+				From:    utils.ID_W2,
+				To:      line,
+				TxId:    txId,
+				OrderID: part.OrderID,
+			})
+		}
+	}
+}
+
+func (trace *PieceTrace) matches(filter TraceFilter) bool {
+	if filter.PieceID != "" && !slices.Contains(trace.PieceIDs, filter.PieceID) {
+		return false
+	}
+	if filter.ShipmentID != 0 && trace.ShipmentID != filter.ShipmentID {
+		return false
+	}
+	if filter.OrderID != "" && trace.OrderID != filter.OrderID {
+		return false
+	}
+	return true
+}
+
+func (ts *traceStore) query(filter TraceFilter) []PieceTrace {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	traces := []PieceTrace{}
+	for i := len(ts.traces) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(traces) >= filter.Limit {
+			break
+		}
+		// Delivered pieces compacted out of the log leave empty traces
+		if trace := ts.traces[i]; len(trace.Events) > 0 && trace.matches(filter) {
+			copied := *trace
+			copied.PieceIDs = append([]string{}, trace.PieceIDs...)
+			copied.Events = append([]TraceEvent{}, trace.Events...)
+			traces = append(traces, copied)
+		}
+	}
+	return traces
+}
+
+// Traces returns the genealogy of the pieces matching the filter, most
+// recently received first.
+func Traces(filter TraceFilter) []PieceTrace {
+	return pieceTraces.query(filter)
+}
@@ -0,0 +1,148 @@
+package sim
+
+import (
+	"mes/internal/utils"
+	"testing"
+)
+
+func TestTraceStoreFollowsPiece(t *testing.T) {
+	ts := newTraceStore(newTestCompactedJournal(t, "traces.jsonl"))
+	traceDeliveredPiece(ts, true)
+
+	// The piece is matched to the oldest material and found by any of its IDs
+	for _, id := range []string{"m1", "p1", "p2"} {
+		traces := ts.query(TraceFilter{PieceID: id})
+		if len(traces) != 1 || traces[0].ID != 0 {
+			t.Fatalf("Expected the first material traced for %s, got %+v", id, traces)
+		}
+	}
+	trace := ts.query(TraceFilter{PieceID: "p2"})[0]
+	if trace.ShipmentID != 7 || trace.Location != "DL1" || len(trace.Events) != 7 {
+		t.Fatalf("Unexpected trace %+v", trace)
+	}
+	if step := trace.Events[4]; step.Machine != "M2" || step.Tool != "T2" || !step.ToolChange ||
+		step.PreviousID != "p1" || step.TransformationID != 2 {
+		t.Fatalf("Unexpected transformation %+v", step)
+	}
+	if len(ts.query(TraceFilter{ShipmentID: 7})) != 2 {
+		t.Fatal("Expected both materials of the shipment traced")
+	}
+}
+
+func TestTraceStoreDelivered(t *testing.T) {
+	ts := newTraceStore(newTestCompactedJournal(t, "traces.jsonl"))
+	for _, id := range []string{"a", "b", "c"} {
+		ts.received(Shipment{ID: 1, MaterialKind: "P5"}, 0, 1)
+		ts.identified(&Piece{ErpIdentifier: id, Kind: "P5", Location: utils.ID_W1})
+	}
+
+	// Pieces of unknown ID are not traced, the others go to the orders in turn
+	ts.delivered([]string{"c", "unknown", "a"}, "DL2", 5, []DeliveryLoadPart{
+		{OrderID: "first", Quantity: 1},
+		{OrderID: "second", Quantity: 3},
+	})
+	for id, want := range map[string]string{"c": "first", "a": "second", "b": ""} {
+		trace := ts.query(TraceFilter{PieceID: id})[0]
+		if trace.OrderID != want {
+			t.Fatalf("Expected piece %s delivered for %q, got %+v", id, want, trace)
+		}
+	}
+}
+
+func TestTraceStoreLoad(t *testing.T) {
+	tests := []struct {
+		name      string
+		delivered bool
+		torn      bool
+		location  string
+		events    int
+	}{
+		{"delivered", true, false, "DL1", 7},
+		{"in W2", false, false, utils.ID_W2, 6},
+		{"torn last line", false, true, utils.ID_W2, 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			journal := newTestCompactedJournal(t, "traces.jsonl")
+			traceDeliveredPiece(newTraceStore(journal), tt.delivered)
+			if tt.torn {
+				tearLastLine(t, journal)
+			}
+
+			ts := newTraceStore(journal)
+			if err := ts.load(); err != nil {
+				t.Fatal(err)
+			}
+			traces := ts.query(TraceFilter{OrderID: "order"})
+			if len(traces) != 1 || traces[0].Location != tt.location || len(traces[0].Events) != tt.events {
+				t.Fatalf("Expected the piece restored in %s, got %+v", tt.location, traces)
+			}
+			if len(ts.unassigned["P1"]) != 1 || ts.unassigned["P1"][0] != 1 {
+				t.Fatalf("Expected the second material still unassigned, got %v", ts.unassigned)
+			}
+		})
+	}
+}
+
+// traceDeliveredPiece traces two materials received and the first one made
+// into a P5 and stored in W2, then delivered if delivered is set.
+func traceDeliveredPiece(ts *traceStore, delivered bool) {
+	ts.received(Shipment{ID: 7, MaterialKind: "P1", NPieces: 2}, 0, 11)
+	ts.received(Shipment{ID: 7, MaterialKind: "P1", NPieces: 2}, 1, 12)
+
+	piece := Piece{
+		ErpIdentifier: "m1",
+		Kind:          "P1",
+		Location:      utils.ID_W1,
+		OrderID:       "order",
+		ControlID:     3,
+		Steps: []Transformation{
+			{MaterialID: "m1", ProductID: "p1", MaterialKind: "P1", ProductKind: "P3", Tool: "T1", ID: 1},
+			{MaterialID: "p1", ProductID: "p2", MaterialKind: "P3", ProductKind: "P5", Tool: "T2", ID: 2},
+		},
+	}
+	ts.identified(&piece)
+	ts.exited(&piece, utils.ID_W1, utils.ID_L1)
+	piece.transform(utils.ID_L1, "M1", false)
+	ts.transformed(&piece, utils.ID_L1, "M1", false)
+	piece.transform(utils.ID_L1, "M2", true)
+	ts.transformed(&piece, utils.ID_L1, "M2", true)
+	ts.stored(&piece, utils.ID_L1, utils.ID_W2)
+	if delivered {
+		ts.delivered([]string{"p2"}, "DL1", 4, []DeliveryLoadPart{{OrderID: "order", Quantity: 1}})
+	}
+}
+
+func TestTraceStoreCompaction(t *testing.T) {
+	journal := newTestCompactedJournal(t, "traces.jsonl")
+	ts := newTraceStore(journal)
+	ts.received(Shipment{ID: 1, MaterialKind: "P5"}, 0, 1)
+	ts.received(Shipment{ID: 2, MaterialKind: "P1"}, 0, 2)
+
+	// The first material is delivered as is
+	delivered := Piece{ErpIdentifier: "d1", Kind: "P5", Location: utils.ID_W1}
+	ts.identified(&delivered)
+	ts.exited(&delivered, utils.ID_W1, utils.ID_L1)
+	ts.stored(&delivered, utils.ID_L1, utils.ID_W2)
+	ts.delivered([]string{"d1"}, "DL1", 3, []DeliveryLoadPart{{OrderID: "order", Quantity: 1}})
+
+	compactAtNextAppend(journal)
+	ts.identified(&Piece{ErpIdentifier: "m2", Kind: "P1", Location: utils.ID_W1})
+
+	restored := newTraceStore(journal)
+	if err := restored.load(); err != nil {
+		t.Fatal(err)
+	}
+	if traces := restored.query(TraceFilter{}); len(traces) != 1 || traces[0].ID != 1 {
+		t.Fatalf("Expected only the piece in W1 kept, under its ID, got %+v", traces)
+	}
+	if traces := restored.query(TraceFilter{PieceID: "m2"}); len(traces) != 1 || len(traces[0].Events) != 2 {
+		t.Fatalf("Expected the events of the piece in W1 kept, got %+v", traces)
+	}
+
+	// New materials are traced after the compacted ones
+	restored.received(Shipment{ID: 3, MaterialKind: "P1"}, 0, 4)
+	if traces := restored.query(TraceFilter{ShipmentID: 3}); len(traces) != 1 || traces[0].ID != 2 {
+		t.Fatalf("Expected a new trace after the compacted ones, got %+v", traces)
+	}
+}
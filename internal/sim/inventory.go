@@ -0,0 +1,353 @@
+package sim
+
+import (
+	"fmt"
+	"log"
+	"mes/internal/utils"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Inventory movements
+const (
+	INVENTORY_RECEIVED   = "received"   // a material came in from a supply line
+	INVENTORY_IDENTIFIED = "identified" // the ERP assigned a piece to a material
+	INVENTORY_STORED     = "stored"     // a piece came back from a line
+	INVENTORY_RELEASED   = "released"   // a piece left for a line
+	INVENTORY_CORRECTED  = "corrected"  // an operator corrected the inventory
+	INVENTORY_CARRIED    = "carried"    // pieces carried over when the log was compacted
+)
+
+// inventoryMovement is pieces entering or leaving a warehouse, or a piece
+// in it getting an ID.
+type inventoryMovement struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	Warehouse string    `json:"warehouse"`
+	Kind      string    `json:"kind"`
+	// Empty for pieces the ERP has not identified
+	PieceID string `json:"piece_id"`
+	Change  int    `json:"change"`
+}
+
+// InventoryPiece is a piece of known ID in a warehouse.
+type InventoryPiece struct {
+	ID    string    `json:"id"`
+	Kind  string    `json:"kind"`
+	Since time.Time `json:"since"`
+}
+
+// WarehouseInventory is the content of a warehouse as tracked by the MES,
+// next to the total the PLC reports.
+type WarehouseInventory struct {
+	Warehouse string         `json:"warehouse"`
+	Kinds     map[string]int `json:"kinds"` // kind -> pieces
+	// Pieces of known ID, oldest first
+	Pieces   []InventoryPiece `json:"pieces"`
+	Total    int              `json:"total"`
+	PlcTotal int              `json:"plc_total"`
+	// PLC total minus the total tracked by the MES
+	Drift int `json:"drift"`
+}
+
+type warehouseStock struct {
+	kinds     map[string]int
+	pieces    []InventoryPiece
+	lastDrift int
+}
+
+func (ws *warehouseStock) total() int {
+	total := 0
+	for _, n := range ws.kinds {
+		total += n
+	}
+	return total
+}
+
+// known returns the pieces of the kind of known ID.
+func (ws *warehouseStock) known(kind string) int {
+	n := 0
+	for _, piece := range ws.pieces {
+		if piece.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+func (ws *warehouseStock) find(pieceID string) int {
+	for i, piece := range ws.pieces {
+		if piece.ID == pieceID {
+			return i
+		}
+	}
+	return -1
+}
+
+// inventory tracks the pieces of each kind, and the pieces of known ID, in
+// W1 and the pieces stored in W2 halfway through their recipe, from the
+// movements the MES commands. The finished pieces in W2 are the finished
+// stock's.
+type inventory struct {
+	lock       sync.Mutex
+	warehouses map[string]*warehouseStock
+	journal    *utils.JSONLog
+}
+
+var stockroom = newInventory(utils.NewCompactedJSONLog(INVENTORY_LOG_PATH))
+
+func newInventory(journal *utils.JSONLog) *inventory {
+	inv := &inventory{warehouses: make(map[string]*warehouseStock), journal: journal}
+	inv.reset()
+	return inv
+}
+
+func (inv *inventory) reset() {
+	for _, wID := range []string{utils.ID_W1, utils.ID_W2} {
+		inv.warehouses[wID] = &warehouseStock{kinds: make(map[string]int)}
+	}
+}
+
+// load moves the pieces as logged, from empty warehouses. The drift the
+// PLC reported is not kept, the next poll reports it again.
+func (inv *inventory) load() error {
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+
+	inv.reset()
+	return utils.ReplayJSONLog(inv.journal, inv.applyLocked)
+}
+
+// applyLocked updates the warehouse with a movement. A piece is only
+// identified if there is a piece of its kind without an ID, and a count
+// below the pieces of known ID forgets the oldest of them.
+func (inv *inventory) applyLocked(m inventoryMovement) {
+	ws, ok := inv.warehouses[m.Warehouse]
+	if !ok {
+		return
+	}
+
+	if m.Event == INVENTORY_IDENTIFIED {
+		if ws.find(m.PieceID) < 0 && ws.known(m.Kind) < ws.kinds[m.Kind] {
+			ws.pieces = append(ws.pieces, InventoryPiece{ID: m.PieceID, Kind: m.Kind, Since: m.Time})
+		}
+		return
+	}
+
+	ws.kinds[m.Kind] = max(0, ws.kinds[m.Kind]+m.Change)
+	if ws.kinds[m.Kind] == 0 {
+		delete(ws.kinds, m.Kind)
+	}
+	switch {
+	case m.Change > 0 && m.PieceID != "":
+		ws.pieces = append(ws.pieces, InventoryPiece{ID: m.PieceID, Kind: m.Kind, Since: m.Time})
+	case m.Change < 0 && m.PieceID != "":
+		if i := ws.find(m.PieceID); i >= 0 {
+			ws.pieces = append(ws.pieces[:i], ws.pieces[i+1:]...)
+		}
+	}
+	for ws.known(m.Kind) > ws.kinds[m.Kind] {
+		i := slices.IndexFunc(ws.pieces, func(p InventoryPiece) bool { return p.Kind == m.Kind })
+		ws.pieces = append(ws.pieces[:i], ws.pieces[i+1:]...)
+	}
+}
+
+func (inv *inventory) record(event string, warehouse string, kind string, pieceID string, change int) {
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+	inv.recordLocked(event, warehouse, kind, pieceID, change)
+}
+
+func (inv *inventory) recordLocked(event string, warehouse string, kind string, pieceID string, change int) {
+	m := inventoryMovement{
+		Time:      time.Now(),
+		Event:     event,
+		Warehouse: warehouse,
+		Kind:      kind,
+		PieceID:   pieceID,
+		Change:    change,
+	}
+	inv.applyLocked(m)
+	inv.journal.Append(m)
+	inv.journal.CompactIfFull(inv.stateLocked)
+}
+
+// stateLocked returns the movements that rebuild the inventory as it is:
+// the pieces of each kind, then the IDs of the pieces known.
+func (inv *inventory) stateLocked() []any {
+	movements := []any{}
+	now := time.Now()
+	for wID, ws := range inv.warehouses {
+		for kind, n := range ws.kinds {
+			movements = append(movements, inventoryMovement{
+				Time: now, Event: INVENTORY_CARRIED, Warehouse: wID, Kind: kind, Change: n,
+			})
+		}
+		for _, piece := range ws.pieces {
+			movements = append(movements, inventoryMovement{
+				Time:      piece.Since,
+				Event:     INVENTORY_IDENTIFIED,
+				Warehouse: wID,
+				Kind:      piece.Kind,
+				PieceID:   piece.ID,
+			})
+		}
+	}
+	return movements
+}
+
+// received adds a material brought in by a supply line to W1.
+func (inv *inventory) received(kind string) {
+	inv.record(INVENTORY_RECEIVED, utils.ID_W1, kind, "", 1)
+}
+
+// identified gives an ID to a piece the ERP assigned to a material in W1.
+// An ID with no material of its kind left to give it to is not recorded:
+// the count is off, and an operator corrects it.
+func (inv *inventory) identified(kind string, pieceID string) {
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+
+	ws := inv.warehouses[utils.ID_W1]
+	if ws.find(pieceID) >= 0 {
+		return
+	}
+	if ws.known(kind) >= ws.kinds[kind] {
+		log.Printf("[inventory.identified] piece %s identified with no %s left without an ID in W1\n",
+			pieceID, kind)
+		return
+	}
+	inv.recordLocked(INVENTORY_IDENTIFIED, utils.ID_W1, kind, pieceID, 0)
+}
+
+// stored adds a piece coming back from a line to a warehouse.
+func (inv *inventory) stored(warehouse string, kind string, pieceID string) {
+	inv.record(INVENTORY_STORED, warehouse, kind, pieceID, 1)
+}
+
+// released removes a piece leaving a warehouse for a line.
+func (inv *inventory) released(warehouse string, kind string, pieceID string) {
+	inv.record(INVENTORY_RELEASED, warehouse, kind, pieceID, -1)
+}
+
+// corrected sets the pieces of the kind in the warehouse, after a count.
+func (inv *inventory) corrected(warehouse string, kind string, pieces int) {
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+
+	if ws, ok := inv.warehouses[warehouse]; ok {
+		inv.recordLocked(INVENTORY_CORRECTED, warehouse, kind, "", pieces-ws.kinds[kind])
+	}
+}
+
+// count returns the pieces of the kind in the warehouse.
+func (inv *inventory) count(warehouse string, kind string) int {
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+
+	if ws, ok := inv.warehouses[warehouse]; ok {
+		return ws.kinds[kind]
+	}
+	return 0
+}
+
+// snapshot returns the content of each warehouse, with the finished stock
+// in W2, next to the PLC totals. Changes of the drift are logged.
+func (inv *inventory) snapshot(plcTotals map[string]int, finished *finishedStock) []WarehouseInventory {
+	finishedKinds, finishedPieces := finished.contents()
+
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+
+	snapshot := []WarehouseInventory{}
+	for _, wID := range []string{utils.ID_W1, utils.ID_W2} {
+		ws := inv.warehouses[wID]
+		report := WarehouseInventory{
+			Warehouse: wID,
+			Kinds:     make(map[string]int),
+			Pieces:    append([]InventoryPiece{}, ws.pieces...),
+			Total:     ws.total(),
+			PlcTotal:  plcTotals[wID],
+		}
+		for kind, n := range ws.kinds {
+			report.Kinds[kind] = n
+		}
+		if wID == utils.ID_W2 {
+			for kind, n := range finishedKinds {
+				report.Kinds[kind] += n
+				report.Total += n
+			}
+			report.Pieces = append(report.Pieces, finishedPieces...)
+			sort.SliceStable(report.Pieces, func(i, j int) bool {
+				return report.Pieces[i].Since.Before(report.Pieces[j].Since)
+			})
+		}
+		report.Drift = report.PlcTotal - report.Total
+
+		if report.Drift != ws.lastDrift {
+			log.Printf("[inventory.snapshot] %s holds %d pieces by the PLC, %d by the MES\n",
+				wID, report.PlcTotal, report.Total)
+			ws.lastDrift = report.Drift
+		}
+		snapshot = append(snapshot, report)
+	}
+	return snapshot
+}
+
+// plcWarehouseTotals returns the total of each warehouse read from the PLC.
+func plcWarehouseTotals() map[string]int {
+	factory, mutex := getFactoryInstance()
+	defer mutex.Unlock()
+	return factory.warehouseTotals()
+}
+
+func (f *factory) warehouseTotals() map[string]int {
+	return map[string]int{
+		utils.ID_W1: int(f.warehouses[0].Quantity.Value),
+		utils.ID_W2: int(f.warehouses[1].Quantity.Value),
+	}
+}
+
+// Inventory returns the content of each warehouse, reconciled against the
+// totals read from the PLC.
+func Inventory() []WarehouseInventory {
+	return stockroom.snapshot(plcWarehouseTotals(), w2Stock)
+}
+
+// CorrectInventory sets the pieces of a kind in W1, or of the pieces of the
+// kind halfway through their recipe in W2, after a physical count. The
+// finished stock is set with SetStock.
+func CorrectInventory(warehouse string, kind string, pieces int) error {
+	if warehouse != utils.ID_W1 && warehouse != utils.ID_W2 {
+		return fmt.Errorf("[CorrectInventory] unknown warehouse %q", warehouse)
+	}
+	if PieceStrToInt(kind) == 0 {
+		return fmt.Errorf("[CorrectInventory] unknown piece kind %q", kind)
+	}
+	if pieces < 0 {
+		return fmt.Errorf("[CorrectInventory] inventory cannot be negative")
+	}
+
+	stockroom.corrected(warehouse, kind, pieces)
+	return nil
+}
+
+// correctCount sets the pieces of a kind in a warehouse, after a count. In
+// W2 the count goes to the finished stock first, the pieces halfway through
+// their recipe only being corrected if there are fewer pieces than them.
+func correctCount(warehouse string, kind string, pieces int) error {
+	if warehouse != utils.ID_W2 {
+		return CorrectInventory(warehouse, kind, pieces)
+	}
+
+	midRecipe := stockroom.count(utils.ID_W2, kind)
+	if pieces >= midRecipe {
+		return SetStock(kind, pieces-midRecipe)
+	}
+	if err := SetStock(kind, 0); err != nil {
+		return err
+	}
+	return CorrectInventory(utils.ID_W2, kind, pieces)
+}
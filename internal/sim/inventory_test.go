@@ -0,0 +1,185 @@
+package sim
+
+import (
+	"mes/internal/utils"
+	"reflect"
+	"testing"
+)
+
+func TestInventoryMovements(t *testing.T) {
+	inv := newInventory(newTestCompactedJournal(t, "inventory.jsonl"))
+
+	inv.received("P1")
+	inv.received("P1")
+	inv.received("P2")
+	inv.identified("P1", "m1")
+	if inv.count(utils.ID_W1, "P1") != 2 {
+		t.Fatalf("Expected identifying a piece to keep the count, got %d", inv.count(utils.ID_W1, "P1"))
+	}
+
+	inv.released(utils.ID_W1, "P1", "m1")
+	inv.stored(utils.ID_W2, "P3", "i1")
+
+	// Finished pieces in W2 are the finished stock's
+	stock := newFinishedStock(newTestCompactedJournal(t, "stock.jsonl"))
+	stock.stored("P5", "p1")
+	stock.stored("P5", "p2")
+	stock.delivered(DeliveryLoad{ID: 1, Kind: "P5", Quantity: 1})
+
+	snapshot := inv.snapshot(map[string]int{utils.ID_W1: 2, utils.ID_W2: 3}, stock)
+	w1, w2 := snapshot[0], snapshot[1]
+	if w1.Kinds["P1"] != 1 || w1.Kinds["P2"] != 1 || len(w1.Pieces) != 0 || w1.Drift != 0 {
+		t.Fatalf("Unexpected W1 inventory %+v", w1)
+	}
+	// The oldest finished piece of the kind is delivered first
+	if w2.Kinds["P3"] != 1 || w2.Kinds["P5"] != 1 || w2.Total != 2 || w2.Drift != 1 ||
+		len(w2.Pieces) != 2 || w2.Pieces[0].ID != "i1" || w2.Pieces[1].ID != "p2" {
+		t.Fatalf("Unexpected W2 inventory %+v", w2)
+	}
+}
+
+func TestInventoryIdentified(t *testing.T) {
+	tests := []struct {
+		name     string
+		received int
+		ids      []string
+		want     []string // IDs known after identifying ids in turn
+	}{
+		{"one per material", 2, []string{"m1", "m2"}, []string{"m1", "m2"}},
+		{"identified twice", 2, []string{"m1", "m1"}, []string{"m1"}},
+		{"more IDs than materials", 1, []string{"m1", "m2"}, []string{"m1"}},
+		{"no material", 0, []string{"m1"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inv := newInventory(newTestCompactedJournal(t, "inventory.jsonl"))
+			for n := 0; n < tt.received; n++ {
+				inv.received("P1")
+			}
+			for _, id := range tt.ids {
+				inv.identified("P1", id)
+			}
+
+			var known []string
+			for _, piece := range inv.warehouses[utils.ID_W1].pieces {
+				known = append(known, piece.ID)
+			}
+			if !reflect.DeepEqual(known, tt.want) {
+				t.Fatalf("Expected %v known, got %v", tt.want, known)
+			}
+		})
+	}
+}
+
+func TestInventoryCorrected(t *testing.T) {
+	inv := newInventory(newTestCompactedJournal(t, "inventory.jsonl"))
+	for _, id := range []string{"m1", "m2", "m3"} {
+		inv.received("P1")
+		inv.identified("P1", id)
+	}
+
+	// A count below the pieces of known ID forgets the oldest
+	inv.corrected(utils.ID_W1, "P1", 2)
+	ws := inv.warehouses[utils.ID_W1]
+	if ws.kinds["P1"] != 2 || len(ws.pieces) != 2 || ws.pieces[0].ID != "m2" {
+		t.Fatalf("Expected 2 pieces, m2 and m3, got %v %+v", ws.kinds, ws.pieces)
+	}
+	inv.corrected(utils.ID_W1, "P1", 4)
+	if ws.kinds["P1"] != 4 || len(ws.pieces) != 2 {
+		t.Fatalf("Expected 4 pieces, 2 of known ID, got %v %+v", ws.kinds, ws.pieces)
+	}
+}
+
+func TestInventoryLoad(t *testing.T) {
+	move := func(event, warehouse, kind, pieceID string, change int) inventoryMovement {
+		return inventoryMovement{Event: event, Warehouse: warehouse, Kind: kind, PieceID: pieceID, Change: change}
+	}
+	received := move(INVENTORY_RECEIVED, utils.ID_W1, "P1", "", 1)
+	tests := []struct {
+		name      string
+		movements []inventoryMovement
+		torn      bool
+		w1, w2    map[string]int
+		pieces    []string // IDs known in W1 and W2
+	}{
+		{"no log", nil, false, map[string]int{}, map[string]int{}, nil},
+		{"received and identified", []inventoryMovement{
+			received, received, move(INVENTORY_IDENTIFIED, utils.ID_W1, "P1", "m1", 0),
+		}, false, map[string]int{"P1": 2}, map[string]int{}, []string{"m1"}},
+		{"identified twice", []inventoryMovement{
+			received,
+			move(INVENTORY_IDENTIFIED, utils.ID_W1, "P1", "m1", 0),
+			move(INVENTORY_IDENTIFIED, utils.ID_W1, "P1", "m1", 0),
+		}, false, map[string]int{"P1": 1}, map[string]int{}, []string{"m1"}},
+		{"released and stored", []inventoryMovement{
+			received,
+			move(INVENTORY_IDENTIFIED, utils.ID_W1, "P1", "m1", 0),
+			move(INVENTORY_RELEASED, utils.ID_W1, "P1", "m1", -1),
+			move(INVENTORY_STORED, utils.ID_W2, "P5", "p1", 1),
+			move(INVENTORY_STORED, utils.ID_W2, "P5", "p2", 1),
+			move(INVENTORY_CORRECTED, utils.ID_W2, "P5", "", -1),
+		}, false, map[string]int{}, map[string]int{"P5": 1}, []string{"p2"}},
+		{"more released than received", []inventoryMovement{
+			received, move(INVENTORY_RELEASED, utils.ID_W1, "P1", "", -2), received,
+		}, false, map[string]int{"P1": 1}, map[string]int{}, nil},
+		{"carried over", []inventoryMovement{
+			move(INVENTORY_CARRIED, utils.ID_W2, "P5", "", 3),
+			move(INVENTORY_IDENTIFIED, utils.ID_W2, "P5", "p1", 0),
+		}, false, map[string]int{}, map[string]int{"P5": 3}, []string{"p1"}},
+		{"torn last line", []inventoryMovement{received, received}, true, map[string]int{"P1": 2}, map[string]int{}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inv := newInventory(newTestCompactedJournal(t, "inventory.jsonl"))
+			for _, m := range tt.movements {
+				inv.journal.Append(m)
+			}
+			if tt.torn {
+				tearLastLine(t, inv.journal)
+			}
+
+			if err := inv.load(); err != nil {
+				t.Fatal(err)
+			}
+			w1, w2 := inv.warehouses[utils.ID_W1], inv.warehouses[utils.ID_W2]
+			if !sameCounts(w1.kinds, tt.w1) || !sameCounts(w2.kinds, tt.w2) {
+				t.Fatalf("Expected W1 %v and W2 %v, got %v and %v", tt.w1, tt.w2, w1.kinds, w2.kinds)
+			}
+			var pieces []string
+			for _, piece := range append(w1.pieces, w2.pieces...) {
+				pieces = append(pieces, piece.ID)
+			}
+			if !reflect.DeepEqual(pieces, tt.pieces) {
+				t.Fatalf("Expected the pieces %v known, got %v", tt.pieces, pieces)
+			}
+		})
+	}
+}
+
+func TestInventoryCompaction(t *testing.T) {
+	journal := newTestCompactedJournal(t, "inventory.jsonl")
+	inv := newInventory(journal)
+	inv.received("P1")
+	inv.received("P1")
+	inv.identified("P1", "m1")
+	inv.stored(utils.ID_W2, "P5", "p1")
+
+	compactAtNextAppend(journal)
+	inv.received("P2")
+
+	restored := newInventory(journal)
+	if err := restored.load(); err != nil {
+		t.Fatal(err)
+	}
+	stock := newFinishedStock(newTestCompactedJournal(t, "stock.jsonl"))
+	want := inv.snapshot(map[string]int{}, stock)
+	got := restored.snapshot(map[string]int{}, stock)
+	for i := range want {
+		if !reflect.DeepEqual(got[i].Kinds, want[i].Kinds) || len(got[i].Pieces) != len(want[i].Pieces) {
+			t.Fatalf("Expected %s restored as %+v, got %+v", want[i].Warehouse, want[i], got[i])
+		}
+	}
+	if restored.warehouses[utils.ID_W1].find("m1") < 0 {
+		t.Fatal("Expected the identified material kept")
+	}
+}
@@ -0,0 +1,205 @@
+package sim
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mes/internal/net/plc"
+	"mes/internal/utils"
+	"os"
+	"sort"
+)
+
+// MachineLayout places a machine, and the tools it can hold, along the
+// conveyor of a processing line. The first tool is the one it starts with.
+type MachineLayout struct {
+	Name     string   `json:"name"`
+	Position int      `json:"position"`
+	Tools    []string `json:"tools"`
+}
+
+// LineLayout describes the conveyor of a processing line and its machines.
+// Pieces enter the conveyor at position 0 and leave it at the last one.
+type LineLayout struct {
+	ConveyorSize int             `json:"conveyor_size"`
+	Machines     []MachineLayout `json:"machines"`
+}
+
+func type1LineLayout() LineLayout {
+	return LineLayout{
+		ConveyorSize: LINE_CONVEYOR_SIZE,
+		Machines: []MachineLayout{
+			{Name: "M1", Position: LINE_DEFAULT_M1_POS, Tools: []string{utils.TOOL_1, utils.TOOL_2, utils.TOOL_3}},
+			{Name: "M2", Position: LINE_DEFAULT_M2_POS, Tools: []string{utils.TOOL_1, utils.TOOL_2, utils.TOOL_3}},
+		},
+	}
+}
+
+func type2LineLayout() LineLayout {
+	return LineLayout{
+		ConveyorSize: LINE_CONVEYOR_SIZE,
+		Machines: []MachineLayout{
+			{Name: "M3", Position: LINE_DEFAULT_M1_POS, Tools: []string{utils.TOOL_1, utils.TOOL_4, utils.TOOL_5}},
+			{Name: "M4", Position: LINE_DEFAULT_M2_POS, Tools: []string{utils.TOOL_1, utils.TOOL_4, utils.TOOL_6}},
+		},
+	}
+}
+
+// validate checks that the machines are placed between the entry and the
+// exit of the conveyor, in conveyor order, and that they hold known tools.
+func (ll LineLayout) validate() error {
+	// The entry slot waits for the PLC ack and the new piece moves to the
+	// next one, so a conveyor needs at least two slots
+	if ll.ConveyorSize < 2 {
+		return fmt.Errorf("[LineLayout] conveyor size must be at least 2, got %d", ll.ConveyorSize)
+	}
+	if len(ll.Machines) == 0 {
+		return fmt.Errorf("[LineLayout] a line needs at least one machine")
+	}
+
+	names := make(map[string]struct{}, len(ll.Machines))
+	previous := 0
+	for _, m := range ll.Machines {
+		if m.Name == "" {
+			return fmt.Errorf("[LineLayout] machine at position %d has no name", m.Position)
+		}
+		if _, ok := names[m.Name]; ok {
+			return fmt.Errorf("[LineLayout] duplicate machine %s", m.Name)
+		}
+		names[m.Name] = struct{}{}
+
+		if m.Position <= previous || m.Position >= ll.ConveyorSize {
+			return fmt.Errorf("[LineLayout] machine %s at position %d: positions must be "+
+				"increasing and between 1 and %d", m.Name, m.Position, ll.ConveyorSize-1)
+		}
+		previous = m.Position
+
+		if len(m.Tools) == 0 {
+			return fmt.Errorf("[LineLayout] machine %s has no tools", m.Name)
+		}
+		for _, tool := range m.Tools {
+			if ToolStrToInt(tool) == 0 {
+				return fmt.Errorf("[LineLayout] machine %s has unknown tool %q", m.Name, tool)
+			}
+		}
+	}
+	return nil
+}
+
+func newConveyor(layout LineLayout) []Conveyor {
+	conveyor := make([]Conveyor, layout.ConveyorSize)
+	for _, m := range layout.Machines {
+		conveyor[m.Position] = Conveyor{
+			item: nil,
+			machine: &Machine{
+				name:         m.Name,
+				selectedTool: m.Tools[0],
+				tools:        append([]string{}, m.Tools...),
+				blockedTools: map[string]uint{},
+			},
+		}
+	}
+	return conveyor
+}
+
+// layout returns the layout of the line conveyor, with the machines
+// holding their current tool first.
+func (pl *ProcessingLine) layout() LineLayout {
+	layout := LineLayout{ConveyorSize: len(pl.conveyorLine), Machines: []MachineLayout{}}
+	for _, pos := range pl.machinePositions() {
+		m := pl.conveyorLine[pos].machine
+		tools := []string{m.selectedTool}
+		for _, tool := range m.tools {
+			if tool != m.selectedTool {
+				tools = append(tools, tool)
+			}
+		}
+		layout.Machines = append(layout.Machines, MachineLayout{
+			Name:     m.name,
+			Position: pos,
+			Tools:    tools,
+		})
+	}
+	return layout
+}
+
+// SetLineLayouts replaces the conveyors of the given lines (line ID ->
+// layout). The lines must be idle. Pieces waiting on them are dispatched
+// again with the new machines.
+func SetLineLayouts(layouts map[string]LineLayout) error {
+	factory, mutex := getFactoryInstance()
+	defer mutex.Unlock()
+
+	lineIDs := make([]string, 0, len(layouts))
+	for lineID, layout := range layouts {
+		line, ok := factory.processLines[lineID]
+		if !ok || lineID == utils.ID_L0 {
+			return fmt.Errorf("[SetLineLayouts] unknown processing line %q", lineID)
+		}
+		if err := layout.validate(); err != nil {
+			return fmt.Errorf("[SetLineLayouts] line %s: %w", lineID, err)
+		}
+		if !line.readyForNext || line.claimPending || line.getNItemsInConveyor() > 0 {
+			return fmt.Errorf("[SetLineLayouts] line %s has pieces on its conveyor", lineID)
+		}
+		lineIDs = append(lineIDs, lineID)
+	}
+	sort.Strings(lineIDs)
+
+	for _, lineID := range lineIDs {
+		factory.applyLineLayout(factory.processLines[lineID], layouts[lineID])
+	}
+
+	for _, lineID := range lineIDs {
+		factory.redistributeWaiters(factory.processLines[lineID])
+	}
+	factory.adoptOrphanWaiters()
+	return nil
+}
+
+// applyLineLayout replaces the conveyor of an idle line. The downtime of
+// the machines removed from the line is forgotten, and the machines of the
+// new layout take the downtime declared for their names.
+func (f *factory) applyLineLayout(line *ProcessingLine, layout LineLayout) {
+	line.conveyorLine = newConveyor(layout)
+	if line.plc != nil {
+		line.plc.SetMachineCount(max(len(layout.Machines), plc.CELL_DEFAULT_MACHINES))
+	}
+	log.Printf("[factory.applyLineLayout] Line %s layout set to %+v\n", line.id, layout)
+
+	machines := make(map[string]struct{}, len(layout.Machines))
+	for _, m := range layout.Machines {
+		machines[m.Name] = struct{}{}
+	}
+	f.downtime.prune(line.id, machines)
+	f.refreshAvailability(line)
+}
+
+// LoadLineLayouts reads the layouts of the lines from a JSON file
+// (line ID -> layout) and applies them.
+func LoadLineLayouts(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	layouts := map[string]LineLayout{}
+	if err := json.Unmarshal(data, &layouts); err != nil {
+		return fmt.Errorf("[LoadLineLayouts] %s: %w", path, err)
+	}
+	return SetLineLayouts(layouts)
+}
+
+// LineLayouts returns the layout of every processing line (except L0).
+func LineLayouts() map[string]LineLayout {
+	factory, mutex := getFactoryInstance()
+	defer mutex.Unlock()
+
+	layouts := make(map[string]LineLayout)
+	for lineID, line := range factory.processLines {
+		if lineID != utils.ID_L0 {
+			layouts[lineID] = line.layout()
+		}
+	}
+	return layouts
+}
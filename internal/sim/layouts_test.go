@@ -0,0 +1,133 @@
+package sim
+
+import (
+	u "mes/internal/utils"
+	"testing"
+)
+
+func TestThreeMachineLayout(t *testing.T) {
+	layout := LineLayout{
+		ConveyorSize: 7,
+		Machines: []MachineLayout{
+			{Name: "MA", Position: 1, Tools: []string{u.TOOL_1, u.TOOL_2}},
+			{Name: "MB", Position: 3, Tools: []string{u.TOOL_4}},
+			{Name: "MC", Position: 5, Tools: []string{u.TOOL_3, u.TOOL_2}},
+		},
+	}
+	if err := layout.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	pLine := &ProcessingLine{
+		id:            u.ID_L1,
+		conveyorLine:  newConveyor(layout),
+		waitingPieces: []*freeLineWaiter{},
+		readyForNext:  true,
+	}
+	if positions := pLine.machinePositions(); len(positions) != 3 || positions[2] != 5 {
+		t.Fatalf("Unexpected machine positions %v", positions)
+	}
+
+	// MB cannot run T2, so the piece goes past it to MC
+	piece := &Piece{
+		Kind: u.P_KIND_1,
+		Steps: []Transformation{
+			{Tool: u.TOOL_1, Time: 30},
+			{Tool: u.TOOL_1, Time: 30},
+			{Tool: u.TOOL_2, Time: 20},
+		},
+	}
+	form := pLine.createBestForm(piece)
+	if form == nil || form.stepsCompleted != 3 {
+		t.Fatalf("Expected the whole recipe in one form, got %+v", form)
+	}
+	first, second, third := form.machines[0], form.machines[1], form.machines[2]
+	if !first.process || first.tool != u.TOOL_1 || first.repeat != 2 || first.change {
+		t.Fatalf("Unexpected command for MA %+v", first)
+	}
+	if second.process {
+		t.Fatalf("Expected MB to be skipped, got %+v", second)
+	}
+	if !third.process || third.tool != u.TOOL_2 || third.repeat != 1 || !third.change {
+		t.Fatalf("Unexpected command for MC %+v", third)
+	}
+	// 2*30 + 20 + one tool swap on MC
+	if form.intrinsicTime != 80+MACHINE_TOOL_SWAP_TIME {
+		t.Fatalf("Expected intrinsic time %d, got %d", 80+MACHINE_TOOL_SWAP_TIME, form.intrinsicTime)
+	}
+
+	// A piece starting with a tool only MC has starts there
+	piece = &Piece{Steps: []Transformation{{Tool: u.TOOL_3, Time: 10}}}
+	form = pLine.createBestForm(piece)
+	if form == nil || form.firstMachine() != 2 {
+		t.Fatalf("Expected a form starting on MC, got %+v", form)
+	}
+}
+
+func TestLineLayoutValidate(t *testing.T) {
+	invalid := []LineLayout{
+		{ConveyorSize: 1, Machines: []MachineLayout{{Name: "M1", Position: 1, Tools: []string{u.TOOL_1}}}},
+		{ConveyorSize: 5},
+		{ConveyorSize: 5, Machines: []MachineLayout{{Name: "M1", Position: 0, Tools: []string{u.TOOL_1}}}},
+		{ConveyorSize: 5, Machines: []MachineLayout{{Name: "M1", Position: 5, Tools: []string{u.TOOL_1}}}},
+		{ConveyorSize: 5, Machines: []MachineLayout{
+			{Name: "M1", Position: 3, Tools: []string{u.TOOL_1}},
+			{Name: "M2", Position: 1, Tools: []string{u.TOOL_1}},
+		}},
+		{ConveyorSize: 5, Machines: []MachineLayout{{Name: "M1", Position: 1, Tools: []string{"T9"}}}},
+	}
+	for _, layout := range invalid {
+		if err := layout.validate(); err == nil {
+			t.Fatalf("Expected layout %+v to be invalid", layout)
+		}
+	}
+
+	for _, layout := range []LineLayout{type1LineLayout(), type2LineLayout()} {
+		if err := layout.validate(); err != nil {
+			t.Fatalf("Default layout is invalid: %v", err)
+		}
+	}
+}
+
+func TestApplyLineLayoutPrunesRemovedMachines(t *testing.T) {
+	f := newTestFactory()
+	f.downtime = newDowntimeRegistry()
+	f.downtime.journal = newTestJournal(t, "downtime.jsonl")
+	scheduler, err := newScheduler(SCHEDULER_LENIENT, DefaultSchedulerOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.scheduler = scheduler
+
+	l1 := f.processLines[u.ID_L1]
+	f.setFault(l1, LINE_DEFAULT_M1_POS, true)
+	f.downtime.manual[downtimeTarget(u.ID_L1, "M2")] = "maintenance"
+	f.refreshAvailability(l1)
+	if !f.anyDown() {
+		t.Fatal("Expected M1 and M2 to be down")
+	}
+
+	// M1 is kept, M2 is replaced by M9
+	layout := type1LineLayout()
+	layout.Machines[1].Name = "M9"
+	f.applyLineLayout(l1, layout)
+
+	if _, ok := f.downtime.manual[downtimeTarget(u.ID_L1, "M2")]; ok {
+		t.Fatal("Expected the downtime of the removed machine to be cleared")
+	}
+	if _, ok := f.downtime.records[downtimeTarget(u.ID_L1, "M2")]; ok {
+		t.Fatal("Expected the availability of the removed machine to be forgotten")
+	}
+	if !f.downtime.faults[downtimeTarget(u.ID_L1, "M1")] {
+		t.Fatal("Expected the fault of the kept machine to stay")
+	}
+	if !l1.conveyorLine[LINE_DEFAULT_M1_POS].machine.down || l1.conveyorLine[LINE_DEFAULT_M2_POS].machine.down {
+		t.Fatal("Expected only the kept faulted machine to be down")
+	}
+
+	f.setFault(l1, LINE_DEFAULT_M1_POS, false)
+	f.refreshAvailability(l1)
+	if f.anyDown() {
+		t.Fatal("Expected no machine left down")
+	}
+}
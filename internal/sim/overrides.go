@@ -0,0 +1,328 @@
+package sim
+
+import (
+	"fmt"
+	"log"
+	"mes/internal/utils"
+	"time"
+)
+
+// Override actions
+const (
+	OVERRIDE_PIN          = "pin"          // dispatch a piece only to a given line
+	OVERRIDE_UNPIN        = "unpin"        // remove a pin
+	OVERRIDE_HOLD         = "hold"         // keep a piece in the warehouse
+	OVERRIDE_RELEASE      = "release"      // let a held piece be dispatched again
+	OVERRIDE_BLOCK_TOOL   = "block-tool"   // forbid a tool on a machine
+	OVERRIDE_UNBLOCK_TOOL = "unblock-tool" // allow a blocked tool again
+	OVERRIDE_PRIORITY     = "priority"     // set the priority class of a piece
+	OVERRIDE_EXPEDITE     = "expedite"     // move a piece and its delivery to the front
+)
+
+// Override is a manual dispatching instruction given by a supervisor.
+// Pieces are identified by their current ERP identifier.
+type Override struct {
+	Action    string `json:"action"`
+	PieceID   string `json:"piece_id"`
+	LineID    string `json:"line_id"`
+	MachineID string `json:"machine_id"`
+	Tool      string `json:"tool"`
+	// Last day (inclusive) a tool block is in effect, 0 for no limit
+	UntilDay uint   `json:"until_day"`
+	Operator string `json:"operator"`
+	Reason   string `json:"reason"`
+	// Priority class set by the priority action
+	Priority int `json:"priority"`
+}
+
+// OverrideAuditEntry is an override as recorded in the audit log.
+type OverrideAuditEntry struct {
+	Time time.Time `json:"time"`
+	Override
+	Error string `json:"error"`
+}
+
+// ActiveOverrides lists the overrides currently in effect.
+type ActiveOverrides struct {
+	Pins         map[string]string `json:"pins"`  // piece ID -> line ID
+	Holds        map[string]string `json:"holds"` // piece ID -> reason
+	BlockedTools []Override        `json:"blocked_tools"`
+	// Priority of the deliveries of orders with prioritised pieces
+	OrderPriorities map[string]int `json:"order_priorities"`
+}
+
+type overrideRegistry struct {
+	pins  map[string]string // piece ID -> line ID
+	holds map[string]string // piece ID -> reason
+	// plan key -> priority class set by an operator since the piece's release
+	priorities map[string]int
+	// order ID -> plan key of its pieces -> priority class set by an operator
+	piecePriorities map[string]map[string]int
+	audit           []OverrideAuditEntry
+	journal         *utils.JSONLog
+}
+
+func newOverrideRegistry() *overrideRegistry {
+	return &overrideRegistry{
+		pins:            make(map[string]string),
+		holds:           make(map[string]string),
+		priorities:      make(map[string]int),
+		piecePriorities: make(map[string]map[string]int),
+		audit:           []OverrideAuditEntry{},
+		journal:         utils.NewJSONLog(OVERRIDES_AUDIT_LOG_PATH),
+	}
+}
+
+func (or *overrideRegistry) record(o Override, err error) {
+	entry := OverrideAuditEntry{Time: time.Now(), Override: o}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	or.audit = append(or.audit, entry)
+	log.Printf("[overrideRegistry.record] %s by %q: %+v (error: %v)\n",
+		o.Action, o.Operator, o, err)
+	or.journal.Append(entry)
+}
+
+// setPiecePriority records the priority an operator set on a piece of the
+// order.
+func (or *overrideRegistry) setPiecePriority(orderID string, key string, priority int) {
+	pieces, ok := or.piecePriorities[orderID]
+	if !ok {
+		pieces = make(map[string]int)
+		or.piecePriorities[orderID] = pieces
+	}
+	pieces[key] = priority
+}
+
+// orderPriority returns the priority of the delivery of the order: the
+// highest priority an operator set on its pieces.
+func (or *overrideRegistry) orderPriority(orderID string) int {
+	priority := PRIORITY_NORMAL
+	for _, piecePriority := range or.piecePriorities[orderID] {
+		priority = max(priority, piecePriority)
+	}
+	return priority
+}
+
+// isToolBlocked reports whether the tool is forbidden on the machine today.
+func (m *Machine) isToolBlocked(tool string) bool {
+	untilDay, ok := m.blockedTools[tool]
+	if !ok {
+		return false
+	}
+	today, _ := simCalendar.today()
+	return untilDay == 0 || today <= untilDay
+}
+
+// findWaiter returns the waiter of the piece if it is waiting for a line.
+func (f *factory) findWaiter(pieceID string) *freeLineWaiter {
+	for _, line := range f.processLines {
+		line.pruneDeadWaiters()
+		for _, w := range line.waitingPieces {
+			if w.piece.ErpIdentifier == pieceID {
+				return w
+			}
+		}
+	}
+	for _, w := range f.orphanWaiters {
+		if w.piece.ErpIdentifier == pieceID {
+			return w
+		}
+	}
+	return nil
+}
+
+// applyPin registers the waiter only with the line its piece is pinned to.
+// Returns false if the piece is not pinned, is not in W1 (pieces in W2 only
+// leave it through L0), or the line cannot process it.
+func (f *factory) applyPin(w *freeLineWaiter) bool {
+	lineID, ok := f.overrides.pins[w.piece.ErpIdentifier]
+	if !ok || w.piece.Location != utils.ID_W1 {
+		return false
+	}
+
+	pinned := f.processLines[lineID]
+	if !pinned.isAvailableFor(w.piece) {
+		log.Printf("[factory.applyPin] line %s cannot process pinned piece %s\n",
+			lineID, w.piece.ErpIdentifier)
+		return false
+	}
+
+	for _, line := range append([]*ProcessingLine{}, w.lines...) {
+		if line == pinned {
+			continue
+		}
+		w.removeLine(line)
+		line.removeWaiter(w)
+	}
+	if !w.isRegisteredWith(pinned) {
+		pinned.registerWaitingPiece(w)
+	}
+	dispatchDecisions.annotate(w.decision, fmt.Sprintf("pinned to line %s", lineID))
+	return true
+}
+
+// ApplyOverride executes a supervisor's override and records it in the
+// audit log, whether it succeeds or not.
+func ApplyOverride(o Override) error {
+	factory, mutex := getFactoryInstance()
+	defer mutex.Unlock()
+
+	return factory.applyOverride(o)
+}
+
+func (f *factory) applyOverride(o Override) (err error) {
+	defer func() { f.overrides.record(o, err) }()
+
+	switch o.Action {
+	case OVERRIDE_PIN:
+		if _, ok := f.processLines[o.LineID]; !ok || o.LineID == utils.ID_L0 {
+			return fmt.Errorf("[ApplyOverride] cannot pin to line %q", o.LineID)
+		}
+		if o.PieceID == "" {
+			return fmt.Errorf("[ApplyOverride] missing piece")
+		}
+		w := f.findWaiter(o.PieceID)
+		if w != nil && w.piece.Location != utils.ID_W1 {
+			return fmt.Errorf("[ApplyOverride] piece %s is in %s and can only leave it through %s",
+				o.PieceID, w.piece.Location, utils.ID_L0)
+		}
+		// A pin the line cannot honour is not kept, the previous one (if
+		// any) stays in effect
+		previous, wasPinned := f.overrides.pins[o.PieceID]
+		f.overrides.pins[o.PieceID] = o.LineID
+		if w != nil && !f.applyPin(w) {
+			if wasPinned {
+				f.overrides.pins[o.PieceID] = previous
+			} else {
+				delete(f.overrides.pins, o.PieceID)
+			}
+			return fmt.Errorf("[ApplyOverride] line %s cannot process piece %s",
+				o.LineID, o.PieceID)
+		}
+
+	case OVERRIDE_UNPIN:
+		if _, ok := f.overrides.pins[o.PieceID]; !ok {
+			return fmt.Errorf("[ApplyOverride] piece %q is not pinned", o.PieceID)
+		}
+		delete(f.overrides.pins, o.PieceID)
+
+	case OVERRIDE_HOLD:
+		if o.PieceID == "" {
+			return fmt.Errorf("[ApplyOverride] missing piece")
+		}
+		f.overrides.holds[o.PieceID] = o.Reason
+		if w := f.findWaiter(o.PieceID); w != nil {
+			w.held = true
+		}
+
+	case OVERRIDE_RELEASE:
+		if _, ok := f.overrides.holds[o.PieceID]; !ok {
+			return fmt.Errorf("[ApplyOverride] piece %q is not held", o.PieceID)
+		}
+		delete(f.overrides.holds, o.PieceID)
+		if w := f.findWaiter(o.PieceID); w != nil {
+			w.held = false
+		}
+
+	case OVERRIDE_BLOCK_TOOL, OVERRIDE_UNBLOCK_TOOL:
+		line, err := f.findTarget(o.LineID, o.MachineID)
+		if err != nil {
+			return err
+		}
+		if o.MachineID == "" {
+			return fmt.Errorf("[ApplyOverride] missing machine")
+		}
+
+		for _, conveyor := range line.conveyorLine {
+			m := conveyor.machine
+			if m == nil || m.name != o.MachineID {
+				continue
+			}
+			if o.Action == OVERRIDE_UNBLOCK_TOOL {
+				delete(m.blockedTools, o.Tool)
+				continue
+			}
+			if !m.hasTool(o.Tool) {
+				return fmt.Errorf("[ApplyOverride] machine %s has no tool %q", m.name, o.Tool)
+			}
+			m.blockedTools[o.Tool] = o.UntilDay
+		}
+		f.redistributeWaiters(line)
+		f.adoptOrphanWaiters()
+
+	case OVERRIDE_PRIORITY:
+		if err := validatePriority(o.Priority); err != nil {
+			return err
+		}
+		return f.setPiecePriority(o.PieceID, o.Priority)
+
+	case OVERRIDE_EXPEDITE:
+		if f.expeditedCount() >= MAX_EXPEDITED_PIECES {
+			return fmt.Errorf("[ApplyOverride] already %d pieces expedited, "+
+				"lower the priority of one first", MAX_EXPEDITED_PIECES)
+		}
+		return f.setPiecePriority(o.PieceID, PRIORITY_EXPEDITED)
+
+	default:
+		return fmt.Errorf("[ApplyOverride] unknown action %q", o.Action)
+	}
+
+	return nil
+}
+
+// Overrides returns the overrides currently in effect.
+func Overrides() ActiveOverrides {
+	factory, mutex := getFactoryInstance()
+	defer mutex.Unlock()
+
+	active := ActiveOverrides{
+		Pins:            make(map[string]string),
+		Holds:           make(map[string]string),
+		BlockedTools:    []Override{},
+		OrderPriorities: make(map[string]int),
+	}
+	for orderID := range factory.overrides.piecePriorities {
+		if priority := factory.overrides.orderPriority(orderID); priority > PRIORITY_NORMAL {
+			active.OrderPriorities[orderID] = priority
+		}
+	}
+	for pieceID, lineID := range factory.overrides.pins {
+		active.Pins[pieceID] = lineID
+	}
+	for pieceID, reason := range factory.overrides.holds {
+		active.Holds[pieceID] = reason
+	}
+	for _, line := range factory.processLines {
+		for _, conveyor := range line.conveyorLine {
+			m := conveyor.machine
+			if m == nil {
+				continue
+			}
+			for tool, untilDay := range m.blockedTools {
+				if m.isToolBlocked(tool) {
+					active.BlockedTools = append(active.BlockedTools, Override{
+						Action:    OVERRIDE_BLOCK_TOOL,
+						LineID:    line.id,
+						MachineID: m.name,
+						Tool:      tool,
+						UntilDay:  untilDay,
+					})
+				}
+			}
+		}
+	}
+	return active
+}
+
+// OverridesAudit returns every override received, oldest first.
+func OverridesAudit() []OverrideAuditEntry {
+	factory, mutex := getFactoryInstance()
+	defer mutex.Unlock()
+
+	audit := make([]OverrideAuditEntry, len(factory.overrides.audit))
+	copy(audit, factory.overrides.audit)
+	return audit
+}
@@ -0,0 +1,353 @@
+package sim
+
+import (
+	u "mes/internal/utils"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newOverridesTestFactory(t *testing.T) *factory {
+	f := newTestFactory()
+	f.overrides = newOverrideRegistry()
+	f.overrides.journal = newTestJournal(t, "overrides.jsonl")
+
+	scheduler, err := newScheduler(SCHEDULER_LENIENT, DefaultSchedulerOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.scheduler = scheduler
+	return f
+}
+
+// newWaitingPiece registers a piece needing the tool with the given lines.
+func newWaitingPiece(f *factory, pieceID string, tool string, lineIDs ...string) *freeLineWaiter {
+	w := &freeLineWaiter{
+		piece: &Piece{
+			ErpIdentifier: pieceID,
+			OrderID:       "order-" + pieceID,
+			Location:      u.ID_W1,
+			Steps:         []Transformation{{MaterialID: pieceID, Tool: tool, Time: 30}},
+		},
+		pieceClaimedCh: make(chan struct{}),
+		claimCountLock: &sync.Mutex{},
+	}
+	for _, lineID := range lineIDs {
+		f.processLines[lineID].registerWaitingPiece(w)
+	}
+	return w
+}
+
+func waiterLineIDs(w *freeLineWaiter) []string {
+	ids := []string{}
+	for _, line := range w.lines {
+		ids = append(ids, line.id)
+	}
+	return ids
+}
+
+func TestOverridePinRejected(t *testing.T) {
+	tests := []struct {
+		name     string
+		override Override
+	}{
+		{"warehouse line", Override{Action: OVERRIDE_PIN, PieceID: "p1", LineID: u.ID_L0}},
+		{"unknown line", Override{Action: OVERRIDE_PIN, PieceID: "p1", LineID: "L9"}},
+		{"missing piece", Override{Action: OVERRIDE_PIN, LineID: u.ID_L4}},
+		// Only type 2 lines have T4
+		{"incapable line", Override{Action: OVERRIDE_PIN, PieceID: "p1", LineID: u.ID_L1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newOverridesTestFactory(t)
+			w := newWaitingPiece(f, "p1", u.TOOL_4, u.ID_L4, u.ID_L5)
+
+			if err := f.applyOverride(tt.override); err == nil {
+				t.Fatalf("Expected the pin to be rejected")
+			}
+			if _, ok := f.overrides.pins["p1"]; ok {
+				t.Fatalf("Expected a rejected pin not to be kept, got %v", f.overrides.pins)
+			}
+			if lines := waiterLineIDs(w); len(lines) != 2 {
+				t.Fatalf("Expected the piece to still wait on both lines, got %v", lines)
+			}
+		})
+	}
+}
+
+func TestOverridePinRejectsW2Piece(t *testing.T) {
+	f := newOverridesTestFactory(t)
+	l0 := &ProcessingLine{id: u.ID_L0, waitingPieces: []*freeLineWaiter{}}
+	f.processLines[u.ID_L0] = l0
+
+	// Halfway through its recipe, waiting in W2 to be taken back to W1
+	w := newWaitingPiece(f, "p1", u.TOOL_4, u.ID_L0)
+	w.piece.Location = u.ID_W2
+
+	if err := f.applyOverride(Override{Action: OVERRIDE_PIN, PieceID: "p1", LineID: u.ID_L4}); err == nil {
+		t.Fatal("Expected a pin of a piece in W2 to be rejected")
+	}
+	if _, ok := f.overrides.pins["p1"]; ok {
+		t.Fatalf("Expected the pin not to be kept, got %v", f.overrides.pins)
+	}
+	if lines := waiterLineIDs(w); len(lines) != 1 || lines[0] != u.ID_L0 {
+		t.Fatalf("Expected the piece to still wait on L0 only, got %v", lines)
+	}
+
+	// A pin kept from before the piece reached W2 is not applied either
+	f.overrides.pins["p1"] = u.ID_L4
+	if f.applyPin(w) {
+		t.Fatal("Expected the pin not to apply to a piece in W2")
+	}
+	if lines := waiterLineIDs(w); len(lines) != 1 || lines[0] != u.ID_L0 {
+		t.Fatalf("Expected the piece to still wait on L0 only, got %v", lines)
+	}
+}
+
+func TestOverridePinKeepsPreviousOnRejection(t *testing.T) {
+	f := newOverridesTestFactory(t)
+	w := newWaitingPiece(f, "p1", u.TOOL_4, u.ID_L4, u.ID_L5)
+
+	if err := f.applyOverride(Override{Action: OVERRIDE_PIN, PieceID: "p1", LineID: u.ID_L5}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.applyOverride(Override{Action: OVERRIDE_PIN, PieceID: "p1", LineID: u.ID_L2}); err == nil {
+		t.Fatalf("Expected a pin to a line without T4 to be rejected")
+	}
+
+	if lineID := f.overrides.pins["p1"]; lineID != u.ID_L5 {
+		t.Fatalf("Expected the previous pin to stay in effect, got %q", lineID)
+	}
+	if lines := waiterLineIDs(w); len(lines) != 1 || lines[0] != u.ID_L5 {
+		t.Fatalf("Expected the piece to wait only on %s, got %v", u.ID_L5, lines)
+	}
+}
+
+func TestOverridePinAndUnpin(t *testing.T) {
+	f := newOverridesTestFactory(t)
+	w := newWaitingPiece(f, "p1", u.TOOL_4, u.ID_L4, u.ID_L5, u.ID_L6)
+
+	if err := f.applyOverride(Override{Action: OVERRIDE_PIN, PieceID: "p1", LineID: u.ID_L6}); err != nil {
+		t.Fatal(err)
+	}
+	if lines := waiterLineIDs(w); len(lines) != 1 || lines[0] != u.ID_L6 {
+		t.Fatalf("Expected the piece to wait only on %s, got %v", u.ID_L6, lines)
+	}
+	for _, lineID := range []string{u.ID_L4, u.ID_L5} {
+		if n := len(f.processLines[lineID].waitingPieces); n != 0 {
+			t.Fatalf("Expected line %s to have no waiter, got %d", lineID, n)
+		}
+	}
+
+	if err := f.applyOverride(Override{Action: OVERRIDE_UNPIN, PieceID: "p1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.overrides.pins["p1"]; ok {
+		t.Fatalf("Expected the pin to be removed")
+	}
+	if err := f.applyOverride(Override{Action: OVERRIDE_UNPIN, PieceID: "p1"}); err == nil {
+		t.Fatalf("Expected unpinning a piece that is not pinned to fail")
+	}
+}
+
+func TestOverrideHoldAndRelease(t *testing.T) {
+	f := newOverridesTestFactory(t)
+	w := newWaitingPiece(f, "p1", u.TOOL_1, u.ID_L1)
+
+	if err := f.applyOverride(Override{Action: OVERRIDE_RELEASE, PieceID: "p1"}); err == nil {
+		t.Fatalf("Expected releasing a piece that is not held to fail")
+	}
+	if err := f.applyOverride(Override{Action: OVERRIDE_HOLD, Reason: "inspection"}); err == nil {
+		t.Fatalf("Expected a hold without a piece to fail")
+	}
+
+	if err := f.applyOverride(Override{Action: OVERRIDE_HOLD, PieceID: "p1", Reason: "inspection"}); err != nil {
+		t.Fatal(err)
+	}
+	if !w.held || f.overrides.holds["p1"] != "inspection" {
+		t.Fatalf("Expected the piece to be held, got held=%t holds=%v", w.held, f.overrides.holds)
+	}
+
+	if err := f.applyOverride(Override{Action: OVERRIDE_RELEASE, PieceID: "p1"}); err != nil {
+		t.Fatal(err)
+	}
+	if w.held || len(f.overrides.holds) != 0 {
+		t.Fatalf("Expected the piece to be released, got held=%t holds=%v", w.held, f.overrides.holds)
+	}
+}
+
+func TestOverrideBlockTool(t *testing.T) {
+	f := newOverridesTestFactory(t)
+	// Only the bottom machine (M4) of type 2 lines has T6
+	w := newWaitingPiece(f, "p1", u.TOOL_6, u.ID_L4, u.ID_L5)
+	m4 := f.processLines[u.ID_L4].conveyorLine[LINE_DEFAULT_M2_POS].machine
+
+	if err := f.applyOverride(Override{
+		Action: OVERRIDE_BLOCK_TOOL, LineID: u.ID_L4, MachineID: "M3", Tool: u.TOOL_6,
+	}); err == nil {
+		t.Fatalf("Expected blocking a tool the machine does not have to fail")
+	}
+	if err := f.applyOverride(Override{
+		Action: OVERRIDE_BLOCK_TOOL, LineID: u.ID_L4, MachineID: "M1", Tool: u.TOOL_1,
+	}); err == nil {
+		t.Fatalf("Expected blocking a tool on an unknown machine to fail")
+	}
+
+	if err := f.applyOverride(Override{
+		Action: OVERRIDE_BLOCK_TOOL, LineID: u.ID_L4, MachineID: "M4", Tool: u.TOOL_6,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !m4.isToolBlocked(u.TOOL_6) {
+		t.Fatalf("Expected T6 to be blocked on M4")
+	}
+	if lines := waiterLineIDs(w); len(lines) != 1 || lines[0] != u.ID_L5 {
+		t.Fatalf("Expected the piece to wait only on %s, got %v", u.ID_L5, lines)
+	}
+
+	if err := f.applyOverride(Override{
+		Action: OVERRIDE_UNBLOCK_TOOL, LineID: u.ID_L4, MachineID: "M4", Tool: u.TOOL_6,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if m4.isToolBlocked(u.TOOL_6) {
+		t.Fatalf("Expected T6 to be allowed on M4 again")
+	}
+}
+
+func TestOverridePriority(t *testing.T) {
+	tests := []struct {
+		name     string
+		override Override
+		wantErr  bool
+	}{
+		{"set", Override{Action: OVERRIDE_PRIORITY, PieceID: "p1", Priority: PRIORITY_HIGH}, false},
+		{"expedited class", Override{Action: OVERRIDE_PRIORITY, PieceID: "p1", Priority: PRIORITY_EXPEDITED}, true},
+		{"below normal", Override{Action: OVERRIDE_PRIORITY, PieceID: "p1", Priority: PRIORITY_NORMAL - 1}, true},
+		{"unknown piece", Override{Action: OVERRIDE_PRIORITY, PieceID: "p9", Priority: PRIORITY_HIGH}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newOverridesTestFactory(t)
+			w := newWaitingPiece(f, "p1", u.TOOL_1, u.ID_L1)
+
+			err := f.applyOverride(tt.override)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %t, got %v", tt.wantErr, err)
+			}
+			if tt.wantErr {
+				if w.priority != PRIORITY_NORMAL || len(f.overrides.priorities) != 0 ||
+					len(f.overrides.piecePriorities) != 0 {
+					t.Fatalf("Expected a rejected priority to change nothing, got %d %v",
+						w.priority, f.overrides.piecePriorities)
+				}
+				return
+			}
+			if w.priority != tt.override.Priority || f.piecePriority(w.piece) != tt.override.Priority {
+				t.Fatalf("Expected priority %d, got %d", tt.override.Priority, w.priority)
+			}
+			if w.piece.Priority != PRIORITY_NORMAL {
+				t.Fatalf("Expected the piece itself left to its tracker, got priority %d", w.piece.Priority)
+			}
+			if p := f.overrides.orderPriority(w.piece.OrderID); p != tt.override.Priority {
+				t.Fatalf("Expected the order to take priority %d, got %d", tt.override.Priority, p)
+			}
+		})
+	}
+}
+
+func TestOverridePriorityOfConveyorPiece(t *testing.T) {
+	f := newOverridesTestFactory(t)
+
+	// The tracker has transformed the piece since it was dispatched
+	live := &Piece{
+		ErpIdentifier: "p1-product",
+		OrderID:       "order",
+		Steps:         []Transformation{{MaterialID: "p1", Tool: u.TOOL_1}},
+		CurrentStep:   1,
+	}
+	dispatched := *live
+	dispatched.ErpIdentifier, dispatched.CurrentStep = "p1", 0
+	f.processLines[u.ID_L1].conveyorLine[1].item = &conveyorItem{piece: live, dispatched: dispatched}
+
+	if err := f.applyOverride(Override{Action: OVERRIDE_EXPEDITE, PieceID: "p1"}); err != nil {
+		t.Fatal(err)
+	}
+	if live.Priority != PRIORITY_NORMAL {
+		t.Fatalf("Expected the live piece not to be written, got priority %d", live.Priority)
+	}
+	if p := f.piecePriority(live); p != PRIORITY_EXPEDITED {
+		t.Fatalf("Expected the piece to wait for its next line expedited, got %d", p)
+	}
+	if f.expeditedCount() != 1 || f.overrides.orderPriority("order") != PRIORITY_EXPEDITED {
+		t.Fatalf("Expected the piece and its order expedited, got %d pieces, order at %d",
+			f.expeditedCount(), f.overrides.orderPriority("order"))
+	}
+}
+
+func TestOverridePriorityFollowsOrderPieces(t *testing.T) {
+	f := newOverridesTestFactory(t)
+	first := newWaitingPiece(f, "p1", u.TOOL_1, u.ID_L1)
+	second := newWaitingPiece(f, "p2", u.TOOL_1, u.ID_L2)
+	first.piece.OrderID, second.piece.OrderID = "order", "order"
+
+	steps := []struct {
+		pieceID  string
+		priority int
+		want     int
+	}{
+		{"p1", PRIORITY_HIGH, PRIORITY_HIGH},
+		{"p2", PRIORITY_URGENT, PRIORITY_URGENT},
+		// Lowering a piece lowers the order to its other pieces
+		{"p2", PRIORITY_NORMAL, PRIORITY_HIGH},
+		{"p1", PRIORITY_NORMAL, PRIORITY_NORMAL},
+	}
+	for _, step := range steps {
+		o := Override{Action: OVERRIDE_PRIORITY, PieceID: step.pieceID, Priority: step.priority}
+		if err := f.applyOverride(o); err != nil {
+			t.Fatal(err)
+		}
+		if p := f.overrides.orderPriority("order"); p != step.want {
+			t.Fatalf("Expected the order at priority %d after setting %s to %d, got %d",
+				step.want, step.pieceID, step.priority, p)
+		}
+	}
+}
+
+func TestOverrideAuditRecordsEveryOverride(t *testing.T) {
+	f := newOverridesTestFactory(t)
+	newWaitingPiece(f, "p1", u.TOOL_4, u.ID_L4)
+
+	overrides := []Override{
+		{Action: OVERRIDE_PIN, PieceID: "p1", LineID: u.ID_L4, Operator: "ana"},
+		{Action: OVERRIDE_PIN, PieceID: "p1", LineID: u.ID_L1, Operator: "ana"},
+		{Action: "teleport", PieceID: "p1", Operator: "rui"},
+	}
+	for _, o := range overrides {
+		f.applyOverride(o)
+	}
+
+	audit := f.overrides.audit
+	if len(audit) != len(overrides) {
+		t.Fatalf("Expected %d audit entries, got %d", len(overrides), len(audit))
+	}
+	if audit[0].Error != "" {
+		t.Fatalf("Expected the first pin to succeed, got %q", audit[0].Error)
+	}
+	if !strings.Contains(audit[1].Error, "cannot process") {
+		t.Fatalf("Expected the rejected pin to be recorded with its error, got %q", audit[1].Error)
+	}
+	if audit[2].Action != "teleport" || !strings.Contains(audit[2].Error, "unknown action") {
+		t.Fatalf("Expected the unknown action to be recorded, got %+v", audit[2])
+	}
+
+	entries, err := u.ReadJSONLog[OverrideAuditEntry](f.overrides.journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(overrides) || entries[1].Operator != "ana" {
+		t.Fatalf("Expected the journal to hold every override, got %+v", entries)
+	}
+}
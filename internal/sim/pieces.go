@@ -84,6 +84,16 @@ type Piece struct {
 	Steps         []Transformation `json:"steps"`
 	CurrentStep   int
 	ControlID     int16
+
+	// Client order the piece is produced for and the day it is due.
+	// A zero DueDate means the ERP did not set a deadline.
+	OrderID string `json:"order_id"`
+	DueDate uint   `json:"due_date"`
+	// Priority class (PRIORITY_*), higher classes go first
+	Priority int `json:"priority"`
+
+	// Planned line visits to complete the remaining steps of the recipe
+	route []routeLeg
 }
 
 func (p *Piece) exitToProdLine(lineID string) *WarehouseExitForm {
@@ -157,6 +167,7 @@ func GetPieces(ctx context.Context, quantity uint) ([]Piece, error) {
 		pieceRecipes[idx].Kind = initStep.MaterialKind
 		pieceRecipes[idx].ErpIdentifier = initStep.MaterialID
 		pieceRecipes[idx].Location = utils.ID_W1
+		pieceRecipes[idx].Priority = clampPriority(pieceRecipes[idx].Priority)
 	}
 
 	return pieceRecipes, nil
@@ -200,9 +211,29 @@ func StartPieceHandler(ctx context.Context) *PieceHandler {
 	piecePool := make(map[string]struct{})
 	piecePoolLock := sync.Mutex{}
 
-	pieceTracker := func(ctx context.Context, piece Piece) {
+	if err := stockroom.load(); err != nil {
+		log.Printf("[PieceHandler] failed to restore inventory: %v\n", err)
+	}
+	if err := pieceTraces.load(); err != nil {
+		log.Printf("[PieceHandler] failed to restore piece traces: %v\n", err)
+	}
+	if err := audits.load(); err != nil {
+		log.Printf("[PieceHandler] failed to restore audits: %v\n", err)
+	}
+
+	pieceTracker := func(ctx context.Context, piece *Piece, awaitLine func(context.Context) *itemHandler) {
 		var handler *itemHandler
 
+		// Released pieces are bound for W2, and give back whatever room
+		// they are still counted for if the tracker ends early
+		bound := warehouseBound.forPiece(utils.ID_W2)
+		defer bound.release()
+
+		if piece.CurrentStep == 0 && piece.Location == utils.ID_W1 {
+			stockroom.identified(piece.Kind, piece.ErpIdentifier)
+			pieceTraces.identified(piece)
+		}
+
 		log.Printf("[PieceHandler] Handling piece %v transform from %v to %v)\n",
 			piece.Steps[0].MaterialID,
 			piece.Steps[0].MaterialKind,
@@ -212,7 +243,11 @@ func StartPieceHandler(ctx context.Context) *PieceHandler {
 	StepLoop:
 		for piece.CurrentStep < len(piece.Steps) {
 
-			handler = sendToProduction(ctx, &piece)
+			if awaitLine == nil {
+				awaitLine = registerForProduction(piece)
+			}
+			handler = awaitLine(ctx)
+			awaitLine = nil
 			log.Printf("[PieceHandler] Piece %v sent to production at step (%d of %d)\n",
 				piece.ErpIdentifier,
 				piece.CurrentStep,
@@ -232,6 +267,19 @@ func StartPieceHandler(ctx context.Context) *PieceHandler {
 				case line, open := <-handler.lineEntryCh:
 					utils.Assert(open, "[PieceHandler] lineEntryCh closed")
 
+					stockroom.released(piece.Location, piece.Kind, piece.ErpIdentifier)
+					pieceTraces.exited(piece, piece.Location, line)
+					// Taken out of W2 to W1 by L0, then back to W2 by its next line
+					if piece.Location == utils.ID_W2 {
+						bound.bound(utils.ID_W1)
+						bound.bound(utils.ID_W2)
+					}
+
+					// Room in W1 may let deferred shipments in
+					if piece.Location == utils.ID_W1 {
+						shipmentReceipts.moved(-1)
+						deferredShipments.wakeUp()
+					}
 					if err := piece.exitToProdLine(line).Post(ctx); err != nil {
 						errCh <- fmt.Errorf(
 							"[PieceHandler] Piece %s failed to post warehouse exit: %w",
@@ -262,6 +310,7 @@ func StartPieceHandler(ctx context.Context) *PieceHandler {
 							err,
 						)
 					}
+					pieceTraces.transformed(piece, line, machine, toolChange)
 					log.Printf(
 						"[PieceHandler] Piece %v transformed at line %s, by machine %s (step %d of %d)\n",
 						piece.ErpIdentifier, line, machine, piece.CurrentStep, len(piece.Steps))
@@ -272,6 +321,7 @@ func StartPieceHandler(ctx context.Context) *PieceHandler {
 					wID := utils.ID_W2
 					if line == utils.ID_L0 {
 						wID = utils.ID_W1
+						shipmentReceipts.moved(1)
 					}
 
 					// Ack the warehouse entry
@@ -302,6 +352,13 @@ func StartPieceHandler(ctx context.Context) *PieceHandler {
 						piece.ErpIdentifier,
 						wID,
 					)
+					if wID == utils.ID_W2 && piece.CurrentStep == len(piece.Steps) {
+						w2Stock.stored(piece.Kind, piece.ErpIdentifier)
+					} else {
+						stockroom.stored(wID, piece.Kind, piece.ErpIdentifier)
+					}
+					pieceTraces.stored(piece, line, wID)
+					bound.arrived(wID)
 
 					continue StepLoop
 				}
@@ -309,11 +366,23 @@ func StartPieceHandler(ctx context.Context) *PieceHandler {
 		}
 
 		piece.validateCompletion()
+		forgetPiecePriority(piece)
+		pieceReleaseQueue.finish()
+
 		piecePoolLock.Lock()
 		defer piecePoolLock.Unlock()
 		delete(piecePool, piece.ErpIdentifier)
 	}
 
+	// startTrackers registers the released pieces with the lines in release
+	// order, most urgent first, and only then lets their trackers run
+	startTrackers := func(pieces []Piece) {
+		for i := range pieces {
+			piece := &pieces[i]
+			go pieceTracker(ctx, piece, registerForProduction(piece))
+		}
+	}
+
 	go func() {
 		defer close(errCh)
 		defer close(wakeUpCh)
@@ -323,6 +392,9 @@ func StartPieceHandler(ctx context.Context) *PieceHandler {
 			case <-ctx.Done():
 				return
 
+			case <-pieceReleaseQueue.wakeCh:
+				startTrackers(releasePieces())
+
 			case _, open := <-wakeUpCh:
 				utils.Assert(open, "[PieceHandler] wakeUpCh closed")
 
@@ -333,18 +405,24 @@ func StartPieceHandler(ctx context.Context) *PieceHandler {
 					// waken up when there are new pieces to handle
 					utils.Assert(len(newPieces) > 0, "[PieceHandler] No new pieces to handle")
 
+					// New pieces wait in the release queue, most urgent first,
+					// until the WIP cap allows them to start production
 					func() {
 						piecePoolLock.Lock()
 						defer piecePoolLock.Unlock()
 
+						queued := make([]Piece, 0, len(newPieces))
 						for _, piece := range newPieces {
 							if _, ok := piecePool[piece.ErpIdentifier]; !ok {
 								piecePool[piece.ErpIdentifier] = struct{}{}
-								go pieceTracker(ctx, piece)
+								queued = append(queued, piece)
 							}
 						}
+						recordDemand(queued)
+						pieceReleaseQueue.enqueue(queued)
 					}()
 
+					startTrackers(releasePieces())
 				}
 			}
 		}
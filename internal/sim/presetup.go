@@ -0,0 +1,183 @@
+package sim
+
+import (
+	"context"
+	"log"
+	"mes/internal/utils"
+	"slices"
+	"sort"
+)
+
+// isIdle reports whether the line has nothing on its conveyor, no piece
+// about to enter it and no piece it could claim.
+func (pl *ProcessingLine) isIdle() bool {
+	if !pl.readyForNext || pl.claimPending || pl.down || pl.getNItemsInConveyor() > 0 {
+		return false
+	}
+
+	pl.pruneDeadWaiters()
+	for _, w := range pl.waitingPieces {
+		if !w.held {
+			return false
+		}
+	}
+	return true
+}
+
+// upcomingPieces returns the work expected to need a processing line soon:
+// the pieces waiting for a line, and the pieces on a conveyor whose planned
+// route continues after the current leg. Each piece is returned as a copy
+// positioned at the first step of its next leg.
+func (f *factory) upcomingPieces() []*Piece {
+	upcoming := []*Piece{}
+	seen := make(map[*Piece]struct{})
+
+	for _, line := range f.processLines {
+		line.pruneDeadWaiters()
+		for _, w := range line.waitingPieces {
+			if _, ok := seen[w.piece]; ok || w.held || w.piece.Location != utils.ID_W1 {
+				continue
+			}
+			seen[w.piece] = struct{}{}
+			upcoming = append(upcoming, &Piece{
+				Steps:       w.piece.Steps,
+				CurrentStep: w.piece.CurrentStep,
+				route:       w.piece.route,
+			})
+		}
+
+		for _, conveyor := range line.conveyorLine {
+			item := conveyor.item
+			if item == nil || item.piece == nil || len(item.piece.route) < 2 {
+				continue
+			}
+			next := item.piece.route[1:]
+			upcoming = append(upcoming, &Piece{
+				Steps:       item.piece.Steps,
+				CurrentStep: next[0].firstStep,
+				route:       next,
+			})
+		}
+	}
+	return upcoming
+}
+
+// demandedTools returns the tools the machines of the line should hold, in
+// conveyor order, to serve most of the given pieces without a swap. Pieces
+// whose next planned leg is not on this line are not taken into account.
+// A machine keeps its current tool when no piece needs it or on ties.
+func (pl *ProcessingLine) demandedTools(pieces []*Piece) []string {
+	positions := pl.machinePositions()
+	votes := make([]map[string]int, len(positions))
+	for i := range votes {
+		votes[i] = make(map[string]int)
+	}
+
+	for _, piece := range pieces {
+		if len(piece.route) > 0 && !containsString(piece.route[0].lines, pl.id) {
+			continue
+		}
+
+		form := pl.createBestForm(piece)
+		if form == nil {
+			continue
+		}
+		for i, cmd := range form.machines {
+			if cmd.process {
+				votes[i][cmd.tool]++
+			}
+		}
+	}
+
+	tools := make([]string, len(positions))
+	for i, pos := range positions {
+		tools[i] = mostDemandedTool(votes[i], pl.currentTool(pos))
+	}
+	return tools
+}
+
+// currentTools returns the tools the machines of the line hold, in
+// conveyor order.
+func (pl *ProcessingLine) currentTools() []string {
+	positions := pl.machinePositions()
+	tools := make([]string, len(positions))
+	for i, pos := range positions {
+		tools[i] = pl.currentTool(pos)
+	}
+	return tools
+}
+
+func mostDemandedTool(votes map[string]int, current string) string {
+	tools := make([]string, 0, len(votes))
+	for tool := range votes {
+		tools = append(tools, tool)
+	}
+	sort.Strings(tools)
+
+	best := current
+	for _, tool := range tools {
+		if votes[tool] > votes[best] {
+			best = tool
+		}
+	}
+	return best
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// preSetupTools commands an idle line to swap its machines to the tools
+// most needed by the upcoming work, so that the swap time is not charged
+// to the next piece it processes.
+func (f *factory) preSetupTools(ctx context.Context, line *ProcessingLine) {
+	if !f.stageToolSetup(line) {
+		return
+	}
+
+	_, err := f.plcClient.Write(line.plc.ToolOpcuaVars(), ctx)
+	utils.Assert(err == nil, "[factory.preSetupTools] Error writing tools to PLC")
+}
+
+// stageToolSetup sets the tools the upcoming work needs on the PLC command
+// of an idle line and on its machines. Returns false if the line is busy or
+// already holds those tools, in which case nothing is to be written.
+func (f *factory) stageToolSetup(line *ProcessingLine) bool {
+	if line.id == utils.ID_L0 || !line.isIdle() {
+		return false
+	}
+
+	tools := line.demandedTools(f.upcomingPieces())
+	current := line.currentTools()
+	if slices.Equal(tools, current) {
+		return false
+	}
+
+	log.Printf("[factory.preSetupTools] Line %s idle, swapping tools from %v to %v\n",
+		line.id, current, tools)
+
+	plcTools := make([]int16, len(tools))
+	for i, tool := range tools {
+		plcTools[i] = ToolStrToInt(tool)
+	}
+	line.plc.SetTools(plcTools)
+
+	for i, pos := range line.machinePositions() {
+		line.setCurrentTool(pos, tools[i])
+	}
+	return true
+}
+
+// UseToolPreSetup enables or disables setting up idle machines ahead of
+// the upcoming work.
+func UseToolPreSetup(enabled bool) {
+	factory, mutex := getFactoryInstance()
+	defer mutex.Unlock()
+
+	factory.toolPreSetup = enabled
+}
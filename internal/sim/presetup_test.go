@@ -0,0 +1,107 @@
+package sim
+
+import (
+	"mes/internal/net/plc"
+	u "mes/internal/utils"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestDemandedTools(t *testing.T) {
+	pLine := &ProcessingLine{
+		id:            u.ID_L1,
+		conveyorLine:  initType1Conveyor(),
+		waitingPieces: []*freeLineWaiter{},
+		readyForNext:  true,
+	}
+
+	pieces := []*Piece{
+		{Steps: []Transformation{{Tool: u.TOOL_2, Time: 30}, {Tool: u.TOOL_3, Time: 30}}},
+		{Steps: []Transformation{{Tool: u.TOOL_2, Time: 30}, {Tool: u.TOOL_3, Time: 30}}},
+		{Steps: []Transformation{{Tool: u.TOOL_3, Time: 30}}, route: []routeLeg{{lines: []string{u.ID_L2}}}},
+	}
+
+	tools := pLine.demandedTools(pieces)
+	if !slices.Equal(tools, []string{u.TOOL_2, u.TOOL_3}) {
+		t.Fatalf("Expected tools %s/%s, got %v", u.TOOL_2, u.TOOL_3, tools)
+	}
+
+	// Without demand the machines keep their tools
+	tools = pLine.demandedTools(nil)
+	if !slices.Equal(tools, []string{u.TOOL_1, u.TOOL_1}) {
+		t.Fatalf("Expected tools to be kept, got %v", tools)
+	}
+}
+
+func TestStageToolSetup(t *testing.T) {
+	// A piece waiting on L2 for T2 then T3, which L1 could run too
+	newDemand := func(f *factory, lineIDs ...string) *freeLineWaiter {
+		w := &freeLineWaiter{
+			piece: &Piece{
+				Location: u.ID_W1,
+				Steps:    []Transformation{{Tool: u.TOOL_2, Time: 30}, {Tool: u.TOOL_3, Time: 30}},
+			},
+			pieceClaimedCh: make(chan struct{}),
+			claimCountLock: &sync.Mutex{},
+		}
+		for _, lineID := range lineIDs {
+			f.processLines[lineID].registerWaitingPiece(w)
+		}
+		return w
+	}
+
+	tests := []struct {
+		name   string
+		setup  func(f *factory, line *ProcessingLine)
+		staged bool
+	}{
+		{"idle", func(f *factory, line *ProcessingLine) { newDemand(f, u.ID_L2) }, true},
+		{"held piece waiting", func(f *factory, line *ProcessingLine) {
+			newDemand(f, u.ID_L2)
+			held := newDemand(f, u.ID_L1)
+			held.held = true
+		}, true},
+		{"busy", func(f *factory, line *ProcessingLine) {
+			newDemand(f, u.ID_L2)
+			line.conveyorLine[0].item = &conveyorItem{}
+		}, false},
+		{"down", func(f *factory, line *ProcessingLine) {
+			newDemand(f, u.ID_L2)
+			line.down = true
+		}, false},
+		{"piece waiting", func(f *factory, line *ProcessingLine) { newDemand(f, u.ID_L1, u.ID_L2) }, false},
+		{"claim pending", func(f *factory, line *ProcessingLine) {
+			newDemand(f, u.ID_L2)
+			line.claimPending = true
+		}, false},
+		{"no demand", func(f *factory, line *ProcessingLine) {}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestFactory()
+			line := f.processLines[u.ID_L1]
+			line.plc = plc.InitCells()[1]
+			tt.setup(f, line)
+			before := line.plc.Tools()
+
+			if staged := f.stageToolSetup(line); staged != tt.staged {
+				t.Fatalf("Expected staged to be %t, got %t", tt.staged, staged)
+			}
+			if !tt.staged {
+				if !slices.Equal(line.currentTools(), []string{u.TOOL_1, u.TOOL_1}) ||
+					!slices.Equal(line.plc.Tools(), before) {
+					t.Fatalf("Expected the line to be left alone, got %v", line.currentTools())
+				}
+				return
+			}
+			if !slices.Equal(line.currentTools(), []string{u.TOOL_2, u.TOOL_3}) {
+				t.Fatalf("Expected tools %s/%s, got %v", u.TOOL_2, u.TOOL_3, line.currentTools())
+			}
+			commanded := line.plc.Tools()
+			if commanded[0] != ToolStrToInt(u.TOOL_2) || commanded[1] != ToolStrToInt(u.TOOL_3) {
+				t.Fatalf("Expected the tools commanded to the PLC, got %v", commanded)
+			}
+		})
+	}
+}
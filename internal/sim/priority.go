@@ -0,0 +1,190 @@
+package sim
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// Priority classes of a piece, set by the ERP or by an operator.
+// Higher classes are released from W1, claimed by lines and delivered first.
+const (
+	PRIORITY_NORMAL = 0
+	PRIORITY_HIGH   = 1
+	PRIORITY_URGENT = 2
+	// Only reachable through the expedite override
+	PRIORITY_EXPEDITED = 3
+)
+
+// effectivePriority ages the priority of a piece by one class for each
+// PRIORITY_AGING_INTERVAL it has waited, so that normal work is not starved
+// by a steady flow of higher priority pieces. Aging stops one class below
+// expedited, which only the capped expedite override gives.
+func effectivePriority(priority int, waited time.Duration) int {
+	aged := priority + int(waited/PRIORITY_AGING_INTERVAL)
+	return max(priority, min(aged, PRIORITY_EXPEDITED-1))
+}
+
+// clampPriority brings a priority received from the ERP into the classes
+// it may set.
+func clampPriority(priority int) int {
+	return max(PRIORITY_NORMAL, min(priority, PRIORITY_URGENT))
+}
+
+// rankByPriority reorders the waiters ranked by a scheduler so that higher
+// (aged) priority classes are claimed first. Within a class the scheduler's
+// order is kept.
+func rankByPriority(ranked []*freeLineWaiter) []*freeLineWaiter {
+	now := time.Now()
+	byPriority := make([]*freeLineWaiter, len(ranked))
+	copy(byPriority, ranked)
+	sort.SliceStable(byPriority, func(i, j int) bool {
+		a, b := byPriority[i], byPriority[j]
+		return effectivePriority(a.priority, now.Sub(a.waitingSince)) >
+			effectivePriority(b.priority, now.Sub(b.waitingSince))
+	})
+	return byPriority
+}
+
+// setPriority changes the priority of a piece waiting to be released.
+// Returns the piece and whether it was found.
+func (rq *releaseQueue) setPriority(pieceID string, priority int) (Piece, bool) {
+	rq.lock.Lock()
+	defer rq.lock.Unlock()
+
+	for i := range rq.queue {
+		if rq.queue[i].piece.ErpIdentifier == pieceID {
+			rq.queue[i].piece.Priority = priority
+			return rq.queue[i].piece, true
+		}
+	}
+	return Piece{}, false
+}
+
+// piecePriority returns the priority class of a released piece: the one an
+// operator set since its release, if any, or the one it was released with.
+func (f *factory) piecePriority(piece *Piece) int {
+	if priority, ok := f.overrides.priorities[piece.planKey()]; ok {
+		return priority
+	}
+	return piece.Priority
+}
+
+// activePieces returns copies of the pieces waiting for a line or on a
+// conveyor, with their current priority class. Pieces on a conveyor are
+// copied from their dispatch copy, as their tracker changes the piece.
+func (f *factory) activePieces() []Piece {
+	pieces := []Piece{}
+	seen := make(map[string]struct{})
+	add := func(piece Piece, priority int) {
+		if _, ok := seen[piece.planKey()]; !ok {
+			seen[piece.planKey()] = struct{}{}
+			piece.Priority = priority
+			pieces = append(pieces, piece)
+		}
+	}
+
+	for _, line := range f.processLines {
+		line.pruneDeadWaiters()
+		for _, w := range line.waitingPieces {
+			add(*w.piece, w.priority)
+		}
+		for _, conveyor := range line.conveyorLine {
+			if item := conveyor.item; item != nil && item.piece != nil {
+				add(item.dispatched, f.piecePriority(&item.dispatched))
+			}
+		}
+	}
+	for _, w := range f.orphanWaiters {
+		add(*w.piece, w.priority)
+	}
+	return pieces
+}
+
+// expeditedCount returns the number of expedited pieces in the factory.
+func (f *factory) expeditedCount() int {
+	count := 0
+	for _, piece := range pieceReleaseQueue.snapshot() {
+		if piece.Priority >= PRIORITY_EXPEDITED {
+			count++
+		}
+	}
+	for _, piece := range f.activePieces() {
+		if piece.Priority >= PRIORITY_EXPEDITED {
+			count++
+		}
+	}
+	return count
+}
+
+// setPiecePriority changes the priority of a piece wherever it is in the
+// factory. A released piece keeps its priority in the overrides, and its
+// waiter if it waits for a line, the piece itself being its tracker's. The
+// delivery of its order takes the highest priority an operator set on its
+// pieces.
+func (f *factory) setPiecePriority(pieceID string, priority int) error {
+	piece, found := pieceReleaseQueue.setPriority(pieceID, priority)
+	if !found {
+		for _, active := range f.activePieces() {
+			if active.ErpIdentifier == pieceID {
+				piece, found = active, true
+				break
+			}
+		}
+		if found {
+			f.overrides.priorities[piece.planKey()] = priority
+			if w := f.findWaiter(pieceID); w != nil {
+				w.priority = priority
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("[factory.setPiecePriority] piece %q not found", pieceID)
+	}
+
+	if piece.OrderID != "" {
+		f.overrides.setPiecePriority(piece.OrderID, piece.planKey(), priority)
+	}
+	pieceReleaseQueue.wakeUp()
+	log.Printf("[factory.setPiecePriority] Piece %s (order %q) set to priority %d, order at %d\n",
+		pieceID, piece.OrderID, priority, f.overrides.orderPriority(piece.OrderID))
+	return nil
+}
+
+// forgetPiecePriority drops the priority an operator set on a released
+// piece once it is produced.
+func forgetPiecePriority(piece *Piece) {
+	factory, mutex := getFactoryInstance()
+	defer mutex.Unlock()
+
+	delete(factory.overrides.priorities, piece.planKey())
+}
+
+// sortDeliveries orders the queued deliveries by priority, taking into
+// account the priority of the pieces of their order.
+func sortDeliveries(dq *deliveryQueue) {
+	factory, mutex := getFactoryInstance()
+	defer mutex.Unlock()
+
+	dq.prioritise(func(d Delivery) int {
+		return max(clampPriority(d.Priority), factory.overrides.orderPriority(d.ID))
+	})
+}
+
+// forgetOrderPriority drops the priority of an order once it is delivered.
+func forgetOrderPriority(orderID string) {
+	factory, mutex := getFactoryInstance()
+	defer mutex.Unlock()
+
+	delete(factory.overrides.piecePriorities, orderID)
+}
+
+// validatePriority checks a priority class an operator may set directly.
+func validatePriority(priority int) error {
+	if priority < PRIORITY_NORMAL || priority > PRIORITY_URGENT {
+		return fmt.Errorf("[validatePriority] priority must be between %d and %d, "+
+			"use %s for the expedited class", PRIORITY_NORMAL, PRIORITY_URGENT, OVERRIDE_EXPEDITE)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package sim
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEffectivePriority(t *testing.T) {
+	if p := effectivePriority(PRIORITY_NORMAL, time.Minute); p != PRIORITY_NORMAL {
+		t.Fatalf("Expected a fresh piece to keep its class, got %d", p)
+	}
+	if p := effectivePriority(PRIORITY_NORMAL, 2*PRIORITY_AGING_INTERVAL); p != PRIORITY_URGENT {
+		t.Fatalf("Expected a piece to age two classes, got %d", p)
+	}
+	if p := effectivePriority(PRIORITY_HIGH, 10*PRIORITY_AGING_INTERVAL); p != PRIORITY_URGENT {
+		t.Fatalf("Expected aging to stop below the expedited class, got %d", p)
+	}
+	if p := effectivePriority(PRIORITY_EXPEDITED, 10*PRIORITY_AGING_INTERVAL); p != PRIORITY_EXPEDITED {
+		t.Fatalf("Expected an expedited piece to stay expedited, got %d", p)
+	}
+	if p := clampPriority(7); p != PRIORITY_URGENT {
+		t.Fatalf("Expected ERP priorities to be clamped, got %d", p)
+	}
+}
+
+func TestRankByPriority(t *testing.T) {
+	now := time.Now()
+	normal := &freeLineWaiter{piece: &Piece{ErpIdentifier: "normal"}, waitingSince: now}
+	high := &freeLineWaiter{piece: &Piece{ErpIdentifier: "high"}, waitingSince: now, priority: PRIORITY_HIGH}
+	expedited := &freeLineWaiter{
+		piece:        &Piece{ErpIdentifier: "expedited"},
+		waitingSince: now,
+		priority:     PRIORITY_EXPEDITED,
+	}
+	// Waited long enough to catch up with every class but expedited
+	starving := &freeLineWaiter{
+		piece:        &Piece{ErpIdentifier: "starving"},
+		waitingSince: now.Add(-4 * PRIORITY_AGING_INTERVAL),
+	}
+
+	ranked := rankByPriority([]*freeLineWaiter{normal, starving, high, expedited})
+	expected := []string{"expedited", "starving", "high", "normal"}
+	for i, w := range ranked {
+		if w.piece.ErpIdentifier != expected[i] {
+			t.Fatalf("Expected order %v, got %s at %d", expected, w.piece.ErpIdentifier, i)
+		}
+	}
+}
+
+func TestReleaseQueuePriority(t *testing.T) {
+	rq := &releaseQueue{wakeCh: make(chan struct{}, 1)}
+	rq.enqueue([]Piece{
+		{ErpIdentifier: "urgent-date", DueDate: 2},
+		{ErpIdentifier: "high", Priority: PRIORITY_HIGH, DueDate: 9},
+		{ErpIdentifier: "normal", OrderID: "order-1"},
+	})
+
+	if piece, ok := rq.setPriority("normal", PRIORITY_EXPEDITED); !ok || piece.OrderID != "order-1" {
+		t.Fatalf("Expected the queued piece to be found, got %+v %t", piece, ok)
+	}
+
+	released := rq.release(WAREHOUSE_CAPACITY)
+	expected := []string{"normal", "high", "urgent-date"}
+	for i, piece := range released {
+		if piece.ErpIdentifier != expected[i] {
+			t.Fatalf("Expected release order %v, got %v", expected, released)
+		}
+	}
+}
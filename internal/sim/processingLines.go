@@ -5,12 +5,24 @@ import (
 	u "mes/internal/utils"
 	"strconv"
 	"sync"
+	"time"
 )
 
 type Machine struct {
 	name         string
 	selectedTool string
 	tools        []string
+	down         bool
+	blockedTools map[string]uint // tool -> last day it is blocked (0 = no limit)
+}
+
+func (m *Machine) hasTool(tool string) bool {
+	for _, t := range m.tools {
+		if t == tool {
+			return true
+		}
+	}
+	return false
 }
 
 // For the inner logic
@@ -31,16 +43,26 @@ type itemHandler struct {
 }
 
 type conveyorItem struct {
+	piece     *Piece
 	handler   *conveyorItemHandler
 	controlID int16
-	m1Repeats int16
-	m2Repeats int16
-	useM1     bool
-	useM2     bool
+	// What each machine of the line does to the piece, with the tool
+	// changes as metadata for the erp
+	commands []machineCommand
+	// Copy of the piece as it was sent to the line. Its tracker transforms
+	// the piece without the factory lock, so code holding the lock reads
+	// this copy instead
+	dispatched Piece
+}
 
-	// Metadata for the erp
-	toolChangeM1 bool
-	toolChangeM2 bool
+// command returns what the machine at the conveyor position does to the item
+func (ci *conveyorItem) command(pos int) (machineCommand, bool) {
+	for _, cmd := range ci.commands {
+		if cmd.pos == pos {
+			return cmd, true
+		}
+	}
+	return machineCommand{}, false
 }
 
 type Conveyor struct {
@@ -49,51 +71,11 @@ type Conveyor struct {
 }
 
 func initType1Conveyor() []Conveyor {
-	conveyor := make([]Conveyor, LINE_CONVEYOR_SIZE)
-
-	conveyor[LINE_DEFAULT_M1_POS] = Conveyor{
-		item: nil,
-		machine: &Machine{
-			name:         "M1",
-			selectedTool: u.TOOL_1,
-			tools:        []string{u.TOOL_1, u.TOOL_2, u.TOOL_3},
-		},
-	}
-
-	conveyor[LINE_DEFAULT_M2_POS] = Conveyor{
-		item: nil,
-		machine: &Machine{
-			name:         "M2",
-			selectedTool: u.TOOL_1,
-			tools:        []string{u.TOOL_1, u.TOOL_2, u.TOOL_3},
-		},
-	}
-
-	return conveyor
+	return newConveyor(type1LineLayout())
 }
 
 func initType2Conveyor() []Conveyor {
-	conveyor := make([]Conveyor, LINE_CONVEYOR_SIZE)
-
-	conveyor[LINE_DEFAULT_M1_POS] = Conveyor{
-		item: nil,
-		machine: &Machine{
-			name:         "M3",
-			selectedTool: u.TOOL_1,
-			tools:        []string{u.TOOL_1, u.TOOL_4, u.TOOL_5},
-		},
-	}
-
-	conveyor[LINE_DEFAULT_M2_POS] = Conveyor{
-		item: nil,
-		machine: &Machine{
-			name:         "M4",
-			selectedTool: u.TOOL_1,
-			tools:        []string{u.TOOL_1, u.TOOL_4, u.TOOL_6},
-		},
-	}
-
-	return conveyor
+	return newConveyor(type2LineLayout())
 }
 
 type ProcessingLine struct {
@@ -103,18 +85,32 @@ type ProcessingLine struct {
 	waitingPieces   []*freeLineWaiter
 	readyForNext    bool
 	lastLeftPieceId int16
+	down            bool
+	// Whether a piece was claimed but not yet added to the conveyor
+	claimPending bool
+	// Maximum number of pieces on the conveyor (0 = no limit)
+	wipCap int
+	// Whether the warehouse the line exits to has no room for its pieces
+	exitFull bool
+}
+
+// machineCommand is what one machine of a line does to a piece
+type machineCommand struct {
+	pos     int // conveyor position of the machine
+	tool    string
+	repeat  int16
+	process bool
+
+	// Whether or not a tool change is needed
+	change bool
 }
 
 type processControlForm struct {
 	// Fields to control the plc
-	toolTop    string
-	toolBot    string
-	pieceKind  string
-	id         int16
-	repeatTop  int16
-	repeatBot  int16
-	processTop bool
-	processBot bool
+	pieceKind string
+	id        int16
+	// One per machine of the line, in conveyor order
+	machines []machineCommand
 
 	// Metadata for decision making in the MES simulation
 
@@ -129,15 +125,10 @@ type processControlForm struct {
 	// taking into account possible delays in queue
 	queueSize int
 
-	// Whether or not a tool change is needed
-	changeM1 bool
-	changeM2 bool
-}
-
-func (pcf *processControlForm) metadataScore() int {
-	return pcf.intrinsicTime*TIME_WEIGHT +
-		pcf.queueSize*QUEUE_WEIGHT +
-		(pcf.totalSteps-pcf.stepsCompleted)*STEP_WEIGHT
+	// Day the piece is due (0 if it has no due date) and the processing
+	// time (in seconds) its recipe still needs after this command
+	dueDate       uint
+	remainingWork int
 }
 
 func ToolStrToInt(s string) int16 {
@@ -185,21 +176,40 @@ func PieceStrToInt(s string) int16 {
 }
 
 func (pcf *processControlForm) toCellCommand() *plc.CellCommand {
+	machines := make([]plc.MachineCommand, len(pcf.machines))
+	for i, cmd := range pcf.machines {
+		machines[i] = plc.MachineCommand{
+			Process: plc.OpcuaBool{Value: cmd.process},
+			Tool:    plc.OpcuaInt16{Value: ToolStrToInt(cmd.tool)},
+			Repeat:  plc.OpcuaInt16{Value: cmd.repeat},
+		}
+	}
+
 	return &plc.CellCommand{
 		TxId:      plc.OpcuaInt16{Value: pcf.id},
 		PieceKind: plc.OpcuaInt16{Value: PieceStrToInt(pcf.pieceKind)},
+		Machines:  machines,
+	}
+}
 
-		ProcessTop: plc.OpcuaBool{Value: pcf.processTop},
-		ToolTop:    plc.OpcuaInt16{Value: ToolStrToInt(pcf.toolTop)},
-		RepeatTop:  plc.OpcuaInt16{Value: pcf.repeatTop},
-
-		ProcessBot: plc.OpcuaBool{Value: pcf.processBot},
-		ToolBot:    plc.OpcuaInt16{Value: ToolStrToInt(pcf.toolBot)},
-		RepeatBot:  plc.OpcuaInt16{Value: pcf.repeatBot},
+// firstMachine returns the index of the first machine that processes the
+// piece, or -1 if none does
+func (pcf *processControlForm) firstMachine() int {
+	for i, cmd := range pcf.machines {
+		if cmd.process {
+			return i
+		}
 	}
+	return -1
 }
 
 type freeLineWaiter struct {
+	piece          *Piece
+	waitingSince   time.Time
+	lines          []*ProcessingLine // lines the piece is registered with
+	decision       *DispatchDecision
+	held           bool // held in the warehouse by a supervisor
+	priority       int  // priority class of the piece, set under the factory lock
 	pieceClaimedCh <-chan struct{}
 	claimPieceCh   chan<- string
 	claimLock      *sync.Mutex
@@ -224,9 +234,40 @@ func (flw *freeLineWaiter) decrementClaimCount() {
 
 func (pl *ProcessingLine) registerWaitingPiece(w *freeLineWaiter) {
 	pl.waitingPieces = append(pl.waitingPieces, w)
+	w.lines = append(w.lines, pl)
 	w.incrementClaimCount()
 }
 
+func (flw *freeLineWaiter) isRegisteredWith(pl *ProcessingLine) bool {
+	for _, line := range flw.lines {
+		if line == pl {
+			return true
+		}
+	}
+	return false
+}
+
+// removeLine unregisters the waiter from the line
+func (flw *freeLineWaiter) removeLine(pl *ProcessingLine) {
+	for i, line := range flw.lines {
+		if line == pl {
+			flw.lines = append(flw.lines[:i], flw.lines[i+1:]...)
+			flw.decrementClaimCount()
+			return
+		}
+	}
+}
+
+// removeWaiter drops the waiter from the line's queue
+func (pl *ProcessingLine) removeWaiter(w *freeLineWaiter) {
+	for i, waiter := range pl.waitingPieces {
+		if waiter == w {
+			pl.waitingPieces = append(pl.waitingPieces[:i], pl.waitingPieces[i+1:]...)
+			return
+		}
+	}
+}
+
 func (pl *ProcessingLine) pruneDeadWaiters() {
 	aliveWaiters := make([]*freeLineWaiter, 0, len(pl.waitingPieces))
 	for _, w := range pl.waitingPieces {
@@ -241,19 +282,33 @@ func (pl *ProcessingLine) pruneDeadWaiters() {
 	pl.waitingPieces = aliveWaiters
 }
 
-func (pl *ProcessingLine) claimWaitingPiece() {
+func (pl *ProcessingLine) claimWaitingPiece(s Scheduler) {
 	u.Assert(pl.readyForNext, "[ProcessingLine.claimPiece] Processing line is not ready")
 	pl.pruneDeadWaiters()
+	if pl.down || pl.claimPending || pl.atWipCap() || pl.exitFull {
+		return
+	}
+
+	ranked := rankByPriority(s.Rank(pl, pl.waitingPieces))
 
 loop:
-	for _, w := range pl.waitingPieces {
+	for rank, w := range ranked {
+		if w.held || !pl.isAvailableFor(w.piece) {
+			continue
+		}
+
 		w.claimLock.Lock()
 		select {
 		case <-w.pieceClaimedCh:
 			w.claimLock.Unlock()
 		default:
+			if w.decision != nil {
+				dispatchDecisions.claimed(w.decision, pl.id,
+					claimReason(w.decision.Scheduler, rank, len(ranked)))
+			}
 			w.claimPieceCh <- pl.id
 			close(w.claimPieceCh)
+			pl.claimPending = true
 			// HACK:
 			// not unlocking here on purpose, so that the piece handler
 			// can unlock it after the pieceClaimedCh is closed, to avoid
@@ -267,6 +322,9 @@ loop:
 func (pl *ProcessingLine) isMachineCompatibleWith(mIndex int, t Transformation) bool {
 	m := pl.conveyorLine[mIndex].machine
 	u.Assert(m != nil, "[ProcessingLine.isMachineCompatibleWith] machine is null")
+	if m.down || m.isToolBlocked(t.Tool) {
+		return false
+	}
 
 	for _, tool := range m.tools {
 		if tool == t.Tool {
@@ -313,6 +371,18 @@ func (pl *ProcessingLine) getNItemsInConveyor() int {
 	return nItemsInQueue
 }
 
+// machinePositions returns the conveyor positions of the line machines,
+// in conveyor order
+func (pl *ProcessingLine) machinePositions() []int {
+	positions := []int{}
+	for pos, conveyor := range pl.conveyorLine {
+		if conveyor.machine != nil {
+			positions = append(positions, pos)
+		}
+	}
+	return positions
+}
+
 func (pl *ProcessingLine) createBestForm(piece *Piece) *processControlForm {
 	if pl.id == u.ID_L0 {
 		return &processControlForm{
@@ -321,167 +391,67 @@ func (pl *ProcessingLine) createBestForm(piece *Piece) *processControlForm {
 		}
 	}
 
-	currentStepIdx := piece.CurrentStep
-	currentStep := piece.Steps[currentStepIdx]
-
-	topCompatible := pl.isMachineCompatibleWith(LINE_DEFAULT_M1_POS, currentStep)
-	botCompatible := pl.isMachineCompatibleWith(LINE_DEFAULT_M2_POS, currentStep)
-
-	if !topCompatible && !botCompatible {
-		return nil
-	}
-
-	if !topCompatible {
-		return pl.createBotOnlyForm(piece, currentStepIdx, currentStep)
-	}
-
-	topFormCandidate := pl.createTopFormWithPossibleBot(piece, currentStepIdx, currentStep)
-	if !botCompatible {
-		return topFormCandidate
-	}
-
-	botFormCandidate := pl.createBotOnlyForm(piece, currentStepIdx, currentStep)
-
-	if topFormCandidate.metadataScore() < botFormCandidate.metadataScore() {
-		return topFormCandidate
-	}
-	return botFormCandidate
-}
-
-func (pl *ProcessingLine) createBotOnlyForm(
-	piece *Piece, currentStepIdx int, currentStep Transformation,
-) *processControlForm {
-	repeatBot := int16(1)
-	stepsCompleted := 1
-	intrinsicTime := currentStep.Time
-
-	changeM2 := false
-	if currentStep.Tool != pl.currentTool(LINE_DEFAULT_M2_POS) {
-		intrinsicTime += MACHINE_TOOL_SWAP_TIME
-		changeM2 = true
-	}
-
-	for currentStepIdx+1 < len(piece.Steps) {
-		nextStep := piece.Steps[currentStepIdx+1]
-		if currentStep.Tool != nextStep.Tool {
-			break
+	var bestForm *processControlForm
+	for first := range pl.machinePositions() {
+		form := pl.createFormFrom(piece, first)
+		if form == nil {
+			continue
+		}
+		// Ties go to the form starting further down the line
+		if bestForm == nil || form.metadataScore() <= bestForm.metadataScore() {
+			bestForm = form
 		}
-		repeatBot++
-		stepsCompleted++
-		currentStepIdx++
-		intrinsicTime += nextStep.Time
-		currentStep = nextStep
-	}
-
-	return &processControlForm{
-		id:        piece.ControlID,
-		pieceKind: piece.Kind,
-
-		processTop: false,
-		toolTop:    "",
-		repeatTop:  1,
-
-		toolBot:    currentStep.Tool,
-		repeatBot:  repeatBot,
-		processBot: true,
-
-		stepsCompleted: stepsCompleted,
-		totalSteps:     len(piece.Steps),
-		intrinsicTime:  intrinsicTime,
-		queueSize:      pl.getNItemsInConveyor(),
-		changeM1:       false,
-		changeM2:       changeM2,
 	}
+	return bestForm
 }
 
-func (pl *ProcessingLine) createTopFormWithPossibleBot(
-	piece *Piece,
-	currentStepIdx int,
-	currentStep Transformation,
-) *processControlForm {
-	repeatTop := int16(1)
-	stepsCompleted := 1
-	intrinsicTime := currentStep.Time
-
-	changeM1 := false
-	if currentStep.Tool != pl.currentTool(LINE_DEFAULT_M1_POS) {
-		intrinsicTime += MACHINE_TOOL_SWAP_TIME
-		changeM1 = true
-	}
-
-	for currentStepIdx+1 < len(piece.Steps) {
-		nextStep := piece.Steps[currentStepIdx+1]
-		if currentStep.Tool != nextStep.Tool {
-			break
-		}
-		repeatTop++
-		stepsCompleted++
-		currentStepIdx++
-		intrinsicTime += nextStep.Time
-		currentStep = nextStep
+// createFormFrom splits the recipe of the piece, from its current step,
+// across the machines of the line starting with the first-th one. Each
+// machine runs the next steps that use the same tool, if it can, and the
+// piece goes past the machines that cannot. Returns nil if the first
+// machine cannot run the current step.
+func (pl *ProcessingLine) createFormFrom(piece *Piece, first int) *processControlForm {
+	positions := pl.machinePositions()
+	stepIdx := piece.CurrentStep
+	if !pl.isMachineCompatibleWith(positions[first], piece.Steps[stepIdx]) {
+		return nil
 	}
 
-	toolBot, repeatBot, changeM2 := pl.determineToolBot(
-		piece, currentStepIdx, &intrinsicTime, &stepsCompleted,
-	)
-
-	return &processControlForm{
+	form := &processControlForm{
 		id:        piece.ControlID,
 		pieceKind: piece.Kind,
+		machines:  make([]machineCommand, len(positions)),
 
-		toolTop:    currentStep.Tool,
-		processTop: true,
-		repeatTop:  repeatTop,
-
-		toolBot:    toolBot,
-		processBot: toolBot != "",
-		repeatBot:  repeatBot,
-
-		stepsCompleted: stepsCompleted,
-		totalSteps:     len(piece.Steps),
-		intrinsicTime:  intrinsicTime,
-		queueSize:      pl.getNItemsInConveyor(),
-		changeM1:       changeM1,
-		changeM2:       changeM2,
+		totalSteps: len(piece.Steps),
+		queueSize:  pl.getNItemsInConveyor(),
+		dueDate:    piece.DueDate,
 	}
-}
 
-func (pl *ProcessingLine) determineToolBot(piece *Piece,
-	currentStepIdx int,
-	intrinsicTime *int,
-	stepsCompleted *int,
-) (string, int16, bool) {
-	if currentStepIdx+1 >= len(piece.Steps) {
-		return "", 0, false
-	}
-	currentStep := piece.Steps[currentStepIdx+1]
-	if !pl.isMachineCompatibleWith(LINE_DEFAULT_M2_POS, currentStep) {
-		return "", 0, false
-	}
-	currentStepIdx++
-	*stepsCompleted++
-	*intrinsicTime += currentStep.Time
+	for i, pos := range positions {
+		form.machines[i].pos = pos
+		if i < first || stepIdx >= len(piece.Steps) ||
+			!pl.isMachineCompatibleWith(pos, piece.Steps[stepIdx]) {
+			continue
+		}
 
-	repeatBot := int16(1)
+		cmd := &form.machines[i]
+		cmd.process = true
+		cmd.tool = piece.Steps[stepIdx].Tool
+		if cmd.tool != pl.currentTool(pos) {
+			form.intrinsicTime += MACHINE_TOOL_SWAP_TIME
+			cmd.change = true
+		}
 
-	for currentStepIdx+1 < len(piece.Steps) {
-		nextStep := piece.Steps[currentStepIdx+1]
-		if currentStep.Tool != nextStep.Tool {
-			break
+		for stepIdx < len(piece.Steps) && piece.Steps[stepIdx].Tool == cmd.tool {
+			form.intrinsicTime += piece.Steps[stepIdx].Time
+			cmd.repeat++
+			stepIdx++
 		}
-		*stepsCompleted++
-		*intrinsicTime += nextStep.Time
-		repeatBot++
-		currentStepIdx++
-		currentStep = nextStep
 	}
 
-	changeM2 := false
-	if currentStep.Tool != pl.currentTool(LINE_DEFAULT_M2_POS) {
-		*intrinsicTime += MACHINE_TOOL_SWAP_TIME
-		changeM2 = true
-	}
-	return currentStep.Tool, repeatBot, changeM2
+	form.stepsCompleted = stepIdx - piece.CurrentStep
+	form.remainingWork = piece.remainingWorkAfter(stepIdx)
+	return form
 }
 
 func (pl *ProcessingLine) addItem(item *conveyorItem) {
@@ -489,6 +459,7 @@ func (pl *ProcessingLine) addItem(item *conveyorItem) {
 	u.Assert(pl.conveyorLine[0].item == nil, "[ProcessingLine.addItem] Conveyor is not empty")
 
 	pl.readyForNext = false
+	pl.claimPending = false
 	pl.conveyorLine[0].item = item
 }
 
@@ -533,25 +504,25 @@ func (pl *ProcessingLine) ProgressNewPiece() {
 // Moves the pieces along the conveyor line and sends the necessary signals to the
 // item handlers that handle the transformations and communication with the ERP
 func (pl *ProcessingLine) progressConveyor() int16 {
-	m1 := pl.conveyorLine[LINE_DEFAULT_M1_POS].machine
-	m1Item := pl.conveyorLine[LINE_DEFAULT_M1_POS].item
-	if m1 != nil && m1Item != nil && m1Item.useM1 {
-		for i := int16(0); i < m1Item.m1Repeats; i++ {
-			m1Item.handler.transformCh <- pl.id + "," + m1.name + "," +
-				strconv.FormatBool(m1Item.toolChangeM1)
+	for _, pos := range pl.machinePositions() {
+		m := pl.conveyorLine[pos].machine
+		item := pl.conveyorLine[pos].item
+		if item == nil {
+			continue
 		}
-	}
 
-	m2 := pl.conveyorLine[LINE_DEFAULT_M2_POS].machine
-	m2Item := pl.conveyorLine[LINE_DEFAULT_M2_POS].item
-	if m2 != nil && m2Item != nil && m2Item.useM2 {
-		for i := int16(0); i < m2Item.m2Repeats; i++ {
-			m2Item.handler.transformCh <- pl.id + "," + m2.name + "," +
-				strconv.FormatBool(m2Item.toolChangeM2)
+		cmd, ok := item.command(pos)
+		if !ok || !cmd.process {
+			continue
+		}
+		for i := int16(0); i < cmd.repeat; i++ {
+			item.handler.transformCh <- pl.id + "," + m.name + "," +
+				strconv.FormatBool(cmd.change)
 		}
 	}
 
-	outItem := pl.conveyorLine[LINE_CONVEYOR_SIZE-1].item
+	last := len(pl.conveyorLine) - 1
+	outItem := pl.conveyorLine[last].item
 	if outItem != nil {
 		outItem.handler.lineExitCh <- pl.id
 		pl.lastLeftPieceId = outItem.controlID
@@ -559,7 +530,7 @@ func (pl *ProcessingLine) progressConveyor() int16 {
 
 	// Move items along the conveyor line
 	// (except the first one that needs to be ACKed)
-	for i := LINE_CONVEYOR_SIZE - 1; i > 1; i-- {
+	for i := last; i > 1; i-- {
 		pl.conveyorLine[i].item = pl.conveyorLine[i-1].item
 	}
 	pl.conveyorLine[1].item = nil
@@ -567,10 +538,10 @@ func (pl *ProcessingLine) progressConveyor() int16 {
 	return pl.lastLeftPieceId
 }
 
-func (pl *ProcessingLine) UpdateConveyor() {
+func (pl *ProcessingLine) UpdateConveyor(s Scheduler) {
 	if pl.plc.PieceLeft() {
 		reportedOutPieceId := pl.plc.OutPieceTxId()
-		iterations := LINE_CONVEYOR_SIZE
+		iterations := len(pl.conveyorLine)
 		for {
 			outPieceId := pl.progressConveyor()
 			if outPieceId == reportedOutPieceId {
@@ -609,6 +580,6 @@ func (pl *ProcessingLine) UpdateConveyor() {
 	}
 
 	if pl.readyForNext {
-		pl.claimWaitingPiece()
+		pl.claimWaitingPiece(s)
 	}
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	plc "mes/internal/net/plc"
 	u "mes/internal/utils"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -27,20 +28,18 @@ func TestCreateBestFormRepeat(t *testing.T) {
 
 	best := pLine.createBestForm(&minimalPieceForM1)
 	expected := &processControlForm{
-		toolTop:        u.TOOL_1,
-		toolBot:        u.TOOL_3,
-		pieceKind:      u.P_KIND_1,
-		id:             0,
-		repeatTop:      1,
-		repeatBot:      2,
-		processTop:     true,
-		processBot:     true,
+		pieceKind: u.P_KIND_1,
+		id:        0,
+		machines: []machineCommand{
+			{pos: LINE_DEFAULT_M1_POS, tool: u.TOOL_1, repeat: 1, process: true},
+			{pos: LINE_DEFAULT_M2_POS, tool: u.TOOL_3, repeat: 2, process: true},
+		},
 		stepsCompleted: 3,
 		intrinsicTime:  120,
 		queueSize:      0,
 	}
 
-	if *best != *expected {
+	if !reflect.DeepEqual(best, expected) {
 		t.Fatalf("Expected %+v, got %+v", expected, best)
 	}
 }
@@ -98,8 +97,10 @@ func TestProgressItemsSingleItem(t *testing.T) {
 			errCh:       make(chan<- error),
 		},
 		controlID: 0,
-		useM1:     true,
-		useM2:     true,
+		commands: []machineCommand{
+			{pos: LINE_DEFAULT_M1_POS, process: true},
+			{pos: LINE_DEFAULT_M2_POS, process: true},
+		},
 	}
 
 	receiveOnChannel := func(ch <-chan string) {
@@ -189,13 +190,13 @@ func TestProgressItemsFullLine(t *testing.T) {
 	}
 
 	conveyorItemM1 := &conveyorItem{
-		handler: &conveyorItemHandler{transformCh: transformChM1},
-		useM1:   true,
+		handler:  &conveyorItemHandler{transformCh: transformChM1},
+		commands: []machineCommand{{pos: LINE_DEFAULT_M1_POS, process: true}},
 	}
 
 	conveyorItemM2 := &conveyorItem{
-		handler: &conveyorItemHandler{transformCh: transformChM2},
-		useM2:   true,
+		handler:  &conveyorItemHandler{transformCh: transformChM2},
+		commands: []machineCommand{{pos: LINE_DEFAULT_M2_POS, process: true}},
 	}
 
 	pLine.conveyorLine[0].item = conveyorItemEntry
@@ -259,25 +260,25 @@ func TestPruneDeadWaiters(t *testing.T) {
 func TestTransformCellCommand(t *testing.T) {
 	// creates a dummy process control form
 	pcf := &processControlForm{
-		toolTop:    u.TOOL_1,
-		toolBot:    u.TOOL_1,
-		pieceKind:  u.P_KIND_1,
-		processTop: true,
-		processBot: false,
-		id:         1,
+		pieceKind: u.P_KIND_1,
+		id:        1,
+		machines: []machineCommand{
+			{tool: u.TOOL_1, process: true},
+			{tool: u.TOOL_1, process: false},
+		},
 	}
 
 	result := pcf.toCellCommand()
 	expected := &plc.CellCommand{
-		TxId:       plc.OpcuaInt16{Value: 1},
-		PieceKind:  plc.OpcuaInt16{Value: 1},
-		ProcessBot: plc.OpcuaBool{Value: false},
-		ProcessTop: plc.OpcuaBool{Value: true},
-		ToolBot:    plc.OpcuaInt16{Value: 1},
-		ToolTop:    plc.OpcuaInt16{Value: 1},
+		TxId:      plc.OpcuaInt16{Value: 1},
+		PieceKind: plc.OpcuaInt16{Value: 1},
+		Machines: []plc.MachineCommand{
+			{Process: plc.OpcuaBool{Value: true}, Tool: plc.OpcuaInt16{Value: 1}},
+			{Process: plc.OpcuaBool{Value: false}, Tool: plc.OpcuaInt16{Value: 1}},
+		},
 	}
 
-	if *result != *expected {
+	if !reflect.DeepEqual(result, expected) {
 		t.Fatalf("Expected %+v, got %+v", expected, result)
 	}
 }
@@ -0,0 +1,217 @@
+package sim
+
+import (
+	"context"
+	"log"
+	"mes/internal/utils"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Shipment receipt reconciliation results
+const (
+	RECEIPT_OK       = "ok"
+	RECEIPT_SHORTAGE = "shortage" // W1 grew by fewer pieces than received
+	RECEIPT_OVERAGE  = "overage"  // W1 grew by more pieces than received
+)
+
+// ShipmentReceipt is the reconciliation of the pieces of a shipment the
+// supply lines acknowledged against the growth of the W1 total.
+type ShipmentReceipt struct {
+	ShipmentID int `json:"shipment_id"`
+	Expected   int `json:"expected"`
+	// Pieces of the shipment that W1 actually took in
+	Observed     int       `json:"observed"`
+	Status       string    `json:"status"`
+	StartedAt    time.Time `json:"started_at"`
+	ReconciledAt time.Time `json:"reconciled_at"`
+	Day          uint      `json:"day"`
+}
+
+// openReceipt is a shipment (or part of one) being brought into W1.
+type openReceipt struct {
+	shipmentID int
+	expected   int
+	startedAt  time.Time
+	// W1 total and pieces moved in and out of W1 when the first piece was sent
+	w1Start    int
+	movesStart int
+	// When its last piece was acknowledged, zero while pieces are arriving
+	doneAt time.Time
+}
+
+// receiptLedger follows the pieces moved in and out of W1 by the MES so
+// that the growth of the W1 total over a shipment can be explained.
+// Whatever the moves do not explain is put down to the shipment. When
+// shipments are received at the same time, a discrepancy seen while both
+// were arriving is put down to the one that started first, and only to it.
+type receiptLedger struct {
+	lock sync.Mutex
+	// Pieces that entered W1 minus pieces that left it, as seen by the MES
+	moves   int
+	open    map[*supplyJob]*openReceipt
+	results []ShipmentReceipt
+	journal *utils.JSONLog
+}
+
+var shipmentReceipts = &receiptLedger{
+	open:    make(map[*supplyJob]*openReceipt),
+	journal: utils.NewJSONLog(RECEIPTS_LOG_PATH),
+}
+
+// start opens the receipt of a job when its first piece is sent.
+func (rl *receiptLedger) start(job *supplyJob, w1Total int, now time.Time) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	if _, ok := rl.open[job]; ok {
+		return
+	}
+	rl.open[job] = &openReceipt{
+		shipmentID: job.admission.shipment.ID,
+		expected:   job.admission.nPieces,
+		startedAt:  now,
+		w1Start:    w1Total,
+		movesStart: rl.moves,
+	}
+}
+
+// moved records pieces entering (positive) or leaving (negative) W1.
+func (rl *receiptLedger) moved(n int) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	rl.moves += n
+}
+
+// done marks that all the pieces of the job were acknowledged.
+func (rl *receiptLedger) done(job *supplyJob, now time.Time) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	if receipt, ok := rl.open[job]; ok {
+		receipt.doneAt = now
+	}
+}
+
+// reconcile closes the receipts of the jobs done for at least the settle
+// interval, so that the W1 total polled from the PLC has caught up.
+func (rl *receiptLedger) reconcile(w1Total int, now time.Time) []ShipmentReceipt {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	ready := []*supplyJob{}
+	for job, receipt := range rl.open {
+		if !receipt.doneAt.IsZero() && now.Sub(receipt.doneAt) >= RECEIPT_SETTLE_INTERVAL {
+			ready = append(ready, job)
+		}
+	}
+	sort.Slice(ready, func(i, j int) bool {
+		return rl.open[ready[i]].startedAt.Before(rl.open[ready[j]].startedAt)
+	})
+
+	day, _ := simCalendar.today()
+	reconciled := []ShipmentReceipt{}
+	for _, job := range ready {
+		receipt := rl.open[job]
+		delete(rl.open, job)
+
+		unexplained := receipt.unexplained(w1Total, rl.moves)
+		rl.attribute(unexplained, w1Total)
+		result := ShipmentReceipt{
+			ShipmentID:   receipt.shipmentID,
+			Expected:     receipt.expected,
+			Observed:     receipt.expected + unexplained,
+			Status:       RECEIPT_OK,
+			StartedAt:    receipt.startedAt,
+			ReconciledAt: now,
+			Day:          day,
+		}
+		switch {
+		case unexplained < 0:
+			result.Status = RECEIPT_SHORTAGE
+		case unexplained > 0:
+			result.Status = RECEIPT_OVERAGE
+		}
+
+		rl.results = append(rl.results, result)
+		reconciled = append(reconciled, result)
+		rl.journal.Append(result)
+	}
+	return reconciled
+}
+
+// unexplained returns the change of the W1 total since the receipt started
+// that the moves do not explain.
+func (receipt *openReceipt) unexplained(w1Total int, moves int) int {
+	return (w1Total - receipt.w1Start) - (moves - receipt.movesStart)
+}
+
+// attribute takes a discrepancy put down to a shipment out of the receipts
+// still open, as far as it falls within their own window, so that it is
+// not reported for them as well.
+func (rl *receiptLedger) attribute(unexplained int, w1Total int) {
+	if unexplained == 0 {
+		return
+	}
+	for _, receipt := range rl.open {
+		overlap := receipt.unexplained(w1Total, rl.moves)
+		switch {
+		case unexplained < 0 && overlap < 0:
+			overlap = max(overlap, unexplained)
+		case unexplained > 0 && overlap > 0:
+			overlap = min(overlap, unexplained)
+		default:
+			continue
+		}
+		receipt.w1Start += overlap
+	}
+}
+
+// hasPending reports whether some receipt is waiting to be reconciled.
+func (rl *receiptLedger) hasPending() bool {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	return len(rl.open) > 0
+}
+
+// reconcileReceipts reconciles the shipments received and reports the
+// discrepancies to the ERP. The ERP not taking a report is only logged.
+func reconcileReceipts(ctx context.Context) {
+	w1Total := func() int {
+		factory, mutex := getFactoryInstance()
+		defer mutex.Unlock()
+		return int(factory.warehouses[0].Quantity.Value)
+	}()
+
+	for _, receipt := range shipmentReceipts.reconcile(w1Total, time.Now()) {
+		if receipt.Status == RECEIPT_OK {
+			log.Printf("[ShipmentHandler] Shipment %d reconciled: %d pieces in W1\n",
+				receipt.ShipmentID, receipt.Observed)
+			continue
+		}
+
+		log.Printf("[ShipmentHandler] Shipment %d %s: %d pieces expected in W1, %d observed\n",
+			receipt.ShipmentID, receipt.Status, receipt.Expected, receipt.Observed)
+		form := ShipmentDiscrepancyForm{
+			ID:       receipt.ShipmentID,
+			Expected: receipt.Expected,
+			Observed: receipt.Observed,
+			Day:      receipt.Day,
+		}
+		if err := form.Post(ctx); err != nil {
+			log.Printf("[ShipmentHandler] failed to report discrepancy of shipment %d: %v\n",
+				receipt.ShipmentID, err)
+		}
+	}
+}
+
+// ShipmentReceipts returns the reconciled shipment receipts, oldest first.
+func ShipmentReceipts() []ShipmentReceipt {
+	shipmentReceipts.lock.Lock()
+	defer shipmentReceipts.lock.Unlock()
+
+	results := make([]ShipmentReceipt, len(shipmentReceipts.results))
+	copy(results, shipmentReceipts.results)
+	return results
+}
@@ -0,0 +1,82 @@
+package sim
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReceiptLedgerReconcile(t *testing.T) {
+	rl := &receiptLedger{
+		open:    make(map[*supplyJob]*openReceipt),
+		journal: newTestJournal(t, "receipts.jsonl"),
+	}
+	now := time.Now()
+	complete := &supplyJob{admission: shipmentAdmission{shipment: Shipment{ID: 1}, nPieces: 3}}
+	short := &supplyJob{admission: shipmentAdmission{shipment: Shipment{ID: 2}, nPieces: 2}}
+
+	rl.start(complete, 10, now)
+	rl.moved(3)  // acks of shipment 1
+	rl.moved(-1) // a piece left W1 for production
+	rl.done(complete, now)
+
+	// Not reconciled before the W1 total had time to catch up
+	if reconciled := rl.reconcile(12, now); len(reconciled) != 0 {
+		t.Fatalf("Expected nothing reconciled yet, got %+v", reconciled)
+	}
+	later := now.Add(RECEIPT_SETTLE_INTERVAL)
+	reconciled := rl.reconcile(12, later)
+	if len(reconciled) != 1 || reconciled[0].Status != RECEIPT_OK || reconciled[0].Observed != 3 {
+		t.Fatalf("Expected shipment 1 to be reconciled, got %+v", reconciled)
+	}
+
+	rl.start(short, 12, later)
+	rl.moved(2)
+	rl.done(short, later)
+	reconciled = rl.reconcile(13, later.Add(RECEIPT_SETTLE_INTERVAL))
+	if len(reconciled) != 1 || reconciled[0].Status != RECEIPT_SHORTAGE || reconciled[0].Observed != 1 {
+		t.Fatalf("Expected a shortage on shipment 2, got %+v", reconciled)
+	}
+	if rl.hasPending() {
+		t.Fatal("Expected no receipt pending")
+	}
+}
+
+func TestReceiptLedgerOverlappingShipments(t *testing.T) {
+	tests := []struct {
+		name string
+		// W1 total when the second shipment starts and once both are done
+		w1AtSecond, w1End int
+		want              map[int]int // shipment ID -> observed pieces
+	}{
+		{"both complete", 13, 15, map[int]int{1: 3, 2: 2}},
+		{"piece missing while both arrive", 13, 14, map[int]int{1: 2, 2: 2}},
+		{"piece missing before the second starts", 12, 14, map[int]int{1: 2, 2: 2}},
+		{"extra piece while both arrive", 13, 16, map[int]int{1: 4, 2: 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl := &receiptLedger{
+				open:    make(map[*supplyJob]*openReceipt),
+				journal: newTestJournal(t, "receipts.jsonl"),
+			}
+			now := time.Now()
+			first := &supplyJob{admission: shipmentAdmission{shipment: Shipment{ID: 1}, nPieces: 3}}
+			second := &supplyJob{admission: shipmentAdmission{shipment: Shipment{ID: 2}, nPieces: 2}}
+
+			rl.start(first, 10, now)
+			rl.moved(3)
+			rl.start(second, tt.w1AtSecond, now.Add(time.Second))
+			rl.moved(2)
+			rl.done(first, now)
+			rl.done(second, now)
+
+			observed := map[int]int{}
+			for _, receipt := range rl.reconcile(tt.w1End, now.Add(RECEIPT_SETTLE_INTERVAL)) {
+				observed[receipt.ShipmentID] = receipt.Observed
+			}
+			if !sameCounts(observed, tt.want) {
+				t.Fatalf("Expected %v observed, got %v", tt.want, observed)
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package sim
+
+import (
+	"fmt"
+	"log"
+	"mes/internal/utils"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WipLimits caps the work in progress of the factory.
+// A zero (or missing) cap means no limit.
+type WipLimits struct {
+	// Pieces released from W1 and not yet completed
+	Global int `json:"global"`
+	// Pieces on the conveyor of each line (line ID -> cap)
+	PerLine map[string]int `json:"per_line"`
+}
+
+// WipStatus reports the state of the W1 release queue.
+type WipStatus struct {
+	Limits       WipLimits     `json:"limits"`
+	InProgress   int           `json:"in_progress"`
+	Queued       int           `json:"queued"`
+	Released     int           `json:"released"`
+	AvgQueueTime time.Duration `json:"avg_queue_time_ns"`
+	MaxQueueTime time.Duration `json:"max_queue_time_ns"`
+	// Time the oldest piece still queued has been waiting
+	OldestQueued time.Duration `json:"oldest_queued_ns"`
+	// Whether releases are paused, during an audit
+	Paused bool `json:"paused"`
+}
+
+type queuedPiece struct {
+	piece Piece
+	since time.Time
+}
+
+// releaseQueue holds the pieces waiting in W1 to be released to production
+// and releases them, most urgent first, while the global WIP cap allows it
+// (CONWIP release control).
+type releaseQueue struct {
+	lock       sync.Mutex
+	limit      int
+	inProgress int
+	queue      []queuedPiece
+	paused     bool
+	// Whether the last release stopped for lack of room in W2
+	w2Full bool
+
+	released       int
+	totalQueueTime time.Duration
+	maxQueueTime   time.Duration
+
+	// Signals the piece handler that pieces may be releasable
+	wakeCh chan struct{}
+}
+
+var pieceReleaseQueue = &releaseQueue{wakeCh: make(chan struct{}, 1)}
+
+// enqueue adds the pieces to the queue.
+func (rq *releaseQueue) enqueue(pieces []Piece) {
+	rq.lock.Lock()
+	defer rq.lock.Unlock()
+
+	now := time.Now()
+	for _, piece := range pieces {
+		rq.queue = append(rq.queue, queuedPiece{piece: piece, since: now})
+	}
+}
+
+// sortLocked orders the queue by (aged) priority class, then by due date.
+func (rq *releaseQueue) sortLocked(now time.Time) {
+	sort.SliceStable(rq.queue, func(i, j int) bool {
+		a, b := rq.queue[i], rq.queue[j]
+		pa := effectivePriority(a.piece.Priority, now.Sub(a.since))
+		pb := effectivePriority(b.piece.Priority, now.Sub(b.since))
+		if pa != pb {
+			return pa > pb
+		}
+		return dueBefore(&a.piece, &b.piece)
+	})
+}
+
+// release pops the pieces that can start production under the WIP cap,
+// highest priority first, at most room of them.
+func (rq *releaseQueue) release(room int) []Piece {
+	rq.lock.Lock()
+	defer rq.lock.Unlock()
+
+	now := time.Now()
+	rq.sortLocked(now)
+	released := []Piece{}
+	full := false
+	for !rq.paused && len(rq.queue) > 0 && (rq.limit <= 0 || rq.inProgress < rq.limit) {
+		if len(released) >= room {
+			full = true
+			break
+		}
+
+		next := rq.queue[0]
+		rq.queue = rq.queue[1:]
+		rq.inProgress++
+
+		queueTime := now.Sub(next.since)
+		rq.released++
+		rq.totalQueueTime += queueTime
+		if queueTime > rq.maxQueueTime {
+			rq.maxQueueTime = queueTime
+		}
+
+		log.Printf("[releaseQueue.release] Piece %s released after %v in queue (WIP %d/%d)\n",
+			next.piece.ErpIdentifier, queueTime, rq.inProgress, rq.limit)
+		released = append(released, next.piece)
+	}
+
+	// Only a change of state is logged, not every release that waits on W2
+	switch {
+	case full && !rq.w2Full:
+		log.Printf("[releaseQueue.release] W2 has no room for more pieces, %d kept in W1\n",
+			len(rq.queue))
+		rq.w2Full = true
+	case !full && rq.w2Full && len(released) > 0:
+		log.Printf("[releaseQueue.release] W2 has room again, releasing pieces\n")
+		rq.w2Full = false
+	}
+	return released
+}
+
+// pause stops, or resumes, the releases.
+func (rq *releaseQueue) pause(paused bool) {
+	rq.lock.Lock()
+	rq.paused = paused
+	rq.lock.Unlock()
+
+	log.Printf("[releaseQueue.pause] releases paused: %v\n", paused)
+	rq.wakeUp()
+}
+
+// finish frees the WIP slot of a completed piece.
+func (rq *releaseQueue) finish() {
+	rq.lock.Lock()
+	rq.inProgress--
+	rq.lock.Unlock()
+
+	rq.wakeUp()
+}
+
+func (rq *releaseQueue) wakeUp() {
+	utils.Signal(rq.wakeCh)
+}
+
+func (rq *releaseQueue) status() WipStatus {
+	rq.lock.Lock()
+	defer rq.lock.Unlock()
+
+	status := WipStatus{
+		Limits:       WipLimits{Global: rq.limit},
+		InProgress:   rq.inProgress,
+		Queued:       len(rq.queue),
+		Released:     rq.released,
+		MaxQueueTime: rq.maxQueueTime,
+		Paused:       rq.paused,
+	}
+	if rq.released > 0 {
+		status.AvgQueueTime = rq.totalQueueTime / time.Duration(rq.released)
+	}
+	if len(rq.queue) > 0 {
+		oldest := rq.queue[0].since
+		for _, queued := range rq.queue {
+			if queued.since.Before(oldest) {
+				oldest = queued.since
+			}
+		}
+		status.OldestQueued = time.Since(oldest)
+	}
+	return status
+}
+
+// snapshot returns a copy of the pieces waiting to be released, in the
+// order they would be released.
+func (rq *releaseQueue) snapshot() []Piece {
+	rq.lock.Lock()
+	defer rq.lock.Unlock()
+
+	rq.sortLocked(time.Now())
+	pieces := make([]Piece, len(rq.queue))
+	for i, queued := range rq.queue {
+		pieces[i] = queued.piece
+	}
+	return pieces
+}
+
+// SetWipLimits changes the global and per-line WIP caps.
+func SetWipLimits(limits WipLimits) error {
+	if limits.Global < 0 {
+		return fmt.Errorf("[SetWipLimits] global cap must not be negative")
+	}
+
+	factory, mutex := getFactoryInstance()
+	defer mutex.Unlock()
+
+	for lineID, limit := range limits.PerLine {
+		if _, ok := factory.processLines[lineID]; !ok {
+			return fmt.Errorf("[SetWipLimits] unknown line %q", lineID)
+		}
+		if limit < 0 {
+			return fmt.Errorf("[SetWipLimits] cap of line %s must not be negative", lineID)
+		}
+	}
+	for lineID, line := range factory.processLines {
+		line.wipCap = limits.PerLine[lineID]
+	}
+
+	pieceReleaseQueue.lock.Lock()
+	pieceReleaseQueue.limit = limits.Global
+	pieceReleaseQueue.lock.Unlock()
+	pieceReleaseQueue.wakeUp()
+
+	log.Printf("[SetWipLimits] WIP limits set to %+v\n", limits)
+	return nil
+}
+
+// Wip returns the WIP caps and the W1 release queue metrics.
+func Wip() WipStatus {
+	status := pieceReleaseQueue.status()
+
+	factory, mutex := getFactoryInstance()
+	defer mutex.Unlock()
+
+	status.Limits.PerLine = make(map[string]int)
+	for lineID, line := range factory.processLines {
+		if line.wipCap > 0 {
+			status.Limits.PerLine[lineID] = line.wipCap
+		}
+	}
+	return status
+}
+
+// atWipCap reports whether the line holds as many pieces as its cap allows.
+func (pl *ProcessingLine) atWipCap() bool {
+	return pl.wipCap > 0 && pl.getNItemsInConveyor() >= pl.wipCap
+}
+
+// ParseLineCaps parses per-line caps written as "L1=2,L4=3".
+func ParseLineCaps(s string) (map[string]int, error) {
+	caps := make(map[string]int)
+	if strings.TrimSpace(s) == "" {
+		return caps, nil
+	}
+
+	for _, entry := range strings.Split(s, ",") {
+		lineID, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("[ParseLineCaps] invalid entry %q, expected <line>=<cap>", entry)
+		}
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("[ParseLineCaps] invalid cap for line %s: %q", lineID, value)
+		}
+		caps[lineID] = limit
+	}
+	return caps, nil
+}
@@ -0,0 +1,57 @@
+package sim
+
+import (
+	"testing"
+)
+
+func TestReleaseQueueWipCap(t *testing.T) {
+	rq := &releaseQueue{limit: 2, wakeCh: make(chan struct{}, 1)}
+	rq.enqueue([]Piece{
+		{ErpIdentifier: "late", DueDate: 9},
+		{ErpIdentifier: "undated"},
+		{ErpIdentifier: "urgent", DueDate: 3},
+	})
+
+	released := rq.release(WAREHOUSE_CAPACITY)
+	if len(released) != 2 {
+		t.Fatalf("Expected 2 pieces released under the cap, got %d", len(released))
+	}
+	if released[0].ErpIdentifier != "urgent" || released[1].ErpIdentifier != "late" {
+		t.Fatalf("Expected the most urgent pieces first, got %v", released)
+	}
+	if more := rq.release(WAREHOUSE_CAPACITY); len(more) != 0 {
+		t.Fatalf("Expected no release at the cap, got %v", more)
+	}
+
+	rq.finish()
+	select {
+	case <-rq.wakeCh:
+	default:
+		t.Fatal("Expected finishing a piece to wake up the release loop")
+	}
+	released = rq.release(WAREHOUSE_CAPACITY)
+	if len(released) != 1 || released[0].ErpIdentifier != "undated" {
+		t.Fatalf("Expected the undated piece to be released, got %v", released)
+	}
+
+	status := rq.status()
+	if status.InProgress != 2 || status.Queued != 0 || status.Released != 3 {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+}
+
+func TestParseLineCaps(t *testing.T) {
+	caps, err := ParseLineCaps("L1=2, L4=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(caps) != 2 || caps["L1"] != 2 || caps["L4"] != 3 {
+		t.Fatalf("Unexpected caps %v", caps)
+	}
+
+	for _, invalid := range []string{"L1", "L1=x"} {
+		if _, err := ParseLineCaps(invalid); err == nil {
+			t.Fatalf("Expected an error for %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package sim
+
+import (
+	"log"
+	"math"
+	"mes/internal/utils"
+	"sort"
+	"strings"
+)
+
+// routeLeg is a single visit of a piece to a processing line kind, from the
+// moment it leaves warehouse W1 until it enters warehouse W2.
+type routeLeg struct {
+	lines        []string // IDs of the lines able to run this leg
+	firstStep    int      // index of the first recipe step run in this leg
+	nSteps       int      // number of recipe steps run in this leg
+	firstMachine int      // index of the first machine used (earlier ones are skipped)
+	time         int      // processing time of the leg (in seconds)
+}
+
+// machineKey identifies the kind of a processing line by the machines
+// placed along its conveyor. Lines with the same key are interchangeable.
+func (pl *ProcessingLine) machineKey() string {
+	names := []string{}
+	for _, conveyor := range pl.conveyorLine {
+		if conveyor.machine != nil {
+			names = append(names, conveyor.machine.name)
+		}
+	}
+	return strings.Join(names, "+")
+}
+
+// lineKinds groups the processing lines of the factory (except L0) by kind.
+// The line IDs of each group are sorted.
+func (f *factory) lineKinds() map[string][]string {
+	kinds := make(map[string][]string)
+	for _, line := range f.processLines {
+		if line.id == utils.ID_L0 {
+			continue
+		}
+		key := line.machineKey()
+		kinds[key] = append(kinds[key], line.id)
+	}
+	for _, lineIDs := range kinds {
+		sort.Strings(lineIDs)
+	}
+	return kinds
+}
+
+// kindForm is a control form the lines of a kind can run, with the lines
+// able to run it.
+type kindForm struct {
+	form  *processControlForm
+	lines []string
+}
+
+// kindForms returns the forms the lines of a kind that are not down can run
+// for the piece, starting on each machine. A machine down or a tool blocked
+// on one line only takes that line off the forms it can no longer run.
+func (f *factory) kindForms(lineIDs []string, piece *Piece) []kindForm {
+	forms := []kindForm{}
+	for _, lineID := range lineIDs {
+		line := f.processLines[lineID]
+		if line.down {
+			continue
+		}
+
+	positions:
+		for first := range line.machinePositions() {
+			form := line.createFormFrom(piece, first)
+			if form == nil {
+				continue
+			}
+			for i := range forms {
+				if forms[i].form.firstMachine() == form.firstMachine() &&
+					forms[i].form.stepsCompleted == form.stepsCompleted {
+					forms[i].lines = append(forms[i].lines, lineID)
+					continue positions
+				}
+			}
+			forms = append(forms, kindForm{form: form, lines: []string{lineID}})
+		}
+	}
+	return forms
+}
+
+// createRouteForm creates the control form that runs the next leg of the
+// piece's route on the line: the steps the planner chose, starting on the
+// machine it chose. The best form the line offers is used instead when the
+// piece has no route through the line, or when the line can no longer run
+// the leg as planned (e.g. a tool was blocked since the route was planned).
+func (pl *ProcessingLine) createRouteForm(piece *Piece) *processControlForm {
+	if len(piece.route) > 0 && containsString(piece.route[0].lines, pl.id) {
+		leg := piece.route[0]
+		form := pl.createFormFrom(piece, leg.firstMachine)
+		if form != nil && form.stepsCompleted == leg.nSteps {
+			return form
+		}
+		log.Printf("[ProcessingLine.createRouteForm] line %s cannot run steps %d-%d of piece %s as planned\n",
+			pl.id, leg.firstStep, leg.firstStep+leg.nSteps-1, piece.ErpIdentifier)
+	}
+	return pl.createBestForm(piece)
+}
+
+// planRoute computes the sequence of line visits that completes the rest of
+// the piece's recipe minimising the total processing time plus a fixed
+// ROUTE_TRANSFER_TIME penalty for each warehouse round trip.
+//
+// Each leg runs the steps a single control form would: a run of same-tool
+// steps on each of the line machines it goes through, in conveyor order.
+// Returns nil if some step cannot be processed by any line.
+func planRoute(f *factory, piece *Piece) []routeLeg {
+	nSteps := len(piece.Steps)
+	start := piece.CurrentStep
+
+	stepsTime := func(from, n int) int {
+		time := 0
+		for _, step := range piece.Steps[from : from+n] {
+			time += step.Time
+		}
+		return time
+	}
+
+	// bestCost[i] is the cost to complete the recipe from step i and
+	// bestLeg[i] the first leg of the route achieving it
+	bestCost := make([]int, nSteps+1)
+	bestLeg := make([]*routeLeg, nSteps+1)
+	for i := start; i < nSteps; i++ {
+		bestCost[i] = math.MaxInt
+	}
+
+	kinds := f.lineKinds()
+	kindKeys := make([]string, 0, len(kinds))
+	for key := range kinds {
+		kindKeys = append(kindKeys, key)
+	}
+	sort.Strings(kindKeys)
+
+	for i := nSteps - 1; i >= start; i-- {
+		stepPiece := *piece
+		stepPiece.CurrentStep = i
+
+		for _, key := range kindKeys {
+			for _, kf := range f.kindForms(kinds[key], &stepPiece) {
+				form := kf.form
+				next := i + form.stepsCompleted
+				if bestCost[next] == math.MaxInt {
+					continue
+				}
+
+				legTime := stepsTime(i, form.stepsCompleted)
+				cost := legTime + ROUTE_TRANSFER_TIME + bestCost[next]
+				if cost < bestCost[i] {
+					bestCost[i] = cost
+					bestLeg[i] = &routeLeg{
+						lines:        kf.lines,
+						firstStep:    i,
+						nSteps:       form.stepsCompleted,
+						firstMachine: form.firstMachine(),
+						time:         legTime,
+					}
+				}
+			}
+		}
+	}
+
+	if start < nSteps && bestLeg[start] == nil {
+		return nil
+	}
+
+	route := []routeLeg{}
+	for i := start; i < nSteps; i += bestLeg[i].nSteps {
+		route = append(route, *bestLeg[i])
+	}
+	return route
+}
@@ -0,0 +1,110 @@
+package sim
+
+import (
+	u "mes/internal/utils"
+	"reflect"
+	"testing"
+)
+
+func TestPlanRouteSingleLeg(t *testing.T) {
+	f := newTestFactory()
+
+	// Type 1 lines can do the T1 step but only type 2 lines can follow it
+	// with T6 in the same visit
+	piece := &Piece{
+		Steps: []Transformation{
+			{Tool: u.TOOL_1, Time: 45},
+			{Tool: u.TOOL_6, Time: 30},
+		},
+	}
+
+	route := planRoute(f, piece)
+	if len(route) != 1 {
+		t.Fatalf("Expected a single leg route, got %+v", route)
+	}
+	if route[0].nSteps != 2 || route[0].time != 75 || route[0].firstMachine != 0 {
+		t.Fatalf("Unexpected leg %+v", route[0])
+	}
+	for _, lineID := range route[0].lines {
+		if lineID != u.ID_L4 && lineID != u.ID_L5 && lineID != u.ID_L6 {
+			t.Fatalf("Expected only type 2 lines, got %v", route[0].lines)
+		}
+	}
+}
+
+func TestPlanRouteFromCurrentStep(t *testing.T) {
+	f := newTestFactory()
+
+	piece := &Piece{
+		CurrentStep: 1,
+		Steps: []Transformation{
+			{Tool: u.TOOL_4, Time: 30},
+			{Tool: u.TOOL_2, Time: 30},
+			{Tool: u.TOOL_4, Time: 30},
+		},
+	}
+
+	route := planRoute(f, piece)
+	if len(route) != 2 {
+		t.Fatalf("Expected a two leg route, got %+v", route)
+	}
+	if route[0].firstStep != 1 || route[1].firstStep != 2 {
+		t.Fatalf("Unexpected route %+v", route)
+	}
+}
+
+func TestPlanRouteUnsupportedTool(t *testing.T) {
+	f := newTestFactory()
+
+	piece := &Piece{Steps: []Transformation{{Tool: "T9", Time: 30}}}
+	if route := planRoute(f, piece); route != nil {
+		t.Fatalf("Expected no route, got %+v", route)
+	}
+}
+
+func TestPlanRouteMachineDownOnOneLine(t *testing.T) {
+	f := newTestFactory()
+
+	// Only M4 has T6, and it is down on L4
+	l4 := f.processLines[u.ID_L4]
+	l4.conveyorLine[l4.machinePositions()[1]].machine.down = true
+	piece := &Piece{
+		Steps: []Transformation{
+			{Tool: u.TOOL_1, Time: 45},
+			{Tool: u.TOOL_6, Time: 30},
+		},
+	}
+
+	route := planRoute(f, piece)
+	if len(route) != 1 || route[0].nSteps != 2 {
+		t.Fatalf("Expected the leg to be run by the other type 2 lines, got %+v", route)
+	}
+	if !reflect.DeepEqual(route[0].lines, []string{u.ID_L5, u.ID_L6}) {
+		t.Fatalf("Expected the leg on L5 and L6 only, got %v", route[0].lines)
+	}
+}
+
+func TestCreateRouteFormFollowsLeg(t *testing.T) {
+	f := newTestFactory()
+
+	piece := &Piece{
+		Steps: []Transformation{
+			{Tool: u.TOOL_1, Time: 45},
+			{Tool: u.TOOL_6, Time: 30},
+		},
+	}
+	piece.route = planRoute(f, piece)
+
+	form := f.processLines[u.ID_L4].createRouteForm(piece)
+	if form == nil || form.firstMachine() != piece.route[0].firstMachine ||
+		form.stepsCompleted != piece.route[0].nSteps {
+		t.Fatalf("Expected the planned leg, got %+v", form)
+	}
+
+	// Off the route the line offers its best form
+	form = f.processLines[u.ID_L1].createRouteForm(piece)
+	best := f.processLines[u.ID_L1].createBestForm(piece)
+	if form == nil || best == nil || form.stepsCompleted != best.stepsCompleted {
+		t.Fatalf("Expected the best form off the route, got %+v", form)
+	}
+}
@@ -0,0 +1,177 @@
+package sim
+
+import (
+	"fmt"
+	"log"
+	"mes/internal/utils"
+	"sort"
+	"time"
+)
+
+// Scheduler decides how the pieces waiting in a warehouse are matched with
+// the processing lines of the factory.
+//
+// Both methods are called with the factory lock held.
+type Scheduler interface {
+	// Assign returns the IDs of the processing lines that the piece
+	// should wait on. Any of those lines may end up claiming the piece.
+	// The lines considered are recorded in the (possibly nil) decision.
+	Assign(f *factory, piece *Piece, d *DispatchDecision) []string
+
+	// Rank orders the (alive) waiters of a free processing line from the
+	// most to the least preferred. The line claims the first waiter in the
+	// returned slice that was not yet claimed by another line.
+	Rank(pl *ProcessingLine, waiters []*freeLineWaiter) []*freeLineWaiter
+}
+
+// SchedulerOptions holds the tunable parameters of the schedulers.
+// Each scheduler only reads the options relevant to it.
+type SchedulerOptions struct {
+	// Leniency margin used when registering pieces with lines
+	Leniency float64
+	// Longest time the batching scheduler may hold a piece back
+	BatchMaxWait time.Duration
+}
+
+// DefaultSchedulerOptions returns the options used when none are given.
+func DefaultSchedulerOptions() SchedulerOptions {
+	return SchedulerOptions{
+		Leniency:     SCHEDULER_LENIENCY,
+		BatchMaxWait: TOOL_BATCH_MAX_WAIT,
+	}
+}
+
+// schedulerFactories maps the scheduler names accepted by UseScheduler
+// to their constructors.
+var schedulerFactories = map[string]func(SchedulerOptions) Scheduler{
+	SCHEDULER_LENIENT: func(opts SchedulerOptions) Scheduler {
+		return &lenientScheduler{leniency: opts.Leniency}
+	},
+	SCHEDULER_BEST: func(SchedulerOptions) Scheduler {
+		return &lenientScheduler{leniency: 0}
+	},
+	SCHEDULER_EDD: func(opts SchedulerOptions) Scheduler {
+		return &dueDateScheduler{
+			lenientScheduler: lenientScheduler{leniency: opts.Leniency},
+			before:           dueBefore,
+		}
+	},
+	SCHEDULER_CR: func(opts SchedulerOptions) Scheduler {
+		return &dueDateScheduler{
+			lenientScheduler: lenientScheduler{leniency: opts.Leniency},
+			before:           criticalRatioBefore,
+		}
+	},
+	SCHEDULER_BATCH: func(opts SchedulerOptions) Scheduler {
+		return &toolBatchingScheduler{
+			lenientScheduler: lenientScheduler{leniency: opts.Leniency},
+			maxWait:          opts.BatchMaxWait,
+		}
+	},
+}
+
+// SchedulerNames returns the names of all the available schedulers.
+func SchedulerNames() []string {
+	names := make([]string, 0, len(schedulerFactories))
+	for name := range schedulerFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newScheduler(name string, opts SchedulerOptions) (Scheduler, error) {
+	newFunc, ok := schedulerFactories[name]
+	if !ok {
+		return nil, fmt.Errorf(
+			"[newScheduler] unknown scheduler %q (available: %v)",
+			name, SchedulerNames(),
+		)
+	}
+	return newFunc(opts), nil
+}
+
+// UseScheduler replaces the scheduler used by the factory.
+// Pieces already waiting on lines keep their current registrations.
+func UseScheduler(name string, opts SchedulerOptions) error {
+	scheduler, err := newScheduler(name, opts)
+	if err != nil {
+		return err
+	}
+
+	factory, mutex := getFactoryInstance()
+	defer mutex.Unlock()
+
+	factory.scheduler = scheduler
+	factory.schedulerName = name
+	// Keep following the day plan, if any, on top of the new scheduler
+	factory.installDayPlan(factory.dayPlan)
+	log.Printf("[UseScheduler] Using scheduler %s\n", name)
+	return nil
+}
+
+// lenientScheduler scores every compatible line with the best control form
+// it can offer the piece and registers the piece with all the lines whose
+// score is within the leniency margin of the best one.
+// If the piece has a planned route only the lines of its next leg are scored.
+// Free lines claim their waiters in registration order.
+type lenientScheduler struct {
+	leniency float64
+}
+
+func (s *lenientScheduler) Assign(
+	f *factory,
+	piece *Piece,
+	d *DispatchDecision,
+) []string {
+	candidates := make([]*ProcessingLine, 0, len(f.processLines))
+	if len(piece.route) > 0 {
+		for _, lineID := range piece.route[0].lines {
+			candidates = append(candidates, f.processLines[lineID])
+		}
+	} else {
+		for _, line := range f.processLines {
+			candidates = append(candidates, line)
+		}
+	}
+
+	lineOffers := make(map[string]*processControlForm)
+	for _, line := range candidates {
+		if line.id == utils.ID_L0 || line.down {
+			continue
+		}
+
+		if form := line.createBestForm(piece); form != nil {
+			lineOffers[line.id] = form
+		}
+	}
+
+	bestScore := 9999999
+	for _, form := range lineOffers {
+		if score := form.metadataScore(); score < bestScore {
+			bestScore = score
+		}
+	}
+
+	lineIDs := make([]string, 0, len(lineOffers))
+	for lineID, form := range lineOffers {
+		registered := (1-s.leniency)*float64(form.metadataScore()) <= float64(bestScore)
+		if registered {
+			lineIDs = append(lineIDs, lineID)
+		}
+		d.offer(lineID, form, registered)
+	}
+
+	if d != nil {
+		d.Leniency = s.leniency
+		d.BestScore = bestScore
+	}
+	return lineIDs
+}
+
+func (s *lenientScheduler) Rank(
+	_ *ProcessingLine,
+	waiters []*freeLineWaiter,
+) []*freeLineWaiter {
+	return waiters
+}
@@ -0,0 +1,145 @@
+package sim
+
+import (
+	u "mes/internal/utils"
+	"sort"
+	"testing"
+	"time"
+)
+
+func newTestFactory() *factory {
+	processLines := make(map[string]*ProcessingLine)
+	for _, lineID := range []string{u.ID_L1, u.ID_L2, u.ID_L3} {
+		processLines[lineID] = &ProcessingLine{
+			id:            lineID,
+			conveyorLine:  initType1Conveyor(),
+			waitingPieces: []*freeLineWaiter{},
+			readyForNext:  true,
+		}
+	}
+	for _, lineID := range []string{u.ID_L4, u.ID_L5, u.ID_L6} {
+		processLines[lineID] = &ProcessingLine{
+			id:            lineID,
+			conveyorLine:  initType2Conveyor(),
+			waitingPieces: []*freeLineWaiter{},
+			readyForNext:  true,
+		}
+	}
+	return &factory{processLines: processLines}
+}
+
+func TestLenientSchedulerAssign(t *testing.T) {
+	f := newTestFactory()
+
+	// Only type 2 lines have T4
+	piece := &Piece{
+		Kind:  u.P_KIND_1,
+		Steps: []Transformation{{Tool: u.TOOL_4, Time: 30}},
+	}
+
+	s, err := newScheduler(SCHEDULER_LENIENT, DefaultSchedulerOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := s.Assign(f, piece, nil)
+	sort.Strings(lines)
+	expected := []string{u.ID_L4, u.ID_L5, u.ID_L6}
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected lines %v, got %v", expected, lines)
+	}
+	for i := range expected {
+		if lines[i] != expected[i] {
+			t.Fatalf("Expected lines %v, got %v", expected, lines)
+		}
+	}
+
+	// A busy line should be left out by the strict scheduler
+	f.processLines[u.ID_L4].conveyorLine[2].item = &conveyorItem{}
+	f.processLines[u.ID_L4].conveyorLine[3].item = &conveyorItem{}
+
+	s, err = newScheduler(SCHEDULER_BEST, DefaultSchedulerOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, lineID := range s.Assign(f, piece, nil) {
+		if lineID == u.ID_L4 {
+			t.Fatalf("Expected busy line %s to be left out", u.ID_L4)
+		}
+	}
+}
+
+func TestUnknownScheduler(t *testing.T) {
+	if _, err := newScheduler("unknown", DefaultSchedulerOptions()); err == nil {
+		t.Fatal("Expected an error for an unknown scheduler")
+	}
+}
+
+func TestDueDateSchedulerRank(t *testing.T) {
+	noDeadline := &freeLineWaiter{piece: &Piece{ErpIdentifier: "none"}}
+	late := &freeLineWaiter{piece: &Piece{ErpIdentifier: "late", DueDate: 9}}
+	early := &freeLineWaiter{piece: &Piece{ErpIdentifier: "early", DueDate: 3}}
+
+	s, err := newScheduler(SCHEDULER_EDD, DefaultSchedulerOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ranked := s.Rank(nil, []*freeLineWaiter{noDeadline, late, early})
+	expected := []string{"early", "late", "none"}
+	for i, w := range ranked {
+		if w.piece.ErpIdentifier != expected[i] {
+			t.Fatalf("Expected rank %d to be %s, got %s",
+				i, expected[i], w.piece.ErpIdentifier)
+		}
+	}
+}
+
+func TestToolBatchingSchedulerRank(t *testing.T) {
+	pLine := &ProcessingLine{
+		id:            u.ID_L1,
+		conveyorLine:  initType1Conveyor(),
+		waitingPieces: []*freeLineWaiter{},
+		readyForNext:  true,
+	}
+
+	// Type 1 machines start with T1 selected
+	now := time.Now()
+	swapT2 := &freeLineWaiter{
+		piece:        &Piece{ErpIdentifier: "t2", Steps: []Transformation{{Tool: u.TOOL_2}}},
+		waitingSince: now,
+	}
+	swapT3 := &freeLineWaiter{
+		piece:        &Piece{ErpIdentifier: "t3", Steps: []Transformation{{Tool: u.TOOL_3}}},
+		waitingSince: now,
+	}
+	swapT3Again := &freeLineWaiter{
+		piece:        &Piece{ErpIdentifier: "t3-again", Steps: []Transformation{{Tool: u.TOOL_3}}},
+		waitingSince: now,
+	}
+	setUp := &freeLineWaiter{
+		piece:        &Piece{ErpIdentifier: "t1", Steps: []Transformation{{Tool: u.TOOL_1}}},
+		waitingSince: now,
+	}
+	starving := &freeLineWaiter{
+		piece:        &Piece{ErpIdentifier: "starving", Steps: []Transformation{{Tool: u.TOOL_2}}},
+		waitingSince: now.Add(-time.Hour),
+	}
+
+	s, err := newScheduler(SCHEDULER_BATCH, DefaultSchedulerOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ranked := s.Rank(pLine, []*freeLineWaiter{swapT2, swapT3, setUp, swapT3Again, starving})
+	expected := []string{"starving", "t1", "t3", "t3-again", "t2"}
+	if len(ranked) != len(expected) {
+		t.Fatalf("Expected %d ranked waiters, got %d", len(expected), len(ranked))
+	}
+	for i, w := range ranked {
+		if w.piece.ErpIdentifier != expected[i] {
+			t.Fatalf("Expected rank %d to be %s, got %s",
+				i, expected[i], w.piece.ErpIdentifier)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package sim
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Scoring terms
+const (
+	SCORE_TERM_TIME            = "time"            // processing time, tool swaps included (s)
+	SCORE_TERM_QUEUE           = "queue"           // pieces already on the line's conveyor
+	SCORE_TERM_TOOL_CHANGES    = "tool_changes"    // tool swaps needed
+	SCORE_TERM_REMAINING_STEPS = "remaining_steps" // recipe steps left after the command
+	SCORE_TERM_DUE_SLACK       = "due_slack"       // projected lateness after the command (s)
+	SCORE_TERM_ENERGY          = "energy"          // machine work, in machine-seconds
+)
+
+// scoreTerm measures one objective of a control form. Lower is better.
+type scoreTerm func(pcf *processControlForm) float64
+
+var scoreTerms = map[string]scoreTerm{
+	SCORE_TERM_TIME: func(pcf *processControlForm) float64 {
+		return float64(pcf.intrinsicTime)
+	},
+	SCORE_TERM_QUEUE: func(pcf *processControlForm) float64 {
+		return float64(pcf.queueSize)
+	},
+	SCORE_TERM_TOOL_CHANGES: func(pcf *processControlForm) float64 {
+		return float64(pcf.toolChanges())
+	},
+	SCORE_TERM_REMAINING_STEPS: func(pcf *processControlForm) float64 {
+		return float64(pcf.totalSteps - pcf.stepsCompleted)
+	},
+	SCORE_TERM_DUE_SLACK: func(pcf *processControlForm) float64 {
+		if pcf.dueDate == 0 {
+			return 0
+		}
+		today, dayLength := simCalendar.today()
+		timeLeft := (float64(pcf.dueDate) - float64(today)) * dayLength.Seconds()
+		slack := timeLeft - float64(pcf.intrinsicTime+pcf.remainingWork)
+		return math.Max(0, -slack)
+	},
+	SCORE_TERM_ENERGY: func(pcf *processControlForm) float64 {
+		swaps := pcf.toolChanges()
+		work := pcf.intrinsicTime - swaps*MACHINE_TOOL_SWAP_TIME
+		return float64(work + swaps*MACHINE_TOOL_SWAP_ENERGY)
+	},
+}
+
+func (pcf *processControlForm) toolChanges() int {
+	changes := 0
+	for _, cmd := range pcf.machines {
+		if cmd.change {
+			changes++
+		}
+	}
+	return changes
+}
+
+// ScoringWeights maps scoring terms to their weight in the score of a
+// control form. Terms left out do not count.
+type ScoringWeights map[string]float64
+
+// DefaultScoringWeights returns the weights used when none are configured.
+func DefaultScoringWeights() ScoringWeights {
+	return ScoringWeights{
+		SCORE_TERM_TIME:            TIME_WEIGHT,
+		SCORE_TERM_QUEUE:           QUEUE_WEIGHT,
+		SCORE_TERM_REMAINING_STEPS: STEP_WEIGHT,
+	}
+}
+
+func (sw ScoringWeights) validate() error {
+	for term, weight := range sw {
+		if _, ok := scoreTerms[term]; !ok {
+			return fmt.Errorf("[ScoringWeights] unknown term %q (available: %v)",
+				term, ScoreTermNames())
+		}
+		if weight < 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+			return fmt.Errorf("[ScoringWeights] invalid weight %v for term %s", weight, term)
+		}
+	}
+	return nil
+}
+
+func (sw ScoringWeights) clone() ScoringWeights {
+	weights := make(ScoringWeights, len(sw))
+	for term, weight := range sw {
+		weights[term] = weight
+	}
+	return weights
+}
+
+// ParseScoringWeights parses weights written as "time=1,queue=125".
+func ParseScoringWeights(s string) (ScoringWeights, error) {
+	weights := ScoringWeights{}
+	for _, entry := range strings.Split(s, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		term, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("[ParseScoringWeights] invalid entry %q, expected <term>=<weight>", entry)
+		}
+		weight, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("[ParseScoringWeights] invalid weight for term %s: %q", term, value)
+		}
+		weights[term] = weight
+	}
+	return weights, weights.validate()
+}
+
+// ScoreTermNames returns the names of all the available scoring terms.
+func ScoreTermNames() []string {
+	names := make([]string, 0, len(scoreTerms))
+	for name := range scoreTerms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// scoringConfig holds the weights the control forms are scored with and
+// the file they were loaded from, if any.
+type scoringConfig struct {
+	lock    sync.RWMutex
+	weights ScoringWeights
+	path    string
+}
+
+var activeScoring = &scoringConfig{weights: DefaultScoringWeights()}
+
+func (sc *scoringConfig) set(weights ScoringWeights) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	sc.weights = weights.clone()
+}
+
+// metadataScore combines the scoring terms of the form with the active
+// weights. Lower scores are better.
+func (pcf *processControlForm) metadataScore() int {
+	activeScoring.lock.RLock()
+	defer activeScoring.lock.RUnlock()
+
+	score := 0.0
+	for term, weight := range activeScoring.weights {
+		score += weight * scoreTerms[term](pcf)
+	}
+	return int(math.Round(score))
+}
+
+// SetScoringWeights replaces the weights the control forms are scored with.
+// Pieces already waiting on lines keep their current registrations.
+func SetScoringWeights(weights ScoringWeights) error {
+	if err := weights.validate(); err != nil {
+		return err
+	}
+
+	activeScoring.set(weights)
+	log.Printf("[SetScoringWeights] Using scoring weights %v\n", weights)
+	return nil
+}
+
+// ReadScoringWeights reads weights from a JSON file
+// (e.g. {"time": 1, "queue": 125}).
+func ReadScoringWeights(path string) (ScoringWeights, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	weights := ScoringWeights{}
+	if err := json.Unmarshal(data, &weights); err != nil {
+		return nil, fmt.Errorf("[ReadScoringWeights] %s: %w", path, err)
+	}
+	return weights, weights.validate()
+}
+
+// LoadScoringWeights reads the weights from a JSON file and starts using
+// them. The file is remembered so that it can be reloaded later.
+func LoadScoringWeights(path string) error {
+	weights, err := ReadScoringWeights(path)
+	if err != nil {
+		return err
+	}
+
+	activeScoring.lock.Lock()
+	activeScoring.path = path
+	activeScoring.lock.Unlock()
+
+	return SetScoringWeights(weights)
+}
+
+// ReloadScoringWeights reads again the file the weights were loaded from.
+func ReloadScoringWeights() error {
+	activeScoring.lock.RLock()
+	path := activeScoring.path
+	activeScoring.lock.RUnlock()
+
+	if path == "" {
+		return fmt.Errorf("[ReloadScoringWeights] no scoring config file loaded")
+	}
+	return LoadScoringWeights(path)
+}
+
+// CurrentScoringWeights returns the weights the control forms are scored with.
+func CurrentScoringWeights() ScoringWeights {
+	activeScoring.lock.RLock()
+	defer activeScoring.lock.RUnlock()
+	return activeScoring.weights.clone()
+}
@@ -0,0 +1,111 @@
+package sim
+
+import (
+	u "mes/internal/utils"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDefaultScoringWeights(t *testing.T) {
+	form := &processControlForm{
+		intrinsicTime:  90,
+		queueSize:      2,
+		stepsCompleted: 1,
+		totalSteps:     3,
+		machines:       []machineCommand{{change: true}},
+	}
+
+	expected := 90*TIME_WEIGHT + 2*QUEUE_WEIGHT + 2*STEP_WEIGHT
+	if score := form.metadataScore(); score != expected {
+		t.Fatalf("Expected score %d, got %d", expected, score)
+	}
+}
+
+func TestSetScoringWeights(t *testing.T) {
+	defer activeScoring.set(DefaultScoringWeights())
+
+	weights, err := ParseScoringWeights("time=1, tool_changes=50, energy=0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SetScoringWeights(weights); err != nil {
+		t.Fatal(err)
+	}
+
+	form := &processControlForm{
+		intrinsicTime: 90,
+		machines:      []machineCommand{{change: true}},
+	}
+	// 90 + 1*50 + 0.5*(60 + 1*MACHINE_TOOL_SWAP_ENERGY)
+	expected := 90 + 50 + (60+MACHINE_TOOL_SWAP_ENERGY)/2
+	if score := form.metadataScore(); score != expected {
+		t.Fatalf("Expected score %d, got %d", expected, score)
+	}
+
+	for _, invalid := range []string{"speed=1", "time=-1", "time"} {
+		if _, err := ParseScoringWeights(invalid); err == nil {
+			t.Fatalf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestLoadScoringWeights(t *testing.T) {
+	defer activeScoring.set(DefaultScoringWeights())
+
+	path := filepath.Join(t.TempDir(), "scoring.json")
+	if err := os.WriteFile(path, []byte(`{"queue": 10}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadScoringWeights(path); err != nil {
+		t.Fatal(err)
+	}
+	if w := CurrentScoringWeights(); len(w) != 1 || w[SCORE_TERM_QUEUE] != 10 {
+		t.Fatalf("Unexpected weights %v", w)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"queue": 20}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReloadScoringWeights(); err != nil {
+		t.Fatal(err)
+	}
+	if w := CurrentScoringWeights(); w[SCORE_TERM_QUEUE] != 20 {
+		t.Fatalf("Expected the reloaded weights, got %v", w)
+	}
+}
+
+func TestBenchmarkScoring(t *testing.T) {
+	demand := []Piece{}
+	for _, id := range []string{"p1", "p2", "p3", "p4"} {
+		demand = append(demand, Piece{
+			ErpIdentifier: id,
+			Location:      u.ID_W1,
+			Steps:         []Transformation{{Tool: u.TOOL_4, Time: 30}},
+			DueDate:       1,
+		})
+	}
+
+	results, err := BenchmarkScoring(demand, map[string]ScoringWeights{
+		"default":   DefaultScoringWeights(),
+		"few-swaps": {SCORE_TERM_TIME: 1, SCORE_TERM_TOOL_CHANGES: 1000},
+	}, SCHEDULER_LENIENT, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Name != "default" || results[1].Name != "few-swaps" {
+		t.Fatalf("Unexpected results %+v", results)
+	}
+
+	for _, r := range results {
+		if r.Pieces != len(demand) || r.Unscheduled != 0 {
+			t.Fatalf("Expected every piece to be scheduled, got %+v", r)
+		}
+	}
+	if results[1].ToolChanges > results[0].ToolChanges {
+		t.Fatalf("Expected fewer tool changes when they are penalised, got %+v", results)
+	}
+	if w := CurrentScoringWeights(); len(w) != len(DefaultScoringWeights()) {
+		t.Fatalf("Expected the weights in use to be restored, got %v", w)
+	}
+}
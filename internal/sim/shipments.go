@@ -36,6 +36,48 @@ func (s *ShipmentArrivalForm) Post(ctx context.Context) error {
 	return erp.Post(ctx, config, data)
 }
 
+// ShipmentDeferralForm is a form used to report to the ERP the pieces of a
+// shipment that could not be received for lack of space in W1.
+//
+// Implements the ErpPoster interface.
+type ShipmentDeferralForm struct {
+	ID        int  `json:"shipment_id"`
+	NDeferred int  `json:"quantity"`
+	Day       uint `json:"day"`
+}
+
+func (s *ShipmentDeferralForm) Post(ctx context.Context) error {
+	data := url.Values{
+		"shipment_id": {strconv.Itoa(s.ID)},
+		"quantity":    {strconv.Itoa(s.NDeferred)},
+		"day":         {strconv.FormatUint(uint64(s.Day), 10)},
+	}
+	config := erp.ConfigDefaultWithEndpoint(erp.ENDPOINT_SHIPMENT_DEFERRED)
+	return erp.Post(ctx, config, data)
+}
+
+// ShipmentDiscrepancyForm is a form used to report to the ERP a shipment
+// whose pieces in W1 do not match the pieces received.
+//
+// Implements the ErpPoster interface.
+type ShipmentDiscrepancyForm struct {
+	ID       int  `json:"shipment_id"`
+	Expected int  `json:"expected"`
+	Observed int  `json:"observed"`
+	Day      uint `json:"day"`
+}
+
+func (s *ShipmentDiscrepancyForm) Post(ctx context.Context) error {
+	data := url.Values{
+		"shipment_id": {strconv.Itoa(s.ID)},
+		"expected":    {strconv.Itoa(s.Expected)},
+		"observed":    {strconv.Itoa(s.Observed)},
+		"day":         {strconv.FormatUint(uint64(s.Day), 10)},
+	}
+	config := erp.ConfigDefaultWithEndpoint(erp.ENDPOINT_SHIPMENT_MISMATCH)
+	return erp.Post(ctx, config, data)
+}
+
 /*
 *
 *  SHIPMENT HANDLING
@@ -76,8 +118,8 @@ func (s *Shipment) arrived() *ShipmentArrivalForm {
 type ShipmentHandler struct {
 	// Send new shipments to this channel
 	ShipCh chan<- []Shipment
-	// ShipmentAckCh chan<- Shipment
-	ShipAckCh chan<- int16
+	// Supply line acks are sent to this channel
+	ShipAckCh chan<- SupplyAckMetadata
 	// Errors are reported on this channel
 	ErrCh <-chan error
 }
@@ -87,94 +129,92 @@ func StartShipmentHandler(
 	pieceWakeUpCh chan<- struct{},
 ) *ShipmentHandler {
 	shipCh := make(chan []Shipment)
-	shipAckCh := make(chan int16, plc.NUMBER_OF_SUPPLY_LINES+1)
+	shipAckCh := make(chan SupplyAckMetadata, plc.NUMBER_OF_SUPPLY_LINES+1)
 	errCh := make(chan error)
 
+	if err := deferredShipments.load(); err != nil {
+		log.Printf("[ShipmentHandler] failed to restore deferred shipments: %v\n", err)
+	}
+
 	go func() {
 		defer close(errCh)
 		defer close(pieceWakeUpCh)
 
+		retryTicker := time.NewTicker(SHIPMENT_RETRY_INTERVAL)
+		defer retryTicker.Stop()
+		reconcileTicker := time.NewTicker(RECEIPT_SETTLE_INTERVAL)
+		defer reconcileTicker.Stop()
+
+		// Commands every free supply line to bring in a piece
+		dispatch := func() {
+			factory, mutex := getFactoryInstance()
+			defer mutex.Unlock()
+
+			writeCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+
+			for {
+				line, job, ok := pieceSupply.next()
+				if !ok {
+					return
+				}
+
+				if job.toWrite == job.admission.nPieces {
+					w1Total := int(factory.warehouses[0].Quantity.Value)
+					shipmentReceipts.start(job, w1Total, time.Now())
+				}
+
+				supplyLine := factory.supplyLines[line]
+				supplyLine.NewShipment(PieceStrToInt(job.admission.shipment.MaterialKind))
+				_, err := factory.plcClient.Write(supplyLine.CommandOpcuaVars(), writeCtx)
+				utils.Assert(err == nil, "[ShipmentHandler] Error writing to supply line")
+				pieceSupply.sent(line, job, supplyLine.LastCommandTxId())
+
+				log.Printf("[ShipmentHandler] Supply line %d bringing in a piece of shipment %d\n",
+					line, job.admission.shipment.ID)
+			}
+		}
+
+		// Admits the new shipments, and the deferred ones, that fit in W1
+		// next to the pieces already on their way
+		receive := func(shipments []Shipment) {
+			space := warehouseFreeSpace(utils.ID_W1) - pieceSupply.outstanding()
+			admissions, deferred := deferredShipments.admit(shipments, max(0, space))
+			reportDeferred(ctx, deferred)
+
+			for _, admission := range admissions {
+				log.Printf(
+					"[ShipmentHandler] New shipment (id %d): %d of %d pieces of type %v",
+					admission.shipment.ID,
+					admission.nPieces,
+					admission.shipment.NPieces,
+					admission.shipment.MaterialKind,
+				)
+				pieceSupply.add(admission)
+			}
+			dispatch()
+		}
+
 		for {
 			select {
 			case <-ctx.Done():
 				return
 
 			case shipments := <-shipCh:
-				totalArrived := 0
-				availableSpace := 0
-				func() {
-					factory, mutex := getFactoryInstance()
-					defer mutex.Unlock()
-
-					w1Total := int(factory.warehouses[0].Quantity.Value)
-					availableSpace = WAREHOUSE_CAPACITY - w1Total
-				}()
-
-				for _, shipment := range shipments {
-					// Ignore (delay) shipments that exceed the available space in the factory
-					if shipment.NPieces+totalArrived > availableSpace {
-						continue
-					}
-					totalArrived += shipment.NPieces
-
-					log.Printf(
-						"[ShipmentHandler] New shipment (id %d): %d pieces of type %v",
-						shipment.ID,
-						shipment.NPieces,
-						shipment.MaterialKind,
-					)
-
-					// 1 - Communicate new shipments to the PLCs
-					log.Printf(
-						"[ShipmentHandler] Communicating shipment %d to PLCs",
-						shipment.ID,
-					)
-					nArrived := 0
-					for nArrived < shipment.NPieces {
-						// NOTE: Running in a func to defer the mutex unlock
-						var expectedAcks []int16
-						func() {
-							factory, mutex := getFactoryInstance()
-							defer mutex.Unlock()
-
-							writeCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
-							defer cancel()
-
-							for i := 0; i < len(factory.supplyLines); i++ {
-								if nArrived >= shipment.NPieces {
-									break
-								}
-								log.Printf("[ShipmentHandler] Communicating with supply line %d", i)
-								material := PieceStrToInt(shipment.MaterialKind)
-								factory.supplyLines[i].NewShipment(material)
-								_, err := factory.plcClient.Write(
-									factory.supplyLines[i].CommandOpcuaVars(),
-									writeCtx,
-								)
-								utils.Assert(err == nil, "[ShipmentHandler] Error writing to supply line")
-								expectedAcks = append(expectedAcks, factory.supplyLines[i].LastCommandTxId())
-								nArrived++
-							}
-						}()
-
-						utils.Assert(len(expectedAcks) > 0, "[ShipmentHandler] No supply lines to write to")
-
-						// NOTE: Wait all expected shipments to arrive (be acked)
-						for len(expectedAcks) > 0 {
-							acked := <-shipAckCh
-							ackedIdx := -1
-							for i, ack := range expectedAcks {
-								if ack == acked {
-									ackedIdx = i
-									break
-								}
-							}
-							utils.Assert(ackedIdx != -1, "[ShipmentHandler] Unexpected ack")
-							expectedAcks = append(expectedAcks[:ackedIdx], expectedAcks[ackedIdx+1:]...)
-						}
-					}
+				receive(shipments)
+
+			case ack := <-shipAckCh:
+				job, done, err := pieceSupply.acked(ack)
+				utils.Assert(err == nil, fmt.Sprintf("[ShipmentHandler] %v", err))
+				stockroom.received(job.admission.shipment.MaterialKind)
+				pieceTraces.received(job.admission.shipment, ack.line, ack.txId)
+				if done {
+					shipmentReceipts.done(job, time.Now())
+				}
 
-					// 2 - Communicate the arrival of each shipment to the ERP
+				// The rest of a partially admitted shipment is still deferred
+				if done && job.admission.final {
+					shipment := job.admission.shipment
 					log.Printf("[ShipmentHandler] Shipment %d arrived", shipment.ID)
 					if err := shipment.arrived().Post(ctx); err != nil {
 						errCh <- fmt.Errorf(
@@ -182,9 +222,24 @@ func StartShipmentHandler(
 							err.Error(),
 						)
 					}
-
 					pieceWakeUpCh <- struct{}{}
 				}
+				dispatch()
+
+			case <-deferredShipments.wakeCh:
+				receive(nil)
+
+			case <-retryTicker.C:
+				// The W1 total is polled from the PLC, so pieces leaving
+				// W1 may not have freed space yet when the handler is woken
+				if !deferredShipments.isEmpty() {
+					receive(nil)
+				}
+
+			case <-reconcileTicker.C:
+				if shipmentReceipts.hasPending() {
+					reconcileReceipts(ctx)
+				}
 			}
 		}
 	}()
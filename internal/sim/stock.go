@@ -0,0 +1,268 @@
+package sim
+
+import (
+	"fmt"
+	"mes/internal/utils"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Finished stock movements
+const (
+	STOCK_STORED    = "stored"    // a finished piece entered W2
+	STOCK_DELIVERED = "delivered" // pieces left W2 on a delivery line
+	STOCK_COUNTED   = "counted"   // an operator set the stock of a kind
+)
+
+// stockEvent is a change to the finished stock of a kind.
+type stockEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Kind   string    `json:"kind"`
+	Change int       `json:"change"`
+	// Piece stored, if the ERP identified it
+	PieceID string `json:"piece_id,omitempty"`
+	// Load the pieces left on and the IDs of those known, for deliveries
+	LoadID   int      `json:"load_id,omitempty"`
+	PieceIDs []string `json:"piece_ids,omitempty"`
+}
+
+// StockLevel is the finished stock of a kind in W2.
+type StockLevel struct {
+	Pieces int `json:"pieces"`
+	// Pieces set aside for deliveries and not on a delivery line yet
+	Reserved int `json:"reserved"`
+}
+
+// finishedStock counts, per kind, the finished pieces in W2 that can be
+// delivered, and knows the IDs of those stored by a production line.
+// Delivery lines take pieces by kind: a load takes the oldest pieces of its
+// kind. Reservations are kept in memory only: after a restart the queued
+// deliveries reserve their pieces again.
+type finishedStock struct {
+	lock     sync.Mutex
+	pieces   map[string]int
+	known    map[string][]InventoryPiece // kind -> pieces of known ID, oldest first
+	reserved map[string]int
+	// Loads debited and maybe still on a delivery line, by ID
+	debited map[int]string
+	journal *utils.JSONLog
+
+	// Signals the delivery handler that pieces were stored
+	wakeCh chan struct{}
+}
+
+var w2Stock = newFinishedStock(utils.NewCompactedJSONLog(STOCK_LOG_PATH))
+
+func newFinishedStock(journal *utils.JSONLog) *finishedStock {
+	fs := &finishedStock{journal: journal, wakeCh: make(chan struct{}, 1)}
+	fs.reset()
+	return fs
+}
+
+func (fs *finishedStock) reset() {
+	fs.pieces = make(map[string]int)
+	fs.known = make(map[string][]InventoryPiece)
+	fs.reserved = make(map[string]int)
+	fs.debited = make(map[int]string)
+}
+
+// load sums the changes logged to the stock of each kind. Reservations
+// start empty, the queued deliveries make them again.
+func (fs *finishedStock) load() error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	fs.reset()
+	return utils.ReplayJSONLog(fs.journal, fs.applyLocked)
+}
+
+// applyLocked updates the stock with an event. A count below the pieces of
+// known ID forgets the oldest of them.
+func (fs *finishedStock) applyLocked(event stockEvent) {
+	fs.pieces[event.Kind] += event.Change
+	if event.LoadID != 0 {
+		fs.debited[event.LoadID] = event.Kind
+	}
+
+	known := fs.known[event.Kind]
+	if event.PieceID != "" && event.Change > 0 {
+		known = append(known, InventoryPiece{ID: event.PieceID, Kind: event.Kind, Since: event.Time})
+	}
+	for _, pieceID := range event.PieceIDs {
+		if i := slices.IndexFunc(known, func(p InventoryPiece) bool { return p.ID == pieceID }); i >= 0 {
+			known = append(known[:i], known[i+1:]...)
+		}
+	}
+	if excess := len(known) - max(0, fs.pieces[event.Kind]); excess > 0 {
+		known = known[excess:]
+	}
+	fs.known[event.Kind] = known
+}
+
+func (fs *finishedStock) recordLocked(event stockEvent) {
+	event.Time = time.Now()
+	fs.applyLocked(event)
+	fs.journal.Append(event)
+	fs.journal.CompactIfFull(fs.stateLocked)
+}
+
+// stateLocked returns the events that rebuild the stock as it is: the
+// pieces of each kind of unknown ID, the pieces of known ID, then the loads
+// already debited.
+func (fs *finishedStock) stateLocked() []any {
+	events := []any{}
+	now := time.Now()
+	for kind, pieces := range fs.pieces {
+		events = append(events, stockEvent{
+			Time: now, Event: STOCK_COUNTED, Kind: kind, Change: pieces - len(fs.known[kind]),
+		})
+		for _, piece := range fs.known[kind] {
+			events = append(events, stockEvent{
+				Time: piece.Since, Event: STOCK_STORED, Kind: kind, Change: 1, PieceID: piece.ID,
+			})
+		}
+	}
+	for loadID, kind := range fs.debited {
+		events = append(events, stockEvent{
+			Time: now, Event: STOCK_DELIVERED, Kind: kind, LoadID: loadID,
+		})
+	}
+	return events
+}
+
+// stored adds a finished piece to the stock.
+func (fs *finishedStock) stored(kind string, pieceID string) {
+	fs.lock.Lock()
+	fs.recordLocked(stockEvent{Event: STOCK_STORED, Kind: kind, Change: 1, PieceID: pieceID})
+	fs.lock.Unlock()
+
+	fs.wakeUp()
+}
+
+func (fs *finishedStock) wakeUp() {
+	utils.Signal(fs.wakeCh)
+}
+
+// available returns the pieces of the kind not reserved yet.
+func (fs *finishedStock) available(kind string) int {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return max(0, fs.pieces[kind]-fs.reserved[kind])
+}
+
+// reserve sets aside up to n pieces of the kind. Returns the pieces
+// reserved.
+func (fs *finishedStock) reserve(kind string, n int) int {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	n = min(n, max(0, fs.pieces[kind]-fs.reserved[kind]))
+	fs.reserved[kind] += n
+	return n
+}
+
+// delivered removes the reserved pieces of a load sent to a delivery line.
+// Returns the IDs of the pieces taken that are known. A load already
+// debited is not debited again.
+func (fs *finishedStock) delivered(load DeliveryLoad) []string {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	return fs.deliveredLocked(load)
+}
+
+func (fs *finishedStock) deliveredLocked(load DeliveryLoad) []string {
+	if _, ok := fs.debited[load.ID]; ok {
+		return nil
+	}
+	pieceIDs := []string{}
+	for _, piece := range fs.known[load.Kind][:min(load.Quantity, len(fs.known[load.Kind]))] {
+		pieceIDs = append(pieceIDs, piece.ID)
+	}
+	fs.reserved[load.Kind] = max(0, fs.reserved[load.Kind]-load.Quantity)
+	fs.recordLocked(stockEvent{
+		Event:    STOCK_DELIVERED,
+		Kind:     load.Kind,
+		Change:   -load.Quantity,
+		LoadID:   load.ID,
+		PieceIDs: pieceIDs,
+	})
+	return pieceIDs
+}
+
+// unloaded forgets a load a delivery line acknowledged, it cannot be sent
+// again.
+func (fs *finishedStock) unloaded(loadID int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	delete(fs.debited, loadID)
+}
+
+// restoreLoads debits the loads found on the delivery lines after a restart
+// that the MES stopped before debiting, and forgets the loads unloaded
+// while it was running.
+func (fs *finishedStock) restoreLoads(onLine []DeliveryLoad) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	keep := make(map[int]bool)
+	for _, load := range onLine {
+		keep[load.ID] = true
+		fs.deliveredLocked(load)
+	}
+	for loadID := range fs.debited {
+		if !keep[loadID] {
+			delete(fs.debited, loadID)
+		}
+	}
+}
+
+// contents returns the pieces of each kind and the pieces of known ID,
+// oldest first.
+func (fs *finishedStock) contents() (map[string]int, []InventoryPiece) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	kinds := make(map[string]int)
+	known := []InventoryPiece{}
+	for kind, pieces := range fs.pieces {
+		if pieces > 0 {
+			kinds[kind] = pieces
+		}
+		known = append(known, fs.known[kind]...)
+	}
+	sort.SliceStable(known, func(i, j int) bool { return known[i].Since.Before(known[j].Since) })
+	return kinds, known
+}
+
+// Stock returns the finished stock of each kind in W2.
+func Stock() map[string]StockLevel {
+	w2Stock.lock.Lock()
+	defer w2Stock.lock.Unlock()
+
+	levels := make(map[string]StockLevel)
+	for kind, pieces := range w2Stock.pieces {
+		levels[kind] = StockLevel{Pieces: pieces, Reserved: w2Stock.reserved[kind]}
+	}
+	return levels
+}
+
+// SetStock sets the finished stock of a kind in W2, after a physical count.
+func SetStock(kind string, pieces int) error {
+	if PieceStrToInt(kind) == 0 {
+		return fmt.Errorf("[SetStock] unknown piece kind %q", kind)
+	}
+	if pieces < 0 {
+		return fmt.Errorf("[SetStock] stock cannot be negative")
+	}
+
+	w2Stock.lock.Lock()
+	w2Stock.recordLocked(stockEvent{Event: STOCK_COUNTED, Kind: kind, Change: pieces - w2Stock.pieces[kind]})
+	w2Stock.lock.Unlock()
+
+	w2Stock.wakeUp()
+	return nil
+}
@@ -0,0 +1,134 @@
+package sim
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFinishedStockLoad(t *testing.T) {
+	change := func(event, kind string, n int) stockEvent {
+		return stockEvent{Event: event, Kind: kind, Change: n}
+	}
+	tests := []struct {
+		name   string
+		events []stockEvent
+		torn   bool
+		want   map[string]int
+	}{
+		{"no log", nil, false, map[string]int{}},
+		{"stored and delivered", []stockEvent{
+			change(STOCK_STORED, "P5", 1), change(STOCK_STORED, "P6", 1),
+			change(STOCK_STORED, "P5", 1), change(STOCK_DELIVERED, "P5", -2),
+		}, false, map[string]int{"P5": 0, "P6": 1}},
+		{"counted", []stockEvent{
+			change(STOCK_STORED, "P5", 1), change(STOCK_COUNTED, "P5", 3),
+		}, false, map[string]int{"P5": 4}},
+		{"torn last line", []stockEvent{change(STOCK_STORED, "P5", 1)}, true, map[string]int{"P5": 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := newFinishedStock(newTestCompactedJournal(t, "stock.jsonl"))
+			for _, event := range tt.events {
+				fs.journal.Append(event)
+			}
+			if tt.torn {
+				tearLastLine(t, fs.journal)
+			}
+
+			if err := fs.load(); err != nil {
+				t.Fatal(err)
+			}
+			if !sameCounts(fs.pieces, tt.want) {
+				t.Fatalf("Expected %v in stock, got %v", tt.want, fs.pieces)
+			}
+		})
+	}
+}
+
+func TestFinishedStockDebitsLoadOnce(t *testing.T) {
+	journal := newTestCompactedJournal(t, "stock.jsonl")
+	fs := newFinishedStock(journal)
+	fs.recordLocked(stockEvent{Event: STOCK_COUNTED, Kind: "P5", Change: 10})
+	sent := DeliveryLoad{ID: 1, Kind: "P5", Quantity: 3}
+	unloaded := DeliveryLoad{ID: 2, Kind: "P5", Quantity: 2}
+
+	fs.reserve("P5", 5)
+	fs.delivered(sent)
+	fs.delivered(sent)
+	fs.delivered(unloaded)
+	fs.unloaded(unloaded.ID)
+	if fs.pieces["P5"] != 5 || fs.reserved["P5"] != 0 {
+		t.Fatalf("Expected each load debited once, got %d pieces, %d reserved", fs.pieces["P5"], fs.reserved["P5"])
+	}
+
+	// After a restart, the load still on a line is not debited again, the
+	// one the MES stopped before debiting is
+	restored := newFinishedStock(journal)
+	if err := restored.load(); err != nil {
+		t.Fatal(err)
+	}
+	notDebited := DeliveryLoad{ID: 3, Kind: "P5", Quantity: 1}
+	restored.restoreLoads([]DeliveryLoad{sent, notDebited})
+	if restored.pieces["P5"] != 4 {
+		t.Fatalf("Expected 4 pieces left, got %d", restored.pieces["P5"])
+	}
+	if len(restored.debited) != 2 {
+		t.Fatalf("Expected only the loads on a line kept, got %v", restored.debited)
+	}
+}
+
+func TestFinishedStockPieceIDs(t *testing.T) {
+	tests := []struct {
+		name      string
+		stored    []string // IDs of the P5 pieces stored, empty if not known
+		delivered int
+		counted   int // -1 for no count
+		taken     []string
+		left      []string
+	}{
+		{"oldest delivered first", []string{"p1", "p2", "p3"}, 2, -1, []string{"p1", "p2"}, []string{"p3"}},
+		{"unknown pieces", []string{"", "p1"}, 2, -1, []string{"p1"}, []string{}},
+		{"count below known pieces", []string{"p1", "p2", "p3"}, 0, 1, []string{}, []string{"p3"}},
+		{"count above known pieces", []string{"p1"}, 2, 3, []string{"p1"}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			journal := newTestCompactedJournal(t, "stock.jsonl")
+			fs := newFinishedStock(journal)
+			for _, id := range tt.stored {
+				fs.stored("P5", id)
+			}
+			if tt.counted >= 0 {
+				fs.recordLocked(stockEvent{Event: STOCK_COUNTED, Kind: "P5", Change: tt.counted - fs.pieces["P5"]})
+			}
+			taken := []string{}
+			if tt.delivered > 0 {
+				taken = fs.delivered(DeliveryLoad{ID: 1, Kind: "P5", Quantity: tt.delivered})
+			}
+			if !reflect.DeepEqual(taken, tt.taken) {
+				t.Fatalf("Expected %v taken, got %v", tt.taken, taken)
+			}
+
+			// The same pieces are known after the log is compacted
+			compactAtNextAppend(journal)
+			fs.stored("P6", "")
+			restored := newFinishedStock(journal)
+			if err := restored.load(); err != nil {
+				t.Fatal(err)
+			}
+			for _, stock := range []*finishedStock{fs, restored} {
+				_, known := stock.contents()
+				left := []string{}
+				for _, piece := range known {
+					left = append(left, piece.ID)
+				}
+				if !reflect.DeepEqual(left, tt.left) {
+					t.Fatalf("Expected %v left, got %v", tt.left, left)
+				}
+			}
+			if restored.pieces["P5"] != fs.pieces["P5"] {
+				t.Fatalf("Expected %d pieces restored, got %d", fs.pieces["P5"], restored.pieces["P5"])
+			}
+		})
+	}
+}
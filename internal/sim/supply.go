@@ -0,0 +1,175 @@
+package sim
+
+import (
+	"fmt"
+	"log"
+	"mes/internal/net/plc"
+	"sync"
+)
+
+// SupplyAckMetadata identifies the piece a supply line acknowledged.
+type SupplyAckMetadata struct {
+	txId int16
+	line int
+}
+
+// supplyJob is (part of) a shipment being brought into W1 by the supply lines.
+type supplyJob struct {
+	admission shipmentAdmission
+	toWrite   int // pieces not commanded to a supply line yet
+	inFlight  int // pieces commanded and not acknowledged yet
+}
+
+func (sj *supplyJob) done() bool {
+	return sj.toWrite == 0 && sj.inFlight == 0
+}
+
+// supplyInFlight is a piece commanded to a supply line and not yet acknowledged.
+type supplyInFlight struct {
+	job  *supplyJob
+	txId int16
+}
+
+// SupplyLineStatus reports the piece in flight on a supply line.
+type SupplyLineStatus struct {
+	Line int `json:"line"`
+	// Shipment of the piece in flight, 0 if the line is free
+	ShipmentID int   `json:"shipment_id"`
+	TxId       int16 `json:"tx_id"`
+}
+
+// SupplyStatus reports the work of the supply lines.
+type SupplyStatus struct {
+	Lines []SupplyLineStatus `json:"lines"`
+	// Pieces admitted and not commanded to a supply line yet
+	Queued int `json:"queued"`
+	// Pieces commanded and not acknowledged yet
+	InFlight int `json:"in_flight"`
+}
+
+// supplyScheduler spreads the pieces of the admitted shipments over the
+// supply lines, oldest shipment first, so that no line stays idle while
+// there are pieces to bring in. Acks are handled as they arrive.
+type supplyScheduler struct {
+	lock  sync.Mutex
+	jobs  []*supplyJob
+	lines []*supplyInFlight // nil if the line is free
+}
+
+func newSupplyScheduler(nLines int) *supplyScheduler {
+	return &supplyScheduler{lines: make([]*supplyInFlight, nLines)}
+}
+
+var pieceSupply = newSupplyScheduler(plc.NUMBER_OF_SUPPLY_LINES)
+
+// add queues the pieces of an admitted shipment.
+func (ss *supplyScheduler) add(admission shipmentAdmission) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	ss.jobs = append(ss.jobs, &supplyJob{admission: admission, toWrite: admission.nPieces})
+}
+
+// next returns a free line and the job whose next piece it should bring in.
+func (ss *supplyScheduler) next() (int, *supplyJob, bool) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	line := -1
+	for i, inFlight := range ss.lines {
+		if inFlight == nil {
+			line = i
+			break
+		}
+	}
+	if line < 0 {
+		return 0, nil, false
+	}
+
+	for _, job := range ss.jobs {
+		if job.toWrite > 0 {
+			return line, job, true
+		}
+	}
+	return 0, nil, false
+}
+
+// sent records that the line was commanded to bring in a piece of the job.
+func (ss *supplyScheduler) sent(line int, job *supplyJob, txId int16) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	job.toWrite--
+	job.inFlight++
+	ss.lines[line] = &supplyInFlight{job: job, txId: txId}
+}
+
+// acked frees the line of an acknowledged piece. Returns the job of the
+// piece and whether all of its pieces are now in W1.
+func (ss *supplyScheduler) acked(ack SupplyAckMetadata) (*supplyJob, bool, error) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	if ack.line < 0 || ack.line >= len(ss.lines) {
+		return nil, false, fmt.Errorf("[supplyScheduler.acked] unknown supply line %d", ack.line)
+	}
+	inFlight := ss.lines[ack.line]
+	if inFlight == nil || inFlight.txId != ack.txId {
+		return nil, false, fmt.Errorf("[supplyScheduler.acked] unexpected ack %d on supply line %d",
+			ack.txId, ack.line)
+	}
+
+	ss.lines[ack.line] = nil
+	job := inFlight.job
+	job.inFlight--
+	if !job.done() {
+		return job, false, nil
+	}
+
+	for i, j := range ss.jobs {
+		if j == job {
+			ss.jobs = append(ss.jobs[:i], ss.jobs[i+1:]...)
+			break
+		}
+	}
+	log.Printf("[supplyScheduler.acked] %d pieces of shipment %d in W1\n",
+		job.admission.nPieces, job.admission.shipment.ID)
+	return job, true, nil
+}
+
+// outstanding returns the pieces admitted that are not in W1 yet.
+func (ss *supplyScheduler) outstanding() int {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	pieces := 0
+	for _, job := range ss.jobs {
+		pieces += job.toWrite + job.inFlight
+	}
+	return pieces
+}
+
+func (ss *supplyScheduler) status() SupplyStatus {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	status := SupplyStatus{Lines: make([]SupplyLineStatus, len(ss.lines))}
+	for i, inFlight := range ss.lines {
+		status.Lines[i].Line = i
+		if inFlight != nil {
+			status.Lines[i].ShipmentID = inFlight.job.admission.shipment.ID
+			status.Lines[i].TxId = inFlight.txId
+		}
+	}
+	for _, job := range ss.jobs {
+		status.Queued += job.toWrite
+		status.InFlight += job.inFlight
+	}
+	return status
+}
+
+// Supply returns the pieces in flight on each supply line and the pieces
+// waiting for one.
+func Supply() SupplyStatus {
+	return pieceSupply.status()
+}
@@ -0,0 +1,50 @@
+package sim
+
+import "testing"
+
+func TestSupplySchedulerParallel(t *testing.T) {
+	ss := newSupplyScheduler(2)
+	ss.add(shipmentAdmission{shipment: Shipment{ID: 1, NPieces: 2}, nPieces: 2, final: true})
+	ss.add(shipmentAdmission{shipment: Shipment{ID: 2, NPieces: 1}, nPieces: 1, final: true})
+
+	// Both lines take the oldest shipment first
+	txId := int16(0)
+	for range 2 {
+		line, job, ok := ss.next()
+		if !ok || job.admission.shipment.ID != 1 {
+			t.Fatalf("Expected a piece of shipment 1 to be dispatched, got %+v", job)
+		}
+		txId++
+		ss.sent(line, job, txId)
+	}
+	if _, _, ok := ss.next(); ok {
+		t.Fatal("Expected no free supply line")
+	}
+	if ss.outstanding() != 3 {
+		t.Fatalf("Expected 3 outstanding pieces, got %d", ss.outstanding())
+	}
+
+	if _, _, err := ss.acked(SupplyAckMetadata{txId: 5, line: 0}); err == nil {
+		t.Fatal("Expected an unknown ack to be rejected")
+	}
+
+	// Acks may arrive in any order
+	job, done, err := ss.acked(SupplyAckMetadata{txId: 2, line: 1})
+	if err != nil || done || job.admission.shipment.ID != 1 {
+		t.Fatalf("Expected shipment 1 to be in progress, got %+v %v %v", job, done, err)
+	}
+
+	line, job, ok := ss.next()
+	if !ok || line != 1 || job.admission.shipment.ID != 2 {
+		t.Fatalf("Expected shipment 2 on the freed line, got line %d %+v", line, job)
+	}
+	ss.sent(line, job, 3)
+
+	if _, done, _ = ss.acked(SupplyAckMetadata{txId: 1, line: 0}); !done {
+		t.Fatal("Expected shipment 1 to be done")
+	}
+	status := ss.status()
+	if status.InFlight != 1 || status.Queued != 0 || status.Lines[1].ShipmentID != 2 {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+}
@@ -0,0 +1,323 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// Size past which a log is archived, or compacted if its owner replays it
+	JSON_LOG_MAX_SIZE = 16 << 20
+	// Archives kept of each log, as <path>.1 (newest) to <path>.N
+	JSON_LOG_ARCHIVES = 3
+)
+
+// JSONLog is a JSON lines file written by a background goroutine. Append
+// queues the value and returns at once, so that the MES can log while
+// holding locks other goroutines (e.g. the PLC poll loop) wait on.
+//
+// A history log is archived by the writer once it reaches its size limit.
+// A log its owner replays on startup must not lose entries that way: the
+// owner checks Full after appending and compacts the log with its state.
+type JSONLog struct {
+	path    string
+	maxSize int64
+	// Whether the owner compacts the log instead of the writer archiving it
+	compacted bool
+
+	lock       sync.Mutex
+	idle       *sync.Cond
+	queue      []any
+	writing    bool
+	size       int64
+	compacting bool
+}
+
+// jsonLogCompaction is queued in place of a value to replace the content
+// of the log.
+type jsonLogCompaction struct {
+	values []any
+}
+
+var (
+	jsonLogsLock sync.Mutex
+	jsonLogs     []*JSONLog
+	dataDir      = "."
+)
+
+// NewJSONLog returns a history log, archived when it grows too large.
+// Relative paths are resolved against the data directory.
+func NewJSONLog(path string) *JSONLog {
+	l := &JSONLog{path: path, maxSize: JSON_LOG_MAX_SIZE}
+	l.idle = sync.NewCond(&l.lock)
+
+	jsonLogsLock.Lock()
+	jsonLogs = append(jsonLogs, l)
+	jsonLogsLock.Unlock()
+	return l
+}
+
+// NewCompactedJSONLog returns a log replayed by its owner, who compacts it
+// when Full reports it has grown too large.
+func NewCompactedJSONLog(path string) *JSONLog {
+	l := NewJSONLog(path)
+	l.compacted = true
+	return l
+}
+
+// SetDataDir sets the directory the logs with a relative path are written
+// to, creating it if needed. Must be called before any log is written.
+func SetDataDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("[SetDataDir] %w", err)
+	}
+
+	jsonLogsLock.Lock()
+	defer jsonLogsLock.Unlock()
+	dataDir = dir
+	return nil
+}
+
+// FlushJSONLogs waits until every log has written its queued values.
+// Called before the MES exits.
+func FlushJSONLogs() {
+	jsonLogsLock.Lock()
+	logs := append([]*JSONLog{}, jsonLogs...)
+	jsonLogsLock.Unlock()
+
+	for _, l := range logs {
+		l.Flush()
+	}
+}
+
+// Path returns the path of the file the log is written to.
+func (l *JSONLog) Path() string {
+	if filepath.IsAbs(l.path) {
+		return l.path
+	}
+
+	jsonLogsLock.Lock()
+	defer jsonLogsLock.Unlock()
+	return filepath.Join(dataDir, l.path)
+}
+
+// SetMaxSize sets the size past which the log is archived or compacted.
+func (l *JSONLog) SetMaxSize(maxSize int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.maxSize = maxSize
+}
+
+// Append queues v to be appended to the log.
+func (l *JSONLog) Append(v any) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.queueLocked(v)
+}
+
+// Full reports whether the log has grown past its size limit and should be
+// compacted. Always false for history logs and while a compaction is queued.
+func (l *JSONLog) Full() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.compacted && !l.compacting && l.size >= l.maxSize
+}
+
+// CompactIfFull compacts the log with the values state returns if the log
+// is full. Called by the owner after appending, with the lock that orders
+// its appends held so that no value is lost or written twice.
+func (l *JSONLog) CompactIfFull(state func() []any) {
+	if l.Full() {
+		l.Compact(state())
+	}
+}
+
+// Compact replaces the content of the log with values, once the values
+// queued before are written. The previous content is archived.
+func (l *JSONLog) Compact(values []any) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.compacting = true
+	l.queueLocked(jsonLogCompaction{values: values})
+}
+
+func (l *JSONLog) queueLocked(v any) {
+	l.queue = append(l.queue, v)
+	if !l.writing {
+		l.writing = true
+		go l.write()
+	}
+}
+
+// write writes the queued values until there are none left.
+func (l *JSONLog) write() {
+	for {
+		l.lock.Lock()
+		queue := l.queue
+		l.queue = nil
+		if len(queue) == 0 {
+			l.writing = false
+			l.idle.Broadcast()
+			l.lock.Unlock()
+			return
+		}
+		maxSize, compacted := l.maxSize, l.compacted
+		l.lock.Unlock()
+
+		path := l.Path()
+		for len(queue) > 0 {
+			if compaction, ok := queue[0].(jsonLogCompaction); ok {
+				queue = queue[1:]
+				size, err := replaceJSONLines(path, compaction.values)
+				if err != nil {
+					log.Printf("[JSONLog.write] failed to compact %s: %v\n", path, err)
+				}
+				l.setSize(size, true)
+				continue
+			}
+
+			n := 0
+			for n < len(queue) {
+				if _, ok := queue[n].(jsonLogCompaction); ok {
+					break
+				}
+				n++
+			}
+			if !compacted && l.currentSize() >= maxSize {
+				if err := archiveJSONLines(path); err != nil {
+					log.Printf("[JSONLog.write] failed to archive %s: %v\n", path, err)
+				}
+			}
+			size, err := appendJSONLines(path, queue[:n])
+			if err != nil {
+				log.Printf("[JSONLog.write] failed to append %d values to %s: %v\n",
+					n, path, err)
+			}
+			l.setSize(size, false)
+			queue = queue[n:]
+		}
+	}
+}
+
+func (l *JSONLog) currentSize() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.size
+}
+
+func (l *JSONLog) setSize(size int64, compacted bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.size = size
+	if compacted {
+		l.compacting = false
+	}
+}
+
+// Flush waits until every queued value is written.
+func (l *JSONLog) Flush() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for l.writing {
+		l.idle.Wait()
+	}
+}
+
+// appendJSONLines appends the values to the file and returns its new size.
+func appendJSONLines(path string, values []any) (int64, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	for _, v := range values {
+		if err := encoder.Encode(v); err != nil {
+			return 0, err
+		}
+	}
+	return file.Seek(0, io.SeekCurrent)
+}
+
+// archiveJSONLines moves the file to <path>.1, shifting the older archives
+// and dropping the oldest.
+func archiveJSONLines(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	if err := shiftArchives(path); err != nil {
+		return err
+	}
+	return os.Rename(path, path+".1")
+}
+
+// shiftArchives renames <path>.n to <path>.n+1, the oldest archive is
+// overwritten.
+func shiftArchives(path string) error {
+	for n := JSON_LOG_ARCHIVES - 1; n > 0; n-- {
+		older := fmt.Sprintf("%s.%d", path, n)
+		if _, err := os.Stat(older); err == nil {
+			if err := os.Rename(older, fmt.Sprintf("%s.%d", path, n+1)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// replaceJSONLines archives the file and writes the values in its place.
+// The values are written to a temporary file renamed over the file, so
+// that a crash leaves either the old content or the new one. Returns the
+// new size.
+func replaceJSONLines(path string, values []any) (int64, error) {
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	size, err := appendJSONLines(tmp, values)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		if err := shiftArchives(path); err != nil {
+			return 0, err
+		}
+		os.Remove(path + ".1")
+		if err := os.Link(path, path+".1"); err != nil {
+			return 0, err
+		}
+	}
+	return size, os.Rename(tmp, path)
+}
+
+// ReadJSONLog flushes the log and decodes every value written to it.
+func ReadJSONLog[T any](l *JSONLog) ([]T, error) {
+	l.Flush()
+	return ReadJSONLines[T](l.Path())
+}
+
+// ReplayJSONLog applies every value written to the log, in order. A log
+// that was never written has nothing to replay.
+func ReplayJSONLog[T any](l *JSONLog, apply func(T)) error {
+	values, err := ReadJSONLog[T](l)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, v := range values {
+		apply(v)
+	}
+	return nil
+}
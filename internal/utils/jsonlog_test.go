@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestJSONLogKeepsOrder(t *testing.T) {
+	l := NewJSONLog(filepath.Join(t.TempDir(), "log.jsonl"))
+
+	var wg sync.WaitGroup
+	for writer := 0; writer < 4; writer++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				l.Append([2]int{writer, i})
+			}
+		}()
+	}
+	wg.Wait()
+
+	values, err := ReadJSONLog[[2]int](l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 200 {
+		t.Fatalf("Expected 200 values, got %d", len(values))
+	}
+	// Each writer's values are written in the order they were appended
+	last := map[int]int{0: -1, 1: -1, 2: -1, 3: -1}
+	for _, v := range values {
+		if v[1] != last[v[0]]+1 {
+			t.Fatalf("Value %v written out of order", v)
+		}
+		last[v[0]] = v[1]
+	}
+}
+
+func TestJSONLogFlushWithoutWrites(t *testing.T) {
+	l := NewJSONLog(filepath.Join(t.TempDir(), "log.jsonl"))
+	l.Flush()
+	FlushJSONLogs()
+}
+
+func TestJSONLogArchivesHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.jsonl")
+	l := NewJSONLog(path)
+	l.SetMaxSize(1)
+
+	// Every value but the first finds the log full and archives it
+	for i := 0; i <= JSON_LOG_ARCHIVES+1; i++ {
+		l.Append(i)
+		l.Flush()
+	}
+
+	for n, want := range map[string]int{"": JSON_LOG_ARCHIVES + 1, ".1": JSON_LOG_ARCHIVES, ".2": JSON_LOG_ARCHIVES - 1} {
+		values, err := ReadJSONLines[int](path + n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(values) != 1 || values[0] != want {
+			t.Fatalf("Expected %s%s to hold %d, got %v", path, n, want, values)
+		}
+	}
+	if _, err := os.Stat(fmt.Sprintf("%s.%d", path, JSON_LOG_ARCHIVES+1)); !os.IsNotExist(err) {
+		t.Fatalf("Expected only %d archives to be kept", JSON_LOG_ARCHIVES)
+	}
+}
+
+func TestJSONLogCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.jsonl")
+	l := NewCompactedJSONLog(path)
+	l.SetMaxSize(1)
+
+	l.Append(1)
+	l.Append(2)
+	l.Flush()
+	if !l.Full() {
+		t.Fatal("Expected the log to be full")
+	}
+
+	// Values appended after the compaction follow the compacted state
+	l.Compact([]any{3})
+	if l.Full() {
+		t.Fatal("Expected a log being compacted not to be reported full")
+	}
+	l.Append(4)
+
+	values, err := ReadJSONLog[int](l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || values[0] != 3 || values[1] != 4 {
+		t.Fatalf("Expected the compacted state then the new value, got %v", values)
+	}
+	archived, err := ReadJSONLines[int](path + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archived) != 2 {
+		t.Fatalf("Expected the previous content to be archived, got %v", archived)
+	}
+}
+
+func TestJSONLogDataDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	if err := SetDataDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetDataDir(".") })
+
+	l := NewJSONLog("log.jsonl")
+	if l.Path() != filepath.Join(dir, "log.jsonl") {
+		t.Fatalf("Expected the log in the data directory, got %s", l.Path())
+	}
+	absolute := filepath.Join(t.TempDir(), "log.jsonl")
+	if NewJSONLog(absolute).Path() != absolute {
+		t.Fatal("Expected an absolute path to be kept")
+	}
+}
+
+func TestReadJSONLines(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []int
+		wantErr bool
+	}{
+		{"empty", "", []int{}, false},
+		{"complete", "1\n2\n3\n", []int{1, 2, 3}, false},
+		{"blank lines", "1\n\n2\n", []int{1, 2}, false},
+		{"torn last line", "1\n2\n{\"tor", []int{1, 2}, false},
+		{"torn last line with newline", "1\n2\n[3,\n", []int{1, 2}, false},
+		{"bad line in the middle", "1\n{\"tor\n3\n", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "log.jsonl")
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			values, err := ReadJSONLines[int](path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if fmt.Sprint(values) != fmt.Sprint(tt.want) {
+				t.Fatalf("Expected %v, got %v", tt.want, values)
+			}
+		})
+	}
+}
+
+func TestReplayJSONLog(t *testing.T) {
+	l := NewJSONLog(filepath.Join(t.TempDir(), "log.jsonl"))
+
+	sum := 0
+	if err := ReplayJSONLog(l, func(v int) { sum += v }); err != nil {
+		t.Fatalf("Replaying a log never written: %v", err)
+	}
+	if sum != 0 {
+		t.Fatalf("Expected nothing replayed, got %d", sum)
+	}
+
+	for i := 1; i <= 4; i++ {
+		l.Append(i)
+	}
+	if err := ReplayJSONLog(l, func(v int) { sum += v }); err != nil {
+		t.Fatal(err)
+	}
+	if sum != 10 {
+		t.Fatalf("Expected the values to sum to 10, got %d", sum)
+	}
+}
+
+func TestSignal(t *testing.T) {
+	ch := make(chan struct{}, 1)
+	Signal(ch)
+	Signal(ch) // must not block
+
+	<-ch
+	select {
+	case <-ch:
+		t.Fatal("Expected the signals to be coalesced")
+	default:
+	}
+}
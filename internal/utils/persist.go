@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+)
+
+// ReadJSONLines decodes every line of the file at path, as written by a
+// JSONLog. A last line that does not decode was torn by a crash while it
+// was written and is skipped. Any other bad line fails the read.
+func ReadJSONLines[T any](path string) ([]T, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	values := []T{}
+	var torn error
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if torn != nil {
+			return nil, torn
+		}
+		var v T
+		if err := json.Unmarshal(scanner.Bytes(), &v); err != nil {
+			torn = fmt.Errorf("%s:%d: %w", path, line, err)
+			continue
+		}
+		values = append(values, v)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if torn != nil {
+		log.Printf("[ReadJSONLines] skipped torn last line %v\n", torn)
+	}
+	return values, nil
+}
@@ -0,0 +1,10 @@
+package utils
+
+// Signal wakes up the goroutine waiting on ch, a channel of capacity 1,
+// without blocking. A signal still pending covers this one.
+func Signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}